@@ -4,8 +4,13 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
 
 	"github.com/bcambl/rtmpauthbot/config"
 	"github.com/bcambl/rtmpauthbot/controllers"
@@ -13,24 +18,44 @@ import (
 	bolt "go.etcd.io/bbolt"
 )
 
-// DataBuckets is a slice of all buckets that exist throught the project
-var DataBuckets = []string{
-	"ConfigBucket",             // General configuration & caching
-	"PublisherBucket",          // Local publishers -> rtmp stream keys
-	"RTMPLiveBucket",           // Local publishers -> rtmp live stream status
-	"TwitchStreamBucket",       // Local publishers -> twitch stream names
-	"TwitchLiveBucket",         // Local publishers -> twitch live stream status
-	"TwitchNotificationBucket", // Local publishers -> twitch notification state
-	"StreamInfoBucket",         // Local publishers -> generic stream information
-}
+// skipTwitchCheck disables the startup twitch credentials check
+var skipTwitchCheck bool
+
+// redisTimeout limits each redis cache operation
+const redisTimeout = 2 * time.Second
+
+// readOnlyDatabaseTimeout limits how long a read-only server waits for a
+// database which is open for writing
+const readOnlyDatabaseTimeout = 5 * time.Second
 
-func init() {
+// DataBuckets is a slice of all buckets that exist throught the project, see
+// controllers.DataBuckets
+var DataBuckets = controllers.DataBuckets
+
+// parseFlags handles the command line flags, exiting after the flags which
+// do not start the server. It runs from Run rather than init so that the
+// package can be tested.
+func parseFlags() {
 	debugFlag := flag.Bool("debug", false, "enable debug logging")
+	traceFlag := flag.Bool("trace", false, "enable trace logging (includes per stream poll logs)")
 	envVarsFlag := flag.Bool("environment", false, "print environment variables with defaults")
 	licenseFlag := flag.Bool("license", false, "print project license")
 	unitFileFlag := flag.Bool("unitfile", false, "print a systemd unit-file template")
+	versionFlag := flag.Bool("version", false, "print version & build information")
+	configFlag := flag.Bool("config", false, "print the effective configuration with secrets masked")
+	flag.BoolVar(&skipTwitchCheck, "skip-twitch-check", false, "skip the twitch credentials check at startup")
+	exportFlag := flag.String("export", "", "export all publishers as json to a file (- for stdout) and exit")
+	importFlag := flag.String("import", "", "import publishers from a json export file (- for stdin) and exit")
+	pruneFlag := flag.Bool("prune", false, "list disabled or unpublished publishers to prune and exit")
+	pruneDisabledFlag := flag.Duration("prune-disabled-for", 90*24*time.Hour, "with -prune, publishers disabled for longer than this (0 to skip)")
+	pruneUnpublishedFlag := flag.Duration("prune-unpublished-for", 90*24*time.Hour, "with -prune, publishers not published for longer than this (0 to skip)")
+	dryRunFlag := flag.Bool("dry-run", true, "with -prune, only list the publishers (-dry-run=false deletes them)")
 	flag.Parse()
 
+	if *versionFlag {
+		config.PrintVersion()
+		os.Exit(0)
+	}
 	if *licenseFlag {
 		config.PrintLicense()
 		os.Exit(0)
@@ -43,35 +68,199 @@ func init() {
 		config.PrintSystemDUnit()
 		os.Exit(0)
 	}
+	if *configFlag {
+		var conf config.Config
+		err := conf.ParseEnv()
+		if err == nil {
+			err = conf.PrintEffective()
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
 
 	logLevel := log.InfoLevel
 	if *debugFlag {
 		logLevel = log.DebugLevel
 	}
+	if *traceFlag {
+		logLevel = log.TraceLevel
+	}
 	log.SetOutput(os.Stdout)
 	log.SetLevel(logLevel)
 
-	// Initialize the database
-	db, err := bolt.Open(config.DatabasePath(), 0700, nil)
-	if err != nil {
-		log.Fatal(err)
+	if *exportFlag != "" {
+		if *exportFlag == "-" {
+			// keep stdout clean for the export
+			log.SetOutput(os.Stderr)
+		}
+		err := exportPublishers(*exportFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+	if *importFlag != "" {
+		err := importPublishers(*importFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+	if *pruneFlag {
+		err := prunePublishers(*pruneDisabledFlag, *pruneUnpublishedFlag, *dryRunFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
 	}
-	defer db.Close()
 
-	for b := range DataBuckets {
-		log.Debug("db: ensuring bucket exists: ", DataBuckets[b])
-		db.Update(func(tx *bolt.Tx) error {
-			_, err := tx.CreateBucketIfNotExists([]byte(DataBuckets[b]))
+	checkDatabasePermissions(config.DatabasePath())
+}
+
+// ensureBuckets creates any missing buckets in a single transaction so that
+// databases created by older versions are upgraded before use
+func ensureBuckets(db *bolt.DB, conf *config.Config) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range DataBuckets {
+			name := conf.BucketName(bucket)
+			log.Debug("db: ensuring bucket exists: ", name)
+			_, err := tx.CreateBucketIfNotExists([]byte(name))
 			if err != nil {
-				return fmt.Errorf("error creating bucket: %s", err)
+				return fmt.Errorf("error creating bucket %s: %s", name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// checkDatabase verifies the consistency of the database pages, returning
+// the problems found
+func checkDatabase(db *bolt.DB) error {
+	var problems []string
+	err := db.View(func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			problems = append(problems, err.Error())
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("database integrity check found %d problem(s): %s",
+			len(problems), strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// openDatabase opens the database, creating it and any parent directories
+// when missing. A zero timeout waits indefinitely for the database lock. The
+// database contains stream keys & access tokens so it is created readable by
+// the owner only.
+func openDatabase(path string, timeout time.Duration) (*bolt.DB, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: timeout})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("database %s is locked, is the server running?", path)
+	}
+	return db, err
+}
+
+// openReadOnlyDatabase opens an existing database without write access. Any
+// number of read-only opens share the database, but not with a server which
+// has it open for writing.
+func openReadOnlyDatabase(path string, timeout time.Duration) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: timeout, ReadOnly: true})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("database %s is open for writing by another server, "+
+			"read-only servers need a copy of the database", path)
+	}
+	return db, err
+}
+
+// checkBuckets ensures every bucket exists, as they cannot be created when the
+// database is read-only
+func checkBuckets(db *bolt.DB, conf *config.Config) error {
+	return db.View(func(tx *bolt.Tx) error {
+		var missing []string
+		for _, bucket := range DataBuckets {
+			name := conf.BucketName(bucket)
+			if tx.Bucket([]byte(name)) == nil {
+				missing = append(missing, name)
 			}
-			return nil
-		})
+		}
+		if len(missing) > 0 {
+			return fmt.Errorf("database buckets missing (%s), start a server with write access "+
+				"on the database once to upgrade it", strings.Join(missing, ", "))
+		}
+		return nil
+	})
+}
+
+// checkDefaultCredentials returns an error when the controller would run with
+// placeholder credentials, unless ALLOW_DEFAULT_CREDENTIALS permits it for
+// local testing, in which case only a warning is logged
+func checkDefaultCredentials(c *controllers.Controller, conf *config.Config) error {
+	err := c.CheckDefaultCredentials()
+	if err != nil && !conf.AllowDefaultCredentials {
+		return fmt.Errorf("%s. set the real credentials, or ALLOW_DEFAULT_CREDENTIALS=true for local testing", err)
+	}
+	if err != nil {
+		log.Warnf("%s, allowed by ALLOW_DEFAULT_CREDENTIALS", err)
+	}
+	return nil
+}
+
+// checkDatabasePermissions warns when an existing database is accessible by
+// users other than the owner
+func checkDatabasePermissions(path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		log.Warnf("database %s is accessible by group/others (%s), consider: chmod 600 %s",
+			path, info.Mode().Perm(), path)
+	}
+}
+
+// newServer returns the http server with the configured timeouts so that
+// slow clients cannot hold connections open indefinitely
+func newServer(conf *config.Config, addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: conf.HTTPReadHeaderTimeout,
+		ReadTimeout:       conf.HTTPReadTimeout,
+		WriteTimeout:      conf.HTTPWriteTimeout,
+		IdleTimeout:       conf.HTTPIdleTimeout,
+	}
+}
+
+// mountBasePath serves the routes under BASE_PATH, also serving the health &
+// metrics endpoints at the root when HEALTH_AT_ROOT is set so that probes and
+// scrapers need not know the base path
+func mountBasePath(conf *config.Config, mux http.Handler) http.Handler {
+	if conf.BasePath == "" {
+		return mux
 	}
+	root := http.NewServeMux()
+	root.Handle(conf.BasePath+"/", http.StripPrefix(conf.BasePath, mux))
+	if conf.HealthAtRoot {
+		root.Handle("/readyz", mux)
+		root.Handle("/metrics", mux)
+	}
+	return root
 }
 
 // Run performs setup and starts the server.
 func Run() {
+	parseFlags()
 
 	var conf config.Config
 	err := conf.ParseEnv()
@@ -79,28 +268,95 @@ func Run() {
 		log.Fatal(err)
 	}
 
-	db, err := bolt.Open(config.DatabasePath(), 0700, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	closeLog, err := setLogOutput(ctx, conf.LogFile, conf.LogStderr)
+	if err != nil {
+		log.Fatal("error opening log file: ", err)
+	}
+	defer closeLog()
+
+	var db *bolt.DB
+	if conf.ReadOnlyDB {
+		db, err = openReadOnlyDatabase(conf.DatabasePath, readOnlyDatabaseTimeout)
+	} else {
+		db, err = openDatabase(conf.DatabasePath, 0)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer db.Close()
 
+	if conf.CheckDBOnStart {
+		err = checkDatabase(db)
+		if err != nil {
+			log.Fatalf("%s. restore the database from a backup, or export the publishers "+
+				"with -export & import them into a new database with -import", err)
+		}
+		log.Info("database integrity check passed")
+	}
+
+	if conf.ReadOnlyDB {
+		err = checkBuckets(db, &conf)
+	} else {
+		err = ensureBuckets(db, &conf)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	c := controllers.Controller{Config: &conf, DB: db}
+	c.SetHTTPClient(controllers.NewHTTPClient(conf.ClientMaxIdleConns, conf.ClientMaxIdleConnsPerHost,
+		conf.ClientIdleConnTimeout, conf.ClientTimeout))
+	if conf.CacheBackend == "redis" {
+		c.SetNotLiveCache(controllers.NewRedisCache(conf.RedisAddr, conf.RedisPassword,
+			"rtmpauthbot:"+conf.BucketName("notlive:"), redisTimeout))
+		c.SetAllowCache(controllers.NewRedisCache(conf.RedisAddr, conf.RedisPassword,
+			"rtmpauthbot:"+conf.BucketName("allow:"), redisTimeout))
+	}
+	if conf.MaintenanceAllowAll {
+		c.SetMaintenance(true)
+	}
 
-	// Start Twitch polling scheduler if integration is enabled
-	if c.Config.TwitchEnabled {
-		log.Infof("twitch integration enabled")
-		log.Infof("starting twitch scheduler (poll rate: %s)", c.Config.TwitchPollRate.String())
-		ctx, cancel := context.WithCancel(context.Background())
-		defer cancel()
-		c.TwitchScheduler(ctx, c.Config.TwitchPollRate)
+	// Start the polling scheduler if any platform sources are enabled. A
+	// read-only server only reports the state written by other servers.
+	c.RegisterSources()
+	err = checkDefaultCredentials(&c, &conf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if conf.ReadOnlyDB {
+		log.Warn("read-only database: polling, session sweeps & all writes are disabled")
 	} else {
-		log.Infof("twitch integration disabled")
+		err = c.MigrateTimestamps()
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = c.MigratePublishTimes()
+		if err != nil {
+			log.Fatal(err)
+		}
+		c.SessionSweepScheduler(ctx, conf.SessionTTL)
+		c.PublishersDirScheduler(ctx, conf.PublishersDir, conf.PublishersDirInterval, conf.PublishersDirPrune)
+	}
+	if len(c.Sources) > 0 && !conf.ReadOnlyDB {
+		if !skipTwitchCheck {
+			c.CheckTwitchCredentials()
+		}
+		log.Infof("starting scheduler (poll rate: %s)", c.Config.TwitchPollRate.String())
+		c.SourceScheduler(ctx, c.Config.TwitchPollRate)
+		c.TokenCheckScheduler(ctx, c.Config.TokenCheckInterval)
 	}
 
 	// Root Handler
 	http.HandleFunc("/", c.IndexHandler)
 
+	// Health Handlers
+	http.HandleFunc("/readyz", c.ReadyzHandler)
+	http.HandleFunc("/api/status", c.StatusHandler)
+	http.HandleFunc("/metrics", c.MetricsHandler)
+
 	// Play Handlers
 	http.HandleFunc("/on_play", c.OnPlayHandler)
 	http.HandleFunc("/on_play_done", c.OnPlayDoneHandler)
@@ -108,22 +364,58 @@ func Run() {
 	// Publish Handlers
 	http.HandleFunc("/on_publish", c.OnPublishHandler)
 	http.HandleFunc("/on_publish_done", c.OnPublishDoneHandler)
+	http.HandleFunc("/on_update", c.OnUpdateHandler)
+	http.HandleFunc("/on_record_done", c.OnRecordDoneHandler)
 
 	// API Endpoints
 	http.HandleFunc("/api/publisher", c.PublisherAPIHandler)
+	http.HandleFunc("/api/publishers/", c.PublishersAPIHandler)
+	http.HandleFunc("/api/publishers/sync", c.SyncAPIHandler)
+	http.HandleFunc("/api/tags/", c.TagsAPIHandler)
+	http.HandleFunc("/api/token/status", c.TokenStatusHandler)
+	http.HandleFunc("/api/refresh", c.RefreshAPIHandler)
+	http.HandleFunc("/api/live", c.LiveAPIHandler)
+	http.HandleFunc("/api/live/check", c.LiveCheckAPIHandler)
+	http.HandleFunc("/api/cache/", c.CacheAPIHandler)
+	http.HandleFunc("/api/maintenance", c.MaintenanceAPIHandler)
+	http.HandleFunc("/api/notify/test", c.NotifyTestAPIHandler)
+	http.HandleFunc("/api/playback/", c.PlaybackAPIHandler)
+	http.HandleFunc("/api/sessions", c.SessionsAPIHandler)
+	http.HandleFunc("/api/sessions/", c.SessionsAPIHandler)
+	http.HandleFunc("/api/openapi.json", c.OpenAPIHandler)
 
-	// if the listen address env variables are not set, set to sane default
-	if conf.AuthServerIP == "" {
-		conf.AuthServerIP = "127.0.0.1"
-	}
-	if conf.AuthServerPort == "" {
-		conf.AuthServerPort = "9090"
-	}
-	listenAddress := fmt.Sprintf("%s:%s", conf.AuthServerIP, conf.AuthServerPort)
+	listenAddress := net.JoinHostPort(conf.AuthServerIP, conf.AuthServerPort)
 
 	// Serve
-	log.Infof("starting rtmpauthbot server on %s", listenAddress)
-	err = http.ListenAndServe(listenAddress, nil)
+	log.WithFields(log.Fields{
+		"version":   config.Version,
+		"commit":    config.Commit,
+		"go":        runtime.Version(),
+		"database":  conf.DatabasePath,
+		"tenant":    conf.Tenant,
+		"platforms": c.SourceNames(),
+		"listen":    listenAddress,
+		"base_path": conf.BasePath,
+	}).Infof("starting rtmpauthbot server on %s", listenAddress)
+	var handler http.Handler = http.DefaultServeMux
+	if conf.ReadOnlyDB {
+		handler = controllers.ReadOnlyMiddleware(handler)
+	}
+	handler = mountBasePath(&conf, handler)
+	server := newServer(&conf, listenAddress, controllers.RequestIDMiddleware(
+		controllers.ClientIPMiddleware(conf.TrustedProxies, handler)))
+	listener, err := net.Listen("tcp", listenAddress)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = sdNotify("READY=1")
+	if err != nil {
+		log.Error("error notifying systemd: ", err)
+	}
+	startWatchdog(ctx, func() error {
+		return c.Healthy(time.Now())
+	})
+	err = server.Serve(listener)
 	if err != nil {
 		log.Fatal(err)
 	}
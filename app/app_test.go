@@ -0,0 +1,220 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bcambl/rtmpauthbot/config"
+	"github.com/bcambl/rtmpauthbot/controllers"
+	"github.com/bcambl/rtmpauthbot/internal/testutil"
+	"github.com/sirupsen/logrus/hooks/test"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestMountBasePath(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/status", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		basePath     string
+		healthAtRoot bool
+		target       string
+		want         int
+	}{
+		{"", false, "/api/status", http.StatusOK},
+		{"/rtmpauth", false, "/rtmpauth/api/status", http.StatusOK},
+		{"/rtmpauth", false, "/api/status", http.StatusNotFound},
+		{"/rtmpauth", false, "/readyz", http.StatusNotFound},
+		{"/rtmpauth", true, "/readyz", http.StatusOK},
+		{"/rtmpauth", true, "/rtmpauth/readyz", http.StatusOK},
+		{"/rtmpauth", true, "/api/status", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		conf := config.Config{BasePath: test.basePath, HealthAtRoot: test.healthAtRoot}
+		w := httptest.NewRecorder()
+		mountBasePath(&conf, mux).ServeHTTP(w, httptest.NewRequest("GET", test.target, nil))
+		if w.Code != test.want {
+			t.Errorf("BASE_PATH=%q HEALTH_AT_ROOT=%t %s: got %d, want %d",
+				test.basePath, test.healthAtRoot, test.target, w.Code, test.want)
+		}
+	}
+}
+
+func TestEnsureBuckets(t *testing.T) {
+	conf := testutil.NewConfig(t)
+	db := testutil.OpenDB(t, &conf, nil)
+
+	for _, tenant := range []string{"", "second"} {
+		conf.Tenant = tenant
+		// upgrading an existing database must keep working
+		for i := 0; i < 2; i++ {
+			err := ensureBuckets(db, &conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := db.View(func(tx *bolt.Tx) error {
+			for _, bucket := range DataBuckets {
+				if tx.Bucket([]byte(conf.BucketName(bucket))) == nil {
+					t.Errorf("tenant %q: bucket %s missing", tenant, conf.BucketName(bucket))
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCheckDatabase(t *testing.T) {
+	path := filepath.Join(testutil.TempDir(t), "rtmpauth.db")
+	db, err := openDatabase(path, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	conf := testutil.NewConfig(t)
+	err = ensureBuckets(db, &conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// enough publishers to fill separate leaf pages
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(conf.BucketName("PublisherBucket")))
+		for i := 0; i < 1000; i++ {
+			err := b.Put([]byte(fmt.Sprintf("publisher-%04d", i)), []byte("secret"))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkDatabase(db)
+	if err != nil {
+		t.Errorf("healthy database: %s", err)
+	}
+}
+
+func TestOpenDatabasePermissions(t *testing.T) {
+	path := filepath.Join(testutil.TempDir(t), "data", "rtmpauth.db")
+	db, err := openDatabase(path, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	for _, want := range []struct {
+		path string
+		mode os.FileMode
+	}{{filepath.Dir(path), 0700}, {path, 0600}} {
+		info, err := os.Stat(want.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != want.mode {
+			t.Errorf("%s: mode %s, want %s", want.path, info.Mode().Perm(), want.mode)
+		}
+	}
+
+	hook := test.NewGlobal()
+	defer hook.Reset()
+	checkDatabasePermissions(path)
+	if len(hook.AllEntries()) != 0 {
+		t.Errorf("warned about a database readable by the owner only: %s", hook.LastEntry().Message)
+	}
+	err = os.Chmod(path, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDatabasePermissions(path)
+	if len(hook.AllEntries()) != 1 {
+		t.Error("no warning about a database readable by others")
+	}
+}
+
+func TestNewServerTimeouts(t *testing.T) {
+	conf := config.Config{
+		HTTPReadHeaderTimeout: 2 * time.Second,
+		HTTPReadTimeout:       3 * time.Second,
+		HTTPWriteTimeout:      4 * time.Second,
+		HTTPIdleTimeout:       5 * time.Second,
+	}
+	server := newServer(&conf, "127.0.0.1:9090", http.NewServeMux())
+	if server.Addr != "127.0.0.1:9090" {
+		t.Errorf("addr: got %s, want 127.0.0.1:9090", server.Addr)
+	}
+	got := []time.Duration{server.ReadHeaderTimeout, server.ReadTimeout, server.WriteTimeout, server.IdleTimeout}
+	want := []time.Duration{2 * time.Second, 3 * time.Second, 4 * time.Second, 5 * time.Second}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("timeouts (read header, read, write, idle): got %v, want %v", got, want)
+			break
+		}
+	}
+
+	// every timeout has a default
+	conf = testutil.NewConfig(t)
+	server = newServer(&conf, "", http.NewServeMux())
+	for _, timeout := range []time.Duration{server.ReadHeaderTimeout, server.ReadTimeout, server.WriteTimeout, server.IdleTimeout} {
+		if timeout <= 0 {
+			t.Errorf("default timeouts (read header, read, write, idle): got %v, %v, %v, %v",
+				server.ReadHeaderTimeout, server.ReadTimeout, server.WriteTimeout, server.IdleTimeout)
+			break
+		}
+	}
+}
+
+func TestCheckDefaultCredentials(t *testing.T) {
+	tests := []struct {
+		name    string
+		set     func(*config.Config)
+		refused bool
+	}{
+		{"real credentials", func(conf *config.Config) {}, false},
+		{"placeholder client id", func(conf *config.Config) {
+			conf.TwitchClients[0].ID = "abcd1234"
+		}, true},
+		{"placeholder secret of an additional client", func(conf *config.Config) {
+			conf.TwitchClients = append(conf.TwitchClients, config.TwitchClient{ID: "other-id", Secret: "abcd1234"})
+		}, true},
+		{"placeholder credentials with twitch disabled", func(conf *config.Config) {
+			conf.TwitchClients[0].ID = "abcd1234"
+			conf.EnabledPlatforms = nil
+		}, false},
+		{"discord without a webhook", func(conf *config.Config) {
+			conf.DiscordEnabled = true
+			conf.DiscordWebhook = ""
+		}, true},
+	}
+	hook := test.NewGlobal()
+	defer hook.Reset()
+	for _, credentials := range tests {
+		for _, allowed := range []bool{false, true} {
+			conf := testutil.NewConfig(t)
+			conf.DiscordEnabled = false
+			credentials.set(&conf)
+			conf.AllowDefaultCredentials = allowed
+			c := &controllers.Controller{Config: &conf, DB: testutil.OpenDB(t, &conf, nil)}
+			c.RegisterSources()
+
+			hook.Reset()
+			err := checkDefaultCredentials(c, &conf)
+			if refused := err != nil; refused != (credentials.refused && !allowed) {
+				t.Errorf("%s, ALLOW_DEFAULT_CREDENTIALS=%t: got error %v", credentials.name, allowed, err)
+			}
+			if warned := len(hook.AllEntries()) > 0; allowed && warned != credentials.refused {
+				t.Errorf("%s, ALLOW_DEFAULT_CREDENTIALS=true: warned %t, want %t", credentials.name, warned, credentials.refused)
+			}
+		}
+	}
+}
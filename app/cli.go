@@ -0,0 +1,114 @@
+package app
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/bcambl/rtmpauthbot/config"
+	"github.com/bcambl/rtmpauthbot/controllers"
+	log "github.com/sirupsen/logrus"
+)
+
+// cliDatabaseTimeout limits how long the cli waits for the database, which
+// is locked while the server is running
+const cliDatabaseTimeout = 5 * time.Second
+
+// cliController opens the database for a cli command
+func cliController() (*controllers.Controller, func(), error) {
+	var conf config.Config
+	err := conf.ParseEnv()
+	if err != nil {
+		return nil, nil, err
+	}
+	db, err := openDatabase(conf.DatabasePath, cliDatabaseTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = ensureBuckets(db, &conf)
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	c := &controllers.Controller{Config: &conf, DB: db}
+	return c, func() { db.Close() }, nil
+}
+
+// exportPublishers writes all publishers to a file, or stdout when "-"
+func exportPublishers(path string) error {
+	c, closeDB, err := cliController()
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+
+	var out io.Writer = os.Stdout
+	if path != "-" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	count, err := c.ExportPublishers(out)
+	if err != nil {
+		return err
+	}
+	log.Infof("exported %d publishers", count)
+	return nil
+}
+
+// importPublishers creates or updates publishers from a file, or stdin when "-"
+func importPublishers(path string) error {
+	c, closeDB, err := cliController()
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+
+	var in io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	count, err := c.ImportPublishers(in)
+	if err != nil {
+		return err
+	}
+	log.Infof("imported %d publishers", count)
+	return nil
+}
+
+// prunePublishers lists the publishers which have been disabled or have not
+// published for too long, deleting them unless it is a dry run
+func prunePublishers(disabledFor, unpublishedFor time.Duration, dryRun bool) error {
+	c, closeDB, err := cliController()
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+
+	candidates, err := c.PruneCandidates(time.Now(), disabledFor, unpublishedFor)
+	if err != nil {
+		return err
+	}
+	for _, candidate := range candidates {
+		fmt.Printf("%s\t%s\n", candidate.Name, candidate.Reason)
+	}
+	if dryRun {
+		log.Infof("%d publishers would be pruned (rerun with -dry-run=false to delete them)", len(candidates))
+		return nil
+	}
+	err = c.PrunePublishers(candidates)
+	if err != nil {
+		return err
+	}
+	log.Infof("pruned %d publishers", len(candidates))
+	return nil
+}
@@ -0,0 +1,59 @@
+package app
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bcambl/rtmpauthbot/internal/testutil"
+)
+
+func TestPruneDryRun(t *testing.T) {
+	setenv(t, "DATABASE_PATH", filepath.Join(testutil.TempDir(t), "rtmpauth.db"))
+	exported := func() string {
+		t.Helper()
+		c, closeDB, err := cliController()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer closeDB()
+		var b bytes.Buffer
+		_, err = c.ExportPublishers(&b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b.String()
+	}
+
+	c, closeDB, err := cliController()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.ImportPublishers(strings.NewReader(`[{"name":"alice","key":"secret"},` +
+		`{"name":"bob","key":"secret","enabled":false}]`))
+	closeDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	// the default dry run only lists the candidates
+	err = prunePublishers(time.Millisecond, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(exported(), `"bob"`) {
+		t.Fatal("dry run deleted a publisher")
+	}
+
+	err = prunePublishers(time.Millisecond, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publishers := exported()
+	if strings.Contains(publishers, `"bob"`) || !strings.Contains(publishers, `"alice"`) {
+		t.Fatalf("publishers after pruning: %s", publishers)
+	}
+}
@@ -0,0 +1,99 @@
+package app
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// logFile is a log destination which can be reopened, so that logrotate can
+// move the file away & signal the server to continue in a new file
+type logFile struct {
+	path string
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+// openLogFile opens (or creates) a log file for appending
+func openLogFile(path string) (*logFile, error) {
+	l := &logFile{path: path}
+	err := l.Reopen()
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *logFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Write(p)
+}
+
+// Reopen closes the current file & opens the path again. The current file is
+// kept when the path cannot be opened.
+func (l *logFile) Reopen() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	old := l.f
+	l.f = f
+	l.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// Close closes the current file
+func (l *logFile) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
+// setLogOutput directs the log to the file when configured, also copying it
+// to stderr when requested. The log file is reopened on SIGHUP until the
+// context is cancelled.
+func setLogOutput(ctx context.Context, path string, stderr bool) (func(), error) {
+	if path == "" {
+		return func() {}, nil
+	}
+	l, err := openLogFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if stderr {
+		log.SetOutput(io.MultiWriter(l, os.Stderr))
+	} else {
+		log.SetOutput(l)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-hup:
+				err := l.Reopen()
+				if err != nil {
+					log.Error("error reopening log file: ", err)
+					continue
+				}
+				log.Info("log file reopened")
+			case <-ctx.Done():
+				signal.Stop(hup)
+				return
+			}
+		}
+	}()
+	return func() { l.Close() }, nil
+}
@@ -0,0 +1,64 @@
+package app
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/bcambl/rtmpauthbot/internal/testutil"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestSetLogOutput(t *testing.T) {
+	path := filepath.Join(testutil.TempDir(t), "rtmpauthd.log")
+	ctx, cancel := context.WithCancel(context.Background())
+	out := log.StandardLogger().Out
+	closeLog, err := setLogOutput(ctx, path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cancel()
+		closeLog()
+		log.SetOutput(out)
+	}()
+	contains := func(path, line string) bool {
+		content, err := ioutil.ReadFile(path)
+		return err == nil && strings.Contains(string(content), line)
+	}
+
+	log.Info("written to the log file")
+	if !contains(path, "written to the log file") {
+		t.Fatal("log line not written to the log file")
+	}
+
+	// logrotate moves the file away & signals the server
+	err = os.Rename(path, path+".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	process, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = process.Signal(syscall.SIGHUP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !contains(path, "log file reopened") {
+		if time.Now().After(deadline) {
+			t.Fatal("log file not reopened on SIGHUP")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	log.Info("written after the rotation")
+	if !contains(path, "written after the rotation") || contains(path+".1", "written after the rotation") {
+		t.Error("log line not written to the new log file")
+	}
+}
@@ -0,0 +1,77 @@
+package app
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// sdNotify sends a state (e.g. "READY=1") to the systemd notify socket. It
+// does nothing unless started by systemd with Type=notify, which sets
+// NOTIFY_SOCKET.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if strings.HasPrefix(socket, "@") {
+		// abstract namespace socket
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns the interval of the systemd watchdog (WatchdogSec)
+// or 0 when the watchdog is not enabled for this process
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// startWatchdog pings the systemd watchdog at half its interval while
+// healthy returns nil, so that systemd restarts the server once it stops
+// being healthy for a whole interval
+func startWatchdog(ctx context.Context, healthy func() error) {
+	interval := watchdogInterval()
+	if interval <= 0 {
+		return
+	}
+	log.Infof("starting systemd watchdog (interval: %s)", interval.String())
+	ticker := time.NewTicker(interval / 2)
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				err := healthy()
+				if err != nil {
+					log.Warn("unhealthy, skipping watchdog ping: ", err)
+					continue
+				}
+				err = sdNotify("WATCHDOG=1")
+				if err != nil {
+					log.Error("error pinging systemd watchdog: ", err)
+				}
+			case <-ctx.Done():
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
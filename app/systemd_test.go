@@ -0,0 +1,144 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bcambl/rtmpauthbot/internal/testutil"
+)
+
+// setenv sets an environment variable for the duration of the test
+func setenv(t *testing.T, key, value string) {
+	t.Helper()
+	previous, ok := os.LookupEnv(key)
+	err := os.Setenv(key, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, previous)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+// notifySocket listens on a fake systemd notify socket set as NOTIFY_SOCKET
+// and returns the states received
+func notifySocket(t *testing.T) <-chan string {
+	t.Helper()
+	path := filepath.Join(testutil.TempDir(t), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	setenv(t, "NOTIFY_SOCKET", path)
+
+	states := make(chan string, 100)
+	go func() {
+		buf := make([]byte, 256)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			states <- string(buf[:n])
+		}
+	}()
+	return states
+}
+
+func TestSdNotify(t *testing.T) {
+	states := notifySocket(t)
+	err := sdNotify("READY=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case state := <-states:
+		if state != "READY=1" {
+			t.Errorf("state: got %q, want READY=1", state)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no state received")
+	}
+
+	// not started by systemd
+	setenv(t, "NOTIFY_SOCKET", "")
+	err = sdNotify("READY=1")
+	if err != nil {
+		t.Errorf("without NOTIFY_SOCKET: %s", err)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	tests := []struct {
+		usec string
+		pid  string
+		want time.Duration
+	}{
+		{"", "", 0},
+		{"invalid", "", 0},
+		{"0", "", 0},
+		{"20000000", "", 20 * time.Second},
+		{"20000000", pid, 20 * time.Second},
+		// the watchdog of another process
+		{"20000000", "1", 0},
+	}
+	for _, test := range tests {
+		setenv(t, "WATCHDOG_USEC", test.usec)
+		setenv(t, "WATCHDOG_PID", test.pid)
+		if got := watchdogInterval(); got != test.want {
+			t.Errorf("WATCHDOG_USEC=%q WATCHDOG_PID=%q: got %s, want %s", test.usec, test.pid, got, test.want)
+		}
+	}
+}
+
+func TestWatchdog(t *testing.T) {
+	states := notifySocket(t)
+	setenv(t, "WATCHDOG_USEC", "100000")
+	setenv(t, "WATCHDOG_PID", "")
+	var unhealthy int32
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startWatchdog(ctx, func() error {
+		if atomic.LoadInt32(&unhealthy) == 1 {
+			return errors.New("poller stalled")
+		}
+		return nil
+	})
+
+	// pinged at half the interval
+	for i := 0; i < 2; i++ {
+		select {
+		case state := <-states:
+			if state != "WATCHDOG=1" {
+				t.Fatalf("state: got %q, want WATCHDOG=1", state)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("watchdog not pinged")
+		}
+	}
+
+	// no ping while unhealthy
+	atomic.StoreInt32(&unhealthy, 1)
+	time.Sleep(100 * time.Millisecond)
+	for len(states) > 0 {
+		<-states
+	}
+	select {
+	case state := <-states:
+		t.Errorf("pinged while unhealthy: %q", state)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
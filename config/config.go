@@ -1,16 +1,28 @@
 package config
 
 import (
+	"fmt"
+	"net"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"text/template"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// TwitchClient is a twitch api client id & secret pair
+type TwitchClient struct {
+	ID     string
+	Secret string
+}
+
 // Config contains config vars parsed from the environment
 type Config struct {
+	DatabasePath       string
 	AuthServerIP       string
 	AuthServerPort     string
 	RTMPServerFQDN     string
@@ -18,15 +30,172 @@ type Config struct {
 	TwitchEnabled      bool
 	TwitchClientID     string
 	TwitchClientSecret string
+	TwitchClients      []TwitchClient
+	TrovoClientID      string
 	DiscordWebhook     string
 	DiscordEnabled     bool
 	TwitchPollRate     time.Duration
+	EnabledPlatforms   []string
+	DenyStatusCode     int
+	RequireTwitchLive  bool
+	LiveGracePeriod    time.Duration
+	NegativeCacheTTL   time.Duration
+	TokenCheckInterval time.Duration
+	TrustedProxies     []*net.IPNet
+	BlockedGameIDs     []string
+	RefreshOnNewToken  bool
+	MaxPublishers      int
+	KeyParam           string
+	// TwitchValidateTimeout limits each access token validation attempt and
+	// TwitchValidateRetries is the number of retries after transport errors
+	TwitchValidateTimeout time.Duration
+	TwitchValidateRetries int
+	// AllowRedirectTemplate renders the stream name allowed publishes are
+	// redirected to, nil when publishes are not redirected
+	AllowRedirectTemplate *template.Template
+	// MaintenanceAllowAll starts the server in maintenance mode
+	MaintenanceAllowAll bool
+	// PublishDenyLimit denies within PublishDenyWindow throttle a publisher
+	// for PublishThrottleBackoff, 0 disables throttling
+	PublishDenyLimit       int
+	PublishDenyWindow      time.Duration
+	PublishThrottleBackoff time.Duration
+	// NotifyDenies alerts of denied publishes, at most once per publisher
+	// every DenyNotifyInterval
+	NotifyDenies       bool
+	DenyNotifyInterval time.Duration
+	// AuthDeadline limits the time taken to authorize a publish
+	AuthDeadline time.Duration
+	// TwitchValidateCache skips validating an access token which was
+	// successfully validated more recently, 0 validates on every use
+	TwitchValidateCache time.Duration
+	// Timeouts of the http server, 0 disables a timeout
+	HTTPReadHeaderTimeout time.Duration
+	HTTPReadTimeout       time.Duration
+	HTTPWriteTimeout      time.Duration
+	HTTPIdleTimeout       time.Duration
+	// PublishHeaders adds the publisher & its live status as headers to
+	// allowed on_publish responses
+	PublishHeaders bool
+	// SessionTTL ends the local live status of publish sessions which have
+	// not been seen (on_publish or on_update) for longer, 0 disables
+	SessionTTL time.Duration
+	// CacheBackend is where twitch logins confirmed as not live are cached,
+	// memory or redis (shared by every server using RedisAddr)
+	CacheBackend  string
+	RedisAddr     string
+	RedisPassword string
+	// NginxStatURL is the nginx-rtmp stat page read when nginx is enabled
+	NginxStatURL string
+	// NginxControlURL is the nginx-rtmp control module used to disconnect
+	// publishers whose session is ended through the api
+	NginxControlURL string
+	// PlaybackSecret signs playback tokens, which on_play requires when set.
+	// PlaybackTokenTTL is the lifetime of tokens issued without a ttl.
+	PlaybackSecret   string
+	PlaybackTokenTTL time.Duration
+	// SourceTimeout is how long a poll waits for each platform before moving
+	// on without it, 0 waits indefinitely
+	SourceTimeout time.Duration
+	// CheckDBOnStart verifies the integrity of the database before serving
+	CheckDBOnStart bool
+	// LogFile is a file the log is written to instead of stdout, reopened on
+	// SIGHUP
+	LogFile string
+	// LogStderr also copies the log to stderr when a LogFile is set
+	LogStderr bool
+	// NotifyDigestWindow coalesces the live & offline notifications posted
+	// within the window into a single message (0 disables)
+	NotifyDigestWindow time.Duration
+	// AllowCacheTTL skips the twitch live check of a publisher which passed
+	// it within the ttl, so that reconnects are cheap (0 disables)
+	AllowCacheTTL time.Duration
+	// NoPlatformPolicy is applied to mirror publishers without a twitch
+	// stream under RequireTwitchLive: allow (key only) or deny
+	NoPlatformPolicy string
+	// HidePublisherExistence answers nginx identically for unknown streams and
+	// denied publishers so that stream names cannot be enumerated
+	HidePublisherExistence bool
+	// ReadOnlyDB opens the database read-only for standby & dashboard
+	// servers, disabling polling, every api request which writes and the
+	// database writes of the nginx callbacks
+	ReadOnlyDB bool
+	// BasePath is prepended to every route, e.g. /rtmpauth for a reverse proxy
+	// subpath. HealthAtRoot also serves /readyz & /metrics without it.
+	BasePath     string
+	HealthAtRoot bool
+	// RecordWebhookURL receives finished recordings reported by nginx
+	RecordWebhookURL string
+	// AllowedApps are the rtmp apps which may be published to, any app when
+	// empty. Other apps are denied before the publisher is looked up.
+	AllowedApps []string
+	// NotifyTitleMaxLength truncates stream titles in notifications to this
+	// many characters, 0 for no limit
+	NotifyTitleMaxLength int
+	// TwitchClockSkew is tolerated when comparing the cached access token
+	// validation & expiry times to the local clock
+	TwitchClockSkew time.Duration
+	// WebhookHeaders are added to every outbound webhook request (discord &
+	// RECORD_WEBHOOK_URL), e.g. to authenticate with a gateway
+	WebhookHeaders map[string]string
+	// PublisherWebhookMode decides whether transitions of publishers with their
+	// own webhook are also posted to the discord webhook (also) or not (instead)
+	PublisherWebhookMode string
+	// AllowDefaultCredentials permits starting with the placeholder twitch
+	// credentials or discord webhook of the environment template, for local
+	// testing
+	AllowDefaultCredentials bool
+	// Connection pooling of outbound requests (twitch, trovo, nginx &
+	// webhooks). A MaxIdleConns of 0 is unlimited.
+	ClientMaxIdleConns        int
+	ClientMaxIdleConnsPerHost int
+	ClientIdleConnTimeout     time.Duration
+	// ClientTimeout limits each outbound request, including reading the
+	// response body (0 disables)
+	ClientTimeout time.Duration
+	// CallbackMaxBodyBytes limits the request body of the nginx callbacks
+	CallbackMaxBodyBytes int64
+	// PublishersDir holds one json file per publisher, reconciled into the
+	// database whenever the files change (empty disables)
+	PublishersDir string
+	// PublishersDirInterval is how often PublishersDir is checked for changes
+	PublishersDirInterval time.Duration
+	// PublishersDirPrune deletes publishers without a file in PublishersDir
+	PublishersDirPrune bool
+	// Tenant namespaces the database buckets so that several tenants may
+	// keep their data separate within one database file
+	Tenant string
+}
+
+// BucketName returns the name of a database bucket within the tenant
+func (c *Config) BucketName(name string) string {
+	if c.Tenant == "" {
+		return name
+	}
+	return c.Tenant + "." + name
+}
+
+// validTenant ensures a tenant cannot collide with another tenant's buckets
+func validTenant(tenant string) bool {
+	for _, ch := range tenant {
+		switch {
+		case ch >= 'a' && ch <= 'z', ch >= 'A' && ch <= 'Z', ch >= '0' && ch <= '9':
+		case ch == '-', ch == '_':
+		default:
+			return false
+		}
+	}
+	return true
 }
 
-// DatabasePath returns the path to the database
+// DatabasePath returns the path to the database. DATABASE_PATH takes
+// precedence over rtmpauthbot.db within the DATA_PATH directory.
 func DatabasePath() string {
-	pathToDB := os.Getenv("DATA_PATH")
-	fullDBPath := filepath.Join(pathToDB, "rtmpauthbot.db")
+	fullDBPath := os.Getenv("DATABASE_PATH")
+	if fullDBPath == "" {
+		pathToDB := os.Getenv("DATA_PATH")
+		fullDBPath = filepath.Join(pathToDB, "rtmpauthbot.db")
+	}
 	log.Debug("Using database path: ", fullDBPath)
 	return fullDBPath
 }
@@ -34,15 +203,59 @@ func DatabasePath() string {
 // ParseEnv parses configurations from environment environment variables
 func (c *Config) ParseEnv() error {
 	var (
-		err         error
-		pollRateSec int64
+		err            error
+		pollRateSec    int64
+		denyStatusCode int64
+		graceSec       int64
+		negativeSec    int64
+		tokenCheckMin  int64
+		validateSec    int64
+		validateTries  int64
+		validateCache  int64
+		readHeaderSec  int64
+		readSec        int64
+		writeSec       int64
+		idleSec        int64
+		sessionSec     int64
+		playbackSec    int64
+		sourceSec      int64
+		maxPublishers  int64
+		denyLimit      int64
+		denyWindowSec  int64
+		backoffSec     int64
+		denyNotifySec  int64
+		digestSec      int64
+		allowSec       int64
+		deadlineSec    int64
+		titleMax       int64
+		skewSec        int64
+		dirSec         int64
+		idleConns      int64
+		idlePerHost    int64
+		idleConnSec    int64
+		clientSec      int64
 	)
+	c.DatabasePath = DatabasePath()
 	c.AuthServerIP = os.Getenv("AUTH_SERVER_IP")
 	c.AuthServerPort = os.Getenv("AUTH_SERVER_PORT")
+	// if the listen address env variables are not set, set to sane default
+	if c.AuthServerIP == "" {
+		c.AuthServerIP = "127.0.0.1"
+	}
+	if c.AuthServerPort == "" {
+		c.AuthServerPort = "9090"
+	}
 	c.RTMPServerFQDN = os.Getenv("RTMP_SERVER_FQDN")
 	c.RTMPServerPort = os.Getenv("RTMP_SERVER_PORT")
 	c.TwitchClientID = os.Getenv("TWITCH_CLIENT_ID")
 	c.TwitchClientSecret = os.Getenv("TWITCH_CLIENT_SECRET")
+	c.TwitchClients, err = parseTwitchClients(c.TwitchClientID, c.TwitchClientSecret, os.Getenv("TWITCH_CLIENTS"))
+	if err != nil {
+		return err
+	}
+	c.TrovoClientID = os.Getenv("TROVO_CLIENT_ID")
+	c.NginxStatURL = os.Getenv("NGINX_STAT_URL")
+	c.NginxControlURL = os.Getenv("NGINX_CONTROL_URL")
 	c.DiscordWebhook = os.Getenv("DISCORD_WEBHOOK")
 	c.DiscordEnabled, err = strconv.ParseBool(os.Getenv("DISCORD_ENABLED"))
 	if err != nil {
@@ -64,6 +277,402 @@ func (c *Config) ParseEnv() error {
 		pollRateSec = 5
 	}
 	c.TwitchPollRate = (time.Duration(pollRateSec) * time.Second)
+	c.EnabledPlatforms = parseList(os.Getenv("ENABLED_PLATFORMS"))
+	if len(c.EnabledPlatforms) == 0 {
+		// twitch is the only platform enabled by default
+		c.EnabledPlatforms = []string{"twitch"}
+	}
+	denyStatusCode, err = strconv.ParseInt(os.Getenv("DENY_STATUS_CODE"), 0, 0)
+	if err != nil {
+		denyStatusCode = http.StatusForbidden
+	}
+	// nginx-rtmp treats any non 2xx response as a deny, but only error codes
+	// make sense for a denied publish
+	if denyStatusCode < 400 || denyStatusCode > 599 {
+		return fmt.Errorf("invalid DENY_STATUS_CODE: %d (must be 4xx or 5xx)", denyStatusCode)
+	}
+	c.DenyStatusCode = int(denyStatusCode)
+	c.RequireTwitchLive, err = strconv.ParseBool(os.Getenv("REQUIRE_TWITCH_LIVE"))
+	if err != nil {
+		c.RequireTwitchLive = false
+		log.Debug("error parsing env var: REQUIRE_TWITCH_LIVE")
+	}
+	c.MaintenanceAllowAll, err = strconv.ParseBool(os.Getenv("MAINTENANCE_ALLOW_ALL"))
+	if err != nil {
+		c.MaintenanceAllowAll = false
+		log.Debug("error parsing env var: MAINTENANCE_ALLOW_ALL")
+	}
+	graceSec, err = strconv.ParseInt(os.Getenv("LIVE_GRACE_PERIOD"), 0, 0)
+	if err != nil || graceSec < 0 {
+		graceSec = 0
+	}
+	c.LiveGracePeriod = (time.Duration(graceSec) * time.Second)
+	negativeSec, err = strconv.ParseInt(os.Getenv("NEGATIVE_CACHE_SECONDS"), 0, 0)
+	if err != nil || negativeSec < 0 {
+		negativeSec = 30
+	}
+	c.NegativeCacheTTL = (time.Duration(negativeSec) * time.Second)
+	tokenCheckMin, err = strconv.ParseInt(os.Getenv("TOKEN_CHECK_INTERVAL"), 0, 0)
+	if err != nil || tokenCheckMin < 0 {
+		tokenCheckMin = 10
+	}
+	c.TokenCheckInterval = (time.Duration(tokenCheckMin) * time.Minute)
+	validateSec, err = strconv.ParseInt(os.Getenv("TWITCH_VALIDATE_TIMEOUT"), 0, 0)
+	if err != nil || validateSec < 1 {
+		validateSec = 5
+	}
+	c.TwitchValidateTimeout = (time.Duration(validateSec) * time.Second)
+	validateTries, err = strconv.ParseInt(os.Getenv("TWITCH_VALIDATE_RETRIES"), 0, 0)
+	if err != nil || validateTries < 0 {
+		validateTries = 1
+	}
+	c.TwitchValidateRetries = int(validateTries)
+	validateCache, err = strconv.ParseInt(os.Getenv("TWITCH_VALIDATE_CACHE"), 0, 0)
+	if err != nil || validateCache < 0 {
+		validateCache = 0
+	}
+	c.TwitchValidateCache = (time.Duration(validateCache) * time.Second)
+	c.RefreshOnNewToken, err = strconv.ParseBool(os.Getenv("REFRESH_ON_NEW_TOKEN"))
+	if err != nil {
+		c.RefreshOnNewToken = true
+		log.Debug("error parsing env var: REFRESH_ON_NEW_TOKEN")
+	}
+	maxPublishers, err = strconv.ParseInt(os.Getenv("MAX_PUBLISHERS"), 0, 0)
+	if err != nil || maxPublishers < 0 {
+		maxPublishers = 0
+	}
+	c.MaxPublishers = int(maxPublishers)
+	denyLimit, err = strconv.ParseInt(os.Getenv("PUBLISH_DENY_LIMIT"), 0, 0)
+	if err != nil || denyLimit < 0 {
+		denyLimit = 0
+	}
+	c.PublishDenyLimit = int(denyLimit)
+	denyWindowSec, err = strconv.ParseInt(os.Getenv("PUBLISH_DENY_WINDOW"), 0, 0)
+	if err != nil || denyWindowSec < 1 {
+		denyWindowSec = 60
+	}
+	c.PublishDenyWindow = (time.Duration(denyWindowSec) * time.Second)
+	backoffSec, err = strconv.ParseInt(os.Getenv("PUBLISH_THROTTLE_SECONDS"), 0, 0)
+	if err != nil || backoffSec < 1 {
+		backoffSec = 300
+	}
+	c.PublishThrottleBackoff = (time.Duration(backoffSec) * time.Second)
+	c.NotifyDenies, err = strconv.ParseBool(os.Getenv("NOTIFY_DENIES"))
+	if err != nil {
+		c.NotifyDenies = false
+		log.Debug("error parsing env var: NOTIFY_DENIES")
+	}
+	c.CheckDBOnStart, err = strconv.ParseBool(os.Getenv("CHECK_DB_ON_START"))
+	if err != nil {
+		c.CheckDBOnStart = false
+		log.Debug("error parsing env var: CHECK_DB_ON_START")
+	}
+	c.PublishHeaders, err = strconv.ParseBool(os.Getenv("PUBLISH_HEADERS"))
+	if err != nil {
+		c.PublishHeaders = false
+		log.Debug("error parsing env var: PUBLISH_HEADERS")
+	}
+	denyNotifySec, err = strconv.ParseInt(os.Getenv("DENY_NOTIFY_INTERVAL"), 0, 0)
+	if err != nil || denyNotifySec < 1 {
+		denyNotifySec = 300
+	}
+	c.DenyNotifyInterval = (time.Duration(denyNotifySec) * time.Second)
+	deadlineSec, err = strconv.ParseInt(os.Getenv("AUTH_DEADLINE_SECONDS"), 0, 0)
+	if err != nil || deadlineSec < 0 {
+		deadlineSec = 10
+	}
+	c.AuthDeadline = (time.Duration(deadlineSec) * time.Second)
+	readHeaderSec, err = strconv.ParseInt(os.Getenv("HTTP_READ_HEADER_TIMEOUT"), 0, 0)
+	if err != nil || readHeaderSec < 0 {
+		readHeaderSec = 5
+	}
+	c.HTTPReadHeaderTimeout = (time.Duration(readHeaderSec) * time.Second)
+	readSec, err = strconv.ParseInt(os.Getenv("HTTP_READ_TIMEOUT"), 0, 0)
+	if err != nil || readSec < 0 {
+		readSec = 10
+	}
+	c.HTTPReadTimeout = (time.Duration(readSec) * time.Second)
+	writeSec, err = strconv.ParseInt(os.Getenv("HTTP_WRITE_TIMEOUT"), 0, 0)
+	if err != nil || writeSec < 0 {
+		writeSec = 30
+	}
+	c.HTTPWriteTimeout = (time.Duration(writeSec) * time.Second)
+	idleSec, err = strconv.ParseInt(os.Getenv("HTTP_IDLE_TIMEOUT"), 0, 0)
+	if err != nil || idleSec < 0 {
+		idleSec = 60
+	}
+	c.HTTPIdleTimeout = (time.Duration(idleSec) * time.Second)
+	sessionSec, err = strconv.ParseInt(os.Getenv("SESSION_TTL"), 0, 0)
+	if err != nil || sessionSec < 0 {
+		sessionSec = 0
+	}
+	c.SessionTTL = (time.Duration(sessionSec) * time.Second)
+	c.CacheBackend = strings.ToLower(os.Getenv("CACHE_BACKEND"))
+	switch c.CacheBackend {
+	case "":
+		c.CacheBackend = "memory"
+	case "memory", "redis":
+	default:
+		return fmt.Errorf("invalid CACHE_BACKEND %q: must be memory or redis", c.CacheBackend)
+	}
+	c.RedisAddr = os.Getenv("REDIS_ADDR")
+	if c.RedisAddr == "" {
+		c.RedisAddr = "127.0.0.1:6379"
+	}
+	c.RedisPassword = os.Getenv("REDIS_PASSWORD")
+	c.PlaybackSecret = os.Getenv("PLAYBACK_SECRET")
+	playbackSec, err = strconv.ParseInt(os.Getenv("PLAYBACK_TOKEN_TTL"), 0, 0)
+	if err != nil || playbackSec < 1 {
+		playbackSec = 86400
+	}
+	c.PlaybackTokenTTL = (time.Duration(playbackSec) * time.Second)
+	sourceSec, err = strconv.ParseInt(os.Getenv("SOURCE_TIMEOUT"), 0, 0)
+	if err != nil || sourceSec < 0 {
+		sourceSec = 30
+	}
+	c.SourceTimeout = (time.Duration(sourceSec) * time.Second)
+	digestSec, err = strconv.ParseInt(os.Getenv("NOTIFY_DIGEST_SECONDS"), 0, 0)
+	if err != nil || digestSec < 0 {
+		digestSec = 0
+	}
+	c.NotifyDigestWindow = (time.Duration(digestSec) * time.Second)
+
+	allowSec, err = strconv.ParseInt(os.Getenv("ALLOW_CACHE_SECONDS"), 0, 0)
+	if err != nil || allowSec < 0 {
+		allowSec = 0
+	}
+	c.AllowCacheTTL = (time.Duration(allowSec) * time.Second)
+
+	c.NoPlatformPolicy = strings.ToLower(os.Getenv("NO_PLATFORM_POLICY"))
+	switch c.NoPlatformPolicy {
+	case "":
+		c.NoPlatformPolicy = "allow"
+	case "allow", "deny":
+	default:
+		return fmt.Errorf("invalid NO_PLATFORM_POLICY %q: must be allow or deny", c.NoPlatformPolicy)
+	}
+
+	c.HidePublisherExistence, err = strconv.ParseBool(os.Getenv("HIDE_PUBLISHER_EXISTENCE"))
+	if err != nil {
+		c.HidePublisherExistence = false
+	}
+
+	c.ReadOnlyDB, err = strconv.ParseBool(os.Getenv("READ_ONLY_DB"))
+	if err != nil {
+		c.ReadOnlyDB = false
+	}
+
+	c.BasePath = strings.TrimSuffix(os.Getenv("BASE_PATH"), "/")
+	if c.BasePath != "" && !strings.HasPrefix(c.BasePath, "/") {
+		return fmt.Errorf("invalid BASE_PATH %q: must start with /", c.BasePath)
+	}
+	c.HealthAtRoot, err = strconv.ParseBool(os.Getenv("HEALTH_AT_ROOT"))
+	if err != nil {
+		c.HealthAtRoot = false
+	}
+
+	c.RecordWebhookURL = os.Getenv("RECORD_WEBHOOK_URL")
+
+	c.AllowedApps = nil
+	for _, app := range strings.Split(os.Getenv("ALLOWED_APPS"), ",") {
+		// app names are case sensitive, so parseList is not used
+		if app = strings.TrimSpace(app); app != "" {
+			c.AllowedApps = append(c.AllowedApps, app)
+		}
+	}
+
+	titleMax, err = strconv.ParseInt(os.Getenv("NOTIFY_TITLE_MAX_LENGTH"), 0, 0)
+	if err != nil || titleMax < 0 {
+		titleMax = 140
+	}
+	c.NotifyTitleMaxLength = int(titleMax)
+
+	skewSec, err = strconv.ParseInt(os.Getenv("TWITCH_CLOCK_SKEW"), 0, 0)
+	if err != nil || skewSec < 0 {
+		skewSec = 30
+	}
+	c.TwitchClockSkew = (time.Duration(skewSec) * time.Second)
+
+	c.WebhookHeaders, err = parseWebhookHeaders(os.Getenv("WEBHOOK_HEADERS"))
+	if err != nil {
+		return err
+	}
+
+	c.PublisherWebhookMode = strings.ToLower(os.Getenv("PUBLISHER_WEBHOOK_MODE"))
+	switch c.PublisherWebhookMode {
+	case "":
+		c.PublisherWebhookMode = "also"
+	case "also", "instead":
+	default:
+		return fmt.Errorf("invalid PUBLISHER_WEBHOOK_MODE %q: must be also or instead", c.PublisherWebhookMode)
+	}
+
+	c.AllowDefaultCredentials, err = strconv.ParseBool(os.Getenv("ALLOW_DEFAULT_CREDENTIALS"))
+	if err != nil {
+		c.AllowDefaultCredentials = false
+	}
+
+	idleConns, err = strconv.ParseInt(os.Getenv("CLIENT_MAX_IDLE_CONNS"), 0, 0)
+	if err != nil || idleConns < 0 {
+		idleConns = 100
+	}
+	c.ClientMaxIdleConns = int(idleConns)
+	idlePerHost, err = strconv.ParseInt(os.Getenv("CLIENT_MAX_IDLE_CONNS_PER_HOST"), 0, 0)
+	if err != nil || idlePerHost < 1 {
+		idlePerHost = 10
+	}
+	c.ClientMaxIdleConnsPerHost = int(idlePerHost)
+	idleConnSec, err = strconv.ParseInt(os.Getenv("CLIENT_IDLE_CONN_TIMEOUT"), 0, 0)
+	if err != nil || idleConnSec < 0 {
+		idleConnSec = 90
+	}
+	c.ClientIdleConnTimeout = (time.Duration(idleConnSec) * time.Second)
+
+	clientSec, err = strconv.ParseInt(os.Getenv("CLIENT_TIMEOUT"), 0, 0)
+	if err != nil || clientSec < 0 {
+		clientSec = 30
+	}
+	c.ClientTimeout = (time.Duration(clientSec) * time.Second)
+
+	c.CallbackMaxBodyBytes, err = strconv.ParseInt(os.Getenv("CALLBACK_MAX_BODY_BYTES"), 0, 64)
+	if err != nil || c.CallbackMaxBodyBytes < 1 {
+		c.CallbackMaxBodyBytes = 16384
+	}
+
+	c.PublishersDir = os.Getenv("PUBLISHERS_DIR")
+	dirSec, err = strconv.ParseInt(os.Getenv("PUBLISHERS_DIR_INTERVAL"), 0, 0)
+	if err != nil || dirSec < 1 {
+		dirSec = 10
+	}
+	c.PublishersDirInterval = (time.Duration(dirSec) * time.Second)
+	c.PublishersDirPrune, err = strconv.ParseBool(os.Getenv("PUBLISHERS_DIR_PRUNE"))
+	if err != nil {
+		c.PublishersDirPrune = true
+	}
+
+	c.LogFile = os.Getenv("LOG_FILE")
+	c.LogStderr, err = strconv.ParseBool(os.Getenv("LOG_STDERR"))
+	if err != nil {
+		c.LogStderr = false
+	}
+
+	c.Tenant = os.Getenv("TENANT")
+	if !validTenant(c.Tenant) {
+		return fmt.Errorf("invalid TENANT %q: only letters, digits, '-' and '_' are allowed", c.Tenant)
+	}
+	c.KeyParam = os.Getenv("KEY_PARAM")
+	if c.KeyParam == "" {
+		c.KeyParam = "key"
+	}
+	c.BlockedGameIDs = parseList(os.Getenv("BLOCKED_GAME_IDS"))
+	c.TrustedProxies, err = parseCIDRs(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		return err
+	}
+	if tmpl := os.Getenv("ALLOW_REDIRECT_TEMPLATE"); tmpl != "" {
+		c.AllowRedirectTemplate, err = template.New("redirect").Option("missingkey=error").Parse(tmpl)
+		if err != nil {
+			return fmt.Errorf("invalid ALLOW_REDIRECT_TEMPLATE: %s", err)
+		}
+	}
 
 	return nil
 }
+
+// PlatformEnabled returns true when the named platform is in EnabledPlatforms
+func (c *Config) PlatformEnabled(name string) bool {
+	for i := range c.EnabledPlatforms {
+		if c.EnabledPlatforms[i] == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseWebhookHeaders returns the headers provided as comma separated
+// "name:value" pairs. The Content-Type of webhooks cannot be overridden.
+func parseWebhookHeaders(value string) (map[string]string, error) {
+	var headers map[string]string
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, ":", 2)
+		name := http.CanonicalHeaderKey(strings.TrimSpace(parts[0]))
+		if len(parts) != 2 || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("invalid WEBHOOK_HEADERS entry: expected name:value")
+		}
+		if name == "Content-Type" || name == "Host" {
+			return nil, fmt.Errorf("invalid WEBHOOK_HEADERS entry: %s cannot be overridden", name)
+		}
+		if headers == nil {
+			headers = make(map[string]string)
+		}
+		headers[name] = strings.TrimSpace(parts[1])
+	}
+	return headers, nil
+}
+
+// parseTwitchClients returns the primary twitch client followed by any
+// additional clients provided as comma separated "id:secret" pairs
+func parseTwitchClients(id, secret, additional string) ([]TwitchClient, error) {
+	clients := []TwitchClient{{ID: id, Secret: secret}}
+	for _, pair := range strings.Split(additional, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid TWITCH_CLIENTS entry: expected id:secret")
+		}
+		clients = append(clients, TwitchClient{ID: parts[0], Secret: parts[1]})
+	}
+	return clients, nil
+}
+
+// parseCIDRs parses a comma separated list of CIDRs. Bare IP addresses are
+// treated as a single host network.
+func parseCIDRs(value string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, v := range strings.Split(value, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(v, "["), "]"))
+			if ip == nil {
+				return nil, fmt.Errorf("invalid TRUSTED_PROXIES entry: %s", v)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TRUSTED_PROXIES entry: %s", v)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// parseList splits a comma separated env var value into a slice of
+// lowercase, whitespace-trimmed values. Empty values are discarded.
+func parseList(value string) []string {
+	var list []string
+	for _, v := range strings.Split(value, ",") {
+		v = strings.ToLower(strings.TrimSpace(v))
+		if v == "" {
+			continue
+		}
+		list = append(list, v)
+	}
+	return list
+}
@@ -0,0 +1,143 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setenv sets an environment variable for the duration of the test
+func setenv(t *testing.T, key, value string) {
+	t.Helper()
+	previous, ok := os.LookupEnv(key)
+	err := os.Setenv(key, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, previous)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+func TestClientTimeout(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 30 * time.Second},
+		{"5", 5 * time.Second},
+		{"0", 0},
+		{"-1", 30 * time.Second},
+		{"invalid", 30 * time.Second},
+	}
+	for _, test := range tests {
+		setenv(t, "CLIENT_TIMEOUT", test.value)
+		var c Config
+		err := c.ParseEnv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.ClientTimeout != test.want {
+			t.Errorf("CLIENT_TIMEOUT=%q: got %s, want %s", test.value, c.ClientTimeout, test.want)
+		}
+	}
+}
+
+func TestDenyStatusCode(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int
+		valid bool
+	}{
+		{"", 403, true},
+		{"401", 401, true},
+		{"503", 503, true},
+		{"302", 0, false},
+		{"200", 0, false},
+		{"600", 0, false},
+	}
+	for _, test := range tests {
+		setenv(t, "DENY_STATUS_CODE", test.value)
+		var c Config
+		err := c.ParseEnv()
+		if (err == nil) != test.valid {
+			t.Errorf("DENY_STATUS_CODE=%q: got error %v, want valid %t", test.value, err, test.valid)
+			continue
+		}
+		if test.valid && c.DenyStatusCode != test.want {
+			t.Errorf("DENY_STATUS_CODE=%q: got %d, want %d", test.value, c.DenyStatusCode, test.want)
+		}
+	}
+}
+
+func TestEffectiveConfigMasked(t *testing.T) {
+	setenv(t, "TWITCH_CLIENT_ID", "visible-client-id")
+	setenv(t, "TWITCH_CLIENT_SECRET", "hidden-client-secret")
+	setenv(t, "DISCORD_WEBHOOK", "https://discord.example/api/webhooks/hidden-webhook")
+	setenv(t, "AUTH_SERVER_PORT", "9191")
+	var c Config
+	err := c.ParseEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := c.effectiveJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"hidden-client-secret", "hidden-webhook"} {
+		if strings.Contains(string(content), secret) {
+			t.Errorf("effective configuration reveals %s", secret)
+		}
+	}
+
+	var e effectiveConfig
+	err = json.Unmarshal(content, &e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e.TwitchClients) != 1 || e.TwitchClients[0].ID != "visible-client-id" || e.TwitchClients[0].Secret != maskedValue {
+		t.Errorf("twitch clients: got %+v, want the id shown & the secret masked", e.TwitchClients)
+	}
+	if e.DiscordWebhook != maskedValue {
+		t.Errorf("discord webhook: got %s, want it masked", e.DiscordWebhook)
+	}
+	if e.AuthServerPort != "9191" {
+		t.Errorf("auth server port: got %s, want 9191", e.AuthServerPort)
+	}
+}
+
+func TestWebhookHeaders(t *testing.T) {
+	tests := []struct {
+		value string
+		want  map[string]string
+		valid bool
+	}{
+		{"", nil, true},
+		{"x-gateway-token: abc:def , Authorization:Bearer xyz", map[string]string{
+			"X-Gateway-Token": "abc:def", "Authorization": "Bearer xyz"}, true},
+		{"X-Token", nil, false},
+		{":value", nil, false},
+		{"Bad Name:value", nil, false},
+		{"content-type:text/plain", nil, false},
+		{"Host:evil.example", nil, false},
+	}
+	for _, test := range tests {
+		setenv(t, "WEBHOOK_HEADERS", test.value)
+		var c Config
+		err := c.ParseEnv()
+		if (err == nil) != test.valid {
+			t.Errorf("WEBHOOK_HEADERS=%q: got error %v, want valid %t", test.value, err, test.valid)
+			continue
+		}
+		if test.valid && !reflect.DeepEqual(c.WebhookHeaders, test.want) {
+			t.Errorf("WEBHOOK_HEADERS=%q: got %v, want %v", test.value, c.WebhookHeaders, test.want)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// maskedValue replaces secrets in the effective configuration
+const maskedValue = "********"
+
+// effectiveConfig is the printable form of Config
+type effectiveConfig struct {
+	DatabasePath          string         `json:"database_path"`
+	CheckDBOnStart        bool           `json:"check_db_on_start"`
+	ReadOnlyDB            bool           `json:"read_only_db"`
+	Tenant                string         `json:"tenant"`
+	LogFile               string         `json:"log_file"`
+	LogStderr             bool           `json:"log_stderr"`
+	AuthServerIP          string         `json:"auth_server_ip"`
+	AuthServerPort        string         `json:"auth_server_port"`
+	BasePath              string         `json:"base_path"`
+	HealthAtRoot          bool           `json:"health_at_root"`
+	HTTPReadHeaderTimeout string         `json:"http_read_header_timeout"`
+	HTTPReadTimeout       string         `json:"http_read_timeout"`
+	HTTPWriteTimeout      string         `json:"http_write_timeout"`
+	HTTPIdleTimeout       string         `json:"http_idle_timeout"`
+	ClientMaxIdleConns    int            `json:"client_max_idle_conns"`
+	ClientMaxIdlePerHost  int            `json:"client_max_idle_conns_per_host"`
+	ClientIdleConnTimeout string         `json:"client_idle_conn_timeout"`
+	ClientTimeout         string         `json:"client_timeout"`
+	CallbackMaxBodyBytes  int64          `json:"callback_max_body_bytes"`
+	RTMPServerFQDN        string         `json:"rtmp_server_fqdn"`
+	RTMPServerPort        string         `json:"rtmp_server_port"`
+	TwitchEnabled         bool           `json:"twitch_enabled"`
+	TwitchClients         []maskedClient `json:"twitch_clients"`
+	TwitchPollRate        string         `json:"twitch_poll_rate"`
+	TwitchValidateTimeout string         `json:"twitch_validate_timeout"`
+	TwitchValidateRetries int            `json:"twitch_validate_retries"`
+	TwitchValidateCache   string         `json:"twitch_validate_cache"`
+	TwitchClockSkew       string         `json:"twitch_clock_skew"`
+	TokenCheckInterval    string         `json:"token_check_interval"`
+	RefreshOnNewToken     bool           `json:"refresh_on_new_token"`
+	TrovoClientID         string         `json:"trovo_client_id"`
+	NginxStatURL          string         `json:"nginx_stat_url"`
+	NginxControlURL       string         `json:"nginx_control_url"`
+	RecordWebhookURL      string         `json:"record_webhook_url"`
+	DiscordEnabled        bool           `json:"discord_enabled"`
+	DiscordWebhook        string         `json:"discord_webhook"`
+	WebhookHeaders        []string       `json:"webhook_headers"`
+	PublisherWebhookMode  string         `json:"publisher_webhook_mode"`
+	AllowDefaultCreds     bool           `json:"allow_default_credentials"`
+	PublishersDir         string         `json:"publishers_dir"`
+	PublishersDirInterval string         `json:"publishers_dir_interval"`
+	PublishersDirPrune    bool           `json:"publishers_dir_prune"`
+	EnabledPlatforms      []string       `json:"enabled_platforms"`
+	SourceTimeout         string         `json:"source_timeout"`
+	KeyParam              string         `json:"key_param"`
+	AuthDeadline          string         `json:"auth_deadline"`
+	PublishDenyLimit      int            `json:"publish_deny_limit"`
+	PublishDenyWindow     string         `json:"publish_deny_window"`
+	PublishThrottle       string         `json:"publish_throttle"`
+	NotifyDenies          bool           `json:"notify_denies"`
+	DenyNotifyInterval    string         `json:"deny_notify_interval"`
+	NotifyDigestWindow    string         `json:"notify_digest_window"`
+	NotifyTitleMaxLength  int            `json:"notify_title_max_length"`
+	DenyStatusCode        int            `json:"deny_status_code"`
+	AllowedApps           []string       `json:"allowed_apps"`
+	HideExistence         bool           `json:"hide_publisher_existence"`
+	MaxPublishers         int            `json:"max_publishers"`
+	RequireTwitchLive     bool           `json:"require_twitch_live"`
+	NoPlatformPolicy      string         `json:"no_platform_policy"`
+	MaintenanceAllowAll   bool           `json:"maintenance_allow_all"`
+	LiveGracePeriod       string         `json:"live_grace_period"`
+	NegativeCacheTTL      string         `json:"negative_cache_ttl"`
+	AllowCacheTTL         string         `json:"allow_cache_ttl"`
+	BlockedGameIDs        []string       `json:"blocked_game_ids"`
+	TrustedProxies        []string       `json:"trusted_proxies"`
+	AllowRedirectTemplate string         `json:"allow_redirect_template"`
+	PublishHeaders        bool           `json:"publish_headers"`
+	SessionTTL            string         `json:"session_ttl"`
+	CacheBackend          string         `json:"cache_backend"`
+	PlaybackSecret        string         `json:"playback_secret"`
+	PlaybackTokenTTL      string         `json:"playback_token_ttl"`
+	RedisAddr             string         `json:"redis_addr"`
+	RedisPassword         string         `json:"redis_password"`
+}
+
+// maskedClient is the printable form of TwitchClient
+type maskedClient struct {
+	ID     string `json:"id"`
+	Secret string `json:"secret"`
+}
+
+// mask hides a secret while showing whether it is set
+func mask(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return maskedValue
+}
+
+// maskHeaders lists header names with their values masked, which may be
+// credentials
+func maskHeaders(headers map[string]string) []string {
+	names := []string{}
+	for name, value := range headers {
+		names = append(names, name+": "+mask(value))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// PrintEffective prints the parsed configuration as json with secrets masked
+func (c *Config) PrintEffective() error {
+	content, err := c.effectiveJSON()
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(content))
+	return nil
+}
+
+// effectiveJSON returns the parsed configuration as indented json with
+// secrets masked
+func (c *Config) effectiveJSON() ([]byte, error) {
+	e := effectiveConfig{
+		DatabasePath:          c.DatabasePath,
+		AuthServerIP:          c.AuthServerIP,
+		AuthServerPort:        c.AuthServerPort,
+		BasePath:              c.BasePath,
+		HealthAtRoot:          c.HealthAtRoot,
+		HTTPReadHeaderTimeout: c.HTTPReadHeaderTimeout.String(),
+		HTTPReadTimeout:       c.HTTPReadTimeout.String(),
+		HTTPWriteTimeout:      c.HTTPWriteTimeout.String(),
+		HTTPIdleTimeout:       c.HTTPIdleTimeout.String(),
+		ClientMaxIdleConns:    c.ClientMaxIdleConns,
+		ClientMaxIdlePerHost:  c.ClientMaxIdleConnsPerHost,
+		ClientIdleConnTimeout: c.ClientIdleConnTimeout.String(),
+		ClientTimeout:         c.ClientTimeout.String(),
+		CallbackMaxBodyBytes:  c.CallbackMaxBodyBytes,
+		RTMPServerFQDN:        c.RTMPServerFQDN,
+		RTMPServerPort:        c.RTMPServerPort,
+		TwitchEnabled:         c.TwitchEnabled,
+		TwitchPollRate:        c.TwitchPollRate.String(),
+		TwitchValidateTimeout: c.TwitchValidateTimeout.String(),
+		TwitchValidateRetries: c.TwitchValidateRetries,
+		TwitchValidateCache:   c.TwitchValidateCache.String(),
+		TwitchClockSkew:       c.TwitchClockSkew.String(),
+		TokenCheckInterval:    c.TokenCheckInterval.String(),
+		RefreshOnNewToken:     c.RefreshOnNewToken,
+		TrovoClientID:         c.TrovoClientID,
+		NginxStatURL:          c.NginxStatURL,
+		NginxControlURL:       c.NginxControlURL,
+		RecordWebhookURL:      mask(c.RecordWebhookURL),
+		DiscordEnabled:        c.DiscordEnabled,
+		DiscordWebhook:        mask(c.DiscordWebhook),
+		WebhookHeaders:        maskHeaders(c.WebhookHeaders),
+		PublisherWebhookMode:  c.PublisherWebhookMode,
+		AllowDefaultCreds:     c.AllowDefaultCredentials,
+		PublishersDir:         c.PublishersDir,
+		PublishersDirInterval: c.PublishersDirInterval.String(),
+		PublishersDirPrune:    c.PublishersDirPrune,
+		EnabledPlatforms:      c.EnabledPlatforms,
+		SourceTimeout:         c.SourceTimeout.String(),
+		KeyParam:              c.KeyParam,
+		Tenant:                c.Tenant,
+		LogFile:               c.LogFile,
+		LogStderr:             c.LogStderr,
+		CheckDBOnStart:        c.CheckDBOnStart,
+		ReadOnlyDB:            c.ReadOnlyDB,
+		AuthDeadline:          c.AuthDeadline.String(),
+		PublishDenyLimit:      c.PublishDenyLimit,
+		PublishDenyWindow:     c.PublishDenyWindow.String(),
+		PublishThrottle:       c.PublishThrottleBackoff.String(),
+		NotifyDenies:          c.NotifyDenies,
+		PublishHeaders:        c.PublishHeaders,
+		SessionTTL:            c.SessionTTL.String(),
+		CacheBackend:          c.CacheBackend,
+		PlaybackSecret:        mask(c.PlaybackSecret),
+		PlaybackTokenTTL:      c.PlaybackTokenTTL.String(),
+		RedisAddr:             c.RedisAddr,
+		RedisPassword:         mask(c.RedisPassword),
+		DenyNotifyInterval:    c.DenyNotifyInterval.String(),
+		NotifyDigestWindow:    c.NotifyDigestWindow.String(),
+		NotifyTitleMaxLength:  c.NotifyTitleMaxLength,
+		DenyStatusCode:        c.DenyStatusCode,
+		AllowedApps:           c.AllowedApps,
+		HideExistence:         c.HidePublisherExistence,
+		MaxPublishers:         c.MaxPublishers,
+		RequireTwitchLive:     c.RequireTwitchLive,
+		NoPlatformPolicy:      c.NoPlatformPolicy,
+		MaintenanceAllowAll:   c.MaintenanceAllowAll,
+		LiveGracePeriod:       c.LiveGracePeriod.String(),
+		NegativeCacheTTL:      c.NegativeCacheTTL.String(),
+		AllowCacheTTL:         c.AllowCacheTTL.String(),
+		BlockedGameIDs:        c.BlockedGameIDs,
+	}
+	for _, client := range c.TwitchClients {
+		e.TwitchClients = append(e.TwitchClients, maskedClient{ID: client.ID, Secret: mask(client.Secret)})
+	}
+	for _, n := range c.TrustedProxies {
+		e.TrustedProxies = append(e.TrustedProxies, n.String())
+	}
+	if c.AllowRedirectTemplate != nil {
+		e.AllowRedirectTemplate = c.AllowRedirectTemplate.Root.String()
+	}
+
+	return json.MarshalIndent(e, "", "  ")
+}
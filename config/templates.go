@@ -35,24 +35,100 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 `
 
 	envVars = `
-# path to database file
+# path to directory containing the database file (rtmpauthbot.db)
 DATA_PATH=""
 
+# full path to database file (overrides DATA_PATH)
+DATABASE_PATH=""
+
+# verify the integrity of the database at startup, refusing to start when it
+# is corrupt (startup takes longer with large databases)
+CHECK_DB_ON_START=false
+
+# file the log is written to instead of stdout (reopened on SIGHUP, e.g. by
+# logrotate's postrotate). set LOG_STDERR=true to also log to stderr
+LOG_FILE=""
+LOG_STDERR=false
+
+# open the database read-only for a standby or dashboard server. polling and
+# every request other than GET & the nginx callbacks are disabled. a database
+# open for writing by another server cannot be opened, so serve a copy (e.g. a
+# periodic backup)
+READ_ONLY_DB=false
+
+# optional tenant the data is stored under, keeping it separate from other
+# tenants within the same database file (letters, digits, '-' and '_')
+TENANT=""
+
 # auth server listen ip
 AUTH_SERVER_IP="127.0.0.1"
 
 # auth server listen port
 AUTH_SERVER_PORT="9090"
 
+# path prefix of every route when mounted behind a reverse proxy at a subpath,
+# e.g. /rtmpauth serves /rtmpauth/on_publish. set HEALTH_AT_ROOT=true to also
+# serve /readyz & /metrics without the prefix
+BASE_PATH=""
+HEALTH_AT_ROOT=false
+
+# seconds allowed to read request headers, to read a whole request, to write
+# a response and to keep an idle connection open (0 disables a timeout). the
+# write timeout should exceed AUTH_DEADLINE_SECONDS
+HTTP_READ_HEADER_TIMEOUT="5"
+HTTP_READ_TIMEOUT="10"
+HTTP_WRITE_TIMEOUT="30"
+HTTP_IDLE_TIMEOUT="60"
+
+# connection pooling of outbound requests (twitch, trovo, nginx & webhooks):
+# idle connections kept open in total (0 is unlimited) & per host, and seconds
+# an idle connection is kept open (0 keeps them until closed by the server)
+CLIENT_MAX_IDLE_CONNS="100"
+CLIENT_MAX_IDLE_CONNS_PER_HOST="10"
+CLIENT_IDLE_CONN_TIMEOUT="90"
+
+# seconds allowed for each outbound request, so that an unresponsive twitch
+# cannot hang startup or a poll (0 disables)
+CLIENT_TIMEOUT="30"
+
+# bytes allowed in the request body of an nginx callback (on_publish etc.),
+# larger bodies are answered with 413
+CALLBACK_MAX_BODY_BYTES="16384"
+
 # rtmp server fqdn (used for discord private stream links)
 RTMP_SERVER_FQDN="stream.mydomain.com"
 
 # rtmp server port (default: 1935)
 RTMP_SERVER_PORT="1935"
 
+# secret used to sign playback tokens. when set, on_play requires a valid
+# token argument (rtmp://host/stream/name?token=...) issued by /api/playback
+PLAYBACK_SECRET=""
+
+# seconds a playback token is valid for when no ttl is requested, including
+# the tokens in discord private stream links
+PLAYBACK_TOKEN_TTL="86400"
+
 # enable/disable discord integrations
 DISCORD_ENABLED=false
 
+# url the finished recordings reported by the nginx on_record_done callback are
+# posted to as json (e.g. to start transcoding)
+RECORD_WEBHOOK_URL=""
+
+# comma separated name:value headers added to every outbound webhook (discord &
+# RECORD_WEBHOOK_URL), e.g. to authenticate with a gateway
+WEBHOOK_HEADERS=""
+
+# publishers may have their own webhook_url for their live & offline
+# notifications. also: post them to DISCORD_WEBHOOK as well, instead: only post
+# them to the publisher's webhook
+PUBLISHER_WEBHOOK_MODE="also"
+
+# start even though twitch is enabled with the placeholder (or empty) client id
+# or secret, or discord with the placeholder webhook. for local testing only
+ALLOW_DEFAULT_CREDENTIALS=false
+
 # discord channel webhook
 DISCORD_WEBHOOK="https://discordapp.com/api/webhooks/1234567890/abcdefghijklmnopqrstuvwxyz1234567890"
 
@@ -65,9 +141,161 @@ TWITCH_CLIENT_ID="abcd1234"
 # twitch api client secret
 TWITCH_CLIENT_SECRET="abcd1234"
 
+# additional twitch api clients as comma separated id:secret pairs. requests
+# are rotated across all clients to spread load across their rate limits
+TWITCH_CLIENTS=""
+
 # twitch poll rate in seconds
 TWITCH_POLL_RATE="60"
 
+# minutes between twitch access token checks. repeated failures to obtain a
+# valid token are posted to discord and reported by /readyz (0 disables)
+TOKEN_CHECK_INTERVAL="10"
+
+# seconds before a twitch access token validation attempt times out, and the
+# number of retries when validation fails to reach twitch
+TWITCH_VALIDATE_TIMEOUT="5"
+TWITCH_VALIDATE_RETRIES="1"
+
+# seconds a successful access token validation is trusted before the token is
+# validated again (0 validates the token every time it is used)
+TWITCH_VALIDATE_CACHE="0"
+
+# seconds of clock skew tolerated when checking whether a cached access token
+# validation is recent or the token has expired, so that a slightly wrong
+# clock does not cause needless token validations & refreshes
+TWITCH_CLOCK_SKEW="30"
+
+# immediately refresh twitch live status whenever a new access token is
+# obtained rather than waiting for the next poll
+REFRESH_ON_NEW_TOKEN=true
+
+# trovo open api client id, used to check the live status of trovo channels
+# when trovo is in ENABLED_PLATFORMS
+TROVO_CLIENT_ID=""
+
+# seconds each platform is given to complete a poll. platforms are polled
+# concurrently and a platform which is still polling is skipped on the next
+# poll, so one slow platform does not delay the others (0 waits indefinitely)
+SOURCE_TIMEOUT="30"
+
+# url of the nginx-rtmp stat page (rtmp_stat all), used to find the streams
+# being published when nginx is in ENABLED_PLATFORMS
+NGINX_STAT_URL=""
+
+# url of the nginx-rtmp control module (rtmp_control all), used to disconnect
+# publishers when their session is ended with DELETE /api/sessions/{name}
+NGINX_CONTROL_URL=""
+
+# comma separated list of platforms to check for live status (twitch, trovo,
+# nginx) (default: twitch)
+ENABLED_PLATFORMS="twitch"
+
+# name of the on_publish argument containing the stream key. nginx-rtmp passes
+# the query arguments of the rtmp url, e.g. rtmp://host/app/name?key=secret
+KEY_PARAM="key"
+
+# publishers denied PUBLISH_DENY_LIMIT times within PUBLISH_DENY_WINDOW seconds
+# for a wrong key or not being live are rejected for PUBLISH_THROTTLE_SECONDS,
+# even with a valid key, to protect twitch from reconnecting encoders
+# (0 disables)
+PUBLISH_DENY_LIMIT="0"
+PUBLISH_DENY_WINDOW="60"
+PUBLISH_THROTTLE_SECONDS="300"
+
+# post denied publishes (with the reason & publisher address) to discord, at
+# most once per publisher every DENY_NOTIFY_INTERVAL seconds
+NOTIFY_DENIES=false
+DENY_NOTIFY_INTERVAL="300"
+
+# seconds to collect live & offline notifications for, posting them as a single
+# digest message (e.g. when many publishers go live at an event start). 0 posts
+# each notification immediately
+NOTIFY_DIGEST_SECONDS="0"
+
+# stream titles are escaped in notifications & truncated to this many
+# characters (0 for no limit)
+NOTIFY_TITLE_MAX_LENGTH="140"
+
+# seconds allowed to authorize a publish. when exceeded (e.g. twitch is slow)
+# the publish is denied with 503 as if twitch were unavailable (0 disables)
+AUTH_DEADLINE_SECONDS="10"
+
+# seconds after which a publish session which has not been seen is considered
+# ended, in case on_publish_done is never delivered. requires the nginx
+# on_update callback with a notify_update_timeout below the ttl (0 disables)
+SESSION_TTL="0"
+
+# directory of one <name>.json publisher file per publisher, reconciled into the
+# database every PUBLISHERS_DIR_INTERVAL seconds when the files have changed
+# (empty disables). PUBLISHERS_DIR_PRUNE deletes publishers without a file
+PUBLISHERS_DIR=""
+PUBLISHERS_DIR_INTERVAL="10"
+PUBLISHERS_DIR_PRUNE=true
+
+# where twitch logins confirmed as not live are cached: memory, or redis to
+# share the cache between several servers
+CACHE_BACKEND="memory"
+REDIS_ADDR="127.0.0.1:6379"
+REDIS_PASSWORD=""
+
+# maximum number of publishers which may be created (0 is unlimited)
+MAX_PUBLISHERS="0"
+
+# http status code returned to nginx for denied publishes (4xx or 5xx)
+DENY_STATUS_CODE="403"
+
+# comma separated rtmp apps which may be published to (any app when empty).
+# publishes to other apps are denied before the publisher is looked up
+ALLOWED_APPS=""
+
+# answer nginx with DENY_STATUS_CODE for unknown streams (instead of 404 on
+# play) and throttled publishes (instead of 429), so that stream names cannot
+# be enumerated. the real reason is still logged
+HIDE_PUBLISHER_EXISTENCE=false
+
+# deny publishers with a twitch stream configured unless they are live on twitch
+REQUIRE_TWITCH_LIVE=false
+
+# with REQUIRE_TWITCH_LIVE, mirror publishers without a twitch stream can never
+# be live. allow: only their key is checked, deny: treat them as misconfigured
+NO_PLATFORM_POLICY="allow"
+
+# start in maintenance mode: enabled publishers with a valid key may publish
+# regardless of twitch live status. toggled at runtime with /api/maintenance
+MAINTENANCE_ALLOW_ALL=false
+
+# seconds after the first publish attempt during which a publisher is allowed
+# before twitch reports them live (only used with REQUIRE_TWITCH_LIVE)
+LIVE_GRACE_PERIOD="0"
+
+# seconds to cache a twitch "not live" result when checking a publisher which
+# the poller has not seen live (only used with REQUIRE_TWITCH_LIVE, 0 disables)
+NEGATIVE_CACHE_SECONDS="30"
+
+# seconds to skip the twitch live check of a publisher which passed it, so that
+# rapid reconnects are cheap (only used with REQUIRE_TWITCH_LIVE, 0 disables).
+# the key, app & enabled checks still run, and changing the key or twitch
+# stream requires a new check
+ALLOW_CACHE_SECONDS="0"
+
+# comma separated twitch game/category ids. streams in these games do not count
+# as live, so with REQUIRE_TWITCH_LIVE their publishes are denied
+BLOCKED_GAME_IDS=""
+
+# comma separated CIDRs of reverse proxies in front of the server. the client
+# ip of requests from these proxies is taken from X-Forwarded-For
+TRUSTED_PROXIES=""
+
+# go template rendered with the publisher for allowed publishes. when set,
+# nginx is redirected to the rendered stream name, e.g. "{{.Name}}" publishes
+# under the publisher name regardless of the stream name used (empty disables)
+ALLOW_REDIRECT_TEMPLATE=""
+
+# add X-Publisher-Name, X-Twitch-Live & X-Viewer-Count headers to allowed
+# on_publish responses for use in nginx logging/lua
+PUBLISH_HEADERS=false
+
 `
 	systemdUnit = `
 [Unit]
@@ -75,7 +303,8 @@ Description=rtmpauthbot rtmp authentication server
 
 [Service]
 EnvironmentFile=/etc/rtmpauthbot/rtmpauthbot.env
-Type=simple
+Type=notify
+WatchdogSec=60
 User=nginx
 WorkingDirectory=/var/cache/nginx
 ExecStart=/usr/local/bin/rtmpauthbot
@@ -88,15 +317,15 @@ WantedBy=multi-user.target
 
 // PrintLicense simply prints the LICENSE to stdout
 func PrintLicense() {
-	fmt.Println(license)
+	fmt.Print(license + "\n")
 }
 
 // PrintEnv simply prints the env vars to stdout
 func PrintEnv() {
-	fmt.Println(envVars)
+	fmt.Print(envVars + "\n")
 }
 
 // PrintSystemDUnit simply prints the systemd unitfile to stdout
 func PrintSystemDUnit() {
-	fmt.Println(systemdUnit)
+	fmt.Print(systemdUnit + "\n")
 }
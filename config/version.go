@@ -0,0 +1,18 @@
+package config
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Version & Commit are set at build time with -ldflags "-X ...", see the
+// build instructions in the README
+var (
+	Version = "dev"
+	Commit  = "unknown"
+)
+
+// PrintVersion prints the version & build information to stdout
+func PrintVersion() {
+	fmt.Printf("rtmpauthbot %s (commit: %s, %s)\n", Version, Commit, runtime.Version())
+}
@@ -2,36 +2,59 @@ package controllers
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
-
-	log "github.com/sirupsen/logrus"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // PublisherAPIHandler manages publisher database records
 func (c *Controller) PublisherAPIHandler(w http.ResponseWriter, r *http.Request) {
 
+	logger := requestLogger(r)
 	var p Publisher
 
 	w.Header().Add("Content-Type", "application/json")
 
 	// API GET REQUESTS
 	if r.Method == "GET" {
+		reveal, err := revealKey(r)
+		if err != nil {
+			logger.Debug(err)
+			writeJSONError(w, http.StatusBadRequest, codeBadRequest, err.Error())
+			return
+		}
 		name, ok := r.URL.Query()["name"]
 		if !ok || len(name[0]) < 1 {
 			publishers, err := c.getAllPublisher()
 			if err != nil {
-				log.Debug("error retrieving all publishers: ", err)
-				w.WriteHeader(http.StatusInternalServerError)
+				logger.Debug("error retrieving all publishers: ", err)
+				writeStatusError(w, http.StatusInternalServerError)
+				return
+			}
+			query := r.URL.Query()
+			err = sortPublishers(publishers, query.Get("sort"), query.Get("order") == "desc")
+			if err != nil {
+				logger.Debug(err)
+				writeJSONError(w, http.StatusBadRequest, codeBadRequest, err.Error())
 				return
 			}
+			if !reveal {
+				for i := range publishers {
+					maskPublisher(&publishers[i])
+				}
+			}
 			content, err := json.Marshal(publishers)
 			if err != nil {
-				log.Debug(err)
-				w.WriteHeader(http.StatusInternalServerError)
+				logger.Debug(err)
+				writeStatusError(w, http.StatusInternalServerError)
 				return
 			}
-			log.Info("listing all publishers")
+			logger.Info("listing all publishers")
 			w.Write(content)
 			return
 		}
@@ -39,17 +62,20 @@ func (c *Controller) PublisherAPIHandler(w http.ResponseWriter, r *http.Request)
 		n := name[0]
 		p, err := c.getPublisher(n)
 		if err != nil {
-			log.Debugf("error retrieving publisher '%s': %s\n", p.Name, err)
-			w.WriteHeader(http.StatusNotFound)
+			logger.Debugf("error retrieving publisher '%s': %s\n", p.Name, err)
+			writeAPIError(w, err)
 			return
 		}
+		if !reveal {
+			maskPublisher(&p)
+		}
 		content, err := json.Marshal(p)
 		if err != nil {
-			log.Debug(err)
-			w.WriteHeader(http.StatusInternalServerError)
+			logger.Debug(err)
+			writeStatusError(w, http.StatusInternalServerError)
 			return
 		}
-		log.Infof("listing publisher %s", p.Name)
+		logger.Infof("listing publisher %s", p.Name)
 		w.Write(content)
 		return
 	}
@@ -59,29 +85,34 @@ func (c *Controller) PublisherAPIHandler(w http.ResponseWriter, r *http.Request)
 
 		body, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			log.Debug("error reading POST body: ", err)
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			logger.Debug("error reading POST body: ", err)
+			writeJSONError(w, http.StatusBadRequest, codeBadRequest, err.Error())
 			return
 		}
 		err = json.Unmarshal(body, &p)
 		if err != nil {
-			log.Debug("error unmarshaling body json: ", err)
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			logger.Debug("error unmarshaling body json: ", err)
+			writeJSONError(w, http.StatusBadRequest, codeBadRequest, err.Error())
 			return
 		}
 		err = p.IsValid()
 		if err != nil {
-			log.Debug(err)
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			logger.Debug(err)
+			writeJSONError(w, http.StatusBadRequest, codeBadRequest, err.Error())
+			return
+		}
+		_, err = c.updatePublisher(p)
+		if errors.Is(err, ErrPublisherLimit) {
+			logger.Warnf("publisher '%s' not created: %s", p.Name, err)
+			writeAPIError(w, err)
 			return
 		}
-		err = c.updatePublisher(p)
 		if err != nil {
-			log.Debugf("error updating publisher '%s': %s\n", p.Name, err)
-			w.WriteHeader(http.StatusInternalServerError)
+			logger.Debugf("error updating publisher '%s': %s\n", p.Name, err)
+			writeStatusError(w, http.StatusInternalServerError)
 			return
 		}
-		log.Infof("publisher updated: %s", p.Name)
+		logger.Infof("publisher updated: %s", p.Name)
 		w.WriteHeader(http.StatusCreated)
 		return
 	}
@@ -90,33 +121,513 @@ func (c *Controller) PublisherAPIHandler(w http.ResponseWriter, r *http.Request)
 	if r.Method == "DELETE" {
 		body, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			log.Debug("error reading DELETE body: ", err)
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			logger.Debug("error reading DELETE body: ", err)
+			writeJSONError(w, http.StatusBadRequest, codeBadRequest, err.Error())
 			return
 		}
 		err = json.Unmarshal(body, &p)
 		if err != nil {
-			log.Debug("error unmarshaling body json: ", err)
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			logger.Debug("error unmarshaling body json: ", err)
+			writeJSONError(w, http.StatusBadRequest, codeBadRequest, err.Error())
 			return
 		}
 		_, err = c.getPublisher(p.Name)
 		if err != nil {
-			log.Debugf("error retrieving publisher for deletion '%s': %s\n", p.Name, err)
-			w.WriteHeader(http.StatusNotFound)
+			logger.Debugf("error retrieving publisher for deletion '%s': %s\n", p.Name, err)
+			writeAPIError(w, err)
 			return
 		}
 		err = c.deletePublisher(p.Name)
 		if err != nil {
-			log.Debugf("error deleting publisher '%s': %s\n", p.Name, err)
-			w.WriteHeader(http.StatusInternalServerError)
+			logger.Debugf("error deleting publisher '%s': %s\n", p.Name, err)
+			writeStatusError(w, http.StatusInternalServerError)
 			return
 		}
-		log.Infof("publisher deleted: %s", p.Name)
+		logger.Infof("publisher deleted: %s", p.Name)
 		w.WriteHeader(http.StatusNoContent)
 		return
 	}
-	log.Debug(http.StatusNotImplemented)
-	w.WriteHeader(http.StatusNotImplemented)
+	logger.Debug(http.StatusNotImplemented)
+	writeStatusError(w, http.StatusNotImplemented)
 	return
 }
+
+// maskedKey replaces stream keys which are not revealed
+const maskedKey = "********"
+
+// maskPublisher masks the stream key & webhook url of a publisher, which both
+// grant access
+func maskPublisher(p *Publisher) {
+	p.Key = maskedKey
+	if p.webhookURL() != "" {
+		masked := maskedKey
+		p.WebhookURL = &masked
+	}
+}
+
+// revealKey returns true when the request asks for the stream keys & webhook
+// urls of publishers with revealKey=true. The api is not authenticated, so
+// masking only keeps keys out of output which does not need them.
+func revealKey(r *http.Request) (bool, error) {
+	value := r.URL.Query().Get("revealKey")
+	if value == "" {
+		return false, nil
+	}
+	reveal, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, errors.New("invalid revealKey: " + value)
+	}
+	return reveal, nil
+}
+
+// PublishersAPIHandler is the http handler for "/api/publishers/{name}",
+// returning a single publisher (PUT creates or updates the publisher). The
+// stream key & webhook url are masked unless revealKey=true is provided.
+// "/api/publishers/{name}/policy" returns the effective publish policy.
+func (c *Controller) PublishersAPIHandler(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
+
+	w.Header().Add("Content-Type", "application/json")
+
+	if r.Method != "GET" && r.Method != "PUT" {
+		logger.Debug(http.StatusNotImplemented)
+		writeStatusError(w, http.StatusNotImplemented)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/api/publishers/")
+	if policyName := strings.TrimSuffix(name, "/policy"); policyName != name && r.Method == "GET" {
+		if policyName == "" || strings.Contains(policyName, "/") {
+			writeStatusError(w, http.StatusNotFound)
+			return
+		}
+		c.getPublisherPolicy(w, r, policyName)
+		return
+	}
+	if name == "" || strings.Contains(name, "/") {
+		writeStatusError(w, http.StatusNotFound)
+		return
+	}
+
+	if r.Method == "PUT" {
+		c.putPublisher(w, r, name)
+		return
+	}
+
+	reveal, err := revealKey(r)
+	if err != nil {
+		logger.Debug(err)
+		writeJSONError(w, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+
+	p, err := c.getPublisher(name)
+	if err != nil {
+		logger.Debugf("error retrieving publisher '%s': %s", name, err)
+		writeAPIError(w, err)
+		return
+	}
+	if !reveal {
+		maskPublisher(&p)
+	}
+	content, err := json.Marshal(p)
+	if err != nil {
+		logger.Debug(err)
+		writeStatusError(w, http.StatusInternalServerError)
+		return
+	}
+	logger.Infof("listing publisher %s (key revealed: %t)", p.Name, reveal)
+	w.Write(content)
+}
+
+// putPublisher creates or updates the publisher named in the path, as
+// POST /api/publisher does, responding with the publisher (key masked) and
+// 201 when it was created or 200 when it was updated
+func (c *Controller) putPublisher(w http.ResponseWriter, r *http.Request, name string) {
+	logger := requestLogger(r)
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		logger.Debug("error reading PUT body: ", err)
+		writeJSONError(w, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+	p := Publisher{}
+	err = json.Unmarshal(body, &p)
+	if err != nil {
+		logger.Debug("error unmarshaling body json: ", err)
+		writeJSONError(w, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+	if p.Name == "" {
+		p.Name = name
+	}
+	if p.Name != name {
+		writeJSONError(w, http.StatusBadRequest, codeBadRequest, fmt.Sprintf("name '%s' does not match path '%s'", p.Name, name))
+		return
+	}
+	err = p.IsValid()
+	if err != nil {
+		logger.Debug(err)
+		writeJSONError(w, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+
+	created, err := c.updatePublisher(p)
+	if errors.Is(err, ErrPublisherLimit) {
+		logger.Warnf("publisher '%s' not created: %s", p.Name, err)
+		writeAPIError(w, err)
+		return
+	}
+	if err != nil {
+		logger.Debugf("error updating publisher '%s': %s", p.Name, err)
+		writeStatusError(w, http.StatusInternalServerError)
+		return
+	}
+
+	p, err = c.getPublisher(name)
+	if err != nil {
+		logger.Debugf("error retrieving publisher '%s': %s", name, err)
+		writeAPIError(w, err)
+		return
+	}
+	maskPublisher(&p)
+	content, err := json.Marshal(p)
+	if err != nil {
+		logger.Debug(err)
+		writeStatusError(w, http.StatusInternalServerError)
+		return
+	}
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+		logger.Infof("publisher created: %s", p.Name)
+	} else {
+		logger.Infof("publisher updated: %s", p.Name)
+	}
+	w.WriteHeader(status)
+	w.Write(content)
+}
+
+// TagResponse is returned after bulk enabling/disabling publishers by tag
+type TagResponse struct {
+	Tag     string `json:"tag"`
+	Enabled bool   `json:"enabled"`
+	Count   int    `json:"count"`
+}
+
+// TagsAPIHandler enables or disables all publishers carrying a tag.
+// Requests take the form: POST /api/tags/{tag}/enable|disable
+func (c *Controller) TagsAPIHandler(w http.ResponseWriter, r *http.Request) {
+
+	logger := requestLogger(r)
+	w.Header().Add("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		logger.Debug(http.StatusNotImplemented)
+		writeStatusError(w, http.StatusNotImplemented)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/tags/"), "/")
+	if len(parts) != 2 || parts[0] == "" {
+		writeStatusError(w, http.StatusNotFound)
+		return
+	}
+	tag := parts[0]
+
+	var enabled bool
+	switch parts[1] {
+	case "enable":
+		enabled = true
+	case "disable":
+		enabled = false
+	default:
+		writeStatusError(w, http.StatusNotFound)
+		return
+	}
+
+	count, err := c.setTagEnabled(tag, enabled)
+	if err != nil {
+		logger.Debugf("error updating publishers with tag '%s': %s\n", tag, err)
+		writeStatusError(w, http.StatusInternalServerError)
+		return
+	}
+	content, err := json.Marshal(TagResponse{Tag: tag, Enabled: enabled, Count: count})
+	if err != nil {
+		logger.Debug(err)
+		writeStatusError(w, http.StatusInternalServerError)
+		return
+	}
+	logger.Infof("publishers with tag %s %sd: %d", tag, parts[1], count)
+	w.Write(content)
+}
+
+// CacheResponse reports whether a twitch login was removed from the "not
+// live" cache & from the allow cache
+type CacheResponse struct {
+	Login        string `json:"login"`
+	Cleared      bool   `json:"cleared"`
+	AllowCleared bool   `json:"allow_cleared"`
+}
+
+// CacheAPIHandler is the http handler for "/api/cache/{login}". Deleting a
+// login removes it from the "not live" cache & the publishers streaming to
+// it from the allow cache, so the next publish attempt queries twitch again.
+func (c *Controller) CacheAPIHandler(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
+
+	w.Header().Add("Content-Type", "application/json")
+
+	if r.Method != "DELETE" {
+		logger.Debug(http.StatusNotImplemented)
+		writeStatusError(w, http.StatusNotImplemented)
+		return
+	}
+
+	login := strings.ToLower(strings.TrimPrefix(r.URL.Path, "/api/cache/"))
+	if login == "" || strings.Contains(login, "/") {
+		writeStatusError(w, http.StatusNotFound)
+		return
+	}
+
+	keys := []string{}
+	err := c.forEachPublisher(func(p Publisher) error {
+		if strings.ToLower(p.TwitchStream) == login {
+			keys = append(keys, allowCacheKey(p))
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Error(err)
+		writeStatusError(w, http.StatusInternalServerError)
+		return
+	}
+	response := CacheResponse{Login: login, Cleared: c.notLive().Delete(login)}
+	for _, key := range keys {
+		if c.allowed().Delete(key) {
+			response.AllowCleared = true
+		}
+	}
+	content, err := json.Marshal(response)
+	if err != nil {
+		logger.Debug(err)
+		writeStatusError(w, http.StatusInternalServerError)
+		return
+	}
+	logger.Infof("cache cleared for twitch login %s (not live: %t, allowed: %t)",
+		login, response.Cleared, response.AllowCleared)
+	w.Write(content)
+}
+
+// TokenStatusHandler reports the status of the cached twitch access token of
+// each configured twitch client
+func (c *Controller) TokenStatusHandler(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
+
+	w.Header().Add("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		logger.Debug(http.StatusNotImplemented)
+		writeStatusError(w, http.StatusNotImplemented)
+		return
+	}
+
+	statuses := []TokenStatus{}
+	for _, client := range c.cfg().TwitchClients {
+		status, err := c.tokenStatus(client)
+		if err != nil {
+			logger.Debug("error retrieving token status: ", err)
+			writeStatusError(w, http.StatusInternalServerError)
+			return
+		}
+		statuses = append(statuses, status)
+	}
+	content, err := json.Marshal(statuses)
+	if err != nil {
+		logger.Debug(err)
+		writeStatusError(w, http.StatusInternalServerError)
+		return
+	}
+	w.Write(content)
+}
+
+// LiveAPIHandler is the http handler for "/api/live". The live streams of
+// all platforms are returned as of their last poll.
+func (c *Controller) LiveAPIHandler(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
+
+	w.Header().Add("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		logger.Debug(http.StatusNotImplemented)
+		writeStatusError(w, http.StatusNotImplemented)
+		return
+	}
+
+	live, err := c.liveStreams()
+	if err != nil {
+		logger.Debug(err)
+		writeAPIError(w, err)
+		return
+	}
+	content, err := json.Marshal(live)
+	if err != nil {
+		logger.Debug(err)
+		writeStatusError(w, http.StatusInternalServerError)
+		return
+	}
+	w.Write(content)
+}
+
+// maxLiveCheckLogins is the most twitch logins accepted by a live check
+const maxLiveCheckLogins = 500
+
+// twitchLoginPattern matches valid twitch logins
+var twitchLoginPattern = regexp.MustCompile(`^[a-z0-9_]{1,25}$`)
+
+// LiveCheck is the twitch live status of a login
+type LiveCheck struct {
+	Login       string `json:"login"`
+	Live        bool   `json:"live"`
+	ViewerCount int    `json:"viewer_count,omitempty"`
+	Title       string `json:"title,omitempty"`
+}
+
+// LiveCheckAPIHandler is the http handler for "/api/live/check", returning
+// the twitch live status of a json list of logins, which do not need to be
+// configured publishers. The logins are queried directly from twitch
+// (batched into as few helix requests as possible) rather than the last poll.
+func (c *Controller) LiveCheckAPIHandler(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
+
+	w.Header().Add("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		logger.Debug(http.StatusNotImplemented)
+		writeStatusError(w, http.StatusNotImplemented)
+		return
+	}
+	if !c.sourceRegistered("twitch") {
+		writeJSONError(w, http.StatusServiceUnavailable, codeUnavailable, "twitch integration is disabled")
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		logger.Debug("error reading POST body: ", err)
+		writeJSONError(w, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+	var requested []string
+	err = json.Unmarshal(body, &requested)
+	if err != nil {
+		logger.Debug("error unmarshaling body json: ", err)
+		writeJSONError(w, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+	if len(requested) > maxLiveCheckLogins {
+		writeJSONError(w, http.StatusBadRequest, codeBadRequest, fmt.Sprintf("too many logins: %d (maximum: %d)", len(requested), maxLiveCheckLogins))
+		return
+	}
+	var logins []string
+	seen := make(map[string]bool, len(requested))
+	for _, login := range requested {
+		login = strings.ToLower(strings.TrimSpace(login))
+		if !twitchLoginPattern.MatchString(login) {
+			writeJSONError(w, http.StatusBadRequest, codeBadRequest, fmt.Sprintf("invalid twitch login: '%s'", login))
+			return
+		}
+		if !seen[login] {
+			seen[login] = true
+			logins = append(logins, login)
+		}
+	}
+
+	results := []LiveCheck{}
+	if len(logins) > 0 {
+		streams, err := c.queryStreams(logins)
+		if err != nil {
+			logger.Warn("error checking twitch live status: ", err)
+			writeAPIError(w, err)
+			return
+		}
+		live := make(map[string]StreamData, len(streams))
+		for i := range streams {
+			live[streams[i].login()] = streams[i]
+		}
+		for _, login := range logins {
+			check := LiveCheck{Login: login}
+			if s, ok := live[login]; ok {
+				check.Live = true
+				check.ViewerCount = s.ViewerCount
+				check.Title = s.Title
+			}
+			results = append(results, check)
+		}
+	}
+
+	content, err := json.Marshal(results)
+	if err != nil {
+		logger.Debug(err)
+		writeStatusError(w, http.StatusInternalServerError)
+		return
+	}
+	logger.Infof("checked the twitch live status of %d logins", len(logins))
+	w.Write(content)
+}
+
+// RefreshResponse lists the publishers live on twitch after a refresh
+type RefreshResponse struct {
+	Live []string `json:"live"`
+}
+
+// RefreshAPIHandler immediately refreshes the twitch live status of all
+// publishers rather than waiting for the next poll
+func (c *Controller) RefreshAPIHandler(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
+
+	w.Header().Add("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		logger.Debug(http.StatusNotImplemented)
+		writeStatusError(w, http.StatusNotImplemented)
+		return
+	}
+	if !c.sourceRegistered("twitch") {
+		writeJSONError(w, http.StatusServiceUnavailable, codeUnavailable, "twitch integration disabled")
+		return
+	}
+
+	c.refreshMu.Lock()
+	if time.Since(c.lastRefresh) < refreshMinInterval {
+		c.refreshMu.Unlock()
+		logger.Debug("refresh rate limited")
+		w.Header().Set("Retry-After", strconv.Itoa(int(refreshMinInterval.Seconds())))
+		writeStatusError(w, http.StatusTooManyRequests)
+		return
+	}
+	c.lastRefresh = time.Now()
+	c.refreshMu.Unlock()
+
+	_, err := c.refreshTwitch()
+	if err != nil {
+		logger.Error("error refreshing twitch streams: ", err)
+		writeAPIError(w, err)
+		return
+	}
+	live, err := c.twitchLivePublishers()
+	if err != nil {
+		logger.Debug(err)
+		writeStatusError(w, http.StatusInternalServerError)
+		return
+	}
+	content, err := json.Marshal(RefreshResponse{Live: live})
+	if err != nil {
+		logger.Debug(err)
+		writeStatusError(w, http.StatusInternalServerError)
+		return
+	}
+	logger.Info("twitch streams refreshed")
+	w.Write(content)
+}
@@ -0,0 +1,487 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bcambl/rtmpauthbot/config"
+	"github.com/bcambl/rtmpauthbot/internal/testutil"
+)
+
+func TestClearPublisherApp(t *testing.T) {
+	c := newTestController(t, &testutil.TwitchStub{}, func(conf *config.Config) {
+		conf.RequireTwitchLive = false
+		conf.AllowedApps = nil
+	})
+	createPublisher(t, c, `{"name":"alice","key":"secret","app":"live"}`)
+	status := publishApp(c, "alice", "secret", "other")
+	if status == http.StatusCreated {
+		t.Fatal("publish to another app was allowed")
+	}
+
+	current, err := c.getPublisher("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	none := ""
+	if !publisherChanged(current, Publisher{Name: "alice", Key: "secret", App: &none}) {
+		t.Fatal("clearing the app is not a change")
+	}
+	if publisherChanged(current, Publisher{Name: "alice", Key: "secret"}) {
+		t.Fatal("not providing the app is a change")
+	}
+
+	createPublisher(t, c, `{"name":"alice","key":"secret","app":""}`)
+	status = publishApp(c, "alice", "secret", "other")
+	if status != http.StatusCreated {
+		t.Fatalf("publish after clearing the app: got %d, want %d", status, http.StatusCreated)
+	}
+}
+
+func TestClearPublisherTrovoChannelAndMode(t *testing.T) {
+	c := newTestController(t, &testutil.TwitchStub{}, nil)
+	createPublisher(t, c, `{"name":"alice","key":"secret","trovo_channel":"alice","mode":"ingest"}`)
+	createPublisher(t, c, `{"name":"alice","key":"secret","trovo_channel":"","mode":""}`)
+
+	p, err := c.getPublisher("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.TrovoChannel != nil {
+		t.Fatalf("trovo channel was not cleared: %s", *p.TrovoChannel)
+	}
+	if p.mode() != ModeMirror {
+		t.Fatalf("mode was not reset: %s", p.mode())
+	}
+	mirror := ModeMirror
+	if publisherChanged(p, Publisher{Name: "alice", Key: "secret", Mode: &mirror}) {
+		t.Fatal("the default mode is a change")
+	}
+}
+
+func TestRevealKey(t *testing.T) {
+	c := newTestController(t, &testutil.TwitchStub{}, nil)
+	createPublisher(t, c, `{"name":"alice","key":"secret","webhook_url":"https://discord.example/hook"}`)
+
+	tests := []struct {
+		handler http.HandlerFunc
+		target  string
+		masked  bool
+	}{
+		{c.PublisherAPIHandler, "/api/publisher", true},
+		{c.PublisherAPIHandler, "/api/publisher?name=alice", true},
+		{c.PublisherAPIHandler, "/api/publisher?revealKey=true", false},
+		{c.PublisherAPIHandler, "/api/publisher?name=alice&revealKey=true", false},
+		{c.PublishersAPIHandler, "/api/publishers/alice", true},
+		{c.PublishersAPIHandler, "/api/publishers/alice?revealKey=false", true},
+		{c.PublishersAPIHandler, "/api/publishers/alice?revealKey=true", false},
+	}
+	for _, test := range tests {
+		w := serve(test.handler, "GET", test.target, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got %d, want %d", test.target, w.Code, http.StatusOK)
+		}
+		body := w.Body.String()
+		revealed := strings.Contains(body, "secret") || strings.Contains(body, "discord.example")
+		if revealed == test.masked {
+			t.Errorf("%s: masked %t, want %t: %s", test.target, !revealed, test.masked, body)
+		}
+	}
+
+	w := serve(c.PublisherAPIHandler, "GET", "/api/publisher?revealKey=maybe", "")
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("invalid revealKey: got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestReservedPublisherName(t *testing.T) {
+	c := newTestController(t, &testutil.TwitchStub{}, nil)
+	w := serve(c.PublisherAPIHandler, "POST", "/api/publisher", `{"name":"sync","key":"secret"}`)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("creating a publisher named sync: got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestMaskedKeyRejected(t *testing.T) {
+	c := newTestController(t, &testutil.TwitchStub{}, nil)
+	createPublisher(t, c, `{"name":"alice","key":"secret"}`)
+	listed := serve(c.PublisherAPIHandler, "GET", "/api/publisher", "").Body.String()
+
+	w := serve(c.SyncAPIHandler, "POST", "/api/publishers/sync", listed)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("syncing masked publishers: got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	p, err := c.getPublisher("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Key != "secret" {
+		t.Fatalf("key replaced with %s", p.Key)
+	}
+}
+
+func TestTagsDisable(t *testing.T) {
+	c := newTestController(t, &testutil.TwitchStub{}, nil)
+	for _, name := range []string{"alice", "bob", "carol"} {
+		createPublisher(t, c, `{"name":"`+name+`","key":"secret","tags":["event","`+name+`"]}`)
+	}
+	createPublisher(t, c, `{"name":"dave","key":"secret","tags":["other"]}`)
+
+	w := serve(c.TagsAPIHandler, "POST", "/api/tags/event/disable", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("disable by tag: got %d, want %d", w.Code, http.StatusOK)
+	}
+	want := `{"tag":"event","enabled":false,"count":3}`
+	if body := w.Body.String(); body != want {
+		t.Fatalf("disable by tag: got %s, want %s", body, want)
+	}
+	for _, name := range []string{"alice", "bob", "carol", "dave"} {
+		p, err := c.getPublisher(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.IsEnabled() != (name == "dave") {
+			t.Errorf("%s enabled: %t", name, p.IsEnabled())
+		}
+	}
+
+	w = serve(c.TagsAPIHandler, "POST", "/api/tags/event/enable", "")
+	if body := w.Body.String(); body != `{"tag":"event","enabled":true,"count":3}` {
+		t.Fatalf("enable by tag: %s", body)
+	}
+	p, err := c.getPublisher("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.IsEnabled() {
+		t.Error("bob was not enabled again")
+	}
+}
+
+func TestTokenStatus(t *testing.T) {
+	stub := &testutil.TwitchStub{}
+	c := newTestController(t, stub, nil)
+	_, _, err := c.lookupTwitchLive("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := serve(c.TokenStatusHandler, "GET", "/api/token/status", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("token status: got %d, want %d", w.Code, http.StatusOK)
+	}
+	if strings.Contains(w.Body.String(), stub.LastToken()) {
+		t.Fatalf("token status reveals the access token: %s", w.Body.String())
+	}
+	var statuses []TokenStatus
+	err = json.Unmarshal(w.Body.Bytes(), &statuses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 1 || !statuses[0].Cached || statuses[0].ExpiresAt == nil {
+		t.Fatalf("token status: got %s, want a cached token with an expiry", w.Body.String())
+	}
+	if statuses[0].ClientIDSuffix == c.Config.TwitchClientID {
+		t.Errorf("token status reveals the whole client id %s", statuses[0].ClientIDSuffix)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	stub := &testutil.TwitchStub{}
+	c := newTestController(t, stub, func(conf *config.Config) {
+		conf.DiscordEnabled = false
+	})
+	createPublisher(t, c, `{"name":"alice","key":"secret","twitch_stream":"alice"}`)
+
+	stub.SetStreams(http.StatusOK, aliceLive)
+	w := serve(c.RefreshAPIHandler, "POST", "/api/refresh", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("refresh: got %d, want %d", w.Code, http.StatusOK)
+	}
+	var refreshed RefreshResponse
+	err := json.Unmarshal(w.Body.Bytes(), &refreshed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refreshed.Live) != 1 || refreshed.Live[0] != "alice" {
+		t.Fatalf("refresh: got live %v, want [alice]", refreshed.Live)
+	}
+	p, err := c.getPublisher("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.IsTwitchLive() {
+		t.Fatal("the refresh did not update the live status of the publisher")
+	}
+
+	// a second refresh within the interval does not query twitch
+	queries := stub.Queries()
+	w = serve(c.RefreshAPIHandler, "POST", "/api/refresh", "")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("second refresh: got %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("rate limited refresh without Retry-After")
+	}
+	if stub.Queries() != queries {
+		t.Error("rate limited refresh queried twitch")
+	}
+}
+
+func TestPublisherMetadata(t *testing.T) {
+	c := newTestController(t, &testutil.TwitchStub{}, nil)
+	createPublisher(t, c, `{"name":"alice","key":"secret","metadata":{"crm":"1001","app":"live"}}`)
+
+	metadata := func(target string) map[string]string {
+		t.Helper()
+		w := serve(c.PublishersAPIHandler, "GET", target, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s: got %d, want %d", target, w.Code, http.StatusOK)
+		}
+		var p Publisher
+		err := json.Unmarshal(w.Body.Bytes(), &p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p.Metadata
+	}
+	got := metadata("/api/publishers/alice")
+	if len(got) != 2 || got["crm"] != "1001" || got["app"] != "live" {
+		t.Fatalf("metadata after create: got %v", got)
+	}
+
+	w := serve(c.PublisherAPIHandler, "GET", "/api/publisher", "")
+	var publishers []Publisher
+	err := json.Unmarshal(w.Body.Bytes(), &publishers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(publishers) != 1 || publishers[0].Metadata["crm"] != "1001" {
+		t.Fatalf("metadata in the list: got %s", w.Body.String())
+	}
+
+	// an update without metadata keeps it, an empty object clears it
+	createPublisher(t, c, `{"name":"alice","key":"secret"}`)
+	if got = metadata("/api/publishers/alice"); got["crm"] != "1001" {
+		t.Fatalf("metadata after an update without it: got %v", got)
+	}
+	createPublisher(t, c, `{"name":"alice","key":"secret","metadata":{}}`)
+	if got = metadata("/api/publishers/alice"); len(got) != 0 {
+		t.Fatalf("metadata after clearing it: got %v", got)
+	}
+}
+
+func TestMaxPublishers(t *testing.T) {
+	c := newTestController(t, &testutil.TwitchStub{}, func(conf *config.Config) {
+		conf.MaxPublishers = 2
+	})
+	createPublisher(t, c, `{"name":"alice","key":"secret"}`)
+	createPublisher(t, c, `{"name":"bob","key":"secret"}`)
+
+	w := serve(c.PublisherAPIHandler, "POST", "/api/publisher", `{"name":"carol","key":"secret"}`)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("create past the limit: got %d, want %d", w.Code, http.StatusConflict)
+	}
+	var apiErr APIError
+	err := json.Unmarshal(w.Body.Bytes(), &apiErr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if apiErr.Code != codePublisherLimit || !strings.Contains(apiErr.Error, "2") {
+		t.Fatalf("create past the limit: got %s, want the limit in the error", w.Body.String())
+	}
+
+	// existing publishers may still be updated
+	createPublisher(t, c, `{"name":"alice","key":"other"}`)
+	_, err = c.ImportPublishers(strings.NewReader(`[{"name":"carol","key":"secret"}]`))
+	if !errors.Is(err, ErrPublisherLimit) {
+		t.Fatalf("import past the limit: got %v, want %v", err, ErrPublisherLimit)
+	}
+	if names := publisherNames(t, c); len(names) != 2 {
+		t.Fatalf("publishers after the rejected creates: got %v", names)
+	}
+}
+
+func TestPutPublisherCreated(t *testing.T) {
+	c := newTestController(t, &testutil.TwitchStub{}, nil)
+
+	// concurrent puts of a new publisher report a single creation
+	const n = 10
+	codes := make(chan int, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- serve(c.PublishersAPIHandler, "PUT", "/api/publishers/alice", `{"key":"secret"}`).Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	created := 0
+	for code := range codes {
+		switch code {
+		case http.StatusCreated:
+			created++
+		case http.StatusOK:
+		default:
+			t.Errorf("concurrent put: got %d", code)
+		}
+	}
+	if created != 1 {
+		t.Errorf("concurrent puts: %d answered %d, want 1", created, http.StatusCreated)
+	}
+
+	w := serve(c.PublishersAPIHandler, "PUT", "/api/publishers/alice", `{"key":"other"}`)
+	if w.Code != http.StatusOK {
+		t.Errorf("update: got %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestCacheClear(t *testing.T) {
+	stub := &testutil.TwitchStub{}
+	stub.SetStreams(http.StatusOK, aliceOffline)
+	c := newTestController(t, stub, func(conf *config.Config) {
+		conf.RequireTwitchLive = true
+		conf.LiveGracePeriod = 0
+		conf.NegativeCacheTTL = time.Hour
+		conf.AllowCacheTTL = time.Hour
+		conf.PublishDenyLimit = 0
+	})
+	createPublisher(t, c, `{"name":"alice","key":"secret","twitch_stream":"Alice"}`)
+
+	clear := func(want CacheResponse) {
+		t.Helper()
+		w := serve(c.CacheAPIHandler, "DELETE", "/api/cache/alice", "")
+		var got CacheResponse
+		err := json.Unmarshal(w.Body.Bytes(), &got)
+		if w.Code != http.StatusOK || err != nil {
+			t.Fatalf("clear: got %d %s", w.Code, w.Body.String())
+		}
+		if got != want {
+			t.Errorf("clear: got %+v, want %+v", got, want)
+		}
+	}
+	// publish & return whether twitch was queried
+	queried := func(want int) bool {
+		t.Helper()
+		queries := stub.Queries()
+		if status := publish(c, "alice", "secret"); status != want {
+			t.Fatalf("publish: got %d, want %d", status, want)
+		}
+		return stub.Queries() > queries
+	}
+
+	// a login stuck as not live is checked again once cleared
+	deny := c.Config.DenyStatusCode
+	queried(deny)
+	stub.SetStreams(http.StatusOK, aliceLive)
+	if queried(deny) {
+		t.Fatal("not live login queried again while cached")
+	}
+	clear(CacheResponse{Login: "alice", Cleared: true})
+	if !queried(http.StatusCreated) {
+		t.Error("not live login not queried again after the cache was cleared")
+	}
+
+	// and so is a publisher stuck as allowed
+	stub.SetStreams(http.StatusOK, aliceOffline)
+	if queried(http.StatusCreated) {
+		t.Fatal("allowed publisher queried again while cached")
+	}
+	clear(CacheResponse{Login: "alice", AllowCleared: true})
+	if !queried(deny) {
+		t.Error("allowed publisher not queried again after the cache was cleared")
+	}
+
+	clear(CacheResponse{Login: "alice", Cleared: true})
+	clear(CacheResponse{Login: "alice"})
+}
+
+func TestLiveCheck(t *testing.T) {
+	stub := &testutil.TwitchStub{}
+	// every login starting with "live" is live
+	stub.Handle(testutil.TwitchStreams, func(r *http.Request) (int, string) {
+		data := []string{}
+		for _, login := range r.URL.Query()["user_login"] {
+			if strings.HasPrefix(login, "live") {
+				data = append(data, fmt.Sprintf(`{"user_login":%q,"type":"live","viewer_count":3,"title":"hi"}`, login))
+			}
+		}
+		return http.StatusOK, `{"data":[` + strings.Join(data, ",") + `]}`
+	})
+	c := newTestController(t, stub, nil)
+	check := func(logins []string) (int, []LiveCheck) {
+		t.Helper()
+		body, err := json.Marshal(logins)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := serve(c.LiveCheckAPIHandler, "POST", "/api/live/check", string(body))
+		var results []LiveCheck
+		if w.Code == http.StatusOK {
+			err = json.Unmarshal(w.Body.Bytes(), &results)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, results
+	}
+
+	// logins are normalized & deduplicated, none needs to be a publisher
+	status, results := check([]string{"LiveAlice", "bob", "livealice", " carol "})
+	want := []LiveCheck{
+		{Login: "livealice", Live: true, ViewerCount: 3, Title: "hi"},
+		{Login: "bob"},
+		{Login: "carol"},
+	}
+	if status != http.StatusOK || !reflect.DeepEqual(results, want) {
+		t.Fatalf("live check: got %d %+v, want %+v", status, results, want)
+	}
+
+	// the logins are batched into helix requests of at most 100 logins
+	queries := stub.Queries()
+	logins := make([]string, maxLiveCheckLogins)
+	for i := range logins {
+		logins[i] = fmt.Sprintf("user%d", i)
+		if i%2 == 0 {
+			logins[i] = fmt.Sprintf("live%d", i)
+		}
+	}
+	status, results = check(logins)
+	if status != http.StatusOK || len(results) != maxLiveCheckLogins {
+		t.Fatalf("live check of %d logins: got %d with %d results", maxLiveCheckLogins, status, len(results))
+	}
+	for i, result := range results {
+		if result.Login != logins[i] || result.Live != (i%2 == 0) {
+			t.Fatalf("live check result %d: got %+v for %s", i, result, logins[i])
+		}
+	}
+	requests := stub.Requests(testutil.TwitchStreams)[queries:]
+	if len(requests) != 5 {
+		t.Errorf("live check of %d logins: %d helix requests, want 5", maxLiveCheckLogins, len(requests))
+	}
+	for _, r := range requests {
+		if n := len(r.URL.Query()["user_login"]); n > maxStreamsQuery {
+			t.Errorf("helix request of %d logins, want at most %d", n, maxStreamsQuery)
+		}
+	}
+
+	// past the limit or with invalid logins nothing is queried
+	queries = stub.Queries()
+	for _, invalid := range [][]string{append(logins, "onemore"), {"alice", "not a login"}} {
+		if status, _ := check(invalid); status != http.StatusBadRequest {
+			t.Errorf("live check of %d logins: got %d, want %d", len(invalid), status, http.StatusBadRequest)
+		}
+	}
+	if stub.Queries() != queries {
+		t.Error("rejected live checks queried twitch")
+	}
+}
@@ -0,0 +1,60 @@
+package controllers
+
+import (
+	"sync"
+	"time"
+)
+
+// Cache is a set of keys which expire after a ttl. Implementations must be
+// safe for concurrent use.
+type Cache interface {
+	// Set adds a key to the cache which expires after the provided ttl
+	Set(key string, ttl time.Duration)
+	// Has returns true when the key is cached and has not expired
+	Has(key string) bool
+	// Delete removes a key from the cache, returning true when it was cached
+	// and had not expired
+	Delete(key string) bool
+}
+
+// ttlCache is a concurrency safe set of keys which expire after a ttl, held
+// in memory
+type ttlCache struct {
+	mu      sync.Mutex
+	entries map[string]time.Time
+}
+
+// Set adds a key to the cache which expires after the provided ttl
+func (t *ttlCache) Set(key string, ttl time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.entries == nil {
+		t.entries = make(map[string]time.Time)
+	}
+	t.entries[key] = time.Now().Add(ttl)
+}
+
+// Has returns true when the key is cached and has not expired
+func (t *ttlCache) Has(key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	expiry, ok := t.entries[key]
+	if !ok {
+		return false
+	}
+	if time.Now().After(expiry) {
+		delete(t.entries, key)
+		return false
+	}
+	return true
+}
+
+// Delete removes a key from the cache, returning true when it was cached
+// and had not expired
+func (t *ttlCache) Delete(key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	expiry, ok := t.entries[key]
+	delete(t.entries, key)
+	return ok && time.Now().Before(expiry)
+}
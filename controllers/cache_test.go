@@ -0,0 +1,290 @@
+package controllers
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bcambl/rtmpauthbot/config"
+	"github.com/bcambl/rtmpauthbot/internal/testutil"
+)
+
+// fakeRedis is a redis server answering the commands used by redisCache
+// (AUTH, SET with PX, EXISTS & DEL) from memory
+type fakeRedis struct {
+	listener net.Listener
+	password string
+
+	mu     sync.Mutex
+	expiry map[string]time.Time
+	keys   []string
+}
+
+// newFakeRedis starts a fake redis server which is stopped at the end of the
+// test. Every connection must authenticate when a password is provided.
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{listener: listener, password: password, expiry: make(map[string]time.Time)}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+// Addr returns the address the server listens on
+func (f *fakeRedis) Addr() string {
+	return f.listener.Addr().String()
+}
+
+// Keys returns the keys of every command received, in order
+func (f *fakeRedis) Keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.keys...)
+}
+
+// serve answers the commands of a connection until it is closed
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	authenticated := f.password == ""
+	for {
+		args, err := readCommand(rd)
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(args[0])
+		if command == "AUTH" {
+			if len(args) != 2 || args[1] != f.password {
+				io.WriteString(conn, "-WRONGPASS invalid password\r\n")
+				continue
+			}
+			authenticated = true
+			io.WriteString(conn, "+OK\r\n")
+			continue
+		}
+		if !authenticated {
+			io.WriteString(conn, "-NOAUTH Authentication required.\r\n")
+			continue
+		}
+		io.WriteString(conn, f.answer(command, args[1:]))
+	}
+}
+
+// answer executes a command & returns its encoded reply
+func (f *fakeRedis) answer(command string, args []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(args) > 0 {
+		f.keys = append(f.keys, args[0])
+	}
+	switch {
+	case command == "SET" && len(args) == 4 && strings.ToUpper(args[2]) == "PX":
+		ms, err := strconv.ParseInt(args[3], 10, 64)
+		if err != nil || ms < 1 {
+			return "-ERR invalid expire time in 'set' command\r\n"
+		}
+		f.expiry[args[0]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		return "+OK\r\n"
+	case command == "EXISTS" && len(args) == 1:
+		return fmt.Sprintf(":%d\r\n", f.take(args[0], false))
+	case command == "DEL" && len(args) == 1:
+		return fmt.Sprintf(":%d\r\n", f.take(args[0], true))
+	}
+	return fmt.Sprintf("-ERR unknown command '%s'\r\n", command)
+}
+
+// take returns 1 when the key exists and has not expired, removing expired
+// keys or any key when del is true. The caller must hold mu.
+func (f *fakeRedis) take(key string, del bool) int {
+	expiry, ok := f.expiry[key]
+	live := ok && time.Now().Before(expiry)
+	if del || !live {
+		delete(f.expiry, key)
+	}
+	if live {
+		return 1
+	}
+	return 0
+}
+
+// readCommand reads a command sent as an array of bulk strings
+func readCommand(rd *bufio.Reader) ([]string, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("not an array: %q", line)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("invalid array length: %q", line)
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err = rd.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("not a bulk string: %q", line)
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("invalid bulk string length: %q", line)
+		}
+		buf := make([]byte, size+2)
+		_, err = io.ReadFull(rd, buf)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+// testCache checks the behaviour every Cache implementation must have
+func testCache(t *testing.T, cache Cache) {
+	t.Helper()
+	if cache.Has("alice") {
+		t.Error("has a key which was never set")
+	}
+	cache.Set("alice", time.Minute)
+	if !cache.Has("alice") {
+		t.Error("does not have a key which was set")
+	}
+	if cache.Has("bob") {
+		t.Error("has another key")
+	}
+	if !cache.Delete("alice") {
+		t.Error("delete: key not reported as cached")
+	}
+	if cache.Has("alice") {
+		t.Error("has a deleted key")
+	}
+	if cache.Delete("alice") {
+		t.Error("delete: deleted key reported as cached")
+	}
+
+	cache.Set("alice", 50*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	if cache.Has("alice") {
+		t.Error("has an expired key")
+	}
+	if cache.Delete("alice") {
+		t.Error("delete: expired key reported as cached")
+	}
+}
+
+func TestTTLCache(t *testing.T) {
+	testCache(t, &ttlCache{})
+}
+
+func TestRedisCache(t *testing.T) {
+	server := newFakeRedis(t, "")
+	testCache(t, NewRedisCache(server.Addr(), "", "rtmpauthbot:notlive:", time.Second))
+
+	// every key is prefixed
+	for _, key := range server.Keys() {
+		if key != "rtmpauthbot:notlive:alice" && key != "rtmpauthbot:notlive:bob" {
+			t.Errorf("key %q sent to redis without the prefix", key)
+		}
+	}
+
+	// caches with distinct prefixes are kept apart
+	first := NewRedisCache(server.Addr(), "", "first:", time.Second)
+	second := NewRedisCache(server.Addr(), "", "second:", time.Second)
+	first.Set("alice", time.Minute)
+	if second.Has("alice") {
+		t.Error("key shared between prefixes")
+	}
+}
+
+func TestRedisCacheAuth(t *testing.T) {
+	server := newFakeRedis(t, "redis-secret")
+	testCache(t, NewRedisCache(server.Addr(), "redis-secret", "", time.Second))
+
+	cache := NewRedisCache(server.Addr(), "wrong", "", time.Second)
+	cache.Set("alice", time.Minute)
+	if cache.Has("alice") {
+		t.Error("cached with a wrong password")
+	}
+}
+
+func TestRedisCacheUnavailable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	hook := captureLogs(t)
+	cache := NewRedisCache(addr, "", "", 100*time.Millisecond)
+	cache.Set("alice", time.Minute)
+	if cache.Has("alice") || cache.Delete("alice") {
+		t.Error("redis unavailable: not treated as a cache miss")
+	}
+	if len(hook.AllEntries()) == 0 {
+		t.Error("redis unavailable: no warning logged")
+	}
+}
+
+func TestAllowCacheShared(t *testing.T) {
+	server := newFakeRedis(t, "")
+	stub := &testutil.TwitchStub{}
+	stub.SetStreams(http.StatusOK, aliceLive)
+	configure := func(conf *config.Config) {
+		conf.RequireTwitchLive = true
+		conf.LiveGracePeriod = 0
+		conf.NegativeCacheTTL = 0
+		conf.AllowCacheTTL = time.Minute
+		conf.PublishDenyLimit = 0
+	}
+	first := newTestController(t, stub, configure)
+	first.SetAllowCache(NewRedisCache(server.Addr(), "", "rtmpauthbot:allow:", time.Second))
+	createPublisher(t, first, `{"name":"alice","key":"secret","twitch_stream":"alice"}`)
+	second := newTestController(t, stub, configure)
+	second.SetAllowCache(NewRedisCache(server.Addr(), "", "rtmpauthbot:allow:", time.Second))
+	createPublisher(t, second, `{"name":"alice","key":"secret","twitch_stream":"alice"}`)
+
+	if status := publish(first, "alice", "secret"); status != http.StatusCreated {
+		t.Fatalf("publish: got %d, want %d", status, http.StatusCreated)
+	}
+	queries := stub.Queries()
+
+	// the second server trusts the live check of the first one
+	stub.SetStreams(http.StatusOK, aliceOffline)
+	if status := publish(second, "alice", "secret"); status != http.StatusCreated {
+		t.Fatalf("publish to the second server: got %d, want %d", status, http.StatusCreated)
+	}
+	if stub.Queries() != queries {
+		t.Errorf("second server queried twitch despite the shared allow cache")
+	}
+
+	// no stream key is sent to redis
+	for _, key := range server.Keys() {
+		if strings.Contains(key, "secret") {
+			t.Errorf("stream key sent to redis: %q", key)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package controllers
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/bcambl/rtmpauthbot/config"
+	"github.com/bcambl/rtmpauthbot/internal/testutil"
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func init() {
+	log.SetOutput(ioutil.Discard)
+}
+
+// newTestController returns a controller using a new database with all
+// buckets and twitch answered by the stub. configure adjusts the
+// configuration before the sources are registered.
+func newTestController(t testing.TB, stub *testutil.TwitchStub, configure func(*config.Config)) *Controller {
+	t.Helper()
+	conf := testutil.NewConfig(t)
+	if configure != nil {
+		configure(&conf)
+	}
+	db := testutil.OpenDB(t, &conf, DataBuckets)
+
+	c := &Controller{Config: &conf, DB: db}
+	c.SetHTTPClient(&http.Client{Transport: stub})
+	c.RegisterSources()
+	return c
+}
+
+// serve runs a request against the handler and returns the response
+func serve(handler http.HandlerFunc, method, target, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if method == "POST" && strings.HasPrefix(target, "/on_") {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+// createPublisher creates a publisher with the legacy api
+func createPublisher(t testing.TB, c *Controller, body string) {
+	t.Helper()
+	w := serve(c.PublisherAPIHandler, "POST", "/api/publisher", body)
+	if w.Code >= 300 {
+		t.Fatalf("creating publisher %s: %d %s", body, w.Code, w.Body.String())
+	}
+}
+
+// publish runs an on_publish callback to the stream app and returns the
+// response status
+func publish(c *Controller, name, key string) int {
+	return publishApp(c, name, key, "stream")
+}
+
+// publishApp runs an on_publish callback and returns the response status
+func publishApp(c *Controller, name, key, app string) int {
+	form := url.Values{"name": {name}, "key": {key}, "app": {app}}
+	return serve(c.OnPublishHandler, "POST", "/on_publish", form.Encode()).Code
+}
+
+const (
+	aliceLive    = `{"data":[{"user_login":"alice","user_name":"Alice","type":"live","viewer_count":5}]}`
+	aliceOffline = `{"data":[]}`
+)
+
+// publisherNames returns the names of all publishers
+func publisherNames(t *testing.T, c *Controller) []string {
+	t.Helper()
+	names := []string{}
+	err := c.forEachPublisher(func(p Publisher) error {
+		names = append(names, p.Name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+// captureLogs records the log entries of the test, down to debug level
+func captureLogs(t *testing.T) *test.Hook {
+	t.Helper()
+	logger := log.StandardLogger()
+	level := logger.GetLevel()
+	logger.SetLevel(log.DebugLevel)
+	hook := test.NewLocal(logger)
+	t.Cleanup(func() {
+		logger.ReplaceHooks(make(log.LevelHooks))
+		logger.SetLevel(level)
+	})
+	return hook
+}
@@ -0,0 +1,72 @@
+package controllers
+
+import (
+	"html/template"
+	"net/http"
+)
+
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>rtmpauthbot</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 0.4em 0.8em; text-align: left; vertical-align: top; }
+td.live { color: #080; font-weight: bold; }
+pre { margin: 0; font-family: inherit; }
+</style>
+</head>
+<body>
+<h1>rtmpauthbot</h1>
+<p><a href="">refresh</a></p>
+<table>
+<tr><th>publisher</th><th>enabled</th><th>rtmp</th><th>twitch stream</th><th>twitch</th><th>viewers</th><th>last published</th><th>stream info</th></tr>
+{{- range .}}
+<tr>
+<td>{{.Name}}</td>
+<td>{{if .IsEnabled}}yes{{else}}no{{end}}</td>
+{{if .RTMPLive}}<td class="live">live</td>{{else}}<td>offline</td>{{end}}
+<td>{{if .TwitchStream}}<a href="https://twitch.tv/{{.TwitchStream}}">{{.TwitchStream}}</a>{{end}}</td>
+{{if .IsTwitchLive}}<td class="live">live</td>{{else}}<td>{{if .TwitchStream}}offline{{end}}</td>{{end}}
+<td>{{if .IsTwitchLive}}{{.ViewerCount}}{{end}}</td>
+<td>{{with .LastPublishedAt}}{{.UTC.Format "2006-01-02 15:04 MST"}}{{else}}never{{end}}</td>
+<td><pre>{{.StreamInfo}}</pre>{{if .ThumbnailURL}}<img src="{{.ThumbnailURL}}" alt="{{.TwitchStream}} thumbnail">{{end}}</td>
+</tr>
+{{- else}}
+<tr><td colspan="8">no publishers configured</td></tr>
+{{- end}}
+</table>
+</body>
+</html>
+`
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(dashboardHTML))
+
+// IndexHandler is the http handler for "/" which renders a read-only
+// dashboard of all publishers and their live status.
+func (c *Controller) IndexHandler(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	publishers, err := c.getAllPublisher()
+	if err != nil {
+		logger.Debug("error retrieving all publishers: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-Type", "text/html; charset=utf-8")
+	err = dashboardTemplate.Execute(w, publishers)
+	if err != nil {
+		logger.Error("error rendering dashboard: ", err)
+	}
+}
@@ -0,0 +1,39 @@
+package controllers
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bcambl/rtmpauthbot/config"
+	"github.com/bcambl/rtmpauthbot/internal/testutil"
+)
+
+func TestDashboard(t *testing.T) {
+	c := newTestController(t, &testutil.TwitchStub{}, func(conf *config.Config) {
+		conf.RequireTwitchLive = false
+		conf.AllowedApps = nil
+	})
+	createPublisher(t, c, `{"name":"alice","key":"alice-secret"}`)
+	createPublisher(t, c, `{"name":"bob","key":"bob-secret"}`)
+	status := publish(c, "alice", "alice-secret")
+	if status != http.StatusCreated {
+		t.Fatalf("publish: got %d, want %d", status, http.StatusCreated)
+	}
+
+	w := serve(c.IndexHandler, "GET", "/", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("dashboard: got %d, want %d", w.Code, http.StatusOK)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, time.Now().UTC().Format("2006-01-02")) {
+		t.Error("dashboard does not show the last publish of alice")
+	}
+	if !strings.Contains(body, "never") {
+		t.Error("dashboard does not show that bob never published")
+	}
+	if strings.Contains(body, "secret") {
+		t.Error("dashboard shows stream keys")
+	}
+}
@@ -4,42 +4,225 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
+	"strings"
+	"time"
+	"unicode"
 
 	log "github.com/sirupsen/logrus"
 )
 
 const defaultWebhookURL = "https://discordapp.com/api/webhooks/1234567890/abcdefghijklmnopqrstuvwxyz1234567890"
 
+// maxWebhookContent is the longest message discord accepts
+const maxWebhookContent = 2000
+
 // DiscordWebhook is used to marshal the data sent to the discord webhook
 type DiscordWebhook struct {
 	Content string `json:"content"`
 }
 
 func (c *Controller) callWebhook(message string) error {
+	_, err := c.postWebhook(c.cfg().DiscordWebhook, message)
+	return err
+}
+
+// postWebhook posts a message to a discord webhook, returning the http status
+// of the response (0 when there is none) and an error unless it is a success
+// status
+func (c *Controller) postWebhook(webhookURL, message string) (int, error) {
 
-	webhookURL := c.Config.DiscordWebhook
 	if webhookURL == defaultWebhookURL {
 		err := errors.New("Default webhook value detected. Skipping webhook call")
-		return err
+		return 0, err
 	}
 	body := DiscordWebhook{}
 	body.Content = message
 
 	b, err := json.Marshal(body)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	contentType := "application/json"
-
-	resp, err := http.Post(c.Config.DiscordWebhook, contentType, bytes.NewBuffer(b))
+	r, err := http.NewRequest("POST", webhookURL, bytes.NewBuffer(b))
+	if err != nil {
+		return 0, err
+	}
+	c.setWebhookHeaders(r)
+	resp, err := c.httpClient().Do(r)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("webhook request failed: %s", resp.Status)
+	}
 
 	log.Info("message posted to webhook: ", message)
 
+	return resp.StatusCode, nil
+}
+
+// setWebhookHeaders sets the WEBHOOK_HEADERS of an outbound webhook request
+// followed by the json Content-Type, which is not overridable
+func (c *Controller) setWebhookHeaders(r *http.Request) {
+	for name, value := range c.cfg().WebhookHeaders {
+		r.Header.Set(name, value)
+	}
+	r.Header.Set("Content-Type", "application/json")
+}
+
+// NotifyResult is the outcome of sending a test message to a notification
+// channel
+type NotifyResult struct {
+	Channel string `json:"channel"`
+	OK      bool   `json:"ok"`
+	Status  int    `json:"status,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// NotifyTestAPIHandler is the http handler for "/api/notify/test", sending a
+// test message through each enabled notification channel (currently discord)
+// and reporting whether each succeeded. The response is 502 when any failed.
+func (c *Controller) NotifyTestAPIHandler(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
+
+	w.Header().Add("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		logger.Debug(http.StatusNotImplemented)
+		writeStatusError(w, http.StatusNotImplemented)
+		return
+	}
+
+	results := []NotifyResult{}
+	if c.cfg().DiscordEnabled {
+		result := NotifyResult{Channel: "discord"}
+		status, err := c.postWebhook(c.cfg().DiscordWebhook, ":test_tube: rtmpauthbot test notification")
+		result.Status = status
+		if err != nil {
+			logger.Warn("test notification failed: discord: ", err)
+			result.Error = err.Error()
+		} else {
+			result.OK = true
+		}
+		results = append(results, result)
+	}
+
+	content, err := json.Marshal(results)
+	if err != nil {
+		logger.Debug(err)
+		writeStatusError(w, http.StatusInternalServerError)
+		return
+	}
+	for i := range results {
+		if !results[i].OK {
+			w.WriteHeader(http.StatusBadGateway)
+			break
+		}
+	}
+	logger.Infof("test notification sent to %d channels", len(results))
+	w.Write(content)
+}
+
+// notifyPublisher posts a publisher going live or offline to the publisher's
+// own webhook_url, when set, and to the discord webhook when DISCORD_ENABLED
+// (see notifyTransition) unless PUBLISHER_WEBHOOK_MODE=instead applies.
+// Errors posting to the publisher's webhook are only logged.
+func (c *Controller) notifyPublisher(p Publisher, message string) error {
+	conf := c.cfg()
+	own := p.webhookURL() != ""
+	if own {
+		_, err := c.postWebhook(p.webhookURL(), message)
+		if err != nil {
+			log.Errorf("error posting to the webhook of %s: %s", p.Name, err)
+		}
+	}
+	if !conf.DiscordEnabled || (own && conf.PublisherWebhookMode == "instead") {
+		return nil
+	}
+	return c.notifyTransition(message)
+}
+
+// notifyTransition posts a publisher going live or offline. When
+// NOTIFY_DIGEST_SECONDS is set the message is queued & every message queued
+// within the window is posted together as a single digest.
+func (c *Controller) notifyTransition(message string) error {
+	window := c.cfg().NotifyDigestWindow
+	if window <= 0 {
+		return c.callWebhook(message)
+	}
+	c.digestMu.Lock()
+	defer c.digestMu.Unlock()
+	c.digest = append(c.digest, message)
+	if len(c.digest) == 1 {
+		time.AfterFunc(window, c.flushDigest)
+	}
 	return nil
 }
+
+// flushDigest posts the queued messages
+func (c *Controller) flushDigest() {
+	c.digestMu.Lock()
+	messages := c.digest
+	c.digest = nil
+	c.digestMu.Unlock()
+
+	for _, content := range digestMessages(messages) {
+		err := c.callWebhook(content)
+		if err != nil {
+			log.Error("error posting notification digest: ", err)
+		}
+	}
+}
+
+// digestMessages combines messages into as few webhook messages as discord
+// allows. A single message is posted as it is.
+func digestMessages(messages []string) []string {
+	if len(messages) < 2 {
+		return messages
+	}
+	var digests []string
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf(":newspaper: %d stream updates", len(messages)))
+	for _, message := range messages {
+		if b.Len()+len(message)+1 > maxWebhookContent {
+			digests = append(digests, b.String())
+			b.Reset()
+		}
+		if b.Len() > 0 {
+			b.WriteString("\n")
+		}
+		b.WriteString(message)
+	}
+	return append(digests, b.String())
+}
+
+// markdownChars are escaped in user provided text so that it is posted as it
+// is rather than formatted, linked or used to mention (@everyone) a channel
+const markdownChars = "\\*_~`|>#[]()<@:"
+
+// sanitizeTitle makes a stream title safe to embed in a notification. Control
+// characters (including newlines) are replaced with spaces, the title is
+// truncated to max characters (0 for no limit) & markdown is escaped.
+func sanitizeTitle(title string, max int) string {
+	title = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, title)
+	title = strings.Join(strings.Fields(title), " ")
+	if runes := []rune(title); max > 0 && len(runes) > max {
+		title = strings.TrimSpace(string(runes[:max-1])) + "…"
+	}
+	var b strings.Builder
+	for _, r := range title {
+		if strings.ContainsRune(markdownChars, r) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
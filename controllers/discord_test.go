@@ -0,0 +1,262 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bcambl/rtmpauthbot/config"
+	"github.com/bcambl/rtmpauthbot/internal/testutil"
+)
+
+func TestNotifyDigest(t *testing.T) {
+	stub := &testutil.TwitchStub{}
+	posted := make(chan string, 10)
+	stub.Handle(testWebhook, func(r *http.Request) (int, string) {
+		var body DiscordWebhook
+		content, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(content, &body)
+		posted <- body.Content
+		return http.StatusNoContent, ""
+	})
+	c := newTestController(t, stub, func(conf *config.Config) {
+		conf.DiscordEnabled = true
+		conf.DiscordWebhook = "https://" + testWebhook
+		conf.NotifyDigestWindow = 100 * time.Millisecond
+	})
+
+	// an event starts
+	for _, name := range []string{"alice", "bob", "carol"} {
+		err := c.notifyTransition(name + " is live")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(posted) != 0 {
+		t.Fatal("notification posted before the end of the digest window")
+	}
+	select {
+	case digest := <-posted:
+		want := ":newspaper: 3 stream updates\nalice is live\nbob is live\ncarol is live"
+		if digest != want {
+			t.Errorf("digest: got %q, want %q", digest, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no digest posted")
+	}
+	time.Sleep(200 * time.Millisecond)
+	if len(posted) != 0 {
+		t.Errorf("%d notifications posted besides the digest", len(posted))
+	}
+
+	// a digest of a single message is the message itself
+	err := c.notifyTransition("alice is offline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case message := <-posted:
+		if message != "alice is offline" {
+			t.Errorf("single message digest: got %q, want %q", message, "alice is offline")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no digest posted")
+	}
+}
+
+func TestDigestMessagesLimit(t *testing.T) {
+	messages := make([]string, 50)
+	for i := range messages {
+		messages[i] = strings.Repeat("x", 99)
+	}
+	digests := digestMessages(messages)
+	if len(digests) < 3 {
+		t.Fatalf("%d digests of 5000 characters, want at least 3", len(digests))
+	}
+	lines := 0
+	for _, digest := range digests {
+		if len(digest) > maxWebhookContent {
+			t.Errorf("digest of %d characters, discord allows %d", len(digest), maxWebhookContent)
+		}
+		lines += strings.Count(digest, strings.Repeat("x", 99))
+	}
+	if lines != len(messages) {
+		t.Errorf("%d messages in the digests, want %d", lines, len(messages))
+	}
+}
+
+func TestSanitizeTitle(t *testing.T) {
+	tests := []struct {
+		title string
+		max   int
+		want  string
+	}{
+		{"just chatting", 140, "just chatting"},
+		{"**free** [nitro](https://evil.example) @everyone", 140,
+			`\*\*free\*\* \[nitro\]\(https\://evil.example\) \@everyone`},
+		{"line one\nline two\r\n\x00end", 140, "line one line two end"},
+		{"`code` _x_ ~y~ |z| > q", 0, "\\`code\\` \\_x\\_ \\~y\\~ \\|z\\| \\> q"},
+		{"abcdefghij", 5, "abcd…"},
+		{"**********", 3, `\*\*…`},
+		{"アリスアリス", 4, "アリス…"},
+	}
+	for _, test := range tests {
+		got := sanitizeTitle(test.title, test.max)
+		if got != test.want {
+			t.Errorf("sanitizeTitle(%q, %d): got %q, want %q", test.title, test.max, got, test.want)
+		}
+	}
+}
+
+func TestNotificationTitleSanitized(t *testing.T) {
+	c := newTestController(t, &testutil.TwitchStub{}, func(conf *config.Config) {
+		conf.DiscordEnabled = false
+		conf.NotifyTitleMaxLength = 20
+	})
+	createPublisher(t, c, `{"name":"alice","key":"secret","twitch_stream":"alice"}`)
+
+	title := "@everyone **free**\nnitro at https://evil.example"
+	err := c.updateLiveStatus([]StreamData{{UserID: "1", UserLogin: "alice", UserName: "Alice",
+		GameID: "1", Type: "live", Title: title}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	notification, err := c.getBucketValue("TwitchNotificationBucket", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `title: \@everyone \*\*free\*\*…`
+	if !strings.Contains(string(notification), want+"\n") {
+		t.Errorf("notification: got %q, want the title %q", notification, want)
+	}
+
+	// the stored stream info keeps the original title
+	info, err := c.getBucketValue("StreamInfoBucket", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(info), title) {
+		t.Errorf("stream info: got %q, want the original title", info)
+	}
+}
+
+func TestNotifyTest(t *testing.T) {
+	tests := []struct {
+		status     int
+		want       int
+		ok         bool
+		errorShown bool
+	}{
+		{http.StatusNoContent, http.StatusOK, true, false},
+		{http.StatusNotFound, http.StatusBadGateway, false, true},
+	}
+	for _, test := range tests {
+		stub := &testutil.TwitchStub{}
+		var posted []string
+		stub.Handle(testWebhook, func(r *http.Request) (int, string) {
+			var body DiscordWebhook
+			content, _ := ioutil.ReadAll(r.Body)
+			json.Unmarshal(content, &body)
+			posted = append(posted, body.Content)
+			return test.status, `{"message":"Unknown Webhook","code":10015}`
+		})
+		c := newTestController(t, stub, func(conf *config.Config) {
+			conf.DiscordEnabled = true
+			conf.DiscordWebhook = "https://" + testWebhook
+		})
+
+		w := serve(c.NotifyTestAPIHandler, "POST", "/api/notify/test", "")
+		if w.Code != test.want {
+			t.Errorf("webhook %d: got %d, want %d", test.status, w.Code, test.want)
+		}
+		var results []NotifyResult
+		err := json.Unmarshal(w.Body.Bytes(), &results)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 1 || results[0].Channel != "discord" {
+			t.Fatalf("webhook %d: got %s, want the discord channel only", test.status, w.Body.String())
+		}
+		result := results[0]
+		if result.OK != test.ok || result.Status != test.status || (result.Error != "") != test.errorShown {
+			t.Errorf("webhook %d: got %+v", test.status, result)
+		}
+		if len(posted) != 1 || !strings.Contains(posted[0], "test") {
+			t.Errorf("webhook %d: posted %q, want one test message", test.status, posted)
+		}
+	}
+
+	// without any channel enabled nothing is sent
+	c := newTestController(t, &testutil.TwitchStub{}, func(conf *config.Config) {
+		conf.DiscordEnabled = false
+	})
+	w := serve(c.NotifyTestAPIHandler, "POST", "/api/notify/test", "")
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Errorf("no channels: got %d %s, want %d []", w.Code, w.Body.String(), http.StatusOK)
+	}
+}
+
+func TestPublisherWebhook(t *testing.T) {
+	const ownWebhook = "alice.example/hook"
+	tests := []struct {
+		mode           string
+		discordEnabled bool
+		global, own    []string
+	}{
+		{"also", true, []string{"alice", "bob"}, []string{"alice"}},
+		{"instead", true, []string{"bob"}, []string{"alice"}},
+		{"also", false, nil, []string{"alice"}},
+	}
+	for _, test := range tests {
+		stub := &testutil.TwitchStub{}
+		var mu sync.Mutex
+		posted := map[string][]string{}
+		for _, route := range []string{testWebhook, ownWebhook} {
+			route := route
+			stub.Handle(route, func(r *http.Request) (int, string) {
+				var body DiscordWebhook
+				content, _ := ioutil.ReadAll(r.Body)
+				json.Unmarshal(content, &body)
+				mu.Lock()
+				posted[route] = append(posted[route], strings.Fields(body.Content)[1])
+				mu.Unlock()
+				return http.StatusNoContent, ""
+			})
+		}
+		c := newTestController(t, stub, func(conf *config.Config) {
+			conf.DiscordEnabled = test.discordEnabled
+			conf.DiscordWebhook = "https://" + testWebhook
+			conf.NotifyDigestWindow = 0
+			conf.PublisherWebhookMode = test.mode
+		})
+		createPublisher(t, c, `{"name":"alice","key":"secret","twitch_stream":"alice","webhook_url":"https://`+ownWebhook+`"}`)
+		createPublisher(t, c, `{"name":"bob","key":"secret","twitch_stream":"bob"}`)
+
+		err := c.updateLiveStatus([]StreamData{
+			{UserID: "1", UserLogin: "alice", UserName: "Alice", GameID: "1", Type: "live"},
+			{UserID: "2", UserLogin: "bob", UserName: "Bob", GameID: "1", Type: "live"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.processNotifications()
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := fmt.Sprintf("PUBLISHER_WEBHOOK_MODE=%s DISCORD_ENABLED=%t", test.mode, test.discordEnabled)
+		mu.Lock()
+		if !reflect.DeepEqual(posted[testWebhook], test.global) {
+			t.Errorf("%s: discord webhook notified of %v, want %v", name, posted[testWebhook], test.global)
+		}
+		if !reflect.DeepEqual(posted[ownWebhook], test.own) {
+			t.Errorf("%s: publisher webhook notified of %v, want %v", name, posted[ownWebhook], test.own)
+		}
+		mu.Unlock()
+	}
+}
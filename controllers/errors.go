@@ -0,0 +1,178 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Errors returned by the controllers which are usable with errors.Is
+var (
+	ErrPublisherNotFound = errors.New("publisher not found")
+	ErrKeyMismatch       = errors.New("stream key mismatch")
+	ErrAppMismatch       = errors.New("rtmp app mismatch")
+	ErrNotLive           = errors.New("publisher is not live")
+	ErrTwitchUnavailable = errors.New("twitch unavailable")
+	ErrRateLimited       = errors.New("rate limited")
+	ErrDisabled          = errors.New("publisher is disabled")
+	ErrBucketMissing     = errors.New("database bucket missing")
+	ErrPublisherLimit    = errors.New("maximum number of publishers reached")
+	ErrPlaybackToken     = errors.New("invalid playback token")
+	ErrInactive          = errors.New("publisher is outside its active window")
+)
+
+// apiStatus maps an error to the http status code returned by the api
+func apiStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrPublisherNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrKeyMismatch), errors.Is(err, ErrAppMismatch),
+		errors.Is(err, ErrNotLive), errors.Is(err, ErrDisabled),
+		errors.Is(err, ErrPlaybackToken), errors.Is(err, ErrInactive):
+		return http.StatusForbidden
+	case errors.Is(err, ErrPublisherLimit):
+		return http.StatusConflict
+	case errors.Is(err, ErrRateLimited):
+		return http.StatusTooManyRequests
+	case errors.Is(err, ErrTwitchUnavailable):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// Codes of api error responses, which clients may rely on
+const (
+	codeBadRequest        = "bad_request"
+	codeNotFound          = "not_found"
+	codeMethodNotAllowed  = "method_not_allowed"
+	codeConflict          = "conflict"
+	codeRateLimited       = "rate_limited"
+	codeInternal          = "internal_error"
+	codeNotImplemented    = "not_implemented"
+	codeBadGateway        = "bad_gateway"
+	codeUnavailable       = "unavailable"
+	codePublisherNotFound = "publisher_not_found"
+	codeKeyMismatch       = "key_mismatch"
+	codeAppMismatch       = "app_mismatch"
+	codeNotLive           = "not_live"
+	codeDisabled          = "publisher_disabled"
+	codeInactive          = "publisher_inactive"
+	codePlaybackToken     = "invalid_playback_token"
+	codePublisherLimit    = "publisher_limit"
+	codeTwitchUnavailable = "twitch_unavailable"
+)
+
+// APIError is the json body of every api error response
+type APIError struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+}
+
+// errorCode maps an error to the code of its api error response
+func errorCode(err error) string {
+	switch {
+	case errors.Is(err, ErrPublisherNotFound):
+		return codePublisherNotFound
+	case errors.Is(err, ErrKeyMismatch):
+		return codeKeyMismatch
+	case errors.Is(err, ErrAppMismatch):
+		return codeAppMismatch
+	case errors.Is(err, ErrNotLive):
+		return codeNotLive
+	case errors.Is(err, ErrDisabled):
+		return codeDisabled
+	case errors.Is(err, ErrInactive):
+		return codeInactive
+	case errors.Is(err, ErrPlaybackToken):
+		return codePlaybackToken
+	case errors.Is(err, ErrPublisherLimit):
+		return codePublisherLimit
+	case errors.Is(err, ErrRateLimited):
+		return codeRateLimited
+	case errors.Is(err, ErrTwitchUnavailable):
+		return codeTwitchUnavailable
+	default:
+		return codeInternal
+	}
+}
+
+// statusErrorCode returns the code of an api error response which has no
+// more specific error
+func statusErrorCode(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return codeBadRequest
+	case http.StatusNotFound:
+		return codeNotFound
+	case http.StatusMethodNotAllowed:
+		return codeMethodNotAllowed
+	case http.StatusConflict:
+		return codeConflict
+	case http.StatusTooManyRequests:
+		return codeRateLimited
+	case http.StatusNotImplemented:
+		return codeNotImplemented
+	case http.StatusBadGateway:
+		return codeBadGateway
+	case http.StatusServiceUnavailable:
+		return codeUnavailable
+	default:
+		return codeInternal
+	}
+}
+
+// writeJSONError responds with an api error
+func writeJSONError(w http.ResponseWriter, status int, code, msg string) {
+	content, err := json.Marshal(APIError{Error: msg, Code: code})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(content)
+}
+
+// writeAPIError responds with the api error of an error returned by the
+// controllers. The details of internal errors are only logged.
+func writeAPIError(w http.ResponseWriter, err error) {
+	status := apiStatus(err)
+	if status == http.StatusInternalServerError {
+		writeStatusError(w, status)
+		return
+	}
+	writeJSONError(w, status, errorCode(err), err.Error())
+}
+
+// writeStatusError responds with the api error of a status code, described
+// by its status text
+func writeStatusError(w http.ResponseWriter, status int) {
+	writeJSONError(w, status, statusErrorCode(status), strings.ToLower(http.StatusText(status)))
+}
+
+// notFoundStatus is the http status code returned to nginx for an unknown
+// stream, which is DENY_STATUS_CODE when HIDE_PUBLISHER_EXISTENCE is set so
+// that unknown streams cannot be told apart from denied ones
+func (c *Controller) notFoundStatus() int {
+	conf := c.cfg()
+	if conf.HidePublisherExistence {
+		return conf.DenyStatusCode
+	}
+	return http.StatusNotFound
+}
+
+// denyStatus maps an error to the http status code returned to nginx when a
+// rtmp callback is denied. Authorization failures use DENY_STATUS_CODE.
+func (c *Controller) denyStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrRateLimited):
+		return http.StatusTooManyRequests
+	case errors.Is(err, ErrTwitchUnavailable):
+		return http.StatusServiceUnavailable
+	default:
+		return c.cfg().DenyStatusCode
+	}
+}
@@ -0,0 +1,147 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bcambl/rtmpauthbot/config"
+	"github.com/bcambl/rtmpauthbot/internal/testutil"
+)
+
+func TestAuthorizeErrors(t *testing.T) {
+	stub := &testutil.TwitchStub{}
+	c := newTestController(t, stub, func(conf *config.Config) {
+		conf.RequireTwitchLive = true
+		conf.LiveGracePeriod = 0
+		conf.NegativeCacheTTL = 0
+		conf.AllowedApps = nil
+	})
+	createPublisher(t, c, `{"name":"alice","key":"secret","twitch_stream":"alice"}`)
+	createPublisher(t, c, `{"name":"bob","key":"secret","app":"live","mode":"ingest"}`)
+	createPublisher(t, c, `{"name":"carol","key":"secret","enabled":false}`)
+	createPublisher(t, c, `{"name":"dave","key":"secret","active_until":"2000-01-01T00:00:00Z"}`)
+
+	tests := []struct {
+		name, key, app string
+		streamsStatus  int
+		want           error
+		status         int
+	}{
+		{"nobody", "secret", "stream", http.StatusOK, ErrPublisherNotFound, http.StatusNotFound},
+		{"alice", "wrong", "stream", http.StatusOK, ErrKeyMismatch, http.StatusForbidden},
+		{"bob", "secret", "stream", http.StatusOK, ErrAppMismatch, http.StatusForbidden},
+		{"carol", "secret", "stream", http.StatusOK, ErrDisabled, http.StatusForbidden},
+		{"dave", "secret", "stream", http.StatusOK, ErrInactive, http.StatusForbidden},
+		{"alice", "secret", "stream", http.StatusOK, ErrNotLive, http.StatusForbidden},
+		{"alice", "secret", "stream", http.StatusServiceUnavailable, ErrTwitchUnavailable, http.StatusServiceUnavailable},
+		{"alice", "secret", "stream", http.StatusTooManyRequests, ErrRateLimited, http.StatusTooManyRequests},
+	}
+	for _, test := range tests {
+		stub.SetStreams(test.streamsStatus, aliceOffline)
+		_, err := c.authorize(test.name, test.key, test.app)
+		if !errors.Is(err, test.want) {
+			t.Errorf("%s with key %s & app %s: got %v, want %v", test.name, test.key, test.app, err, test.want)
+			continue
+		}
+		if status := apiStatus(err); status != test.status {
+			t.Errorf("%v: got status %d, want %d", err, status, test.status)
+		}
+	}
+}
+
+func TestWriteAPIError(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{ErrPublisherNotFound, http.StatusNotFound, codePublisherNotFound},
+		{ErrKeyMismatch, http.StatusForbidden, codeKeyMismatch},
+		{ErrAppMismatch, http.StatusForbidden, codeAppMismatch},
+		{ErrNotLive, http.StatusForbidden, codeNotLive},
+		{ErrDisabled, http.StatusForbidden, codeDisabled},
+		{ErrInactive, http.StatusForbidden, codeInactive},
+		{ErrPlaybackToken, http.StatusForbidden, codePlaybackToken},
+		{ErrPublisherLimit, http.StatusConflict, codePublisherLimit},
+		{ErrRateLimited, http.StatusTooManyRequests, codeRateLimited},
+		{ErrTwitchUnavailable, http.StatusServiceUnavailable, codeTwitchUnavailable},
+		{ErrBucketMissing, http.StatusInternalServerError, codeInternal},
+		{errors.New("disk on fire"), http.StatusInternalServerError, codeInternal},
+	}
+	for _, test := range tests {
+		// wrapped errors map like the error they wrap
+		err := fmt.Errorf("alice: %w", test.err)
+		w := httptest.NewRecorder()
+		writeAPIError(w, err)
+		if w.Code != test.status {
+			t.Errorf("%v: got status %d, want %d", err, w.Code, test.status)
+		}
+		apiErr := decodeAPIError(t, w)
+		want := APIError{Error: err.Error(), Code: test.code}
+		if test.status == http.StatusInternalServerError {
+			// the details of internal errors are not revealed
+			want.Error = "internal server error"
+		}
+		if apiErr != want {
+			t.Errorf("%v: got %+v, want %+v", err, apiErr, want)
+		}
+	}
+}
+
+// decodeAPIError decodes an api error response, which must have the error &
+// code fields only
+func decodeAPIError(t *testing.T, w *httptest.ResponseRecorder) APIError {
+	t.Helper()
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("error response content type: got %q, want application/json", contentType)
+	}
+	var fields map[string]interface{}
+	err := json.Unmarshal(w.Body.Bytes(), &fields)
+	if err != nil {
+		t.Fatalf("error response is not json: %s", w.Body.String())
+	}
+	_, hasError := fields["error"]
+	_, hasCode := fields["code"]
+	if len(fields) != 2 || !hasError || !hasCode {
+		t.Errorf("error response fields: got %s, want error & code", w.Body.String())
+	}
+	var apiErr APIError
+	json.Unmarshal(w.Body.Bytes(), &apiErr)
+	return apiErr
+}
+
+func TestAPIErrorResponses(t *testing.T) {
+	c := newTestController(t, &testutil.TwitchStub{}, func(conf *config.Config) {
+		conf.MaxPublishers = 1
+	})
+	createPublisher(t, c, `{"name":"alice","key":"secret"}`)
+
+	tests := []struct {
+		handler              http.HandlerFunc
+		method, target, body string
+		status               int
+		code                 string
+	}{
+		{c.PublishersAPIHandler, "GET", "/api/publishers/nobody", "", http.StatusNotFound, codePublisherNotFound},
+		{c.PublisherAPIHandler, "GET", "/api/publisher?name=nobody", "", http.StatusNotFound, codePublisherNotFound},
+		{c.PublishersAPIHandler, "PUT", "/api/publishers/bob", `{"key":"secret"}`, http.StatusConflict, codePublisherLimit},
+		{c.PublisherAPIHandler, "POST", "/api/publisher", `{"name":"bob","key":"secret"}`, http.StatusConflict, codePublisherLimit},
+		{c.PublisherAPIHandler, "POST", "/api/publisher", `{"name":`, http.StatusBadRequest, codeBadRequest},
+		{c.PublisherAPIHandler, "PATCH", "/api/publisher", "", http.StatusNotImplemented, codeNotImplemented},
+	}
+	for _, test := range tests {
+		name := test.method + " " + test.target
+		w := serve(test.handler, test.method, test.target, test.body)
+		if w.Code != test.status {
+			t.Errorf("%s: got %d, want %d", name, w.Code, test.status)
+			continue
+		}
+		if apiErr := decodeAPIError(t, w); apiErr.Code != test.code || apiErr.Error == "" {
+			t.Errorf("%s: got %s, want code %s & a message", name, w.Body.String(), test.code)
+		}
+	}
+}
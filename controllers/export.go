@@ -0,0 +1,85 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ExportPublishers writes all publishers as json in the same format as
+// GET /api/publisher, ordered by name
+func (c *Controller) ExportPublishers(w io.Writer) (int, error) {
+	publishers, err := c.getAllPublisher()
+	if err != nil {
+		return 0, err
+	}
+	err = sortPublishers(publishers, "name", false)
+	if err != nil {
+		return 0, err
+	}
+	content, err := json.MarshalIndent(publishers, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	_, err = w.Write(append(content, '\n'))
+	if err != nil {
+		return 0, err
+	}
+	return len(publishers), nil
+}
+
+// ImportPublishers creates or updates publishers from json in the format
+// written by ExportPublishers. Every publisher is validated and the import
+// is written in a single transaction, so either all publishers are imported
+// or none are. Live status & timestamps are managed internally and not
+// imported.
+func (c *Controller) ImportPublishers(r io.Reader) (int, error) {
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	var publishers []Publisher
+	err = json.Unmarshal(body, &publishers)
+	if err != nil {
+		return 0, err
+	}
+	for i := range publishers {
+		err = publishers[i].IsValid()
+		if err != nil {
+			return 0, fmt.Errorf("publisher %d: %w", i, err)
+		}
+	}
+	defer c.publishersChanged()
+	now := time.Now()
+	err = c.DB.Update(func(tx *bolt.Tx) error {
+		b := c.bucket(tx, "PublisherBucket")
+		if b == nil {
+			return fmt.Errorf("%w: PublisherBucket", ErrBucketMissing)
+		}
+		creating := 0
+		for i := range publishers {
+			if b.Get([]byte(publishers[i].Name)) == nil {
+				creating++
+			}
+		}
+		err := c.checkPublisherLimit(b, creating)
+		if err != nil {
+			return err
+		}
+		for i := range publishers {
+			err = c.updatePublisherTx(tx, publishers[i], now)
+			if err != nil {
+				return fmt.Errorf("error importing publisher '%s': %w", publishers[i].Name, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(publishers), nil
+}
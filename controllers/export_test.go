@@ -0,0 +1,56 @@
+package controllers
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bcambl/rtmpauthbot/internal/testutil"
+)
+
+func TestExportImport(t *testing.T) {
+	source := newTestController(t, &testutil.TwitchStub{}, nil)
+	createPublisher(t, source, `{"name":"alice","key":"secret-1","twitch_stream":"alice","app":"live","tags":["event"],`+
+		`"metadata":{"crm":"1001"},"platform_roles":{"twitch":"require"},"min_viewers":3,`+
+		`"webhook_url":"https://discord.example/hook","active_until":"2099-01-01T00:00:00Z"}`)
+	createPublisher(t, source, `{"name":"bob","key":"secret-2","mode":"ingest","enabled":false}`)
+
+	var exported bytes.Buffer
+	count, err := source.ExportPublishers(&exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("exported %d publishers, want 2", count)
+	}
+	target := newTestController(t, &testutil.TwitchStub{}, nil)
+	count, err = target.ImportPublishers(bytes.NewReader(exported.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("imported %d publishers, want 2", count)
+	}
+
+	// timestamps are managed by each database
+	publishers := func(c *Controller) []Publisher {
+		t.Helper()
+		all, err := c.getAllPublisher()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = sortPublishers(all, "name", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range all {
+			all[i].CreatedAt, all[i].UpdatedAt = time.Time{}, time.Time{}
+		}
+		return all
+	}
+	want, got := publishers(source), publishers(target)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("imported publishers differ from the exported ones:\ngot  %+v\nwant %+v", got, want)
+	}
+}
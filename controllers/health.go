@@ -0,0 +1,189 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/bcambl/rtmpauthbot/config"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// pollStallPolls is the number of poll intervals the source scheduler may
+// miss before the server is considered unhealthy
+const pollStallPolls = 3
+
+// tokenCheckFailureThreshold is the number of consecutive failed token
+// checks before an alert is sent, so that a single blip does not alert
+const tokenCheckFailureThreshold = 3
+
+// ReadyResponse is returned by the readiness endpoint
+type ReadyResponse struct {
+	Ready  bool   `json:"ready"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// StatusResponse is returned by the status endpoint
+type StatusResponse struct {
+	Version   string   `json:"version"`
+	Commit    string   `json:"commit"`
+	GoVersion string   `json:"go_version"`
+	Platforms []string `json:"platforms"`
+}
+
+// checkTokens ensures every twitch client has a valid access token, refreshing
+// any which are invalid. An alert is sent once checks have failed repeatedly
+// and again when the tokens recover.
+func (c *Controller) checkTokens() {
+	var failure error
+	for _, client := range c.cfg().TwitchClients {
+		_, err := c.twitchAuthToken(client)
+		if err != nil {
+			failure = err
+			break
+		}
+	}
+
+	var message string
+	c.healthMu.Lock()
+	if failure == nil {
+		if c.tokenAlerted {
+			log.Info("twitch access token check recovered")
+			message = ":white_check_mark: twitch access token check recovered"
+		}
+		c.tokenFailures = 0
+		c.tokenAlerted = false
+	} else {
+		c.tokenFailures++
+		log.Warnf("twitch access token check failed (%d/%d): %s",
+			c.tokenFailures, tokenCheckFailureThreshold, failure)
+		if c.tokenFailures >= tokenCheckFailureThreshold && !c.tokenAlerted {
+			c.tokenAlerted = true
+			message = fmt.Sprintf(":warning: unable to obtain a valid twitch access token: %s", failure)
+		}
+	}
+	c.healthMu.Unlock()
+
+	if message != "" {
+		c.alert(message)
+	}
+}
+
+// Healthy returns an error when the database cannot be read or the source
+// scheduler has stalled, as when a poll hangs without SOURCE_TIMEOUT
+func (c *Controller) Healthy(now time.Time) error {
+	err := c.DB.View(func(tx *bolt.Tx) error {
+		if c.bucket(tx, "ConfigBucket") == nil {
+			return fmt.Errorf("%w: ConfigBucket", ErrBucketMissing)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("database: %w", err)
+	}
+	last := atomic.LoadInt64(&c.lastPoll)
+	if last == 0 {
+		// the scheduler is not running
+		return nil
+	}
+	conf := c.cfg()
+	stallAfter := pollStallPolls*conf.TwitchPollRate + conf.SourceTimeout
+	if since := now.Sub(time.Unix(0, last)); since > stallAfter {
+		return fmt.Errorf("source scheduler has not polled for %s", since.Round(time.Second))
+	}
+	return nil
+}
+
+// alert posts a message to the discord webhook when discord is enabled
+func (c *Controller) alert(message string) {
+	if !c.cfg().DiscordEnabled {
+		return
+	}
+	err := c.callWebhook(message)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// TokenCheckScheduler launches the periodic twitch access token check
+func (c *Controller) TokenCheckScheduler(ctx context.Context, interval time.Duration) {
+	if !c.sourceRegistered("twitch") || interval <= 0 {
+		return
+	}
+	for _, client := range c.cfg().TwitchClients {
+		if validateClientCredentials(client) != nil {
+			return
+		}
+	}
+	log.Infof("starting twitch token check (interval: %s)", interval.String())
+	ticker := time.NewTicker(interval)
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				c.checkTokens()
+			case <-ctx.Done():
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// ReadyzHandler is the http handler for "/readyz". The server is not ready
+// while the twitch access token check is failing.
+func (c *Controller) ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
+
+	w.Header().Add("Content-Type", "application/json")
+
+	ready := ReadyResponse{Ready: true}
+	c.healthMu.Lock()
+	if c.tokenAlerted {
+		ready = ReadyResponse{Ready: false, Reason: "twitch access token check failing"}
+	}
+	c.healthMu.Unlock()
+
+	content, err := json.Marshal(ready)
+	if err != nil {
+		logger.Debug(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !ready.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(content)
+}
+
+// StatusHandler is the http handler for "/api/status", reporting the version
+// & build information of the server
+func (c *Controller) StatusHandler(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
+
+	w.Header().Add("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		logger.Debug(http.StatusNotImplemented)
+		writeStatusError(w, http.StatusNotImplemented)
+		return
+	}
+
+	content, err := json.Marshal(StatusResponse{
+		Version:   config.Version,
+		Commit:    config.Commit,
+		GoVersion: runtime.Version(),
+		Platforms: c.SourceNames(),
+	})
+	if err != nil {
+		logger.Debug(err)
+		writeStatusError(w, http.StatusInternalServerError)
+		return
+	}
+	w.Write(content)
+}
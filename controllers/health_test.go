@@ -0,0 +1,85 @@
+package controllers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/bcambl/rtmpauthbot/config"
+	"github.com/bcambl/rtmpauthbot/internal/testutil"
+)
+
+const testWebhook = "discord.example/api/webhooks/1"
+
+func TestTokenCheckAlertsOnce(t *testing.T) {
+	stub := &testutil.TwitchStub{}
+	var alerts []string
+	stub.Handle(testWebhook, func(r *http.Request) (int, string) {
+		body, _ := ioutil.ReadAll(r.Body)
+		alerts = append(alerts, string(body))
+		return http.StatusNoContent, ""
+	})
+	failing := true
+	stub.Handle(testutil.TwitchToken, func(r *http.Request) (int, string) {
+		if failing {
+			return http.StatusInternalServerError, `{"status":500,"message":"internal error"}`
+		}
+		return http.StatusOK, `{"access_token":"test-token","token_type":"bearer","expires_in":3600}`
+	})
+	c := newTestController(t, stub, func(conf *config.Config) {
+		conf.DiscordEnabled = true
+		conf.DiscordWebhook = "https://" + testWebhook
+	})
+	ready := func() int {
+		return serve(c.ReadyzHandler, "GET", "/readyz", "").Code
+	}
+
+	// a single failure is a blip, neither alerted nor failing readiness
+	c.checkTokens()
+	if len(alerts) != 0 || ready() != http.StatusOK {
+		t.Fatalf("after one failure: %d alerts & readyz %d, want none & %d", len(alerts), ready(), http.StatusOK)
+	}
+	for i := 1; i < 2*tokenCheckFailureThreshold; i++ {
+		c.checkTokens()
+	}
+	if len(alerts) != 1 {
+		t.Fatalf("after sustained failure: %d alerts, want 1", len(alerts))
+	}
+	if ready() != http.StatusServiceUnavailable {
+		t.Fatalf("readyz after sustained failure: got %d, want %d", ready(), http.StatusServiceUnavailable)
+	}
+
+	// recovering is announced and restores readiness
+	failing = false
+	c.checkTokens()
+	c.checkTokens()
+	if len(alerts) != 2 || ready() != http.StatusOK {
+		t.Fatalf("after recovering: %d alerts & readyz %d, want 2 & %d", len(alerts), ready(), http.StatusOK)
+	}
+	if !strings.Contains(alerts[1], "recovered") {
+		t.Error("the second alert is not the recovery")
+	}
+}
+
+func TestStatusVersion(t *testing.T) {
+	version, commit := config.Version, config.Commit
+	config.Version, config.Commit = "1.2.3", "abc1234"
+	defer func() { config.Version, config.Commit = version, commit }()
+	c := newTestController(t, &testutil.TwitchStub{}, nil)
+
+	w := serve(c.StatusHandler, "GET", "/api/status", "")
+	var status StatusResponse
+	err := json.Unmarshal(w.Body.Bytes(), &status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Version != "1.2.3" || status.Commit != "abc1234" || status.GoVersion != runtime.Version() {
+		t.Fatalf("status: got %s, want version 1.2.3 & commit abc1234", w.Body.String())
+	}
+	if strings.Join(status.Platforms, ",") != "twitch" {
+		t.Fatalf("status platforms: got %v, want [twitch]", status.Platforms)
+	}
+}
@@ -1,28 +1,198 @@
 package controllers
 
 import (
+	"fmt"
 	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/bcambl/rtmpauthbot/config"
 	bolt "go.etcd.io/bbolt"
 )
 
+// DataBuckets is a slice of all buckets that exist throught the project
+var DataBuckets = []string{
+	"ConfigBucket",             // General configuration & caching
+	"PublisherBucket",          // Local publishers -> rtmp stream keys
+	"RTMPLiveBucket",           // Local publishers -> rtmp live stream status
+	"TwitchStreamBucket",       // Local publishers -> twitch stream names
+	"TwitchLiveBucket",         // Local publishers -> twitch live stream status
+	"TwitchNotificationBucket", // Local publishers -> twitch notification state
+	"StreamInfoBucket",         // Local publishers -> generic stream information
+	"UsersBucket",              // Twitch logins -> twitch user ids
+	"UserResolvedBucket",       // Twitch logins -> time the user id was resolved
+	"DisabledBucket",           // Local publishers -> disabled state
+	"TagsBucket",               // Local publishers -> comma separated tags
+	"CreatedAtBucket",          // Local publishers -> creation time
+	"UpdatedAtBucket",          // Local publishers -> last modified time
+	"PublishAttemptBucket",     // Local publishers -> first publish attempt while not live
+	"MetadataBucket",           // Local publishers -> json encoded custom metadata
+	"AppBucket",                // Local publishers -> rtmp app restriction
+	"ThumbnailBucket",          // Local publishers -> twitch stream thumbnail url
+	"ModeBucket",               // Local publishers -> publish mode (mirror/ingest)
+	"ViewersBucket",            // Local publishers -> twitch viewer count while live
+	"MinViewersBucket",         // Local publishers -> twitch viewers required to count as live
+	"TitleBucket",              // Local publishers -> twitch stream title while live
+	"TrovoChannelBucket",       // Local publishers -> trovo channel names
+	"SessionSeenBucket",        // Local publishers -> last on_publish/on_update of the rtmp session
+	"SessionBucket",            // Local publishers -> json encoded details of the rtmp session
+	"ActiveFromBucket",         // Local publishers -> start of the active window
+	"ActiveUntilBucket",        // Local publishers -> end of the active window
+	"RecordingBucket",          // Local publishers -> path of the last finished recording
+	"LastPublishedBucket",      // Local publishers -> time of the last authorized publish
+	"PlatformRolesBucket",      // Local publishers -> json encoded platform roles (require/any)
+	"WebhookBucket",            // Local publishers -> own webhook url for their notifications
+}
+
 // Controller struct to provide the database to all handlers
 type Controller struct {
-	Config *config.Config
-	DB     *bolt.DB
+	// Config is the configuration the controller starts with. Use cfg() to
+	// read the current configuration, which may be replaced with SetConfig.
+	Config  *config.Config
+	DB      *bolt.DB
+	Sources []StreamSource
+
+	// client of all outbound requests, see httpClient
+	client *http.Client
+
+	// current configuration, see cfg
+	conf atomic.Value
+
+	// index of the next twitch client to use, see nextTwitchClient
+	twitchClientIndex uint32
+	// twitch logins recently confirmed as not live, see notLive
+	notLiveCache   Cache
+	notLiveDefault ttlCache
+	// publishers recently allowed by the twitch live check, see allowed
+	allowCache   Cache
+	allowDefault ttlCache
+	// twitch games by id, guarded by gamesMu
+	gamesMu sync.Mutex
+	games   map[string]GameData
+	// serializes twitch refreshes
+	twitchMu sync.Mutex
+	// set while the refresh following a new access token runs
+	tokenRefreshing int32
+	// time of the last on-demand refresh, guarded by refreshMu
+	refreshMu   sync.Mutex
+	lastRefresh time.Time
+	// publishers recently notified of a denied publish
+	denyNotified ttlCache
+	// publishers denied repeatedly
+	publishThrottle publishThrottle
+	// 1 while maintenance mode is enabled, see SetMaintenance
+	maintenance int32
+	// twitch access token check state, guarded by healthMu
+	healthMu      sync.Mutex
+	tokenFailures int
+	tokenAlerted  bool
+	// unix nanoseconds of the last poll of the source scheduler, see Healthy
+	lastPoll int64
+	// bumped by publishersChanged, see twitchLogins
+	publisherGen uint64
+	// cached twitch logins, guarded by loginsMu
+	loginsMu     sync.Mutex
+	logins       []string
+	loginsGen    uint64
+	loginsCached bool
+	// denied publishes by reason, see MetricsHandler
+	denies counterVec
+	// failed database writes by nginx callback, see MetricsHandler
+	dbWriteErrors counterVec
+	// durations of twitch api requests by endpoint, see MetricsHandler
+	twitchLatency histogramVec
+	// live transitions queued for the next digest, guarded by digestMu
+	digestMu sync.Mutex
+	digest   []string
+}
+
+// cfg returns the current configuration. The configuration is never
+// modified once in use, SetConfig replaces it, so reading fields of the
+// returned configuration is safe while another goroutine calls SetConfig.
+// Read it once into a local when several fields must be consistent.
+func (c *Controller) cfg() *config.Config {
+	if conf, ok := c.conf.Load().(*config.Config); ok {
+		return conf
+	}
+	return c.Config
 }
 
-// IndexHandler is the http handler for "/".
-func (c *Controller) IndexHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Add("Content-Type", "application/json")
-	w.Write([]byte(`{"handler": "index"}`))
+// SetConfig atomically replaces the configuration used by the controller.
+// The provided configuration must not be modified afterwards.
+func (c *Controller) SetConfig(conf *config.Config) {
+	c.conf.Store(conf)
+}
+
+// SetNotLiveCache replaces the in memory cache of twitch logins confirmed as
+// not live, e.g. with a cache shared by several servers. It must be called
+// before the controller is in use.
+func (c *Controller) SetNotLiveCache(cache Cache) {
+	c.notLiveCache = cache
+}
+
+// SetAllowCache replaces the in memory cache of publishers recently allowed
+// by the twitch live check, e.g. with a cache shared by several servers. It
+// must be called before the controller is in use.
+func (c *Controller) SetAllowCache(cache Cache) {
+	c.allowCache = cache
+}
+
+// NewHTTPClient returns a client for outbound requests which keeps up to
+// maxIdle idle connections (maxIdlePerHost to any one host) open for reuse
+// for idleTimeout, so that polling bursts avoid new tls handshakes. Each
+// request is limited to timeout (0 disables).
+func NewHTTPClient(maxIdle, maxIdlePerHost int, idleTimeout, timeout time.Duration) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = maxIdle
+	transport.MaxIdleConnsPerHost = maxIdlePerHost
+	transport.IdleConnTimeout = idleTimeout
+	return &http.Client{Transport: transport, Timeout: timeout}
+}
 
+// SetHTTPClient replaces the client of outbound requests, which is
+// http.DefaultClient otherwise. It must be called before the controller is
+// in use.
+func (c *Controller) SetHTTPClient(client *http.Client) {
+	c.client = client
+}
+
+// httpClient returns the client of outbound requests
+func (c *Controller) httpClient() *http.Client {
+	if c.client == nil {
+		return http.DefaultClient
+	}
+	return c.client
+}
+
+// notLive returns the cache of twitch logins confirmed as not live
+func (c *Controller) notLive() Cache {
+	if c.notLiveCache == nil {
+		return &c.notLiveDefault
+	}
+	return c.notLiveCache
+}
+
+// allowed returns the cache of publishers recently allowed by the twitch
+// live check
+func (c *Controller) allowed() Cache {
+	if c.allowCache == nil {
+		return &c.allowDefault
+	}
+	return c.allowCache
+}
+
+// bucket returns a database bucket within the configured tenant
+func (c *Controller) bucket(tx *bolt.Tx, name string) *bolt.Bucket {
+	return tx.Bucket([]byte(c.cfg().BucketName(name)))
 }
 
 func (c *Controller) setBucketValue(bucket, key, value string) error {
 	err := c.DB.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(bucket))
+		b := c.bucket(tx, bucket)
+		if b == nil {
+			return fmt.Errorf("%w: %s", ErrBucketMissing, bucket)
+		}
 		err := b.Put([]byte(key), []byte(value))
 		return err
 	})
@@ -35,9 +205,22 @@ func (c *Controller) setBucketValue(bucket, key, value string) error {
 func (c *Controller) getBucketValue(bucket, key string) ([]byte, error) {
 	var result []byte
 	err := c.DB.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(bucket))
+		b := c.bucket(tx, bucket)
+		if b == nil {
+			return fmt.Errorf("%w: %s", ErrBucketMissing, bucket)
+		}
 		result = b.Get([]byte(key))
 		return nil
 	})
 	return result, err
 }
+
+// bucketValue returns a value within a transaction. The value is only valid
+// for the lifetime of the transaction.
+func (c *Controller) bucketValue(tx *bolt.Tx, bucket, key string) ([]byte, error) {
+	b := c.bucket(tx, bucket)
+	if b == nil {
+		return nil, fmt.Errorf("%w: %s", ErrBucketMissing, bucket)
+	}
+	return b.Get([]byte(key)), nil
+}
@@ -0,0 +1,97 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bcambl/rtmpauthbot/config"
+	"github.com/bcambl/rtmpauthbot/internal/testutil"
+)
+
+func TestHTTPClientTimeout(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+
+	client := NewHTTPClient(1, 1, time.Second, 50*time.Millisecond)
+	start := time.Now()
+	_, err := client.Get(server.URL)
+	if err == nil {
+		t.Fatal("request to an unresponsive server did not time out")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("request timed out after %s", elapsed)
+	}
+}
+
+func TestSetConfigWhileServing(t *testing.T) {
+	stub := &testutil.TwitchStub{}
+	stub.SetStreams(http.StatusOK, aliceOffline)
+	c := newTestController(t, stub, func(conf *config.Config) {
+		conf.RequireTwitchLive = false
+		conf.AllowedApps = nil
+		conf.LiveGracePeriod = 0
+		conf.PublishDenyLimit = 0
+		conf.NegativeCacheTTL = 0
+		conf.AllowCacheTTL = 0
+		conf.DenyStatusCode = http.StatusUnauthorized
+	})
+	createPublisher(t, c, `{"name":"alice","key":"secret","twitch_stream":"alice"}`)
+
+	// requiring the live check denies alice, who is not live. A publish may
+	// read the configuration more than once, so both share the deny status.
+	lenient, strict := *c.Config, *c.Config
+	strict.RequireTwitchLive = true
+
+	done := make(chan struct{})
+	swapped := make(chan struct{})
+	go func() {
+		defer close(swapped)
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			// a new copy each time, as the configuration is not modified once in use
+			next := lenient
+			if i%2 == 0 {
+				next = strict
+			}
+			c.SetConfig(&next)
+		}
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				status := publish(c, "alice", "secret")
+				if status != http.StatusCreated && status != http.StatusUnauthorized {
+					t.Errorf("publish while the configuration is replaced: got %d", status)
+				}
+				serve(c.PublisherAPIHandler, "GET", "/api/publisher", "")
+				serve(c.StatusHandler, "GET", "/api/status", "")
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	<-swapped
+
+	c.SetConfig(&strict)
+	if status := publish(c, "alice", "secret"); status != http.StatusUnauthorized {
+		t.Fatalf("publish after replacing the configuration: got %d, want %d", status, http.StatusUnauthorized)
+	}
+	c.SetConfig(&lenient)
+	if status := publish(c, "alice", "secret"); status != http.StatusCreated {
+		t.Fatalf("publish after restoring the configuration: got %d, want %d", status, http.StatusCreated)
+	}
+}
@@ -0,0 +1,73 @@
+package controllers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MaintenanceResponse reports whether maintenance mode is active
+type MaintenanceResponse struct {
+	Enabled bool `json:"enabled"`
+}
+
+// SetMaintenance enables or disables maintenance mode. While enabled, any
+// enabled publisher with a valid key may publish regardless of platform
+// live status.
+func (c *Controller) SetMaintenance(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+		log.Warn("MAINTENANCE MODE ENABLED: platform live checks are skipped for all publishers")
+	} else {
+		log.Warn("maintenance mode disabled")
+	}
+	atomic.StoreInt32(&c.maintenance, v)
+}
+
+// maintenanceActive returns true while maintenance mode is enabled
+func (c *Controller) maintenanceActive() bool {
+	return atomic.LoadInt32(&c.maintenance) == 1
+}
+
+// MaintenanceAPIHandler is the http handler for "/api/maintenance"
+func (c *Controller) MaintenanceAPIHandler(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
+
+	w.Header().Add("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+	case "POST":
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			logger.Debug("error reading POST body: ", err)
+			writeJSONError(w, http.StatusBadRequest, codeBadRequest, err.Error())
+			return
+		}
+		var m MaintenanceResponse
+		err = json.Unmarshal(body, &m)
+		if err != nil {
+			logger.Debug("error unmarshaling body json: ", err)
+			writeJSONError(w, http.StatusBadRequest, codeBadRequest, err.Error())
+			return
+		}
+		logger.Infof("maintenance mode requested: %t", m.Enabled)
+		c.SetMaintenance(m.Enabled)
+	default:
+		logger.Debug(http.StatusNotImplemented)
+		writeStatusError(w, http.StatusNotImplemented)
+		return
+	}
+
+	content, err := json.Marshal(MaintenanceResponse{Enabled: c.maintenanceActive()})
+	if err != nil {
+		logger.Debug(err)
+		writeStatusError(w, http.StatusInternalServerError)
+		return
+	}
+	w.Write(content)
+}
@@ -0,0 +1,50 @@
+package controllers
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/bcambl/rtmpauthbot/config"
+	"github.com/bcambl/rtmpauthbot/internal/testutil"
+)
+
+func TestMaintenanceMode(t *testing.T) {
+	stub := &testutil.TwitchStub{}
+	stub.SetStreams(http.StatusOK, aliceOffline)
+	c := newTestController(t, stub, func(conf *config.Config) {
+		conf.RequireTwitchLive = true
+		conf.LiveGracePeriod = 0
+		conf.NegativeCacheTTL = 0
+		conf.PublishDenyLimit = 0
+		conf.HidePublisherExistence = false
+	})
+	createPublisher(t, c, `{"name":"alice","key":"secret","twitch_stream":"alice"}`)
+	createPublisher(t, c, `{"name":"bob","key":"secret","enabled":false}`)
+
+	tests := []struct {
+		maintenance bool
+		name, key   string
+		want        int
+	}{
+		{false, "alice", "secret", c.Config.DenyStatusCode},
+		{true, "alice", "secret", http.StatusCreated},
+		// keys & disabled publishers still apply
+		{true, "alice", "wrong", c.Config.DenyStatusCode},
+		{true, "bob", "secret", c.Config.DenyStatusCode},
+		{false, "alice", "secret", c.Config.DenyStatusCode},
+	}
+	for _, test := range tests {
+		body := `{"enabled":false}`
+		if test.maintenance {
+			body = `{"enabled":true}`
+		}
+		w := serve(c.MaintenanceAPIHandler, "POST", "/api/maintenance", body)
+		if w.Code != http.StatusOK || w.Body.String() != body {
+			t.Fatalf("POST /api/maintenance %s: got %d %s", body, w.Code, w.Body.String())
+		}
+		if status := publish(c, test.name, test.key); status != test.want {
+			t.Errorf("maintenance %t: publish %s with key %s: got %d, want %d",
+				test.maintenance, test.name, test.key, status, test.want)
+		}
+	}
+}
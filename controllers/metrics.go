@@ -0,0 +1,224 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Publish deny reasons reported by the rtmpauthd_deny_total metric
+const (
+	denyKeyMismatch       = "key_mismatch"
+	denyAppMismatch       = "app_mismatch"
+	denyAppNotAllowed     = "app_not_allowed"
+	denyNotFound          = "not_found"
+	denyNotLive           = "not_live"
+	denyDisabled          = "disabled"
+	denyInactive          = "inactive"
+	denyRateLimited       = "rate_limited"
+	denyTwitchUnavailable = "twitch_unavailable"
+	denyOther             = "other"
+)
+
+// denyReasons are always exported so that every series exists from startup
+var denyReasons = []string{
+	denyKeyMismatch, denyAppMismatch, denyAppNotAllowed, denyNotFound, denyNotLive, denyDisabled,
+	denyInactive, denyRateLimited, denyTwitchUnavailable, denyOther,
+}
+
+// denyReason maps a publish deny error to its metric label
+func denyReason(err error) string {
+	switch {
+	case errors.Is(err, ErrKeyMismatch):
+		return denyKeyMismatch
+	case errors.Is(err, ErrAppMismatch):
+		return denyAppMismatch
+	case errors.Is(err, ErrPublisherNotFound):
+		return denyNotFound
+	case errors.Is(err, ErrNotLive):
+		return denyNotLive
+	case errors.Is(err, ErrDisabled):
+		return denyDisabled
+	case errors.Is(err, ErrInactive):
+		return denyInactive
+	case errors.Is(err, ErrRateLimited):
+		return denyRateLimited
+	case errors.Is(err, ErrTwitchUnavailable):
+		return denyTwitchUnavailable
+	default:
+		return denyOther
+	}
+}
+
+// counterVec is a concurrency safe set of counters by label value
+type counterVec struct {
+	mu     sync.Mutex
+	values map[string]uint64
+}
+
+// Inc increments the counter of a label value
+func (v *counterVec) Inc(label string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.values == nil {
+		v.values = make(map[string]uint64)
+	}
+	v.values[label]++
+}
+
+// snapshot returns the current counters, including zero counters for the
+// provided labels
+func (v *counterVec) snapshot(labels []string) map[string]uint64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	values := make(map[string]uint64, len(labels)+len(v.values))
+	for _, label := range labels {
+		values[label] = 0
+	}
+	for label, value := range v.values {
+		values[label] = value
+	}
+	return values
+}
+
+// Nginx callbacks reported by the rtmpauthd_db_write_errors_total metric
+const (
+	callbackPublish     = "on_publish"
+	callbackPublishDone = "on_publish_done"
+)
+
+// writeCallbacks are always exported so that every series exists from startup
+var writeCallbacks = []string{callbackPublish, callbackPublishDone}
+
+// Twitch api endpoints reported by the twitch request duration metric
+const (
+	twitchStreams  = "streams"
+	twitchGames    = "games"
+	twitchUsers    = "users"
+	twitchToken    = "token"
+	twitchValidate = "validate"
+)
+
+// twitchEndpoints are always exported so that every series exists from startup
+var twitchEndpoints = []string{twitchStreams, twitchGames, twitchUsers, twitchToken, twitchValidate}
+
+// latencyBuckets are the histogram upper bounds in seconds, up to the default
+// AUTH_DEADLINE_SECONDS
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// histogram counts observations by latencyBuckets
+type histogram struct {
+	buckets []uint64 // non cumulative, the last counts observations above every bound
+	sum     float64
+	count   uint64
+}
+
+// histogramVec is a concurrency safe set of latency histograms by label value
+type histogramVec struct {
+	mu     sync.Mutex
+	values map[string]*histogram
+}
+
+// Observe records a duration for a label value
+func (v *histogramVec) Observe(label string, d time.Duration) {
+	seconds := d.Seconds()
+	i := sort.SearchFloat64s(latencyBuckets, seconds)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.values == nil {
+		v.values = make(map[string]*histogram)
+	}
+	h, ok := v.values[label]
+	if !ok {
+		h = &histogram{buckets: make([]uint64, len(latencyBuckets)+1)}
+		v.values[label] = h
+	}
+	h.buckets[i]++
+	h.sum += seconds
+	h.count++
+}
+
+// snapshot returns copies of the current histograms, including empty
+// histograms for the provided labels
+func (v *histogramVec) snapshot(labels []string) map[string]histogram {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	values := make(map[string]histogram, len(labels)+len(v.values))
+	for _, label := range labels {
+		values[label] = histogram{buckets: make([]uint64, len(latencyBuckets)+1)}
+	}
+	for label, h := range v.values {
+		values[label] = histogram{
+			buckets: append([]uint64(nil), h.buckets...),
+			sum:     h.sum,
+			count:   h.count,
+		}
+	}
+	return values
+}
+
+// timeTwitch records the duration of a twitch api request since start
+func (c *Controller) timeTwitch(endpoint string, start time.Time) {
+	c.twitchLatency.Observe(endpoint, time.Since(start))
+}
+
+// writeCounterVec writes a counter in the prometheus text format
+func writeCounterVec(b *strings.Builder, name, help, label string, values map[string]uint64) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(b, "%s{%s=%q} %d\n", name, label, k, values[k])
+	}
+}
+
+// writeHistogramVec writes a histogram in the prometheus text format
+func writeHistogramVec(b *strings.Builder, name, help, label string, values map[string]histogram) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		h := values[k]
+		var cumulative uint64
+		for i, bound := range latencyBuckets {
+			cumulative += h.buckets[i]
+			fmt.Fprintf(b, "%s_bucket{%s=%q,le=\"%g\"} %d\n", name, label, k, bound, cumulative)
+		}
+		fmt.Fprintf(b, "%s_bucket{%s=%q,le=\"+Inf\"} %d\n", name, label, k, h.count)
+		fmt.Fprintf(b, "%s_sum{%s=%q} %g\n", name, label, k, h.sum)
+		fmt.Fprintf(b, "%s_count{%s=%q} %d\n", name, label, k, h.count)
+	}
+}
+
+// MetricsHandler is the http handler for "/metrics", exporting the metrics
+// in the prometheus text format
+func (c *Controller) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
+
+	if r.Method != "GET" {
+		logger.Debug(http.StatusNotImplemented)
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	var b strings.Builder
+	writeCounterVec(&b, "rtmpauthd_deny_total", "Publishes denied by reason.",
+		"reason", c.denies.snapshot(denyReasons))
+	writeCounterVec(&b, "rtmpauthd_db_write_errors_total", "Failed database writes of allowed nginx callbacks.",
+		"callback", c.dbWriteErrors.snapshot(writeCallbacks))
+	writeHistogramVec(&b, "rtmpauthd_twitch_request_duration_seconds", "Duration of twitch api requests by endpoint.",
+		"endpoint", c.twitchLatency.snapshot(twitchEndpoints))
+
+	w.Header().Add("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(b.String()))
+}
@@ -0,0 +1,179 @@
+package controllers
+
+import (
+	"bufio"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bcambl/rtmpauthbot/config"
+	"github.com/bcambl/rtmpauthbot/internal/testutil"
+	bolt "go.etcd.io/bbolt"
+)
+
+// scrape returns the samples exported by the metrics handler by series, e.g.
+// `rtmpauthd_deny_total{reason="not_live"}`
+func scrape(t *testing.T, c *Controller) map[string]float64 {
+	t.Helper()
+	w := serve(c.MetricsHandler, "GET", "/metrics", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("metrics: got %d, want %d", w.Code, http.StatusOK)
+	}
+	samples := make(map[string]float64)
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		if i < 0 || err != nil {
+			t.Fatalf("invalid sample: %q", line)
+		}
+		samples[line[:i]] = value
+	}
+	return samples
+}
+
+func TestDenyMetric(t *testing.T) {
+	stub := &testutil.TwitchStub{}
+	stub.SetStreams(http.StatusOK, aliceOffline)
+	c := newTestController(t, stub, func(conf *config.Config) {
+		conf.RequireTwitchLive = true
+		conf.LiveGracePeriod = 0
+		conf.NegativeCacheTTL = 0
+		conf.PublishDenyLimit = 0
+		conf.AllowedApps = []string{"stream"}
+	})
+	createPublisher(t, c, `{"name":"alice","key":"secret","twitch_stream":"alice"}`)
+	createPublisher(t, c, `{"name":"bob","key":"secret","enabled":false}`)
+
+	// every reason is exported from startup
+	samples := scrape(t, c)
+	for _, reason := range denyReasons {
+		series := `rtmpauthd_deny_total{reason="` + reason + `"}`
+		if value, ok := samples[series]; !ok || value != 0 {
+			t.Errorf("%s: got %v (exported: %t), want 0", series, value, ok)
+		}
+	}
+
+	publish(c, "alice", "wrong")
+	publish(c, "alice", "wrong")
+	publish(c, "alice", "secret")
+	publish(c, "bob", "secret")
+	publish(c, "nobody", "secret")
+	publishApp(c, "alice", "secret", "other")
+
+	want := map[string]float64{
+		denyKeyMismatch:   2,
+		denyNotLive:       1,
+		denyDisabled:      1,
+		denyNotFound:      1,
+		denyAppNotAllowed: 1,
+	}
+	samples = scrape(t, c)
+	for _, reason := range denyReasons {
+		series := `rtmpauthd_deny_total{reason="` + reason + `"}`
+		if samples[series] != want[reason] {
+			t.Errorf("%s: got %v, want %v", series, samples[series], want[reason])
+		}
+	}
+}
+
+func TestTwitchLatencyMetric(t *testing.T) {
+	stub := &testutil.TwitchStub{}
+	stub.SetStreams(http.StatusOK, aliceLive)
+	c := newTestController(t, stub, func(conf *config.Config) {
+		conf.NegativeCacheTTL = 0
+	})
+
+	// every endpoint is exported from startup
+	samples := scrape(t, c)
+	for _, endpoint := range twitchEndpoints {
+		series := `rtmpauthd_twitch_request_duration_seconds_count{endpoint="` + endpoint + `"}`
+		if value, ok := samples[series]; !ok || value != 0 {
+			t.Errorf("%s: got %v (exported: %t), want 0", series, value, ok)
+		}
+	}
+
+	stub.Delay(testutil.TwitchStreams, 300*time.Millisecond)
+	_, _, err := c.lookupTwitchLive("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples = scrape(t, c)
+	streams := func(suffix, le string) float64 {
+		labels := `endpoint="streams"`
+		if le != "" {
+			labels += `,le="` + le + `"`
+		}
+		return samples["rtmpauthd_twitch_request_duration_seconds_"+suffix+"{"+labels+"}"]
+	}
+	// the buckets are cumulative
+	want := map[string]float64{"0.05": 0, "0.1": 0, "0.25": 0, "0.5": 1, "1": 1, "10": 1, "+Inf": 1}
+	for le, count := range want {
+		if got := streams("bucket", le); got != count {
+			t.Errorf("streams bucket le=%s: got %v, want %v", le, got, count)
+		}
+	}
+	if count := streams("count", ""); count != 1 {
+		t.Errorf("streams count: got %v, want 1", count)
+	}
+	if sum := streams("sum", ""); sum < 0.3 || sum >= 0.5 {
+		t.Errorf("streams sum: got %v, want the delay of 0.3s", sum)
+	}
+	series := `rtmpauthd_twitch_request_duration_seconds_count{endpoint="token"}`
+	if samples[series] != 1 {
+		t.Errorf("%s: got %v, want 1", series, samples[series])
+	}
+}
+
+func TestDBWriteErrorsMetric(t *testing.T) {
+	c := newTestController(t, &testutil.TwitchStub{}, func(conf *config.Config) {
+		conf.RequireTwitchLive = false
+		conf.AllowedApps = nil
+		conf.PublishDenyLimit = 0
+	})
+	createPublisher(t, c, `{"name":"alice","key":"secret"}`)
+
+	// every callback is exported from startup
+	samples := scrape(t, c)
+	for _, callback := range writeCallbacks {
+		series := `rtmpauthd_db_write_errors_total{callback="` + callback + `"}`
+		if value, ok := samples[series]; !ok || value != 0 {
+			t.Errorf("%s: got %v (exported: %t), want 0", series, value, ok)
+		}
+	}
+
+	// reopen the database read only so that every write fails
+	path := c.DB.Path()
+	err := c.DB.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.DB, err = bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.DB.Close() })
+
+	// the callbacks still succeed
+	if status := publish(c, "alice", "secret"); status != http.StatusCreated {
+		t.Fatalf("publish with failing writes: got %d, want %d", status, http.StatusCreated)
+	}
+	form := url.Values{"name": {"alice"}, "key": {"secret"}, "app": {"stream"}}
+	serve(c.OnPublishDoneHandler, "POST", "/on_publish_done", form.Encode())
+
+	// each callback makes four writes
+	samples = scrape(t, c)
+	for _, callback := range writeCallbacks {
+		series := `rtmpauthd_db_write_errors_total{callback="` + callback + `"}`
+		if samples[series] != 4 {
+			t.Errorf("%s: got %v, want 4", series, samples[series])
+		}
+	}
+}
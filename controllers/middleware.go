@@ -0,0 +1,216 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// requestIDHeader is the header used to propagate the correlation id
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength limits the size of a propagated correlation id
+const maxRequestIDLength = 128
+
+type contextKey string
+
+const (
+	requestIDKey contextKey = "request_id"
+	clientIPKey  contextKey = "client_ip"
+)
+
+// RequestIDMiddleware assigns every request a correlation id, propagating
+// the X-Request-ID header when provided, and echoes it back in the response
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		ctx := context.WithValue(r.Context(), requestIDKey, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// readOnlyCallbacks are the nginx callbacks served by a read-only server,
+// which skip their database writes (see Config.ReadOnlyDB). on_record_done
+// only records a path, so it is rejected.
+var readOnlyCallbacks = map[string]bool{
+	"/on_publish":      true,
+	"/on_publish_done": true,
+	"/on_play":         true,
+	"/on_play_done":    true,
+	"/on_update":       true,
+}
+
+// ReadOnlyMiddleware rejects every request which may modify the database
+// with 405 so that a read-only server only serves reads & the nginx
+// callbacks in readOnlyCallbacks. It must be applied within the base path.
+func ReadOnlyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" && !(r.Method == "POST" && readOnlyCallbacks[r.URL.Path]) {
+			requestLogger(r).Debugf("read-only database: rejecting %s %s", r.Method, r.URL.Path)
+			w.Header().Set("Allow", "GET, HEAD")
+			writeJSONError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "read-only database")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ClientIPMiddleware records the client ip of every request. X-Forwarded-For
+// is only used when the request arrives from one of the trusted proxies.
+func ClientIPMiddleware(trusted []*net.IPNet, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r, trusted)
+		ctx := context.WithValue(r.Context(), clientIPKey, ip)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// clientIP returns the ip of the client which made the request. When the
+// peer is a trusted proxy, X-Forwarded-For is walked from the right and the
+// first untrusted hop is returned so that clients cannot spoof their ip by
+// prepending entries to the header.
+func clientIP(r *http.Request, trusted []*net.IPNet) string {
+	peer := normalizeIP(r.RemoteAddr)
+	if peer == "" {
+		return r.RemoteAddr
+	}
+	if !ipTrusted(peer, trusted) {
+		return peer
+	}
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(header, ",") {
+			hops = append(hops, normalizeIP(hop))
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if hops[i] == "" {
+			// a malformed hop cannot be trusted past
+			return peer
+		}
+		if !ipTrusted(hops[i], trusted) {
+			return hops[i]
+		}
+	}
+	if len(hops) > 0 {
+		return hops[0]
+	}
+	return peer
+}
+
+// normalizeIP returns the canonical form of an ip address which may include a
+// port ("[::1]:8080", "127.0.0.1:8080"), brackets or an ipv6 zone, or an
+// empty string when it is not an ip address. IPv4-mapped ipv6 addresses are
+// returned in their ipv4 form so that they match ipv4 networks & log lines.
+func normalizeIP(addr string) string {
+	addr = strings.TrimSpace(addr)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	addr = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	if i := strings.LastIndex(addr, "%"); i >= 0 {
+		addr = addr[:i]
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// ipTrusted returns true when the ip is within one of the trusted networks
+func ipTrusted(ip string, trusted []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range trusted {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCallbackForm parses the form of an nginx callback. Bodies larger than
+// CALLBACK_MAX_BODY_BYTES are answered with 413 and false is returned, so
+// that a large body cannot exhaust memory.
+func (c *Controller) parseCallbackForm(w http.ResponseWriter, r *http.Request) bool {
+	limit := c.cfg().CallbackMaxBodyBytes
+	oversized := r.ContentLength > limit
+	if !oversized {
+		// read past the limit to tell an oversized body from one at the limit
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, limit+1))
+		if err != nil {
+			requestLogger(r).Debug("error reading callback body: ", err)
+		}
+		oversized = int64(len(body)) > limit
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	if oversized {
+		requestLogger(r).Warnf("%s rejected: body exceeds %d bytes", r.URL.Path, limit)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return false
+	}
+	r.ParseForm()
+	return true
+}
+
+// requestClientIP returns the client ip recorded by ClientIPMiddleware
+func requestClientIP(r *http.Request) string {
+	ip, _ := r.Context().Value(clientIPKey).(string)
+	return ip
+}
+
+// requestID returns the correlation id of a request
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey).(string)
+	return id
+}
+
+// requestLogger returns a logger which includes the request correlation id
+// and client ip
+func requestLogger(r *http.Request) *log.Entry {
+	return log.WithFields(log.Fields{
+		"request_id": requestID(r),
+		"client_ip":  requestClientIP(r),
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		log.Error("error generating request id: ", err)
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// validRequestID ensures a propagated id is safe to include in logs & headers
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, ch := range id {
+		switch {
+		case ch >= 'a' && ch <= 'z', ch >= 'A' && ch <= 'Z', ch >= '0' && ch <= '9':
+		case ch == '-', ch == '_', ch == '.', ch == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
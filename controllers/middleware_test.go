@@ -0,0 +1,308 @@
+package controllers
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bcambl/rtmpauthbot/config"
+	"github.com/bcambl/rtmpauthbot/internal/testutil"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestRequestID(t *testing.T) {
+	c := newTestController(t, &testutil.TwitchStub{}, func(conf *config.Config) {
+		conf.RequireTwitchLive = false
+		conf.AllowedApps = nil
+	})
+	createPublisher(t, c, `{"name":"alice","key":"secret"}`)
+	handler := RequestIDMiddleware(http.HandlerFunc(c.OnPublishHandler))
+
+	tests := []struct {
+		header     string
+		propagated bool
+	}{
+		{"nginx-1234", true},
+		{"", false},
+		{"invalid id\r\n", false},
+	}
+	for _, test := range tests {
+		hook := captureLogs(t)
+		form := url.Values{"name": {"alice"}, "key": {"secret"}, "app": {"stream"}}
+		r := httptest.NewRequest("POST", "/on_publish", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if test.header != "" {
+			r.Header.Set(requestIDHeader, test.header)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("publish: got %d, want %d", w.Code, http.StatusCreated)
+		}
+
+		id := w.Header().Get(requestIDHeader)
+		if !validRequestID(id) {
+			t.Fatalf("%q: invalid response id %q", test.header, id)
+		}
+		if (id == test.header) != test.propagated {
+			t.Errorf("%q: response id %q, propagated %t", test.header, id, test.propagated)
+		}
+		logged := false
+		for _, entry := range hook.AllEntries() {
+			if entry.Message == "on_publish authorized: alice" {
+				logged = true
+				if entry.Data["request_id"] != id {
+					t.Errorf("%q: logged request id %v, want %s", test.header, entry.Data["request_id"], id)
+				}
+			}
+		}
+		if !logged {
+			t.Errorf("%q: the authorized publish was not logged", test.header)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	var trusted []*net.IPNet
+	for _, cidr := range []string{"10.0.0.0/8", "::1/128"} {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		trusted = append(trusted, n)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        []string
+		want       string
+	}{
+		{"untrusted peer without xff", "203.0.113.7:5000", nil, "203.0.113.7"},
+		{"untrusted peer's xff is ignored", "203.0.113.7:5000", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"trusted peer without xff", "10.0.0.1:5000", nil, "10.0.0.1"},
+		{"trusted peer", "10.0.0.1:5000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"trusted ipv6 peer", "[::1]:5000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"rightmost untrusted hop", "10.0.0.1:5000", []string{"192.0.2.66, 198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{"rightmost untrusted hop across headers", "10.0.0.1:5000", []string{"192.0.2.66", "198.51.100.1", "10.0.0.2"}, "198.51.100.1"},
+		{"all hops trusted", "10.0.0.1:5000", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"malformed xff", "10.0.0.1:5000", []string{"not-an-ip"}, "10.0.0.1"},
+		{"malformed hop is not trusted past", "10.0.0.1:5000", []string{"192.0.2.66, garbage, 10.0.0.2"}, "10.0.0.1"},
+		{"empty xff", "10.0.0.1:5000", []string{""}, "10.0.0.1"},
+		{"hop with a port", "10.0.0.1:5000", []string{"198.51.100.1:4711"}, "198.51.100.1"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remoteAddr
+		for _, xff := range test.xff {
+			r.Header.Add("X-Forwarded-For", xff)
+		}
+		if got := clientIP(r, trusted); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestNormalizeIP(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"203.0.113.7", "203.0.113.7"},
+		{"203.0.113.7:5000", "203.0.113.7"},
+		{" 203.0.113.7 ", "203.0.113.7"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"2001:DB8:0:0:0:0:0:1", "2001:db8::1"},
+		{"[2001:db8::1]", "2001:db8::1"},
+		{"[2001:db8::1]:1935", "2001:db8::1"},
+		{"::1", "::1"},
+		{"[::1]:5000", "::1"},
+		{"fe80::1%eth0", "fe80::1"},
+		{"[fe80::1%eth0]:5000", "fe80::1"},
+		{"::ffff:198.51.100.1", "198.51.100.1"},
+		{"[::ffff:198.51.100.1]:5000", "198.51.100.1"},
+		{"", ""},
+		{"unix", ""},
+		{"rtmp.example:1935", ""},
+		{"203.0.113.256", ""},
+	}
+	for _, test := range tests {
+		if got := normalizeIP(test.addr); got != test.want {
+			t.Errorf("normalizeIP(%q): got %q, want %q", test.addr, got, test.want)
+		}
+	}
+}
+
+func TestClientIPv6(t *testing.T) {
+	var trusted []*net.IPNet
+	for _, cidr := range []string{"10.0.0.0/8", "2001:db8:1::/48"} {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		trusted = append(trusted, n)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        string
+		want       string
+	}{
+		{"untrusted ipv6 peer", "[2001:db8::2]:5000", "198.51.100.1", "2001:db8::2"},
+		{"trusted ipv6 proxy", "[2001:db8:1::1]:443", "2001:db8::7", "2001:db8::7"},
+		{"trusted ipv6 proxy chain", "[2001:db8:1::1]:443", "2001:db8::7, [2001:db8:1::2]:80", "2001:db8::7"},
+		{"ipv4 mapped peer within an ipv4 network", "[::ffff:10.0.0.1]:5000", "2001:db8::7", "2001:db8::7"},
+		{"zoned peer", "[fe80::1%eth0]:5000", "198.51.100.1", "fe80::1"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remoteAddr
+		r.Header.Set("X-Forwarded-For", test.xff)
+		if got := clientIP(r, trusted); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestPublishIPv6Addr(t *testing.T) {
+	c := newTestController(t, &testutil.TwitchStub{}, func(conf *config.Config) {
+		conf.RequireTwitchLive = false
+		conf.AllowedApps = nil
+		conf.DiscordEnabled = false
+	})
+	createPublisher(t, c, `{"name":"alice","key":"secret"}`)
+	form := url.Values{"name": {"alice"}, "key": {"secret"}, "app": {"stream"}, "addr": {"[2001:DB8::1]:50312"}}
+	if w := serve(c.OnPublishHandler, "POST", "/on_publish", form.Encode()); w.Code != http.StatusCreated {
+		t.Fatalf("publish from ipv6: got %d, want %d", w.Code, http.StatusCreated)
+	}
+	sessions, err := c.activeSessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].Addr != "2001:db8::1" {
+		t.Errorf("sessions: got %+v, want alice from 2001:db8::1", sessions)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	c := newTestController(t, &testutil.TwitchStub{}, func(conf *config.Config) {
+		conf.RequireTwitchLive = false
+		conf.AllowedApps = nil
+		conf.DiscordEnabled = false
+		conf.ReadOnlyDB = true
+	})
+	createPublisher(t, c, `{"name":"alice","key":"secret"}`)
+	// reopen the database as a read-only server does
+	c.DB.Close()
+	db, err := bolt.Open(c.Config.DatabasePath, 0600, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	c = &Controller{Config: c.Config, DB: db}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/on_publish", c.OnPublishHandler)
+	mux.HandleFunc("/on_publish_done", c.OnPublishDoneHandler)
+	mux.HandleFunc("/on_update", c.OnUpdateHandler)
+	mux.HandleFunc("/on_record_done", c.OnRecordDoneHandler)
+	mux.HandleFunc("/api/publisher", c.PublisherAPIHandler)
+	handler := ReadOnlyMiddleware(mux)
+	hook := captureLogs(t)
+	request := func(method, target, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		if strings.HasPrefix(target, "/on_") {
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// the callbacks are served without writing
+	form := url.Values{"name": {"alice"}, "key": {"secret"}, "app": {"stream"}}.Encode()
+	for _, target := range []string{"/on_publish", "/on_update", "/on_publish_done"} {
+		if w := request("POST", target, form); w.Code != http.StatusCreated {
+			t.Errorf("%s: got %d, want %d", target, w.Code, http.StatusCreated)
+		}
+	}
+	if w := request("POST", "/on_publish", url.Values{"name": {"alice"}, "key": {"wrong"}}.Encode()); w.Code != c.Config.DenyStatusCode {
+		t.Errorf("/on_publish with a wrong key: got %d, want %d", w.Code, c.Config.DenyStatusCode)
+	}
+	for _, entry := range hook.AllEntries() {
+		if entry.Level <= log.WarnLevel && strings.Contains(entry.Message, "error") {
+			t.Errorf("callback attempted a write: %s", entry.Message)
+		}
+	}
+	if n := len(c.dbWriteErrors.snapshot(nil)); n != 0 {
+		t.Errorf("%d callbacks counted database write errors", n)
+	}
+
+	// mutating calls fail cleanly
+	for _, test := range []struct{ method, target, body string }{
+		{"POST", "/api/publisher", `{"name":"bob","key":"secret"}`},
+		{"DELETE", "/api/publisher", `{"name":"alice"}`},
+		{"POST", "/on_record_done", url.Values{"name": {"alice"}, "path": {"/tmp/alice.flv"}}.Encode()},
+	} {
+		w := request(test.method, test.target, test.body)
+		if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET, HEAD" {
+			t.Errorf("%s %s: got %d (Allow: %s), want %d", test.method, test.target,
+				w.Code, w.Header().Get("Allow"), http.StatusMethodNotAllowed)
+		}
+		if !strings.Contains(w.Body.String(), `"code":"method_not_allowed"`) {
+			t.Errorf("%s %s: got %s, want a json error", test.method, test.target, w.Body.String())
+		}
+	}
+	if w := request("GET", "/api/publisher?name=alice", ""); w.Code != http.StatusOK {
+		t.Errorf("GET /api/publisher: got %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestCallbackMaxBodyBytes(t *testing.T) {
+	const limit = 256
+	c := newTestController(t, &testutil.TwitchStub{}, func(conf *config.Config) {
+		conf.RequireTwitchLive = false
+		conf.AllowedApps = nil
+		conf.CallbackMaxBodyBytes = limit
+	})
+	createPublisher(t, c, `{"name":"alice","key":"secret"}`)
+
+	// body returns a valid callback form of exactly size bytes
+	body := func(size int) string {
+		form := url.Values{"name": {"alice"}, "key": {"secret"}, "app": {"stream"}}.Encode() + "&pad="
+		return form + strings.Repeat("x", size-len(form))
+	}
+	handlers := map[string]http.HandlerFunc{
+		"/on_publish":      c.OnPublishHandler,
+		"/on_publish_done": c.OnPublishDoneHandler,
+		"/on_update":       c.OnUpdateHandler,
+	}
+	for target, handler := range handlers {
+		// with & without a content length, as with a chunked body
+		for _, known := range []bool{true, false} {
+			for _, size := range []int{limit, limit + 1} {
+				r := httptest.NewRequest("POST", target, strings.NewReader(body(size)))
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				if !known {
+					r.ContentLength = -1
+				}
+				w := httptest.NewRecorder()
+				handler(w, r)
+				want := http.StatusCreated
+				if size > limit {
+					want = http.StatusRequestEntityTooLarge
+				}
+				if w.Code != want {
+					t.Errorf("%s with a %d byte body (content length known: %t): got %d, want %d",
+						target, size, known, w.Code, want)
+				}
+			}
+		}
+	}
+}
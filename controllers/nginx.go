@@ -0,0 +1,150 @@
+package controllers
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// nginxStatTimeout limits each request for the nginx-rtmp stat page
+const nginxStatTimeout = 5 * time.Second
+
+// NginxStat is the subset of the nginx-rtmp stat page (rtmp_stat all) used
+// to find the streams which are being published
+type NginxStat struct {
+	Servers []struct {
+		Applications []struct {
+			Name    string        `xml:"name"`
+			Streams []NginxStream `xml:"live>stream"`
+		} `xml:"application"`
+	} `xml:"server"`
+}
+
+// NginxStream is a stream of an nginx-rtmp application
+type NginxStream struct {
+	App        string    `xml:"-"`
+	Name       string    `xml:"name"`
+	Clients    int       `xml:"nclients"`
+	Publishing *struct{} `xml:"publishing"`
+	Active     *struct{} `xml:"active"`
+}
+
+// parseNginxStat returns the streams of the stat page which are actively
+// being published
+func parseNginxStat(body []byte) ([]NginxStream, error) {
+	var stat NginxStat
+	err := xml.Unmarshal(body, &stat)
+	if err != nil {
+		return nil, err
+	}
+	streams := []NginxStream{}
+	for _, server := range stat.Servers {
+		for _, app := range server.Applications {
+			for _, stream := range app.Streams {
+				if stream.Publishing == nil || stream.Active == nil {
+					continue
+				}
+				stream.App = app.Name
+				streams = append(streams, stream)
+			}
+		}
+	}
+	return streams, nil
+}
+
+// nginxSource reads the nginx-rtmp stat page to find the publishers which are
+// actually streaming to the rtmp server, regardless of any platform. Publish
+// sessions found on the stat page count as seen for SESSION_TTL. The live
+// streams of the last poll are kept in memory.
+type nginxSource struct {
+	c *Controller
+
+	mu   sync.Mutex
+	live map[string]LiveStream
+}
+
+func (s *nginxSource) Name() string {
+	return "nginx"
+}
+
+func (s *nginxSource) Setup() error {
+	return nil
+}
+
+func (s *nginxSource) Poll() {
+	streams, err := s.c.getNginxStreams()
+	if err != nil {
+		// keep the last known status, nginx may be restarting
+		log.Warn("error reading nginx stat page: ", err)
+		return
+	}
+
+	now := time.Now()
+	live := make(map[string]LiveStream)
+	for _, stream := range streams {
+		p, err := s.c.getPublisher(stream.Name)
+		if err != nil {
+			continue
+		}
+		if p.app() != "" && p.app() != stream.App {
+			continue
+		}
+		viewers := stream.Clients - 1 // the publisher is also a client
+		if viewers < 0 {
+			viewers = 0
+		}
+		live[p.Name] = LiveStream{Publisher: p.Name, Platform: s.Name(), ViewerCount: viewers}
+		if p.RTMPLive == "live" {
+			err = s.c.touchSession(p.Name, now)
+			if err != nil {
+				log.Error("error recording session update: ", err)
+			}
+		}
+	}
+
+	s.mu.Lock()
+	s.live = live
+	s.mu.Unlock()
+	log.WithFields(log.Fields{"source": s.Name(), "streams": len(streams), "live": len(live)}).Info("nginx poll")
+}
+
+func (s *nginxSource) Live() ([]LiveStream, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	live := []LiveStream{}
+	for _, stream := range s.live {
+		live = append(live, stream)
+	}
+	return live, nil
+}
+
+// getNginxStreams retrieves the streams being published from the nginx-rtmp
+// stat page
+func (c *Controller) getNginxStreams() ([]NginxStream, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), nginxStatTimeout)
+	defer cancel()
+	r, err := http.NewRequestWithContext(ctx, "GET", c.cfg().NginxStatURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.httpClient().Do(r)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("nginx stat request failed: %s", resp.Status)
+	}
+	return parseNginxStat(body)
+}
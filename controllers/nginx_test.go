@@ -0,0 +1,117 @@
+package controllers
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/bcambl/rtmpauthbot/config"
+	"github.com/bcambl/rtmpauthbot/internal/testutil"
+)
+
+// nginxStatRoute is the stat page route answered by the twitch stub
+const nginxStatRoute = "nginx.example/stat"
+
+// nginxStat is a stat page with a stream being published to each app, a
+// stream which is no longer published & an idle one
+const nginxStat = `<?xml version="1.0" encoding="utf-8" ?>
+<rtmp>
+  <nginx_version>1.18.0</nginx_version>
+  <server>
+    <application>
+      <name>stream</name>
+      <live>
+        <stream>
+          <name>alice</name>
+          <nclients>3</nclients>
+          <client><id>1</id><publishing/><active/></client>
+          <publishing/>
+          <active/>
+        </stream>
+        <stream>
+          <name>bob</name>
+          <nclients>1</nclients>
+          <client><id>2</id></client>
+        </stream>
+        <stream>
+          <name>carol</name>
+          <nclients>0</nclients>
+        </stream>
+        <nclients>4</nclients>
+      </live>
+    </application>
+    <application>
+      <name>live</name>
+      <live>
+        <stream>
+          <name>dave</name>
+          <nclients>1</nclients>
+          <publishing/>
+          <active/>
+        </stream>
+      </live>
+    </application>
+  </server>
+</rtmp>`
+
+func TestParseNginxStat(t *testing.T) {
+	streams, err := parseNginxStat([]byte(nginxStat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, stream := range streams {
+		got = append(got, stream.App+"/"+stream.Name)
+	}
+	want := []string{"stream/alice", "live/dave"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("active streams: got %v, want %v", got, want)
+	}
+	if len(streams) > 0 && streams[0].Clients != 3 {
+		t.Errorf("clients of alice: got %d, want 3", streams[0].Clients)
+	}
+
+	_, err = parseNginxStat([]byte("<rtmp><server>"))
+	if err == nil {
+		t.Error("truncated stat page parsed without an error")
+	}
+}
+
+func TestNginxSource(t *testing.T) {
+	stub := &testutil.TwitchStub{}
+	status, body := http.StatusOK, nginxStat
+	stub.Handle(nginxStatRoute, func(*http.Request) (int, string) { return status, body })
+	c := newTestController(t, stub, func(conf *config.Config) {
+		conf.EnabledPlatforms = []string{"nginx"}
+		conf.NginxStatURL = "http://" + nginxStatRoute
+	})
+	createPublisher(t, c, `{"name":"alice","key":"secret"}`)
+	createPublisher(t, c, `{"name":"bob","key":"secret"}`)
+	// dave is published to another app than the one he is restricted to
+	createPublisher(t, c, `{"name":"dave","key":"secret","app":"stream"}`)
+	if !reflect.DeepEqual(c.SourceNames(), []string{"nginx"}) {
+		t.Fatalf("sources: got %v, want [nginx]", c.SourceNames())
+	}
+
+	source := c.Sources[0]
+	want := []LiveStream{{Publisher: "alice", Platform: "nginx", ViewerCount: 2}}
+	source.Poll()
+	live, err := source.Live()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(live, want) {
+		t.Errorf("live streams: got %+v, want %+v", live, want)
+	}
+
+	// nginx restarting keeps the last known status
+	status, body = http.StatusBadGateway, ""
+	source.Poll()
+	live, err = source.Live()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(live, want) {
+		t.Errorf("live streams after a failed poll: got %+v, want %+v", live, want)
+	}
+}
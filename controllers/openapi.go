@@ -0,0 +1,572 @@
+package controllers
+
+import (
+	"net/http"
+)
+
+// openAPISpec is the hand maintained OpenAPI 3 description of the http
+// endpoints. Keep it in sync with the handlers when endpoints change.
+const openAPISpec = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "rtmpauthbot",
+    "description": "Authentication & notification server for the nginx rtmp module. Error responses of the api have an APIError body.",
+    "version": "1.0.0"
+  },
+  "paths": {
+    "/api/publisher": {
+      "get": {
+        "summary": "List all publishers or retrieve a single publisher, with the stream keys & webhook urls masked unless revealed",
+        "parameters": [
+          {"name": "name", "in": "query", "description": "publisher name to retrieve", "schema": {"type": "string"}},
+          {"name": "sort", "in": "query", "description": "sort field when listing", "schema": {"type": "string", "enum": ["name", "created_at", "updated_at"]}},
+          {"name": "order", "in": "query", "description": "sort order when listing", "schema": {"type": "string", "enum": ["asc", "desc"]}},
+          {"name": "revealKey", "in": "query", "description": "include the stream keys & webhook urls", "schema": {"type": "boolean", "default": false}}
+        ],
+        "responses": {
+          "200": {
+            "description": "a publisher when name is provided, otherwise all publishers",
+            "content": {"application/json": {"schema": {"oneOf": [
+              {"$ref": "#/components/schemas/Publisher"},
+              {"type": "array", "items": {"$ref": "#/components/schemas/Publisher"}}
+            ]}}}
+          },
+          "400": {"description": "invalid sort field or revealKey"},
+          "404": {"description": "publisher not found"}
+        }
+      },
+      "post": {
+        "summary": "Create or update a publisher",
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Publisher"}}}
+        },
+        "responses": {
+          "201": {"description": "publisher created or updated"},
+          "400": {"description": "invalid publisher"},
+          "409": {"description": "MAX_PUBLISHERS reached"}
+        }
+      },
+      "delete": {
+        "summary": "Delete a publisher",
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {
+            "type": "object",
+            "required": ["name"],
+            "properties": {"name": {"type": "string"}}
+          }}}
+        },
+        "responses": {
+          "204": {"description": "publisher deleted"},
+          "404": {"description": "publisher not found"}
+        }
+      }
+    },
+    "/api/publishers/{name}": {
+      "get": {
+        "summary": "Retrieve a single publisher, with the stream key & webhook url masked unless revealed",
+        "parameters": [
+          {"name": "name", "in": "path", "required": true, "schema": {"type": "string"}},
+          {"name": "revealKey", "in": "query", "description": "include the stream key & webhook url", "schema": {"type": "boolean", "default": false}}
+        ],
+        "responses": {
+          "200": {
+            "description": "the publisher",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Publisher"}}}
+          },
+          "400": {"description": "invalid revealKey"},
+          "404": {"description": "publisher not found"}
+        }
+      },
+      "put": {
+        "summary": "Create or update a publisher, the name defaults to the path",
+        "parameters": [
+          {"name": "name", "in": "path", "required": true, "schema": {"type": "string"}}
+        ],
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Publisher"}}}
+        },
+        "responses": {
+          "200": {
+            "description": "publisher updated",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Publisher"}}}
+          },
+          "201": {
+            "description": "publisher created",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Publisher"}}}
+          },
+          "400": {"description": "invalid publisher or name does not match the path"},
+          "409": {"description": "MAX_PUBLISHERS reached"}
+        }
+      }
+    },
+    "/api/publishers/{name}/policy": {
+      "get": {
+        "summary": "Retrieve the effective publish policy of a publisher, including the global settings which apply",
+        "parameters": [
+          {"name": "name", "in": "path", "required": true, "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {
+            "description": "the effective policy",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/PublisherPolicy"}}}
+          },
+          "404": {"description": "publisher not found"}
+        }
+      }
+    },
+    "/api/publishers/sync": {
+      "post": {
+        "summary": "Reconcile the publishers to match the provided list, creating, updating & deleting publishers",
+        "parameters": [
+          {"name": "prune", "in": "query", "description": "delete publishers which are not listed", "schema": {"type": "boolean", "default": true}}
+        ],
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Publisher"}}}}
+        },
+        "responses": {
+          "200": {
+            "description": "changes made",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/SyncResponse"}}}
+          },
+          "400": {"description": "invalid publishers"},
+          "409": {"description": "MAX_PUBLISHERS would be exceeded"}
+        }
+      }
+    },
+    "/api/tags/{tag}/{action}": {
+      "post": {
+        "summary": "Enable or disable all publishers carrying a tag",
+        "parameters": [
+          {"name": "tag", "in": "path", "required": true, "schema": {"type": "string"}},
+          {"name": "action", "in": "path", "required": true, "schema": {"type": "string", "enum": ["enable", "disable"]}}
+        ],
+        "responses": {
+          "200": {
+            "description": "number of publishers affected",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/TagResponse"}}}
+          }
+        }
+      }
+    },
+    "/api/token/status": {
+      "get": {
+        "summary": "Status of the cached twitch access token of each twitch client",
+        "responses": {
+          "200": {
+            "description": "token status per client, the token itself is never included",
+            "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/TokenStatus"}}}}
+          }
+        }
+      }
+    },
+    "/api/refresh": {
+      "post": {
+        "summary": "Immediately refresh the twitch live status of all publishers",
+        "responses": {
+          "200": {
+            "description": "publishers live on twitch after the refresh",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/RefreshResponse"}}}
+          },
+          "429": {"description": "refreshed too recently"},
+          "503": {"description": "twitch integration disabled or unavailable"}
+        }
+      }
+    },
+    "/api/live": {
+      "get": {
+        "summary": "Publishers currently live on any platform, as of the last poll",
+        "responses": {
+          "200": {
+            "description": "live streams ordered by publisher",
+            "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/LiveStream"}}}}
+          }
+        }
+      }
+    },
+    "/api/live/check": {
+      "post": {
+        "summary": "Check the twitch live status of any logins, directly with twitch",
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"type": "array", "maxItems": 500, "items": {"type": "string"}}}}
+        },
+        "responses": {
+          "200": {
+            "description": "live status of each distinct login, in request order",
+            "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/LiveCheck"}}}}
+          },
+          "400": {"description": "invalid login or too many logins"},
+          "503": {"description": "twitch is disabled or unavailable"}
+        }
+      }
+    },
+    "/api/cache/{login}": {
+      "delete": {
+        "summary": "Remove a twitch login from the not live & allow caches so it is checked again on the next publish",
+        "parameters": [
+          {"name": "login", "in": "path", "required": true, "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {
+            "description": "whether the login was cached",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/CacheResponse"}}}
+          }
+        }
+      }
+    },
+    "/api/maintenance": {
+      "get": {
+        "summary": "Whether maintenance mode is active",
+        "responses": {
+          "200": {"description": "maintenance mode status", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/MaintenanceResponse"}}}}
+        }
+      },
+      "post": {
+        "summary": "Enable or disable maintenance mode, which skips platform live checks for all publishers",
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/MaintenanceResponse"}}}
+        },
+        "responses": {
+          "200": {"description": "maintenance mode status", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/MaintenanceResponse"}}}},
+          "400": {"description": "invalid request"}
+        }
+      }
+    },
+    "/api/notify/test": {
+      "post": {
+        "summary": "Send a test message through each enabled notification channel",
+        "responses": {
+          "200": {"description": "every channel succeeded", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/NotifyResult"}}}}},
+          "502": {"description": "a channel failed", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/NotifyResult"}}}}}
+        }
+      }
+    },
+    "/api/playback/{name}": {
+      "get": {
+        "summary": "Issue a signed, expiring playback token for a stream",
+        "parameters": [
+          {"name": "name", "in": "path", "required": true, "schema": {"type": "string"}},
+          {"name": "ttl", "in": "query", "description": "seconds until the token expires (default: PLAYBACK_TOKEN_TTL)", "schema": {"type": "integer", "minimum": 1}}
+        ],
+        "responses": {
+          "200": {"description": "playback token", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/PlaybackResponse"}}}},
+          "400": {"description": "invalid ttl"},
+          "404": {"description": "publisher not found"},
+          "503": {"description": "PLAYBACK_SECRET is not set"}
+        }
+      }
+    },
+    "/api/sessions": {
+      "get": {
+        "summary": "Active publish sessions",
+        "responses": {
+          "200": {
+            "description": "sessions ordered by publisher",
+            "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Session"}}}}
+          }
+        }
+      }
+    },
+    "/api/sessions/{publisher}": {
+      "delete": {
+        "summary": "End the session of a publisher, disconnecting it from nginx when NGINX_CONTROL_URL is set",
+        "parameters": [
+          {"name": "publisher", "in": "path", "required": true, "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "204": {"description": "session ended"},
+          "404": {"description": "no active session"},
+          "502": {"description": "nginx failed to disconnect the publisher, the session is kept"}
+        }
+      }
+    },
+    "/api/status": {
+      "get": {
+        "summary": "Version & build information of the server",
+        "responses": {
+          "200": {"description": "server status", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/StatusResponse"}}}}
+        }
+      }
+    },
+    "/api/openapi.json": {
+      "get": {
+        "summary": "This document",
+        "responses": {"200": {"description": "OpenAPI 3 document"}}
+      }
+    },
+    "/readyz": {
+      "get": {
+        "summary": "Readiness of the server",
+        "responses": {
+          "200": {"description": "ready", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ReadyResponse"}}}},
+          "503": {"description": "not ready", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ReadyResponse"}}}}
+        }
+      }
+    },
+    "/metrics": {
+      "get": {
+        "summary": "Metrics in the prometheus text format",
+        "responses": {
+          "200": {"description": "metrics", "content": {"text/plain": {"schema": {"type": "string"}}}}
+        }
+      }
+    },
+    "/on_publish": {
+      "post": {
+        "summary": "nginx rtmp on_publish callback",
+        "requestBody": {"content": {"application/x-www-form-urlencoded": {"schema": {"$ref": "#/components/schemas/RTMPCallback"}}}},
+        "responses": {
+          "201": {"description": "publish allowed"},
+          "302": {"description": "publish allowed and redirected to the stream name in the Location header (ALLOW_REDIRECT_TEMPLATE)"},
+          "4XX": {"description": "publish denied (DENY_STATUS_CODE)"},
+          "429": {"description": "publisher throttled after repeated denies, or twitch rate limited"},
+          "503": {"description": "twitch unavailable or AUTH_DEADLINE_SECONDS exceeded"}
+        }
+      }
+    },
+    "/on_publish_done": {
+      "post": {
+        "summary": "nginx rtmp on_publish_done callback",
+        "requestBody": {"content": {"application/x-www-form-urlencoded": {"schema": {"$ref": "#/components/schemas/RTMPCallback"}}}},
+        "responses": {"201": {"description": "publish finished"}}
+      }
+    },
+    "/on_update": {
+      "post": {
+        "summary": "nginx rtmp on_update callback, recording that a publish session is still alive",
+        "requestBody": {"content": {"application/x-www-form-urlencoded": {"schema": {"$ref": "#/components/schemas/RTMPCallback"}}}},
+        "responses": {"201": {"description": "session continues"}}
+      }
+    },
+    "/on_record_done": {
+      "post": {
+        "summary": "nginx rtmp on_record_done callback, storing the recording as the last recording of the publisher & posting it to RECORD_WEBHOOK_URL",
+        "requestBody": {"content": {"application/x-www-form-urlencoded": {"schema": {"$ref": "#/components/schemas/RTMPCallback"}}}},
+        "responses": {
+          "201": {"description": "recording stored"},
+          "404": {"description": "unknown stream"}
+        }
+      }
+    },
+    "/on_play": {
+      "post": {
+        "summary": "nginx rtmp on_play callback",
+        "requestBody": {"content": {"application/x-www-form-urlencoded": {"schema": {"$ref": "#/components/schemas/RTMPCallback"}}}},
+        "responses": {
+          "201": {"description": "play allowed"},
+          "4XX": {"description": "missing, invalid or expired playback token when PLAYBACK_SECRET is set (DENY_STATUS_CODE)"},
+          "404": {"description": "stream not found"}
+        }
+      }
+    },
+    "/on_play_done": {
+      "post": {
+        "summary": "nginx rtmp on_play_done callback",
+        "requestBody": {"content": {"application/x-www-form-urlencoded": {"schema": {"$ref": "#/components/schemas/RTMPCallback"}}}},
+        "responses": {"201": {"description": "play finished"}}
+      }
+    }
+  },
+  "components": {
+    "schemas": {
+      "APIError": {
+        "type": "object",
+        "required": ["error", "code"],
+        "properties": {
+          "error": {"type": "string", "description": "description of the error"},
+          "code": {"type": "string", "description": "stable error code, e.g. publisher_not_found or publisher_limit"}
+        }
+      },
+      "Publisher": {
+        "type": "object",
+        "required": ["name", "key"],
+        "properties": {
+          "name": {"type": "string"},
+          "key": {"type": "string"},
+          "rtmp_live": {"type": "string", "readOnly": true},
+          "twitch_stream": {"type": "string"},
+          "twitch_live": {"type": "string", "readOnly": true},
+          "trovo_channel": {"type": "string", "description": "trovo channel checked when trovo is enabled, \"\" clears"},
+          "app": {"type": "string", "description": "rtmp app the key is restricted to, any app when not set, \"\" clears"},
+          "mode": {"type": "string", "enum": ["mirror", "ingest", ""], "description": "ingest publishers skip the twitch live check, \"\" resets to mirror"},
+          "min_viewers": {"type": "integer", "minimum": 0, "description": "twitch viewers required to count as live for REQUIRE_TWITCH_LIVE"},
+          "viewer_count": {"type": "integer", "readOnly": true, "description": "twitch viewer count while live"},
+          "title": {"type": "string", "readOnly": true, "description": "twitch stream title while live"},
+          "thumbnail_url": {"type": "string", "readOnly": true, "description": "twitch stream thumbnail while live"},
+          "enabled": {"type": "boolean"},
+          "active_from": {"type": "string", "format": "date-time", "description": "publishes are denied before this time, the zero time clears it"},
+          "last_recording": {"type": "string", "readOnly": true, "description": "path of the last recording reported by on_record_done"},
+          "last_published_at": {"type": "string", "format": "date-time", "readOnly": true, "description": "time of the last authorized publish"},
+          "active_until": {"type": "string", "format": "date-time", "description": "publishes are denied from this time, the zero time clears it"},
+          "tags": {"type": "array", "items": {"type": "string"}},
+          "metadata": {"type": "object", "additionalProperties": {"type": "string"}},
+          "webhook_url": {"type": "string", "description": "discord webhook the publisher's live & offline notifications are also posted to, \"\" clears"},
+          "platform_roles": {"type": "object", "additionalProperties": {"type": "string", "enum": ["require", "any"]}, "description": "platforms (twitch, trovo) the publisher must be live on for REQUIRE_TWITCH_LIVE, {} clears"},
+          "created_at": {"type": "string", "format": "date-time", "readOnly": true},
+          "updated_at": {"type": "string", "format": "date-time", "readOnly": true}
+        }
+      },
+      "TagResponse": {
+        "type": "object",
+        "properties": {
+          "tag": {"type": "string"},
+          "enabled": {"type": "boolean"},
+          "count": {"type": "integer"}
+        }
+      },
+      "SyncResponse": {
+        "type": "object",
+        "properties": {
+          "created": {"type": "array", "items": {"type": "string"}},
+          "updated": {"type": "array", "items": {"type": "string"}},
+          "deleted": {"type": "array", "items": {"type": "string"}},
+          "unchanged": {"type": "integer"}
+        }
+      },
+      "TokenStatus": {
+        "type": "object",
+        "properties": {
+          "client_id_suffix": {"type": "string"},
+          "cached": {"type": "boolean"},
+          "expires_at": {"type": "string", "format": "date-time", "nullable": true},
+          "validated_at": {"type": "string", "format": "date-time", "nullable": true},
+          "scopes": {"type": "array", "items": {"type": "string"}, "nullable": true}
+        }
+      },
+      "RefreshResponse": {
+        "type": "object",
+        "properties": {
+          "live": {"type": "array", "items": {"type": "string"}}
+        }
+      },
+      "LiveStream": {
+        "type": "object",
+        "properties": {
+          "publisher": {"type": "string"},
+          "platform": {"type": "string"},
+          "viewer_count": {"type": "integer"},
+          "title": {"type": "string"},
+          "thumbnail_url": {"type": "string", "description": "preview of twitch streams"}
+        }
+      },
+      "CacheResponse": {
+        "type": "object",
+        "properties": {
+          "login": {"type": "string"},
+          "cleared": {"type": "boolean", "description": "whether the login was cached as not live"},
+          "allow_cleared": {"type": "boolean", "description": "whether a publisher streaming to the login was cached as allowed"}
+        }
+      },
+      "MaintenanceResponse": {
+        "type": "object",
+        "properties": {
+          "enabled": {"type": "boolean"}
+        }
+      },
+      "LiveCheck": {
+        "type": "object",
+        "properties": {
+          "login": {"type": "string"},
+          "live": {"type": "boolean"},
+          "viewer_count": {"type": "integer"},
+          "title": {"type": "string"}
+        }
+      },
+      "PublisherPolicy": {
+        "type": "object",
+        "properties": {
+          "name": {"type": "string"},
+          "enabled": {"type": "boolean"},
+          "active_now": {"type": "boolean", "description": "within the active window"},
+          "active_from": {"type": "string", "format": "date-time"},
+          "active_until": {"type": "string", "format": "date-time"},
+          "app": {"type": "string"},
+          "allowed_apps": {"type": "array", "items": {"type": "string"}},
+          "mode": {"type": "string", "enum": ["mirror", "ingest"]},
+          "live_check": {"type": "boolean", "description": "REQUIRE_TWITCH_LIVE applies"},
+          "required_platforms": {"type": "array", "items": {"type": "string"}},
+          "any_platforms": {"type": "array", "items": {"type": "string"}},
+          "min_viewers": {"type": "integer"},
+          "no_platform_denied": {"type": "boolean", "description": "denied by NO_PLATFORM_POLICY=deny"},
+          "live_grace_period": {"type": "string"},
+          "allow_cache_ttl": {"type": "string"},
+          "maintenance": {"type": "boolean"},
+          "throttled_until": {"type": "string", "format": "date-time"},
+          "defaults": {"type": "array", "items": {"type": "string"}, "description": "global settings applied to the publisher"}
+        }
+      },
+      "NotifyResult": {
+        "type": "object",
+        "properties": {
+          "channel": {"type": "string"},
+          "ok": {"type": "boolean"},
+          "status": {"type": "integer", "description": "http status returned by the channel"},
+          "error": {"type": "string"}
+        }
+      },
+      "PlaybackResponse": {
+        "type": "object",
+        "properties": {
+          "stream": {"type": "string"},
+          "token": {"type": "string"},
+          "expires_at": {"type": "string", "format": "date-time"},
+          "url": {"type": "string", "description": "rtmp url including the token when RTMP_SERVER_FQDN is set"}
+        }
+      },
+      "Session": {
+        "type": "object",
+        "properties": {
+          "publisher": {"type": "string"},
+          "app": {"type": "string"},
+          "addr": {"type": "string", "description": "address of the publisher"},
+          "client_id": {"type": "string", "description": "nginx client id"},
+          "started_at": {"type": "string", "format": "date-time"},
+          "last_seen": {"type": "string", "format": "date-time", "description": "last on_publish, on_update or stat page sighting"}
+        }
+      },
+      "StatusResponse": {
+        "type": "object",
+        "properties": {
+          "version": {"type": "string"},
+          "commit": {"type": "string"},
+          "go_version": {"type": "string"},
+          "platforms": {"type": "array", "items": {"type": "string"}, "description": "platforms with a registered live status source"}
+        }
+      },
+      "ReadyResponse": {
+        "type": "object",
+        "properties": {
+          "ready": {"type": "boolean"},
+          "reason": {"type": "string"}
+        }
+      },
+      "RTMPCallback": {
+        "type": "object",
+        "properties": {
+          "name": {"type": "string", "description": "stream name"},
+          "key": {"type": "string", "description": "stream key"},
+          "app": {"type": "string", "description": "rtmp application"},
+          "token": {"type": "string", "description": "playback token for on_play when PLAYBACK_SECRET is set"},
+          "recorder": {"type": "string", "description": "recorder name for on_record_done"},
+          "path": {"type": "string", "description": "recorded file for on_record_done"}
+        }
+      }
+    }
+  }
+}
+`
+
+// OpenAPIHandler serves the OpenAPI description of the http endpoints
+func (c *Controller) OpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeStatusError(w, http.StatusNotImplemented)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Write([]byte(openAPISpec))
+}
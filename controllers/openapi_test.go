@@ -0,0 +1,329 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bcambl/rtmpauthbot/config"
+	"github.com/bcambl/rtmpauthbot/internal/testutil"
+)
+
+// openAPIDocument is the subset of an OpenAPI 3 document used by the tests
+type openAPIDocument struct {
+	OpenAPI string `json:"openapi"`
+	Paths   map[string]map[string]struct {
+		Responses map[string]struct {
+			Content map[string]struct {
+				Schema *schema `json:"schema"`
+			} `json:"content"`
+		} `json:"responses"`
+	} `json:"paths"`
+	Components struct {
+		Schemas map[string]*schema `json:"schemas"`
+	} `json:"components"`
+}
+
+// schema is the subset of an OpenAPI 3 schema validated by the tests
+type schema struct {
+	Ref        string             `json:"$ref"`
+	Type       string             `json:"type"`
+	Required   []string           `json:"required"`
+	Properties map[string]*schema `json:"properties"`
+	Items      *schema            `json:"items"`
+	OneOf      []*schema          `json:"oneOf"`
+	Enum       []interface{}      `json:"enum"`
+}
+
+// parseOpenAPI fetches & parses the document served by the controller
+func parseOpenAPI(t *testing.T, c *Controller) openAPIDocument {
+	t.Helper()
+	w := serve(c.OpenAPIHandler, "GET", "/api/openapi.json", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("openapi document: got %d, want %d", w.Code, http.StatusOK)
+	}
+	var doc openAPIDocument
+	err := json.Unmarshal(w.Body.Bytes(), &doc)
+	if err != nil {
+		t.Fatalf("openapi document is not valid json: %s", err)
+	}
+	return doc
+}
+
+// resolve follows the reference of a schema to the components
+func (d openAPIDocument) resolve(s *schema) (*schema, error) {
+	if s.Ref == "" {
+		return s, nil
+	}
+	name := strings.TrimPrefix(s.Ref, "#/components/schemas/")
+	resolved, ok := d.Components.Schemas[name]
+	if !ok {
+		return nil, fmt.Errorf("unresolved reference %s", s.Ref)
+	}
+	return resolved, nil
+}
+
+// validate returns an error when the json value does not match the schema.
+// Objects may only have the documented properties, so that fields which are
+// added to a response must be added to the document too. Optional fields
+// may be null.
+func (d openAPIDocument) validate(s *schema, value interface{}, path string) error {
+	s, err := d.resolve(s)
+	if err != nil {
+		return err
+	}
+	if s.OneOf != nil {
+		for _, option := range s.OneOf {
+			if d.validate(option, value, path) == nil {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s: matches none of oneOf", path)
+	}
+	if value == nil {
+		return nil
+	}
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			found = found || e == value
+		}
+		if !found {
+			return fmt.Errorf("%s: %v is not one of %v", path, value, s.Enum)
+		}
+	}
+	switch s.Type {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: %v is not an object", path, value)
+		}
+		for _, name := range s.Required {
+			if _, ok := object[name]; !ok {
+				return fmt.Errorf("%s: required property %s missing", path, name)
+			}
+		}
+		if s.Properties == nil {
+			return nil
+		}
+		for name, v := range object {
+			property, ok := s.Properties[name]
+			if !ok {
+				return fmt.Errorf("%s: undocumented property %s", path, name)
+			}
+			err = d.validate(property, v, path+"."+name)
+			if err != nil {
+				return err
+			}
+		}
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: %v is not an array", path, value)
+		}
+		for i := range array {
+			err = d.validate(s.Items, array[i], path+"["+strconv.Itoa(i)+"]")
+			if err != nil {
+				return err
+			}
+		}
+	case "string":
+		if _, ok := value.(string); !ok {
+			return fmt.Errorf("%s: %v is not a string", path, value)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s: %v is not a boolean", path, value)
+		}
+	case "integer":
+		if n, ok := value.(float64); !ok || n != float64(int64(n)) {
+			return fmt.Errorf("%s: %v is not an integer", path, value)
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			return fmt.Errorf("%s: %v is not a number", path, value)
+		}
+	}
+	return nil
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+	doc := parseOpenAPI(t, newTestController(t, &testutil.TwitchStub{}, nil))
+	if doc.OpenAPI != "3.0.3" {
+		t.Fatalf("openapi version: got %s, want 3.0.3", doc.OpenAPI)
+	}
+	if len(doc.Paths) == 0 {
+		t.Fatal("openapi document describes no paths")
+	}
+
+	// every reference must resolve
+	var check func(s *schema, where string)
+	check = func(s *schema, where string) {
+		if s == nil {
+			return
+		}
+		if _, err := doc.resolve(s); err != nil {
+			t.Errorf("%s: %s", where, err)
+		}
+		for name, property := range s.Properties {
+			check(property, where+"."+name)
+		}
+		check(s.Items, where+"[]")
+		for i := range s.OneOf {
+			check(s.OneOf[i], where+".oneOf")
+		}
+	}
+	for path, methods := range doc.Paths {
+		for method, operation := range methods {
+			for status, response := range operation.Responses {
+				for _, content := range response.Content {
+					check(content.Schema, method+" "+path+" "+status)
+				}
+			}
+		}
+	}
+	for name, s := range doc.Components.Schemas {
+		check(s, name)
+	}
+}
+
+func TestOpenAPIResponses(t *testing.T) {
+	stub := &testutil.TwitchStub{}
+	stub.SetStreams(http.StatusOK, aliceLive)
+	c := newTestController(t, stub, func(conf *config.Config) {
+		conf.RequireTwitchLive = false
+		conf.AllowedApps = nil
+		conf.PlaybackSecret = "playback-secret"
+	})
+	doc := parseOpenAPI(t, c)
+	createPublisher(t, c, `{"name":"alice","key":"secret","twitch_stream":"alice","tags":["event"],`+
+		`"metadata":{"crm":"1"},"platform_roles":{"twitch":"require"},"webhook_url":"https://discord.example/hook"}`)
+	if status := publish(c, "alice", "secret"); status != http.StatusCreated {
+		t.Fatalf("publish: got %d, want %d", status, http.StatusCreated)
+	}
+	_, err := c.refreshTwitch()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		handler http.HandlerFunc
+		method  string
+		target  string
+		path    string
+		body    string
+	}{
+		{c.PublisherAPIHandler, "GET", "/api/publisher", "/api/publisher", ""},
+		{c.PublisherAPIHandler, "GET", "/api/publisher?name=alice&revealKey=true", "/api/publisher", ""},
+		{c.PublisherAPIHandler, "GET", "/api/publisher?name=nobody", "/api/publisher", ""},
+		{c.PublisherAPIHandler, "GET", "/api/publisher?sort=invalid", "/api/publisher", ""},
+		{c.PublishersAPIHandler, "GET", "/api/publishers/alice", "/api/publishers/{name}", ""},
+		{c.PublishersAPIHandler, "PUT", "/api/publishers/bob", "/api/publishers/{name}", `{"key":"secret"}`},
+		{c.PublishersAPIHandler, "GET", "/api/publishers/alice/policy", "/api/publishers/{name}/policy", ""},
+		{c.SyncAPIHandler, "POST", "/api/publishers/sync?prune=false", "/api/publishers/sync", `[{"name":"carol","key":"secret"}]`},
+		{c.TagsAPIHandler, "POST", "/api/tags/event/enable", "/api/tags/{tag}/{action}", ""},
+		{c.TokenStatusHandler, "GET", "/api/token/status", "/api/token/status", ""},
+		{c.LiveAPIHandler, "GET", "/api/live", "/api/live", ""},
+		{c.LiveCheckAPIHandler, "POST", "/api/live/check", "/api/live/check", `["alice","bob"]`},
+		{c.CacheAPIHandler, "DELETE", "/api/cache/alice", "/api/cache/{login}", ""},
+		{c.MaintenanceAPIHandler, "GET", "/api/maintenance", "/api/maintenance", ""},
+		{c.PlaybackAPIHandler, "GET", "/api/playback/alice", "/api/playback/{name}", ""},
+		{c.SessionsAPIHandler, "GET", "/api/sessions", "/api/sessions", ""},
+		{c.StatusHandler, "GET", "/api/status", "/api/status", ""},
+		{c.ReadyzHandler, "GET", "/readyz", "/readyz", ""},
+	}
+	for _, test := range tests {
+		name := test.method + " " + test.target
+		operation, ok := doc.Paths[test.path][strings.ToLower(test.method)]
+		if !ok {
+			t.Errorf("%s: %s %s is not documented", name, test.method, test.path)
+			continue
+		}
+		w := serve(test.handler, test.method, test.target, test.body)
+		response, ok := operation.Responses[strconv.Itoa(w.Code)]
+		if !ok {
+			response, ok = operation.Responses[strconv.Itoa(w.Code/100)+"XX"]
+		}
+		if !ok {
+			codes := []string{}
+			for code := range operation.Responses {
+				codes = append(codes, code)
+			}
+			sort.Strings(codes)
+			t.Errorf("%s: status %d is not documented (%s)", name, w.Code, strings.Join(codes, ", "))
+			continue
+		}
+		content, ok := response.Content["application/json"]
+		if !ok && w.Code >= 400 && strings.HasPrefix(test.path, "/api/") {
+			// error responses of the api are documented once, as APIError
+			content.Schema = &schema{Ref: "#/components/schemas/APIError"}
+			ok = true
+		}
+		if !ok || content.Schema == nil {
+			continue
+		}
+		var value interface{}
+		err := json.Unmarshal(w.Body.Bytes(), &value)
+		if err != nil {
+			t.Errorf("%s: response is not json: %s", name, w.Body.String())
+			continue
+		}
+		err = doc.validate(content.Schema, value, "response")
+		if err != nil {
+			t.Errorf("%s: %d response does not match the document: %s: %s", name, w.Code, err, w.Body.String())
+		}
+	}
+}
+
+func TestPublisherJSONContract(t *testing.T) {
+	// the json keys of a publisher are part of the api, renaming a go field
+	// must not change them
+	contract := []string{
+		"active_from", "active_until", "app", "created_at", "enabled", "key", "last_published_at",
+		"last_recording", "metadata", "min_viewers", "mode", "name", "platform_roles", "rtmp_live",
+		"tags", "thumbnail_url", "title", "trovo_channel", "twitch_live", "twitch_stream",
+		"updated_at", "viewer_count", "webhook_url",
+	}
+	s, enabled, minViewers, now := "value", true, 1, time.Now()
+	p := Publisher{
+		Name: s, Key: s, RTMPLive: s, TwitchStream: s, TwitchLive: s, TrovoChannel: &s, App: &s, Mode: &s,
+		ThumbnailURL: s, ViewerCount: 1, Title: s, MinViewers: &minViewers, Enabled: &enabled,
+		Tags: []string{s}, Metadata: map[string]string{s: s}, PlatformRoles: map[string]string{"twitch": RoleAny},
+		WebhookURL: &s, ActiveFrom: &now, ActiveUntil: &now, LastRecording: s, LastPublishedAt: &now,
+		CreatedAt: now, UpdatedAt: now, TwitchNotification: s, StreamInfo: s,
+	}
+	content, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var object map[string]interface{}
+	err = json.Unmarshal(content, &object)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{}
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if strings.Join(keys, ",") != strings.Join(contract, ",") {
+		t.Fatalf("publisher json keys:\ngot  %v\nwant %v", keys, contract)
+	}
+
+	// and each of them is documented
+	doc := parseOpenAPI(t, newTestController(t, &testutil.TwitchStub{}, nil))
+	documented := doc.Components.Schemas["Publisher"].Properties
+	for _, key := range contract {
+		if _, ok := documented[key]; !ok {
+			t.Errorf("publisher key %s is not documented", key)
+		}
+	}
+	if len(documented) != len(contract) {
+		t.Errorf("%d publisher properties documented, want %d", len(documented), len(contract))
+	}
+}
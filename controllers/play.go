@@ -3,27 +3,37 @@ package controllers
 import (
 	"fmt"
 	"net/http"
-
-	log "github.com/sirupsen/logrus"
+	"time"
 )
 
 // OnPlayHandler is the http handler for "/on_play".
 func (c *Controller) OnPlayHandler(w http.ResponseWriter, r *http.Request) {
-	r.ParseForm()
+	logger := requestLogger(r)
+	if !c.parseCallbackForm(w, r) {
+		return
+	}
 	streamName := r.Form.Get("name")
 	p, err := c.getPublisher(streamName)
 	if err != nil {
-		log.Warnf("on_play: stream not found: %s\n", streamName)
-		w.WriteHeader(http.StatusNotFound)
+		logger.Warnf("on_play: stream not found: %s\n", streamName)
+		w.WriteHeader(c.notFoundStatus())
 		return
 	}
-	log.Printf("on_play: %s\n", p.Name)
+	if c.cfg().PlaybackSecret != "" {
+		err = c.verifyPlaybackToken(p.Name, r.Form.Get("token"), time.Now())
+		if err != nil {
+			logger.Warnf("on_play unauthorized: %s: %s", p.Name, err)
+			w.WriteHeader(c.denyStatus(err))
+			return
+		}
+	}
+	logger.Printf("on_play: %s\n", p.Name)
 
-	if c.Config.DiscordEnabled {
+	if c.cfg().DiscordEnabled {
 		content := fmt.Sprintf(":chart_with_upwards_trend: %s gained a viewer.", streamName)
 		err := c.callWebhook(content)
 		if err != nil {
-			log.Error(err)
+			logger.Error(err)
 		}
 	}
 
@@ -32,21 +42,24 @@ func (c *Controller) OnPlayHandler(w http.ResponseWriter, r *http.Request) {
 
 // OnPlayDoneHandler is the http handler for "/on_play_done".
 func (c *Controller) OnPlayDoneHandler(w http.ResponseWriter, r *http.Request) {
-	r.ParseForm()
+	logger := requestLogger(r)
+	if !c.parseCallbackForm(w, r) {
+		return
+	}
 	streamName := r.Form.Get("name")
 	p, err := c.getPublisher(streamName)
 	if err != nil {
-		log.Warnf("on_play_done: stream not found: %s\n", streamName)
-		w.WriteHeader(http.StatusNotFound)
+		logger.Warnf("on_play_done: stream not found: %s\n", streamName)
+		w.WriteHeader(c.notFoundStatus())
 		return
 	}
-	log.Printf("on_play_done: %s\n", p.Name)
+	logger.Printf("on_play_done: %s\n", p.Name)
 
-	if c.Config.DiscordEnabled {
+	if c.cfg().DiscordEnabled {
 		content := fmt.Sprintf(":chart_with_downwards_trend: %s lost a viewer.", streamName)
 		err := c.callWebhook(content)
 		if err != nil {
-			log.Error(err)
+			logger.Error(err)
 		}
 	}
 
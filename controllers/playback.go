@@ -0,0 +1,138 @@
+package controllers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PlaybackResponse is a signed playback token for a stream
+type PlaybackResponse struct {
+	Stream    string    `json:"stream"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+	URL       string    `json:"url,omitempty"`
+}
+
+// SignPlaybackToken returns a token allowing the stream to be played until
+// the ttl has passed. The token is the expiry (unix seconds) & a hmac of the
+// stream name and expiry keyed with PLAYBACK_SECRET, separated by a '.'.
+func (c *Controller) SignPlaybackToken(stream string, ttl time.Duration) string {
+	expiry := time.Now().Add(ttl).Unix()
+	return c.playbackToken(stream, expiry)
+}
+
+func (c *Controller) playbackToken(stream string, expiry int64) string {
+	exp := strconv.FormatInt(expiry, 10)
+	mac := hmac.New(sha256.New, []byte(c.cfg().PlaybackSecret))
+	mac.Write([]byte(stream + "\n" + exp))
+	return exp + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyPlaybackToken ensures a token was signed for the stream and has not
+// expired
+func (c *Controller) verifyPlaybackToken(stream, token string, now time.Time) error {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("%w: malformed", ErrPlaybackToken)
+	}
+	expiry, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: malformed", ErrPlaybackToken)
+	}
+	// compared in constant time so that a signature cannot be guessed one
+	// byte at a time
+	expected := c.playbackToken(stream, expiry)
+	if !hmac.Equal([]byte(token), []byte(expected)) {
+		return fmt.Errorf("%w: invalid signature", ErrPlaybackToken)
+	}
+	if now.Unix() >= expiry {
+		return fmt.Errorf("%w: expired at %s", ErrPlaybackToken, time.Unix(expiry, 0).UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// playbackURL returns the rtmp url of a stream including a playback token,
+// or an empty string when the rtmp server is not configured
+func (c *Controller) playbackURL(stream, token string) string {
+	conf := c.cfg()
+	if conf.RTMPServerFQDN == "" {
+		return ""
+	}
+	host := conf.RTMPServerFQDN
+	if conf.RTMPServerPort != "" {
+		host = net.JoinHostPort(host, conf.RTMPServerPort)
+	}
+	link := fmt.Sprintf("rtmp://%s/stream/%s", host, stream)
+	if token != "" {
+		link += "?token=" + url.QueryEscape(token)
+	}
+	return link
+}
+
+// PlaybackAPIHandler is the http handler for "/api/playback/{name}",
+// returning a signed playback token for the stream which expires after
+// ?ttl= seconds (default: PLAYBACK_TOKEN_TTL)
+func (c *Controller) PlaybackAPIHandler(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
+
+	w.Header().Add("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		logger.Debug(http.StatusNotImplemented)
+		writeStatusError(w, http.StatusNotImplemented)
+		return
+	}
+
+	conf := c.cfg()
+	if conf.PlaybackSecret == "" {
+		writeJSONError(w, http.StatusServiceUnavailable, codeUnavailable, "playback tokens are disabled (PLAYBACK_SECRET)")
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/api/playback/")
+	if name == "" || strings.Contains(name, "/") {
+		writeStatusError(w, http.StatusNotFound)
+		return
+	}
+	ttl := conf.PlaybackTokenTTL
+	if value := r.URL.Query().Get("ttl"); value != "" {
+		seconds, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || seconds < 1 {
+			writeJSONError(w, http.StatusBadRequest, codeBadRequest, "invalid ttl: "+value)
+			return
+		}
+		ttl = time.Duration(seconds) * time.Second
+	}
+
+	p, err := c.getPublisher(name)
+	if err != nil {
+		logger.Debugf("error retrieving publisher '%s': %s", name, err)
+		writeAPIError(w, err)
+		return
+	}
+
+	expiry := time.Now().Add(ttl).Unix()
+	token := c.playbackToken(p.Name, expiry)
+	content, err := json.Marshal(PlaybackResponse{
+		Stream:    p.Name,
+		Token:     token,
+		ExpiresAt: time.Unix(expiry, 0).UTC(),
+		URL:       c.playbackURL(p.Name, token),
+	})
+	if err != nil {
+		logger.Debug(err)
+		writeStatusError(w, http.StatusInternalServerError)
+		return
+	}
+	logger.Infof("playback token issued for %s (ttl: %s)", p.Name, ttl.String())
+	w.Write(content)
+}
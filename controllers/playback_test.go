@@ -0,0 +1,92 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bcambl/rtmpauthbot/config"
+	"github.com/bcambl/rtmpauthbot/internal/testutil"
+)
+
+func TestVerifyPlaybackToken(t *testing.T) {
+	c := newTestController(t, &testutil.TwitchStub{}, func(conf *config.Config) {
+		conf.PlaybackSecret = "playback-secret"
+	})
+	other := newTestController(t, &testutil.TwitchStub{}, func(conf *config.Config) {
+		conf.PlaybackSecret = "other-secret"
+	})
+	now := time.Now()
+	valid := c.SignPlaybackToken("alice", time.Minute)
+	expiry, signature := valid[:strings.Index(valid, ".")], valid[strings.Index(valid, ".")+1:]
+	tampered := []byte(signature)
+	if tampered[0] == '0' {
+		tampered[0] = '1'
+	} else {
+		tampered[0] = '0'
+	}
+	later := strconv.FormatInt(now.Add(time.Hour).Unix(), 10)
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"valid", valid, true},
+		{"expired", c.SignPlaybackToken("alice", -time.Second), false},
+		{"signed for another stream", c.SignPlaybackToken("bob", time.Minute), false},
+		{"signed with another secret", other.SignPlaybackToken("alice", time.Minute), false},
+		{"tampered signature", expiry + "." + string(tampered), false},
+		{"truncated signature", expiry + "." + signature[:len(signature)-2], false},
+		{"extended expiry", later + "." + signature, false},
+		{"empty", "", false},
+		{"no signature", expiry, false},
+		{"malformed expiry", "soon." + signature, false},
+		{"signature only", "." + signature, false},
+	}
+	for _, test := range tests {
+		err := c.verifyPlaybackToken("alice", test.token, now)
+		if test.ok && err != nil {
+			t.Errorf("%s token: rejected: %s", test.name, err)
+		}
+		if !test.ok && !errors.Is(err, ErrPlaybackToken) {
+			t.Errorf("%s token: got %v, want %v", test.name, err, ErrPlaybackToken)
+		}
+	}
+}
+
+func TestOnPlayToken(t *testing.T) {
+	c := newTestController(t, &testutil.TwitchStub{}, func(conf *config.Config) {
+		conf.PlaybackSecret = "playback-secret"
+		conf.DiscordEnabled = false
+	})
+	createPublisher(t, c, `{"name":"alice","key":"secret"}`)
+
+	w := serve(c.PlaybackAPIHandler, "GET", "/api/playback/alice?ttl=60", "")
+	var response PlaybackResponse
+	err := json.Unmarshal(w.Body.Bytes(), &response)
+	if w.Code != http.StatusOK || err != nil {
+		t.Fatalf("playback token: got %d %s", w.Code, w.Body.String())
+	}
+	if d := time.Until(response.ExpiresAt); d <= 0 || d > time.Minute {
+		t.Errorf("playback token expires in %s, want within a minute", d)
+	}
+
+	play := func(token string) int {
+		form := url.Values{"name": {"alice"}, "app": {"stream"}, "token": {token}}
+		return serve(c.OnPlayHandler, "POST", "/on_play", form.Encode()).Code
+	}
+	if status := play(response.Token); status != http.StatusCreated {
+		t.Errorf("play with a valid token: got %d, want %d", status, http.StatusCreated)
+	}
+	for _, token := range []string{"", c.SignPlaybackToken("alice", -time.Second), c.SignPlaybackToken("bob", time.Minute)} {
+		if status := play(token); status != c.Config.DenyStatusCode {
+			t.Errorf("play with token %q: got %d, want %d", token, status, c.Config.DenyStatusCode)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// PublisherPolicy is the effective publish policy of a publisher, combining
+// its own settings with the global settings which apply to it
+type PublisherPolicy struct {
+	Name              string     `json:"name"`
+	Enabled           bool       `json:"enabled"`
+	ActiveNow         bool       `json:"active_now"`
+	ActiveFrom        *time.Time `json:"active_from,omitempty"`
+	ActiveUntil       *time.Time `json:"active_until,omitempty"`
+	App               string     `json:"app,omitempty"`
+	AllowedApps       []string   `json:"allowed_apps"`
+	Mode              string     `json:"mode"`
+	LiveCheck         bool       `json:"live_check"`
+	RequiredPlatforms []string   `json:"required_platforms"`
+	AnyPlatforms      []string   `json:"any_platforms"`
+	MinViewers        int        `json:"min_viewers"`
+	NoPlatformDenied  bool       `json:"no_platform_denied"`
+	LiveGracePeriod   string     `json:"live_grace_period,omitempty"`
+	AllowCacheTTL     string     `json:"allow_cache_ttl,omitempty"`
+	Maintenance       bool       `json:"maintenance"`
+	ThrottledUntil    *time.Time `json:"throttled_until,omitempty"`
+	// Defaults lists the global settings which apply to the publisher
+	Defaults []string `json:"defaults"`
+}
+
+// publisherPolicy resolves the policy authorize applies to the publisher
+func (c *Controller) publisherPolicy(p Publisher, now time.Time) PublisherPolicy {
+	conf := c.cfg()
+	policy := PublisherPolicy{
+		Name:              p.Name,
+		Enabled:           p.IsEnabled(),
+		ActiveNow:         p.activeAt(now) == nil,
+		ActiveFrom:        p.ActiveFrom,
+		ActiveUntil:       p.ActiveUntil,
+		App:               p.app(),
+		AllowedApps:       conf.AllowedApps,
+		Mode:              p.mode(),
+		LiveCheck:         conf.RequireTwitchLive && p.mode() != ModeIngest,
+		RequiredPlatforms: []string{},
+		AnyPlatforms:      []string{},
+		MinViewers:        p.minViewers(),
+		Maintenance:       c.maintenanceActive(),
+		Defaults:          []string{},
+	}
+	if policy.AllowedApps == nil {
+		policy.AllowedApps = []string{}
+	}
+	if len(conf.AllowedApps) > 0 {
+		policy.Defaults = append(policy.Defaults, "ALLOWED_APPS")
+	}
+	if until := c.publishThrottle.Blocked(p.Name, now); !until.IsZero() {
+		policy.ThrottledUntil = &until
+	}
+	if conf.PublishDenyLimit > 0 {
+		policy.Defaults = append(policy.Defaults, "PUBLISH_DENY_LIMIT")
+	}
+	if !policy.LiveCheck {
+		return policy
+	}
+	policy.Defaults = append(policy.Defaults, "REQUIRE_TWITCH_LIVE")
+
+	if len(p.PlatformRoles) == 0 {
+		// without roles only twitch is checked, as in checkPlatforms
+		if p.TwitchStream != "" {
+			policy.RequiredPlatforms = append(policy.RequiredPlatforms, "twitch")
+		} else {
+			policy.NoPlatformDenied = conf.NoPlatformPolicy == "deny"
+			policy.Defaults = append(policy.Defaults, "NO_PLATFORM_POLICY")
+		}
+	}
+	for _, platform := range rolePlatforms {
+		switch p.PlatformRoles[platform] {
+		case RoleRequire:
+			policy.RequiredPlatforms = append(policy.RequiredPlatforms, platform)
+		case RoleAny:
+			policy.AnyPlatforms = append(policy.AnyPlatforms, platform)
+		}
+	}
+	// any platforms are only checked when no platform is required
+	checked := policy.RequiredPlatforms
+	if len(checked) == 0 {
+		checked = policy.AnyPlatforms
+	}
+	if containsString(checked, "twitch") {
+		policy.LiveGracePeriod = conf.LiveGracePeriod.String()
+		if conf.LiveGracePeriod > 0 {
+			policy.Defaults = append(policy.Defaults, "LIVE_GRACE_PERIOD")
+		}
+	}
+	policy.AllowCacheTTL = conf.AllowCacheTTL.String()
+	if conf.AllowCacheTTL > 0 {
+		policy.Defaults = append(policy.Defaults, "ALLOW_CACHE_TTL")
+	}
+	return policy
+}
+
+// getPublisherPolicy responds with the effective policy of the publisher
+// named in the path, for "/api/publishers/{name}/policy"
+func (c *Controller) getPublisherPolicy(w http.ResponseWriter, r *http.Request, name string) {
+	logger := requestLogger(r)
+
+	p, err := c.getPublisher(name)
+	if err != nil {
+		logger.Debugf("error retrieving publisher '%s': %s", name, err)
+		writeAPIError(w, err)
+		return
+	}
+	content, err := json.Marshal(c.publisherPolicy(p, time.Now()))
+	if err != nil {
+		logger.Debug(err)
+		writeStatusError(w, http.StatusInternalServerError)
+		return
+	}
+	logger.Infof("listing policy of publisher %s", p.Name)
+	w.Write(content)
+}
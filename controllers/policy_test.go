@@ -0,0 +1,100 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bcambl/rtmpauthbot/config"
+	"github.com/bcambl/rtmpauthbot/internal/testutil"
+)
+
+func TestPublisherPolicy(t *testing.T) {
+	c := newTestController(t, &testutil.TwitchStub{}, func(conf *config.Config) {
+		conf.RequireTwitchLive = true
+		conf.LiveGracePeriod = 2 * time.Minute
+		conf.AllowCacheTTL = 0
+		conf.PublishDenyLimit = 3
+		conf.AllowedApps = []string{"stream", "live"}
+		conf.NoPlatformPolicy = "deny"
+	})
+	from := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	createPublisher(t, c, `{"name":"alice","key":"secret","twitch_stream":"alice"}`)
+	createPublisher(t, c, `{"name":"bob","key":"secret","twitch_stream":"bob","enabled":false,"app":"live",`+
+		`"mode":"ingest","min_viewers":5,"active_from":"`+from.Format(time.RFC3339)+`"}`)
+	createPublisher(t, c, `{"name":"carol","key":"secret"}`)
+	createPublisher(t, c, `{"name":"dave","key":"secret","twitch_stream":"dave","trovo_channel":"dave",`+
+		`"platform_roles":{"twitch":"any","trovo":"require"}}`)
+	for i := 0; i < 3; i++ {
+		publish(c, "alice", "wrong")
+	}
+
+	policy := func(name string) PublisherPolicy {
+		t.Helper()
+		w := serve(c.PublishersAPIHandler, "GET", "/api/publishers/"+name+"/policy", "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("policy of %s: got %d %s", name, w.Code, w.Body.String())
+		}
+		var p PublisherPolicy
+		err := json.Unmarshal(w.Body.Bytes(), &p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	// the global defaults apply
+	alice := policy("alice")
+	if alice.ThrottledUntil == nil || !alice.ThrottledUntil.After(time.Now()) {
+		t.Errorf("alice: throttled until %v, want a time after the denies", alice.ThrottledUntil)
+	}
+	alice.ThrottledUntil = nil
+	want := PublisherPolicy{
+		Name: "alice", Enabled: true, ActiveNow: true, AllowedApps: []string{"stream", "live"}, Mode: ModeMirror,
+		LiveCheck: true, RequiredPlatforms: []string{"twitch"}, AnyPlatforms: []string{},
+		LiveGracePeriod: "2m0s", AllowCacheTTL: "0s",
+		Defaults: []string{"ALLOWED_APPS", "PUBLISH_DENY_LIMIT", "REQUIRE_TWITCH_LIVE", "LIVE_GRACE_PERIOD"},
+	}
+	if !reflect.DeepEqual(alice, want) {
+		t.Errorf("alice:\ngot  %+v\nwant %+v", alice, want)
+	}
+
+	// publisher overrides
+	bob := policy("bob")
+	want = PublisherPolicy{
+		Name: "bob", Enabled: false, ActiveNow: false, ActiveFrom: &from, App: "live",
+		AllowedApps: []string{"stream", "live"}, Mode: ModeIngest, LiveCheck: false,
+		RequiredPlatforms: []string{}, AnyPlatforms: []string{}, MinViewers: 5,
+		Defaults: []string{"ALLOWED_APPS", "PUBLISH_DENY_LIMIT"},
+	}
+	if bob.ActiveFrom == nil || !bob.ActiveFrom.Equal(from) {
+		t.Errorf("bob: active from %v, want %s", bob.ActiveFrom, from)
+	}
+	bob.ActiveFrom = &from
+	if !reflect.DeepEqual(bob, want) {
+		t.Errorf("bob:\ngot  %+v\nwant %+v", bob, want)
+	}
+
+	// without a platform NO_PLATFORM_POLICY applies
+	carol := policy("carol")
+	if !carol.NoPlatformDenied || len(carol.RequiredPlatforms) != 0 || !containsString(carol.Defaults, "NO_PLATFORM_POLICY") {
+		t.Errorf("carol: got %+v, want denied by NO_PLATFORM_POLICY", carol)
+	}
+
+	// a required platform makes any platforms informational, so the twitch
+	// grace period does not apply
+	dave := policy("dave")
+	if !reflect.DeepEqual(dave.RequiredPlatforms, []string{"trovo"}) || !reflect.DeepEqual(dave.AnyPlatforms, []string{"twitch"}) {
+		t.Errorf("dave: required %v & any %v, want [trovo] & [twitch]", dave.RequiredPlatforms, dave.AnyPlatforms)
+	}
+	if dave.LiveGracePeriod != "" || containsString(dave.Defaults, "LIVE_GRACE_PERIOD") {
+		t.Errorf("dave: got %+v, want no twitch grace period", dave)
+	}
+
+	w := serve(c.PublishersAPIHandler, "GET", "/api/publishers/nobody/policy", "")
+	if w.Code != c.notFoundStatus() {
+		t.Errorf("policy of an unknown publisher: got %d, want %d", w.Code, c.notFoundStatus())
+	}
+}
@@ -0,0 +1,101 @@
+package controllers
+
+import (
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// publishTimesSinceKey is the ConfigBucket key of the time publish times were
+// first recorded. Publishers created earlier may have published before then.
+const publishTimesSinceKey = "publish_times_since"
+
+// PruneCandidate is a publisher which may be pruned & why
+type PruneCandidate struct {
+	Name   string
+	Reason string
+}
+
+// MigratePublishTimes records when publish times were first recorded so that
+// publishers which existed before then are not considered never published
+func (c *Controller) MigratePublishTimes() error {
+	return c.DB.Update(func(tx *bolt.Tx) error {
+		b := c.bucket(tx, "ConfigBucket")
+		if b == nil {
+			return fmt.Errorf("%w: ConfigBucket", ErrBucketMissing)
+		}
+		if b.Get([]byte(publishTimesSinceKey)) != nil {
+			return nil
+		}
+		return b.Put([]byte(publishTimesSinceKey), formatTimestamp(time.Now()))
+	})
+}
+
+// PruneCandidates returns the publishers, in name order, which have been
+// disabled (and not modified) for longer than disabledFor or have not
+// published for longer than unpublishedFor. A duration of 0 skips that
+// check. Publishers which are live are never candidates.
+func (c *Controller) PruneCandidates(now time.Time, disabledFor, unpublishedFor time.Duration) ([]PruneCandidate, error) {
+	b, err := c.getBucketValue("ConfigBucket", publishTimesSinceKey)
+	if err != nil {
+		return nil, err
+	}
+	// until the server has recorded publish times every publisher is recent
+	since := parseTimestamp(b)
+	if since.IsZero() {
+		since = now
+	}
+
+	candidates := []PruneCandidate{}
+	err = c.forEachPublisher(func(p Publisher) error {
+		if p.RTMPLive == "live" {
+			return nil
+		}
+		if disabledFor > 0 && !p.IsEnabled() && now.Sub(p.UpdatedAt) > disabledFor {
+			candidates = append(candidates, PruneCandidate{
+				Name:   p.Name,
+				Reason: fmt.Sprintf("disabled & not modified since %s", p.UpdatedAt.Format(time.RFC3339)),
+			})
+			return nil
+		}
+		if unpublishedFor <= 0 {
+			return nil
+		}
+		if p.LastPublishedAt != nil {
+			if now.Sub(*p.LastPublishedAt) > unpublishedFor {
+				candidates = append(candidates, PruneCandidate{
+					Name:   p.Name,
+					Reason: fmt.Sprintf("not published since %s", p.LastPublishedAt.Format(time.RFC3339)),
+				})
+			}
+			return nil
+		}
+		first := p.CreatedAt
+		if first.Before(since) {
+			first = since
+		}
+		if now.Sub(first) > unpublishedFor {
+			candidates = append(candidates, PruneCandidate{
+				Name:   p.Name,
+				Reason: fmt.Sprintf("never published since %s", first.Format(time.RFC3339)),
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return candidates, nil
+}
+
+// PrunePublishers deletes the candidates returned by PruneCandidates
+func (c *Controller) PrunePublishers(candidates []PruneCandidate) error {
+	for _, candidate := range candidates {
+		err := c.deletePublisher(candidate.Name)
+		if err != nil {
+			return fmt.Errorf("error deleting publisher '%s': %w", candidate.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package controllers
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bcambl/rtmpauthbot/config"
+	"github.com/bcambl/rtmpauthbot/internal/testutil"
+)
+
+func TestPrunePublishers(t *testing.T) {
+	c := newTestController(t, &testutil.TwitchStub{}, func(conf *config.Config) {
+		conf.RequireTwitchLive = false
+		conf.AllowedApps = nil
+	})
+	for _, name := range []string{"alice", "bob", "carol", "dave"} {
+		createPublisher(t, c, `{"name":"`+name+`","key":"secret"}`)
+	}
+	now := time.Now()
+	days := func(n int) time.Time { return now.Add(time.Duration(n) * 24 * time.Hour) }
+	cutoff := 90 * 24 * time.Hour
+
+	names := func(at time.Time) []string {
+		t.Helper()
+		candidates, err := c.PruneCandidates(at, cutoff, cutoff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := []string{}
+		for _, candidate := range candidates {
+			names = append(names, candidate.Name)
+		}
+		return names
+	}
+
+	// publishers which existed before publish times were recorded are recent
+	if got := names(days(100)); len(got) != 0 {
+		t.Fatalf("candidates before publish times were recorded: %v", got)
+	}
+	err := c.MigratePublishTimes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// alice is live, bob disabled, carol never published & dave published
+	if status := publish(c, "alice", "secret"); status != http.StatusCreated {
+		t.Fatalf("publish alice: got %d", status)
+	}
+	w := serve(c.PublishersAPIHandler, "PUT", "/api/publishers/bob", `{"key":"secret","enabled":false}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("disable bob: got %d %s", w.Code, w.Body.String())
+	}
+	if status := publish(c, "dave", "secret"); status != http.StatusCreated {
+		t.Fatalf("publish dave: got %d", status)
+	}
+	form := url.Values{"name": {"dave"}, "key": {"secret"}, "app": {"stream"}}
+	serve(c.OnPublishDoneHandler, "POST", "/on_publish_done", form.Encode())
+
+	if got := names(days(30)); len(got) != 0 {
+		t.Errorf("candidates within the cutoff: %v", got)
+	}
+	want := []string{"bob", "carol", "dave"}
+	if got := names(days(100)); !reflect.DeepEqual(got, want) {
+		t.Fatalf("candidates past the cutoff: got %v, want %v", got, want)
+	}
+
+	// listing the candidates deletes nothing, pruning deletes only those given
+	if got := publisherNames(t, c); len(got) != 4 {
+		t.Fatalf("publishers after listing the candidates: %v", got)
+	}
+	candidates, err := c.PruneCandidates(days(100), cutoff, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.PrunePublishers(candidates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := publisherNames(t, c); !reflect.DeepEqual(got, []string{"alice", "carol", "dave"}) {
+		t.Errorf("publishers after pruning the disabled ones: %v", got)
+	}
+	candidates, err = c.PruneCandidates(days(100), cutoff, cutoff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.PrunePublishers(candidates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := publisherNames(t, c); !reflect.DeepEqual(got, []string{"alice"}) {
+		t.Errorf("publishers after pruning: %v", got)
+	}
+}
@@ -1,25 +1,91 @@
 package controllers
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	bolt "go.etcd.io/bbolt"
 )
 
-// Publisher struct contains rtmp stream name, stream key, twitch channel name
+// Publisher struct contains rtmp stream name, stream key, twitch channel name.
+// The json field names are part of the api (see openapi.go) and must not be
+// renamed along with the go fields.
 type Publisher struct {
-	Name               string `json:"name"`
-	Key                string `json:"key"`
-	RTMPLive           string `json:"rtmp_live"`
-	TwitchStream       string `json:"twitch_stream"`
-	TwitchLive         string `json:"twitch_live"`
-	TwitchNotification string `json:"-"`
-	StreamInfo         string `json:"-"`
+	Name               string            `json:"name"`
+	Key                string            `json:"key"`
+	RTMPLive           string            `json:"rtmp_live"`
+	TwitchStream       string            `json:"twitch_stream"`
+	TwitchLive         string            `json:"twitch_live"`
+	TrovoChannel       *string           `json:"trovo_channel,omitempty"`
+	App                *string           `json:"app,omitempty"`
+	Mode               *string           `json:"mode,omitempty"`
+	ThumbnailURL       string            `json:"thumbnail_url,omitempty"`
+	ViewerCount        int               `json:"viewer_count,omitempty"`
+	Title              string            `json:"title,omitempty"`
+	MinViewers         *int              `json:"min_viewers,omitempty"`
+	Enabled            *bool             `json:"enabled,omitempty"`
+	Tags               []string          `json:"tags,omitempty"`
+	Metadata           map[string]string `json:"metadata,omitempty"`
+	PlatformRoles      map[string]string `json:"platform_roles,omitempty"`
+	WebhookURL         *string           `json:"webhook_url,omitempty"`
+	ActiveFrom         *time.Time        `json:"active_from,omitempty"`
+	ActiveUntil        *time.Time        `json:"active_until,omitempty"`
+	LastRecording      string            `json:"last_recording,omitempty"`
+	LastPublishedAt    *time.Time        `json:"last_published_at,omitempty"`
+	CreatedAt          time.Time         `json:"created_at"`
+	UpdatedAt          time.Time         `json:"updated_at"`
+	TwitchNotification string            `json:"-"`
+	StreamInfo         string            `json:"-"`
 }
 
+// reservedNames are names which are routed elsewhere under /api/publishers/,
+// so a publisher with the name could not be retrieved, updated or deleted
+var reservedNames = []string{"sync"}
+
+// Publisher modes
+const (
+	// ModeMirror publishers stream to twitch at the same time as the rtmp
+	// server, so they are subject to REQUIRE_TWITCH_LIVE. This is the default.
+	ModeMirror = "mirror"
+	// ModeIngest publishers only stream to the rtmp server (which may restream
+	// to twitch itself), so the twitch live check is always skipped.
+	ModeIngest = "ingest"
+)
+
+// Platform roles decide which platforms a mirror publisher must be live on
+// for REQUIRE_TWITCH_LIVE. Without any roles only twitch is checked.
+const (
+	// RoleRequire platforms must all be live
+	RoleRequire = "require"
+	// RoleAny platforms are informational when a platform is required,
+	// otherwise at least one of them must be live
+	RoleAny = "any"
+)
+
+// rolePlatforms are the platforms which may be given a role
+var rolePlatforms = []string{"twitch", "trovo"}
+
+// createdAtSentinel is the creation time assigned to publishers which were
+// created before creation times were recorded
+var createdAtSentinel = time.Unix(0, 0).UTC()
+
+// graceRetryWindow is how long after the grace period has passed the retries
+// of nginx still belong to the same attempt to go live. An older first attempt
+// starts a new grace period, so a publisher gets one on every go-live.
+const graceRetryWindow = 5 * time.Minute
+
 // IsValid perform basic validations on a publisher record
 func (p *Publisher) IsValid() error {
 	var err error
@@ -27,13 +93,144 @@ func (p *Publisher) IsValid() error {
 		err = errors.New("missing parameter: name")
 		return err
 	}
+	if containsString(reservedNames, p.Name) {
+		err = fmt.Errorf("invalid name: '%s' is reserved", p.Name)
+		return err
+	}
 	if len(p.Key) < 1 {
 		err = errors.New("missing parameter: key")
 		return err
 	}
+	if p.Key == maskedKey {
+		// masked output posted back, e.g. a sync of GET /api/publisher
+		err = errors.New("invalid key: the key is masked, use revealKey=true")
+		return err
+	}
+	switch p.mode() {
+	case ModeMirror, ModeIngest:
+	default:
+		err = fmt.Errorf("invalid mode: '%s' (must be %s or %s)", p.mode(), ModeMirror, ModeIngest)
+		return err
+	}
+	if p.MinViewers != nil && *p.MinViewers < 0 {
+		err = fmt.Errorf("invalid min_viewers: %d", *p.MinViewers)
+		return err
+	}
+	if p.ActiveFrom != nil && p.ActiveUntil != nil && !p.ActiveFrom.IsZero() &&
+		!p.ActiveUntil.IsZero() && !p.ActiveUntil.After(*p.ActiveFrom) {
+		err = errors.New("invalid active window: active_until must be after active_from")
+		return err
+	}
+	for i := range p.Tags {
+		if strings.TrimSpace(p.Tags[i]) == "" || strings.Contains(p.Tags[i], ",") {
+			err = fmt.Errorf("invalid tag: '%s'", p.Tags[i])
+			return err
+		}
+	}
+	if p.webhookURL() != "" {
+		u, err := url.Parse(p.webhookURL())
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("invalid webhook_url: must be an http(s) url")
+		}
+	}
+	for platform, role := range p.PlatformRoles {
+		if !containsString(rolePlatforms, platform) {
+			err = fmt.Errorf("invalid platform_roles platform: '%s' (must be one of %s)", platform, strings.Join(rolePlatforms, ", "))
+			return err
+		}
+		if role != RoleRequire && role != RoleAny {
+			err = fmt.Errorf("invalid platform_roles role for %s: '%s' (must be %s or %s)", platform, role, RoleRequire, RoleAny)
+			return err
+		}
+	}
+	return nil
+}
+
+func containsString(list []string, value string) bool {
+	for i := range list {
+		if list[i] == value {
+			return true
+		}
+	}
+	return false
+}
+
+// trovoChannel returns the publisher's trovo channel, which may be empty
+func (p *Publisher) trovoChannel() string {
+	if p.TrovoChannel == nil {
+		return ""
+	}
+	return *p.TrovoChannel
+}
+
+// mode returns the publish mode of the publisher, mirror unless set
+func (p *Publisher) mode() string {
+	if p.Mode == nil || *p.Mode == "" {
+		return ModeMirror
+	}
+	return *p.Mode
+}
+
+// app returns the rtmp app the publisher's key is restricted to, which may be
+// empty for any app
+func (p *Publisher) app() string {
+	if p.App == nil {
+		return ""
+	}
+	return *p.App
+}
+
+// webhookURL returns the publisher's own webhook url, which may be empty
+func (p *Publisher) webhookURL() string {
+	if p.WebhookURL == nil {
+		return ""
+	}
+	return *p.WebhookURL
+}
+
+// IsEnabled returns false only when the publisher has been explicitly disabled
+func (p *Publisher) IsEnabled() bool {
+	return p.Enabled == nil || *p.Enabled
+}
+
+// activeAt returns an error when the time is outside the active window of the
+// publisher. A zero or missing bound leaves that side of the window open.
+func (p *Publisher) activeAt(now time.Time) error {
+	if p.ActiveFrom != nil && !p.ActiveFrom.IsZero() && now.Before(*p.ActiveFrom) {
+		return fmt.Errorf("%w: %s is active from %s", ErrInactive, p.Name, p.ActiveFrom.UTC().Format(time.RFC3339))
+	}
+	if p.ActiveUntil != nil && !p.ActiveUntil.IsZero() && !now.Before(*p.ActiveUntil) {
+		return fmt.Errorf("%w: %s was active until %s", ErrInactive, p.Name, p.ActiveUntil.UTC().Format(time.RFC3339))
+	}
 	return nil
 }
 
+// minViewers returns the twitch viewer count required to count as live
+func (p *Publisher) minViewers() int {
+	if p.MinViewers == nil {
+		return 0
+	}
+	return *p.MinViewers
+}
+
+// HasTag returns true when the publisher carries the provided tag
+func (p *Publisher) HasTag(tag string) bool {
+	for i := range p.Tags {
+		if p.Tags[i] == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// splitList converts a comma separated bucket value into a slice
+func splitList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
 // IsTwitchLive returns a boolean based on string value of TwitchLive field
 func (p *Publisher) IsTwitchLive() bool {
 	if p.TwitchLive != "" {
@@ -44,60 +241,342 @@ func (p *Publisher) IsTwitchLive() bool {
 
 // FetchPublisher populates the publisher struct from the database
 func (c *Controller) FetchPublisher(p *Publisher) error {
+	return c.DB.View(func(tx *bolt.Tx) error {
+		return c.fetchPublisher(tx, p)
+	})
+}
+
+// fetchPublisher populates the publisher struct within a transaction
+func (c *Controller) fetchPublisher(tx *bolt.Tx, p *Publisher) error {
 	var b []byte
 	var err error
-	b, err = c.getBucketValue("RTMPLiveBucket", p.Name)
+	b, err = c.bucketValue(tx, "RTMPLiveBucket", p.Name)
 	if err != nil {
 		return err
 	}
 	p.RTMPLive = string(b)
-	b, err = c.getBucketValue("TwitchStreamBucket", p.Name)
+	b, err = c.bucketValue(tx, "TwitchStreamBucket", p.Name)
 	if err != nil {
 		return err
 	}
 	p.TwitchStream = string(b)
-	b, err = c.getBucketValue("TwitchLiveBucket", p.Name)
+	b, err = c.bucketValue(tx, "TwitchLiveBucket", p.Name)
 	if err != nil {
 		return err
 	}
 	p.TwitchLive = string(b)
-	b, err = c.getBucketValue("TwitchNotificationBucket", p.Name)
+	b, err = c.bucketValue(tx, "TrovoChannelBucket", p.Name)
+	if err != nil {
+		return err
+	}
+	p.TrovoChannel = nil
+	if len(b) > 0 {
+		trovoChannel := string(b)
+		p.TrovoChannel = &trovoChannel
+	}
+	b, err = c.bucketValue(tx, "TwitchNotificationBucket", p.Name)
 	if err != nil {
 		return err
 	}
 	p.TwitchNotification = string(b)
-	b, err = c.getBucketValue("StreamInfoBucket", p.Name)
+	b, err = c.bucketValue(tx, "StreamInfoBucket", p.Name)
 	if err != nil {
 		return err
 	}
 	p.StreamInfo = string(b)
+	b, err = c.bucketValue(tx, "ThumbnailBucket", p.Name)
+	if err != nil {
+		return err
+	}
+	p.ThumbnailURL = string(b)
+	b, err = c.bucketValue(tx, "ViewersBucket", p.Name)
+	if err != nil {
+		return err
+	}
+	p.ViewerCount, _ = strconv.Atoi(string(b))
+	b, err = c.bucketValue(tx, "TitleBucket", p.Name)
+	if err != nil {
+		return err
+	}
+	p.Title = string(b)
+	b, err = c.bucketValue(tx, "MinViewersBucket", p.Name)
+	if err != nil {
+		return err
+	}
+	minViewers, _ := strconv.Atoi(string(b))
+	p.MinViewers = &minViewers
+	b, err = c.bucketValue(tx, "AppBucket", p.Name)
+	if err != nil {
+		return err
+	}
+	p.App = nil
+	if len(b) > 0 {
+		app := string(b)
+		p.App = &app
+	}
+	b, err = c.bucketValue(tx, "ModeBucket", p.Name)
+	if err != nil {
+		return err
+	}
+	mode := string(b)
+	if mode == "" {
+		mode = ModeMirror
+	}
+	p.Mode = &mode
+	b, err = c.bucketValue(tx, "DisabledBucket", p.Name)
+	if err != nil {
+		return err
+	}
+	enabled := len(b) == 0
+	p.Enabled = &enabled
+	b, err = c.bucketValue(tx, "TagsBucket", p.Name)
+	if err != nil {
+		return err
+	}
+	p.Tags = splitList(string(b))
+	b, err = c.bucketValue(tx, "MetadataBucket", p.Name)
+	if err != nil {
+		return err
+	}
+	p.Metadata = nil
+	if len(b) > 0 {
+		err = json.Unmarshal(b, &p.Metadata)
+		if err != nil {
+			return err
+		}
+	}
+	b, err = c.bucketValue(tx, "PlatformRolesBucket", p.Name)
+	if err != nil {
+		return err
+	}
+	p.PlatformRoles = nil
+	if len(b) > 0 {
+		err = json.Unmarshal(b, &p.PlatformRoles)
+		if err != nil {
+			return err
+		}
+	}
+	b, err = c.bucketValue(tx, "WebhookBucket", p.Name)
+	if err != nil {
+		return err
+	}
+	p.WebhookURL = nil
+	if len(b) > 0 {
+		webhookURL := string(b)
+		p.WebhookURL = &webhookURL
+	}
+	b, err = c.bucketValue(tx, "CreatedAtBucket", p.Name)
+	if err != nil {
+		return err
+	}
+	p.CreatedAt = parseTimestamp(b)
+	b, err = c.bucketValue(tx, "UpdatedAtBucket", p.Name)
+	if err != nil {
+		return err
+	}
+	p.UpdatedAt = parseTimestamp(b)
+	b, err = c.bucketValue(tx, "ActiveFromBucket", p.Name)
+	if err != nil {
+		return err
+	}
+	p.ActiveFrom = optionalTimestamp(b)
+	b, err = c.bucketValue(tx, "ActiveUntilBucket", p.Name)
+	if err != nil {
+		return err
+	}
+	p.ActiveUntil = optionalTimestamp(b)
+	b, err = c.bucketValue(tx, "RecordingBucket", p.Name)
+	if err != nil {
+		return err
+	}
+	p.LastRecording = string(b)
+	b, err = c.bucketValue(tx, "LastPublishedBucket", p.Name)
+	if err != nil {
+		return err
+	}
+	p.LastPublishedAt = optionalTimestamp(b)
 
 	return nil
 }
 
-func (c *Controller) getAllPublisher() ([]Publisher, error) {
-	var err error
-	publishers := []Publisher{}
-	c.DB.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("PublisherBucket"))
-		c := b.Cursor()
-		for k, v := c.First(); k != nil; k, v = c.Next() {
-			var p Publisher
-			p.Name = string(k)
-			p.Key = string(v)
-			publishers = append(publishers, p)
+// optionalTimestamp converts a timestamp bucket value into a time, or nil
+// when the value is missing or invalid
+func optionalTimestamp(value []byte) *time.Time {
+	t := parseTimestamp(value)
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// parseTimestamp converts a timestamp bucket value into a time. Missing or
+// invalid values result in the zero time.
+func parseTimestamp(value []byte) time.Time {
+	t, err := time.Parse(time.RFC3339, string(value))
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+func formatTimestamp(t time.Time) []byte {
+	return []byte(t.UTC().Format(time.RFC3339))
+}
+
+// windowTimestamp converts an active window bound into a bucket value, which
+// is empty for the zero time
+func windowTimestamp(t time.Time) []byte {
+	if t.IsZero() {
+		return []byte("")
+	}
+	return formatTimestamp(t)
+}
+
+// touchPublisher bumps the modified time of a publisher within a transaction
+func (c *Controller) touchPublisher(tx *bolt.Tx, name string, now time.Time) error {
+	return c.bucket(tx, "UpdatedAtBucket").Put([]byte(name), formatTimestamp(now))
+}
+
+// sortPublishers sorts publishers by name, created_at or updated_at
+func sortPublishers(publishers []Publisher, field string, descending bool) error {
+	var less func(i, j int) bool
+	switch field {
+	case "", "name":
+		less = func(i, j int) bool { return publishers[i].Name < publishers[j].Name }
+	case "created_at":
+		less = func(i, j int) bool { return publishers[i].CreatedAt.Before(publishers[j].CreatedAt) }
+	case "updated_at":
+		less = func(i, j int) bool { return publishers[i].UpdatedAt.Before(publishers[j].UpdatedAt) }
+	default:
+		return fmt.Errorf("invalid sort field: '%s'", field)
+	}
+	if descending {
+		asc := less
+		less = func(i, j int) bool { return asc(j, i) }
+	}
+	sort.SliceStable(publishers, less)
+	return nil
+}
+
+// MigrateTimestamps backfills the creation time of publishers which were
+// created before creation times were recorded
+func (c *Controller) MigrateTimestamps() error {
+	return c.DB.Update(func(tx *bolt.Tx) error {
+		created := c.bucket(tx, "CreatedAtBucket")
+		updated := c.bucket(tx, "UpdatedAtBucket")
+		cur := c.bucket(tx, "PublisherBucket").Cursor()
+		for k, _ := cur.First(); k != nil; k, _ = cur.Next() {
+			if created.Get(k) != nil {
+				continue
+			}
+			log.Debugf("backfilling creation time for %s", string(k))
+			err := created.Put(k, formatTimestamp(createdAtSentinel))
+			if err != nil {
+				return err
+			}
+			if updated.Get(k) == nil {
+				err = updated.Put(k, formatTimestamp(createdAtSentinel))
+				if err != nil {
+					return err
+				}
+			}
 		}
 		return nil
 	})
+}
 
-	for i := range publishers {
-		p := &publishers[i]
-		err = c.FetchPublisher(p)
-		if err != nil {
-			return nil, err
+// checkPublisherLimit returns ErrPublisherLimit when creating the provided
+// number of publishers would exceed MAX_PUBLISHERS
+func (c *Controller) checkPublisherLimit(b *bolt.Bucket, creating int) error {
+	limit := c.cfg().MaxPublishers
+	if limit <= 0 || creating <= 0 {
+		return nil
+	}
+	count := b.Stats().KeyN
+	if count+creating > limit {
+		return fmt.Errorf("%w: %d of %d publishers exist", ErrPublisherLimit, count, limit)
+	}
+	return nil
+}
+
+// publishersChanged invalidates the cached twitch logins. It must be called
+// after creating, updating or deleting a publisher.
+func (c *Controller) publishersChanged() {
+	atomic.AddUint64(&c.publisherGen, 1)
+}
+
+// twitchLogins returns the distinct lowercased twitch logins of all
+// publishers. The list is cached until publishersChanged is called, so that
+// each poll does not decode every publisher from the database.
+func (c *Controller) twitchLogins() ([]string, error) {
+	gen := atomic.LoadUint64(&c.publisherGen)
+	c.loginsMu.Lock()
+	if c.loginsCached && c.loginsGen == gen {
+		logins := c.logins
+		c.loginsMu.Unlock()
+		return logins, nil
+	}
+	c.loginsMu.Unlock()
+
+	// publishers may share a twitch login, which is only queried once
+	var logins []string
+	seen := make(map[string]bool)
+	err := c.forEachPublisher(func(p Publisher) error {
+		login := strings.ToLower(p.TwitchStream)
+		if login != "" && !seen[login] {
+			seen[login] = true
+			logins = append(logins, login)
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
+	// a change during the read leaves the cache invalid as gen is outdated
+	c.loginsMu.Lock()
+	c.logins = logins
+	c.loginsGen = gen
+	c.loginsCached = true
+	c.loginsMu.Unlock()
+	return logins, nil
+}
+
+// forEachPublisher calls fn with each publisher in name order from a single
+// read transaction, without loading every publisher into memory. The
+// transaction is held open while fn runs, so fn must not modify the
+// database or block. Iteration stops at the first error returned by fn.
+func (c *Controller) forEachPublisher(fn func(Publisher) error) error {
+	return c.DB.View(func(tx *bolt.Tx) error {
+		b := c.bucket(tx, "PublisherBucket")
+		if b == nil {
+			return fmt.Errorf("%w: PublisherBucket", ErrBucketMissing)
+		}
+		cur := b.Cursor()
+		for k, v := cur.First(); k != nil; k, v = cur.Next() {
+			p := Publisher{Name: string(k), Key: string(v)}
+			err := c.fetchPublisher(tx, &p)
+			if err != nil {
+				return err
+			}
+			err = fn(p)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (c *Controller) getAllPublisher() ([]Publisher, error) {
+	publishers := []Publisher{}
+	err := c.forEachPublisher(func(p Publisher) error {
+		publishers = append(publishers, p)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 	return publishers, nil
 }
 
@@ -105,7 +584,7 @@ func (c *Controller) getPublisher(name string) (Publisher, error) {
 	var keyBytes []byte
 	var err error
 
-	p := Publisher{}
+	p := Publisher{Name: name}
 
 	keyBytes, err = c.getBucketValue("PublisherBucket", name)
 	if err != nil {
@@ -114,7 +593,7 @@ func (c *Controller) getPublisher(name string) (Publisher, error) {
 	p.Key = string(keyBytes)
 
 	if len(p.Key) < 1 {
-		return p, errors.New("publisher not found")
+		return p, ErrPublisherNotFound
 	}
 
 	err = c.FetchPublisher(&p)
@@ -125,41 +604,177 @@ func (c *Controller) getPublisher(name string) (Publisher, error) {
 	return p, nil
 }
 
-func (c *Controller) updatePublisher(p Publisher) error {
-	var err error
-	c.DB.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("PublisherBucket"))
-		err = b.Put([]byte(p.Name), []byte(p.Key))
-		return err
+// updatePublisher creates or updates a publisher, returning true when it was
+// created. Both are decided within the transaction, so concurrent requests
+// for the same name report a single creation.
+func (c *Controller) updatePublisher(p Publisher) (bool, error) {
+	defer c.publishersChanged()
+	created := false
+	err := c.DB.Update(func(tx *bolt.Tx) error {
+		created = c.bucket(tx, "PublisherBucket").Get([]byte(p.Name)) == nil
+		if created {
+			err := c.checkPublisherLimit(c.bucket(tx, "PublisherBucket"), 1)
+			if err != nil {
+				return err
+			}
+		}
+		return c.updatePublisherTx(tx, p, time.Now())
 	})
+	if err != nil {
+		return false, err
+	}
+	return created, nil
+}
+
+// updatePublisherTx creates or updates a publisher within a transaction.
+// Fields which are not provided are left as they are. The publisher limit
+// is left to the caller, as the bucket stats do not include the writes of
+// the transaction.
+func (c *Controller) updatePublisherTx(tx *bolt.Tx, p Publisher, now time.Time) error {
+	b := c.bucket(tx, "PublisherBucket")
+	if b.Get([]byte(p.Name)) == nil {
+		// new publisher, record the creation time
+		err := c.bucket(tx, "CreatedAtBucket").Put([]byte(p.Name), formatTimestamp(now))
+		if err != nil {
+			return err
+		}
+	}
+	err := b.Put([]byte(p.Name), []byte(p.Key))
+	if err != nil {
+		return err
+	}
+	err = c.touchPublisher(tx, p.Name, now)
+	if err != nil {
+		return err
+	}
 
 	// debug only. live status is managed internally
-	// c.DB.Update(func(tx *bolt.Tx) error {
-	// 	b := tx.Bucket([]byte("RTMPLiveBucket"))
-	// 	err = b.Put([]byte(p.Name), []byte(p.LocalLive))
-	// 	return err
-	// })
+	// err = c.bucket(tx, "RTMPLiveBucket").Put([]byte(p.Name), []byte(p.LocalLive))
 
 	if p.TwitchStream != "" {
 		// only update the stream if a value is provided
-		c.DB.Update(func(tx *bolt.Tx) error {
-			b := tx.Bucket([]byte("TwitchStreamBucket"))
-			err = b.Put([]byte(p.Name), []byte(p.TwitchStream))
+		err = c.bucket(tx, "TwitchStreamBucket").Put([]byte(p.Name), []byte(p.TwitchStream))
+		if err != nil {
+			return err
+		}
+	}
+
+	if p.TrovoChannel != nil {
+		// only update the trovo channel if a value is provided, "" clears it
+		err = c.bucket(tx, "TrovoChannelBucket").Put([]byte(p.Name), []byte(*p.TrovoChannel))
+		if err != nil {
+			return err
+		}
+	}
+
+	if p.App != nil {
+		// only update the app if a value is provided, "" clears it
+		err = c.bucket(tx, "AppBucket").Put([]byte(p.Name), []byte(*p.App))
+		if err != nil {
+			return err
+		}
+	}
+
+	if p.Mode != nil {
+		// only update the mode if a value is provided, "" resets it to mirror
+		err = c.bucket(tx, "ModeBucket").Put([]byte(p.Name), []byte(*p.Mode))
+		if err != nil {
+			return err
+		}
+	}
+
+	if p.MinViewers != nil {
+		// only update the minimum viewers if a value is provided
+		err = c.bucket(tx, "MinViewersBucket").Put([]byte(p.Name), []byte(strconv.Itoa(*p.MinViewers)))
+		if err != nil {
+			return err
+		}
+	}
+
+	if p.Enabled != nil {
+		// only update the enabled state if a value is provided
+		disabled := ""
+		if !*p.Enabled {
+			disabled = "disabled"
+		}
+		err = c.bucket(tx, "DisabledBucket").Put([]byte(p.Name), []byte(disabled))
+		if err != nil {
+			return err
+		}
+	}
+
+	if p.Tags != nil {
+		// only update the tags if a value is provided
+		err = c.bucket(tx, "TagsBucket").Put([]byte(p.Name), []byte(strings.Join(p.Tags, ",")))
+		if err != nil {
+			return err
+		}
+	}
+
+	if p.ActiveFrom != nil {
+		// only update the window if a value is provided, the zero time clears it
+		err = c.bucket(tx, "ActiveFromBucket").Put([]byte(p.Name), windowTimestamp(*p.ActiveFrom))
+		if err != nil {
+			return err
+		}
+	}
+
+	if p.ActiveUntil != nil {
+		// only update the window if a value is provided, the zero time clears it
+		err = c.bucket(tx, "ActiveUntilBucket").Put([]byte(p.Name), windowTimestamp(*p.ActiveUntil))
+		if err != nil {
+			return err
+		}
+	}
+
+	if p.Metadata != nil {
+		// only update the metadata if a value is provided
+		metadata, err := json.Marshal(p.Metadata)
+		if err != nil {
+			return err
+		}
+		err = c.bucket(tx, "MetadataBucket").Put([]byte(p.Name), metadata)
+		if err != nil {
+			return err
+		}
+	}
+
+	if p.WebhookURL != nil {
+		// only update the webhook if a value is provided, "" clears it
+		err = c.bucket(tx, "WebhookBucket").Put([]byte(p.Name), []byte(*p.WebhookURL))
+		if err != nil {
 			return err
-		})
+		}
+	}
+
+	if p.PlatformRoles != nil {
+		// only update the roles if a value is provided, {} clears them
+		roles, err := json.Marshal(p.PlatformRoles)
+		if err != nil {
+			return err
+		}
+		err = c.bucket(tx, "PlatformRolesBucket").Put([]byte(p.Name), roles)
+		if err != nil {
+			return err
+		}
 	}
 
 	// debug only. live status is managed internally
-	// c.DB.Update(func(tx *bolt.Tx) error {
-	// 	b := tx.Bucket([]byte("TwitchLiveBucket"))
-	// 	err = b.Put([]byte(p.Name), []byte(p.TwitchLive))
-	// 	return err
-	// })
+	// err = c.bucket(tx, "TwitchLiveBucket").Put([]byte(p.Name), []byte(p.TwitchLive))
 
 	return nil
 }
 
 func (c *Controller) deletePublisher(name string) error {
+	defer c.publishersChanged()
+	return c.DB.Update(func(tx *bolt.Tx) error {
+		return c.deletePublisherTx(tx, name)
+	})
+}
+
+// deletePublisherTx deletes a publisher from every bucket within a
+// transaction
+func (c *Controller) deletePublisherTx(tx *bolt.Tx, name string) error {
 	log.Debug("deleting ", name)
 	buckets := []string{
 		"PublisherBucket",
@@ -167,84 +782,508 @@ func (c *Controller) deletePublisher(name string) error {
 		"TwitchStreamBucket",
 		"TwitchLiveBucket",
 		"TwitchNotificationBucket",
+		"DisabledBucket",
+		"TagsBucket",
+		"CreatedAtBucket",
+		"UpdatedAtBucket",
+		"PublishAttemptBucket",
+		"MetadataBucket",
+		"AppBucket",
+		"ThumbnailBucket",
+		"ModeBucket",
+		"ViewersBucket",
+		"MinViewersBucket",
+		"TitleBucket",
+		"TrovoChannelBucket",
+		"SessionSeenBucket",
+		"SessionBucket",
+		"ActiveFromBucket",
+		"ActiveUntilBucket",
+		"RecordingBucket",
+		"LastPublishedBucket",
+		"PlatformRolesBucket",
+		"WebhookBucket",
 	}
 	for i := range buckets {
-		c.DB.Update(func(tx *bolt.Tx) error {
-			b := tx.Bucket([]byte(buckets[i]))
-			err := b.Delete([]byte(name))
+		err := c.bucket(tx, buckets[i]).Delete([]byte(name))
+		if err != nil {
 			return err
-		})
+		}
 	}
 	return nil
 }
 
+// setTagEnabled enables or disables all publishers carrying a tag within a
+// single transaction and returns the number of publishers affected
+func (c *Controller) setTagEnabled(tag string, enabled bool) (int, error) {
+	var count int
+	now := time.Now()
+	disabled := ""
+	if !enabled {
+		disabled = "disabled"
+	}
+	err := c.DB.Update(func(tx *bolt.Tx) error {
+		tags := c.bucket(tx, "TagsBucket")
+		d := c.bucket(tx, "DisabledBucket")
+		cur := c.bucket(tx, "PublisherBucket").Cursor()
+		for k, _ := cur.First(); k != nil; k, _ = cur.Next() {
+			p := Publisher{Name: string(k), Tags: splitList(string(tags.Get(k)))}
+			if !p.HasTag(tag) {
+				continue
+			}
+			err := d.Put(k, []byte(disabled))
+			if err != nil {
+				return err
+			}
+			err = c.touchPublisher(tx, p.Name, now)
+			if err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// checkTwitchLive returns an error when a publisher with a twitch stream is
+// not live on twitch. Twitch may report a stream as live several seconds
+// after it started, so a publisher is allowed for the configured grace
+// period following their first publish attempt.
+func (c *Controller) checkTwitchLive(p Publisher) error {
+	if p.TwitchStream == "" {
+		if c.cfg().NoPlatformPolicy == "deny" {
+			return fmt.Errorf("%w: %s has no twitch stream configured", ErrNotLive, p.Name)
+		}
+		return nil
+	}
+	if p.IsTwitchLive() && p.ViewerCount >= p.minViewers() {
+		return nil
+	}
+	// the poller may not have caught up yet, check twitch directly
+	stream, live, lookupErr := c.lookupTwitchLive(p.TwitchStream)
+	if lookupErr != nil {
+		log.Warnf("error checking twitch live status of %s: %s", p.TwitchStream, lookupErr)
+	}
+	if live && stream.ViewerCount >= p.minViewers() {
+		return nil
+	}
+	if grace := c.cfg().LiveGracePeriod; grace > 0 {
+		now := time.Now()
+		b, err := c.getBucketValue("PublishAttemptBucket", p.Name)
+		if err != nil {
+			return err
+		}
+		firstAttempt := parseTimestamp(b)
+		// a read-only server cannot record an attempt, so it only applies the
+		// grace period of an attempt recorded by the server writing the database
+		if (firstAttempt.IsZero() || now.Sub(firstAttempt) >= grace+graceRetryWindow) && !c.cfg().ReadOnlyDB {
+			firstAttempt = now
+			err = c.setBucketValue("PublishAttemptBucket", p.Name, string(formatTimestamp(now)))
+			if err != nil {
+				return err
+			}
+		}
+		if now.Sub(firstAttempt) < grace {
+			log.Infof("%s is not live on twitch yet, allowing within grace period", p.Name)
+			return nil
+		}
+	}
+	if lookupErr != nil {
+		// twitch could not tell, which is not the same as not being live
+		return fmt.Errorf("checking twitch live status of %s: %w", p.TwitchStream, lookupErr)
+	}
+	if live {
+		return fmt.Errorf("%w: %s has %d twitch viewers (minimum: %d)",
+			ErrNotLive, p.Name, stream.ViewerCount, p.minViewers())
+	}
+	return fmt.Errorf("%w: %s is not live on twitch (%s)", ErrNotLive, p.Name, p.TwitchStream)
+}
+
+// checkPlatforms returns an error when a mirror publisher is not live on the
+// platforms its roles require. Publishers without roles are only checked on
+// twitch, as before roles existed.
+func (c *Controller) checkPlatforms(p Publisher) error {
+	if len(p.PlatformRoles) == 0 {
+		return c.checkTwitchLive(p)
+	}
+	var required, optional []string
+	for _, platform := range rolePlatforms {
+		switch p.PlatformRoles[platform] {
+		case RoleRequire:
+			required = append(required, platform)
+		case RoleAny:
+			optional = append(optional, platform)
+		}
+	}
+	for _, platform := range required {
+		err := c.checkPlatformLive(p, platform)
+		if err != nil {
+			return err
+		}
+	}
+	if len(required) > 0 {
+		return nil
+	}
+	// an upstream error is reported over not being live on the other platforms
+	var upstreamErr error
+	for _, platform := range optional {
+		err := c.checkPlatformLive(p, platform)
+		if err == nil {
+			return nil
+		}
+		log.Debug(err)
+		if upstreamErr == nil && !errors.Is(err, ErrNotLive) {
+			upstreamErr = err
+		}
+	}
+	if upstreamErr != nil {
+		return upstreamErr
+	}
+	return fmt.Errorf("%w: %s is not live on any of %s", ErrNotLive, p.Name, strings.Join(optional, ", "))
+}
+
+// checkPlatformLive returns an error unless the publisher is live on the
+// platform. A platform with a role must be configured on the publisher.
+func (c *Controller) checkPlatformLive(p Publisher, platform string) error {
+	switch platform {
+	case "twitch":
+		if p.TwitchStream == "" {
+			return fmt.Errorf("%w: %s has no twitch stream configured", ErrNotLive, p.Name)
+		}
+		return c.checkTwitchLive(p)
+	case "trovo":
+		return c.checkTrovoLive(p)
+	}
+	return fmt.Errorf("%w: %s: unknown platform %s", ErrNotLive, p.Name, platform)
+}
+
+// authorize returns the publisher when it is allowed to publish to the rtmp
+// app with the provided stream key
+func (c *Controller) authorize(name, key, app string) (Publisher, error) {
+	p, err := c.getPublisher(name)
+	if err != nil {
+		return p, err
+	}
+	if key != p.Key {
+		return p, fmt.Errorf("%w: %s with 'key': %s", ErrKeyMismatch, p.Name, key)
+	}
+	if p.app() != "" && app != p.app() {
+		return p, fmt.Errorf("%w: %s with 'app': %s", ErrAppMismatch, p.Name, app)
+	}
+	if !p.IsEnabled() {
+		return p, fmt.Errorf("%w: %s", ErrDisabled, p.Name)
+	}
+	err = p.activeAt(time.Now())
+	if err != nil {
+		return p, err
+	}
+	if c.maintenanceActive() {
+		log.Warnf("maintenance mode active: allowing %s without platform checks", p.Name)
+		return p, nil
+	}
+	conf := c.cfg()
+	if conf.RequireTwitchLive && p.mode() != ModeIngest {
+		if c.allowed().Has(allowCacheKey(p)) {
+			log.Debugf("%s recently allowed, skipping twitch live check", p.Name)
+			return p, nil
+		}
+		err = c.checkPlatforms(p)
+		if err != nil {
+			return p, err
+		}
+		if conf.AllowCacheTTL > 0 {
+			c.allowed().Set(allowCacheKey(p), conf.AllowCacheTTL)
+		}
+	}
+	return p, nil
+}
+
+// allowCacheKey identifies an allowed publisher in the allow cache. The key
+// & platforms are included so that changing any of them requires a new
+// live check, while the key, app & enabled checks always run. The result is
+// hashed so that stream keys are never stored in a shared cache.
+func allowCacheKey(p Publisher) string {
+	key := p.Name + "\n" + p.Key + "\n" + p.TwitchStream
+	if len(p.PlatformRoles) > 0 {
+		key += "\n" + p.trovoChannel()
+		for _, platform := range rolePlatforms {
+			key += "\n" + p.PlatformRoles[platform]
+		}
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// notifyDeny alerts of a denied publish when NOTIFY_DENIES is enabled. At
+// most one alert is sent per publisher every DENY_NOTIFY_INTERVAL, and
+// unknown publishers share a single interval so that names made up by a
+// client cannot flood the webhook or grow the cache.
+func (c *Controller) notifyDeny(name, addr string, reason error) {
+	conf := c.cfg()
+	if !conf.NotifyDenies {
+		return
+	}
+	key := name
+	if errors.Is(reason, ErrPublisherNotFound) {
+		key = ""
+	}
+	if c.denyNotified.Has(key) {
+		return
+	}
+	c.denyNotified.Set(key, conf.DenyNotifyInterval)
+	description := reason.Error()
+	if errors.Is(reason, ErrKeyMismatch) {
+		// never share the attempted key
+		description = ErrKeyMismatch.Error()
+	}
+	message := fmt.Sprintf(":no_entry: publish denied for %s from %s: %s", name, addr, description)
+	go c.alert(message)
+}
+
+// appAllowed returns true when the rtmp app is one of the allowed apps, or
+// when the list is empty
+func appAllowed(allowed []string, app string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for i := range allowed {
+		if allowed[i] == app {
+			return true
+		}
+	}
+	return false
+}
+
+// throttledDeny returns true for denies which count towards the publish
+// throttle: a wrong stream key, or not being live. Upstream & storage errors
+// are not the publisher's fault and unknown publishers are not tracked.
+func throttledDeny(err error) bool {
+	return errors.Is(err, ErrKeyMismatch) || errors.Is(err, ErrNotLive)
+}
+
+// authorizeWithin runs authorize, giving up after the deadline so that nginx
+// is always answered in time. A deadline is treated like twitch being
+// unavailable. The abandoned authorization completes in the background.
+func (c *Controller) authorizeWithin(deadline time.Duration, name, key, app string) (Publisher, error) {
+	if deadline <= 0 {
+		return c.authorize(name, key, app)
+	}
+	type result struct {
+		p   Publisher
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		p, err := c.authorize(name, key, app)
+		done <- result{p, err}
+	}()
+	timer := time.NewTimer(deadline)
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		return res.p, res.err
+	case <-timer.C:
+		return Publisher{Name: name}, fmt.Errorf("%w: authorization of %s exceeded %s",
+			ErrTwitchUnavailable, name, deadline)
+	}
+}
+
 // OnPublishHandler is the http handler for "/on_publish".
 func (c *Controller) OnPublishHandler(w http.ResponseWriter, r *http.Request) {
-	r.ParseForm()
+	logger := requestLogger(r)
+	if !c.parseCallbackForm(w, r) {
+		return
+	}
+	conf := c.cfg()
 	streamName := r.Form.Get("name")
-	streamKey := r.Form.Get("key")
-	p, err := c.getPublisher(streamName)
-	if err != nil {
-		log.Warnf("on_publish unauthorized: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
+	streamKey := r.Form.Get(conf.KeyParam)
+	app := r.Form.Get("app")
+	addr := r.Form.Get("addr")
+	if ip := normalizeIP(addr); ip != "" {
+		addr = ip
+	}
+	now := time.Now()
+	if !appAllowed(conf.AllowedApps, app) {
+		// misconfigured encoders are not worth a lookup, an alert or a throttle
+		logger.Warnf("on_publish unauthorized: %s: app '%s' is not allowed", streamName, app)
+		c.denies.Inc(denyAppNotAllowed)
+		w.WriteHeader(conf.DenyStatusCode)
 		return
 	}
-	if streamKey != p.Key {
-		log.Warnf("on_publish unauthorized: %s with 'key': %s", p.Name, streamKey)
-		w.WriteHeader(http.StatusUnauthorized)
+	if until := c.publishThrottle.Blocked(streamName, now); !until.IsZero() {
+		logger.Warnf("on_publish unauthorized: %s is throttled until %s after repeated denies",
+			streamName, until.Format(time.RFC3339))
+		c.denies.Inc(denyRateLimited)
+		if conf.HidePublisherExistence {
+			// only known publishers are throttled
+			w.WriteHeader(conf.DenyStatusCode)
+			return
+		}
+		w.WriteHeader(c.denyStatus(ErrRateLimited))
+		return
+	}
+	p, err := c.authorizeWithin(conf.AuthDeadline, streamName, streamKey, app)
+	if err != nil {
+		logger.Warnf("on_publish unauthorized: %s", err)
+		if conf.PublishDenyLimit > 0 && throttledDeny(err) {
+			if c.publishThrottle.Deny(p.Name, now, conf.PublishDenyLimit, conf.PublishDenyWindow, conf.PublishThrottleBackoff) {
+				logger.Warnf("%s denied %d times within %s, throttling for %s",
+					p.Name, conf.PublishDenyLimit, conf.PublishDenyWindow, conf.PublishThrottleBackoff)
+			}
+		}
+		c.notifyDeny(streamName, addr, err)
+		c.denies.Inc(denyReason(err))
+		w.WriteHeader(c.denyStatus(err))
 		return
 	}
-	log.Printf("on_publish authorized: %s", p.Name)
+	c.publishThrottle.Reset(p.Name)
+	logger.Printf("on_publish authorized: %s", p.Name)
 
-	serverFQDN := c.Config.RTMPServerFQDN
-	serverPort := c.Config.RTMPServerPort
+	serverFQDN := conf.RTMPServerFQDN
+	serverPort := conf.RTMPServerPort
 
-	err = c.setBucketValue("RTMPLiveBucket", p.Name, "live")
-	if err != nil {
-		log.Error("error enabling local live status")
+	if !conf.ReadOnlyDB {
+		c.recordPublish(logger, p, Session{
+			Publisher: p.Name,
+			App:       app,
+			Addr:      addr,
+			ClientID:  r.Form.Get("clientid"),
+			StartedAt: now.UTC().Truncate(time.Second),
+		}, now)
 	}
 
-	if c.Config.DiscordEnabled && (serverFQDN != "") {
-		content := fmt.Sprintf(":movie_camera: %s started a private stream!\nwatch now: `rtmp://%s:%s/stream/%s`", streamName, serverFQDN, serverPort, streamName)
-		err := c.callWebhook(content)
+	if serverFQDN != "" {
+		watch := fmt.Sprintf("rtmp://%s:%s/stream/%s", serverFQDN, serverPort, streamName)
+		if conf.PlaybackSecret != "" {
+			watch = c.playbackURL(streamName, c.SignPlaybackToken(streamName, conf.PlaybackTokenTTL))
+		}
+		content := fmt.Sprintf(":movie_camera: %s started a private stream!\nwatch now: `%s`", streamName, watch)
+		err := c.notifyPublisher(p, content)
 		if err != nil {
-			log.Error(err)
+			logger.Error(err)
+		}
+	}
+
+	if conf.PublishHeaders {
+		setPublishHeaders(w.Header(), p)
+	}
+
+	if conf.AllowRedirectTemplate != nil {
+		var location bytes.Buffer
+		err = conf.AllowRedirectTemplate.Execute(&location, p)
+		if err != nil {
+			logger.Errorf("error rendering ALLOW_REDIRECT_TEMPLATE for %s: %s", p.Name, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if location.Len() > 0 {
+			// nginx-rtmp continues the publish under the stream name in the
+			// Location header of a 3xx response
+			logger.Debugf("on_publish redirecting %s to %s", p.Name, location.String())
+			w.Header().Set("Location", location.String())
+			w.WriteHeader(http.StatusFound)
+			w.Write(location.Bytes())
+			return
 		}
 	}
 
 	w.WriteHeader(http.StatusCreated)
 }
 
+// recordPublish records the live status, session & publish time of an
+// allowed publish. nginx has already been answered for, so write errors are
+// only logged & counted.
+func (c *Controller) recordPublish(logger *log.Entry, p Publisher, s Session, now time.Time) {
+	err := c.setBucketValue("RTMPLiveBucket", p.Name, "live")
+	if err != nil {
+		logger.Error("error enabling local live status: ", err)
+		c.dbWriteErrors.Inc(callbackPublish)
+	}
+	err = c.touchSession(p.Name, now)
+	if err != nil {
+		logger.Error("error recording session start: ", err)
+		c.dbWriteErrors.Inc(callbackPublish)
+	}
+	err = c.startSession(s)
+	if err != nil {
+		logger.Error("error recording session start: ", err)
+		c.dbWriteErrors.Inc(callbackPublish)
+	}
+	err = c.setBucketValue("LastPublishedBucket", p.Name, string(formatTimestamp(now)))
+	if err != nil {
+		logger.Error("error recording publish time: ", err)
+		c.dbWriteErrors.Inc(callbackPublish)
+	}
+}
+
+// setPublishHeaders describes an allowed publisher & its last known twitch
+// status in response headers which nginx may log or use
+func setPublishHeaders(h http.Header, p Publisher) {
+	h.Set("X-Publisher-Name", p.Name)
+	h.Set("X-Twitch-Live", strconv.FormatBool(p.IsTwitchLive()))
+	h.Set("X-Viewer-Count", strconv.Itoa(p.ViewerCount))
+}
+
 // OnPublishDoneHandler is the http handler for "/on_publish_done".
 func (c *Controller) OnPublishDoneHandler(w http.ResponseWriter, r *http.Request) {
-	r.ParseForm()
+	logger := requestLogger(r)
+	if !c.parseCallbackForm(w, r) {
+		return
+	}
 	streamName := r.Form.Get("name")
-	streamKey := r.Form.Get("key")
+	streamKey := r.Form.Get(c.cfg().KeyParam)
 	p, err := c.getPublisher(streamName)
 	if err != nil {
-		log.Warnf("on_publish_done unauthorized: %s", p.Name)
-		w.WriteHeader(http.StatusUnauthorized)
+		logger.Warnf("on_publish_done unauthorized: %s", p.Name)
+		w.WriteHeader(c.denyStatus(err))
 		return
 	}
 	if streamKey != p.Key {
-		log.Warnf("on_publish_done unauthorized: %s with key: %s", p.Name, p.Key)
-		w.WriteHeader(http.StatusUnauthorized)
+		logger.Warnf("on_publish_done unauthorized: %s with key: %s", p.Name, p.Key)
+		w.WriteHeader(c.denyStatus(ErrKeyMismatch))
 		return
 	}
-	log.Printf("on_publish_done authorized: %s", p.Name)
+	logger.Printf("on_publish_done authorized: %s", p.Name)
 
-	err = c.setBucketValue("RTMPLiveBucket", p.Name, "")
-	if err != nil {
-		log.Error("error disabling local live status")
+	if !c.cfg().ReadOnlyDB {
+		c.recordPublishDone(logger, p)
 	}
 
-	if c.Config.DiscordEnabled {
-		content := fmt.Sprintf(":checkered_flag:  %s finished streaming.", streamName)
-		err := c.callWebhook(content)
-		if err != nil {
-			log.Error(err)
-		}
+	content := fmt.Sprintf(":checkered_flag:  %s finished streaming.", streamName)
+	err = c.notifyPublisher(p, content)
+	if err != nil {
+		logger.Error(err)
 	}
 
 	w.WriteHeader(http.StatusCreated)
 }
+
+// recordPublishDone clears the live status, publish attempt & session of a
+// publisher. nginx ignores the response, so write errors are only logged &
+// counted.
+func (c *Controller) recordPublishDone(logger *log.Entry, p Publisher) {
+	err := c.setBucketValue("RTMPLiveBucket", p.Name, "")
+	if err != nil {
+		logger.Warn("error disabling local live status: ", err)
+		c.dbWriteErrors.Inc(callbackPublishDone)
+	}
+	err = c.setBucketValue("PublishAttemptBucket", p.Name, "")
+	if err != nil {
+		logger.Warn("error resetting publish attempt: ", err)
+		c.dbWriteErrors.Inc(callbackPublishDone)
+	}
+	err = c.setBucketValue("SessionSeenBucket", p.Name, "")
+	if err != nil {
+		logger.Warn("error resetting session: ", err)
+		c.dbWriteErrors.Inc(callbackPublishDone)
+	}
+	err = c.setBucketValue("SessionBucket", p.Name, "")
+	if err != nil {
+		logger.Warn("error resetting session: ", err)
+		c.dbWriteErrors.Inc(callbackPublishDone)
+	}
+}
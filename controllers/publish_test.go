@@ -0,0 +1,927 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/bcambl/rtmpauthbot/config"
+	"github.com/bcambl/rtmpauthbot/internal/testutil"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestPublishTwitchUnavailable(t *testing.T) {
+	stub := &testutil.TwitchStub{}
+	stub.SetStreams(http.StatusServiceUnavailable, `{"message":"unavailable"}`)
+	c := newTestController(t, stub, func(conf *config.Config) {
+		conf.RequireTwitchLive = true
+		conf.LiveGracePeriod = 0
+		conf.PublishDenyLimit = 1
+		conf.PublishDenyWindow = time.Minute
+		conf.PublishThrottleBackoff = time.Minute
+	})
+	createPublisher(t, c, `{"name":"alice","key":"secret","twitch_stream":"alice"}`)
+
+	// an outage is not reported as the publisher not being live
+	status := publish(c, "alice", "secret")
+	if status != http.StatusServiceUnavailable {
+		t.Fatalf("publish while twitch is unavailable: got %d, want %d", status, http.StatusServiceUnavailable)
+	}
+
+	// nor does it count towards the throttle
+	stub.SetStreams(http.StatusOK, aliceLive)
+	status = publish(c, "alice", "secret")
+	if status != http.StatusCreated {
+		t.Fatalf("publish once twitch is back: got %d, want %d", status, http.StatusCreated)
+	}
+}
+
+func TestPublishThrottle(t *testing.T) {
+	stub := &testutil.TwitchStub{}
+	stub.SetStreams(http.StatusOK, aliceLive)
+	c := newTestController(t, stub, func(conf *config.Config) {
+		conf.RequireTwitchLive = true
+		conf.PublishDenyLimit = 2
+		conf.PublishDenyWindow = time.Minute
+		conf.PublishThrottleBackoff = time.Minute
+		conf.HidePublisherExistence = false
+	})
+	createPublisher(t, c, `{"name":"alice","key":"secret","twitch_stream":"alice"}`)
+
+	for i := 0; i < 2; i++ {
+		status := publish(c, "alice", "wrong")
+		if status == http.StatusCreated {
+			t.Fatalf("publish %d with a wrong key was allowed", i+1)
+		}
+	}
+	status := publish(c, "alice", "secret")
+	if status != http.StatusTooManyRequests {
+		t.Fatalf("publish after repeated denies: got %d, want %d", status, http.StatusTooManyRequests)
+	}
+}
+
+func TestPublishNegativeCache(t *testing.T) {
+	stub := &testutil.TwitchStub{}
+	stub.SetStreams(http.StatusOK, aliceOffline)
+	c := newTestController(t, stub, func(conf *config.Config) {
+		conf.RequireTwitchLive = true
+		conf.LiveGracePeriod = 0
+		conf.NegativeCacheTTL = time.Minute
+		conf.PublishDenyLimit = 0
+	})
+	createPublisher(t, c, `{"name":"alice","key":"secret","twitch_stream":"alice"}`)
+
+	for i := 0; i < 3; i++ {
+		status := publish(c, "alice", "secret")
+		if status != c.Config.DenyStatusCode {
+			t.Fatalf("publish %d while not live: got %d, want %d", i+1, status, c.Config.DenyStatusCode)
+		}
+	}
+	if queries := stub.Queries(); queries != 1 {
+		t.Fatalf("twitch was queried %d times, want 1", queries)
+	}
+}
+
+func TestDenyStatusCode(t *testing.T) {
+	c := newTestController(t, &testutil.TwitchStub{}, func(conf *config.Config) {
+		conf.DenyStatusCode = http.StatusUnauthorized
+		conf.HidePublisherExistence = false
+	})
+	createPublisher(t, c, `{"name":"alice","key":"secret"}`)
+
+	if status := publish(c, "alice", "wrong"); status != http.StatusUnauthorized {
+		t.Fatalf("publish with a wrong key: got %d, want %d", status, http.StatusUnauthorized)
+	}
+	if status := publish(c, "alice", "secret"); status != http.StatusCreated {
+		t.Fatalf("publish with the key: got %d, want %d", status, http.StatusCreated)
+	}
+}
+
+func TestUpdateBumpsUpdatedAt(t *testing.T) {
+	c := newTestController(t, &testutil.TwitchStub{}, nil)
+	createPublisher(t, c, `{"name":"alice","key":"secret"}`)
+
+	// date the publisher back, as timestamps are stored by the second
+	hourAgo := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	for _, bucket := range []string{"CreatedAtBucket", "UpdatedAtBucket"} {
+		err := c.setBucketValue(bucket, "alice", string(formatTimestamp(hourAgo)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	createPublisher(t, c, `{"name":"alice","key":"rotated"}`)
+
+	p, err := c.getPublisher("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.CreatedAt.Equal(hourAgo) {
+		t.Errorf("created_at changed by an update: %s, want %s", p.CreatedAt, hourAgo)
+	}
+	if !p.UpdatedAt.After(hourAgo) {
+		t.Errorf("updated_at not bumped by an update: %s", p.UpdatedAt)
+	}
+}
+
+func TestMigrateTimestamps(t *testing.T) {
+	c := newTestController(t, &testutil.TwitchStub{}, nil)
+	// a publisher created before creation times were recorded
+	err := c.setBucketValue("PublisherBucket", "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.MigrateTimestamps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := c.getPublisher("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.CreatedAt.Equal(createdAtSentinel) || !p.UpdatedAt.Equal(createdAtSentinel) {
+		t.Fatalf("backfilled timestamps: created_at %s, updated_at %s, want %s",
+			p.CreatedAt, p.UpdatedAt, createdAtSentinel)
+	}
+}
+
+func TestLiveGracePeriod(t *testing.T) {
+	stub := &testutil.TwitchStub{}
+	stub.SetStreams(http.StatusOK, aliceOffline)
+	c := newTestController(t, stub, func(conf *config.Config) {
+		conf.RequireTwitchLive = true
+		conf.LiveGracePeriod = time.Minute
+		conf.NegativeCacheTTL = 0
+		conf.AllowCacheTTL = 0
+		conf.PublishDenyLimit = 0
+	})
+	createPublisher(t, c, `{"name":"alice","key":"secret","twitch_stream":"alice"}`)
+
+	tests := []struct {
+		firstAttempt time.Duration
+		want         int
+	}{
+		// the first attempt starts the grace period
+		{0, http.StatusCreated},
+		{30 * time.Second, http.StatusCreated},
+		{2 * time.Minute, c.Config.DenyStatusCode},
+		// going live again a day later starts a new one
+		{24 * time.Hour, http.StatusCreated},
+	}
+	for _, test := range tests {
+		if test.firstAttempt > 0 {
+			attempt := formatTimestamp(time.Now().Add(-test.firstAttempt))
+			err := c.setBucketValue("PublishAttemptBucket", "alice", string(attempt))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		status := publish(c, "alice", "secret")
+		if status != test.want {
+			t.Errorf("publish %s after the first attempt: got %d, want %d", test.firstAttempt, status, test.want)
+		}
+	}
+}
+
+func TestPublishModes(t *testing.T) {
+	stub := &testutil.TwitchStub{}
+	stub.SetStreams(http.StatusOK, aliceOffline)
+	c := newTestController(t, stub, func(conf *config.Config) {
+		conf.RequireTwitchLive = true
+		conf.LiveGracePeriod = 0
+		conf.NegativeCacheTTL = 0
+		conf.PublishDenyLimit = 0
+		conf.HidePublisherExistence = false
+	})
+	createPublisher(t, c, `{"name":"alice","key":"secret","twitch_stream":"alice"}`)
+	createPublisher(t, c, `{"name":"bob","key":"secret","twitch_stream":"bob","mode":"ingest"}`)
+
+	// mirror publishers, the default, must be live on twitch
+	if status := publish(c, "alice", "secret"); status != c.Config.DenyStatusCode {
+		t.Fatalf("mirror publish while not live: got %d, want %d", status, c.Config.DenyStatusCode)
+	}
+	stub.SetStreams(http.StatusOK, aliceLive)
+	if status := publish(c, "alice", "secret"); status != http.StatusCreated {
+		t.Fatalf("mirror publish while live: got %d, want %d", status, http.StatusCreated)
+	}
+
+	// ingest publishers are never checked with twitch, but still need their key
+	queries := stub.Queries()
+	if status := publish(c, "bob", "secret"); status != http.StatusCreated {
+		t.Fatalf("ingest publish while not live: got %d, want %d", status, http.StatusCreated)
+	}
+	if stub.Queries() != queries {
+		t.Error("ingest publish queried twitch")
+	}
+	if status := publish(c, "bob", "wrong"); status == http.StatusCreated {
+		t.Fatal("ingest publish with a wrong key was allowed")
+	}
+}
+
+func TestMinViewers(t *testing.T) {
+	stub := &testutil.TwitchStub{}
+	stub.SetStreams(http.StatusOK, aliceLive)
+	c := newTestController(t, stub, func(conf *config.Config) {
+		conf.RequireTwitchLive = true
+		conf.LiveGracePeriod = 0
+		conf.NegativeCacheTTL = 0
+		conf.AllowCacheTTL = 0
+		conf.PublishDenyLimit = 0
+	})
+
+	// alice is live with 5 viewers
+	tests := []struct {
+		minViewers int
+		want       int
+	}{
+		{0, http.StatusCreated},
+		{5, http.StatusCreated},
+		{6, c.Config.DenyStatusCode},
+	}
+	for _, test := range tests {
+		createPublisher(t, c, fmt.Sprintf(`{"name":"alice","key":"secret","twitch_stream":"alice","min_viewers":%d}`, test.minViewers))
+		if status := publish(c, "alice", "secret"); status != test.want {
+			t.Errorf("publish with 5 viewers & a minimum of %d: got %d, want %d", test.minViewers, status, test.want)
+		}
+	}
+}
+
+func TestAllowRedirectTemplate(t *testing.T) {
+	c := newTestController(t, &testutil.TwitchStub{}, func(conf *config.Config) {
+		conf.RequireTwitchLive = false
+		conf.AllowedApps = nil
+		conf.AllowRedirectTemplate = template.Must(template.New("redirect").Parse(
+			`{{if .TwitchStream}}live/{{.TwitchStream}}{{end}}`))
+	})
+	createPublisher(t, c, `{"name":"alice","key":"secret","twitch_stream":"Alice_TV"}`)
+	createPublisher(t, c, `{"name":"bob","key":"secret"}`)
+
+	form := url.Values{"name": {"alice"}, "key": {"secret"}, "app": {"stream"}}
+	w := serve(c.OnPublishHandler, "POST", "/on_publish", form.Encode())
+	if w.Code != http.StatusFound {
+		t.Fatalf("publish: got %d, want %d", w.Code, http.StatusFound)
+	}
+	if location := w.Header().Get("Location"); location != "live/Alice_TV" || w.Body.String() != location {
+		t.Fatalf("publish: got location %q & body %q, want live/Alice_TV", location, w.Body.String())
+	}
+
+	// an empty rendering allows the publish under its own name
+	if status := publish(c, "bob", "secret"); status != http.StatusCreated {
+		t.Fatalf("publish without a redirect: got %d, want %d", status, http.StatusCreated)
+	}
+}
+
+func TestBlockedGameDenied(t *testing.T) {
+	stub := &testutil.TwitchStub{}
+	stub.SetStreams(http.StatusOK, `{"data":[{"user_login":"alice","user_name":"Alice","type":"live","viewer_count":5,"game_id":"1"}]}`)
+	c := newTestController(t, stub, func(conf *config.Config) {
+		conf.RequireTwitchLive = true
+		conf.LiveGracePeriod = 0
+		conf.NegativeCacheTTL = 0
+		conf.AllowCacheTTL = 0
+		conf.PublishDenyLimit = 0
+		conf.DiscordEnabled = false
+		conf.BlockedGameIDs = []string{"1"}
+	})
+	createPublisher(t, c, `{"name":"alice","key":"secret","twitch_stream":"alice"}`)
+
+	// neither the direct lookup nor the poll count the stream as live
+	if status := publish(c, "alice", "secret"); status != c.Config.DenyStatusCode {
+		t.Fatalf("publish streaming a blocked game: got %d, want %d", status, c.Config.DenyStatusCode)
+	}
+	_, err := c.refreshTwitch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := publish(c, "alice", "secret"); status != c.Config.DenyStatusCode {
+		t.Fatalf("publish streaming a blocked game after a poll: got %d, want %d", status, c.Config.DenyStatusCode)
+	}
+
+	conf := *c.Config
+	conf.BlockedGameIDs = []string{"2"}
+	c.SetConfig(&conf)
+	if status := publish(c, "alice", "secret"); status != http.StatusCreated {
+		t.Fatalf("publish streaming another game: got %d, want %d", status, http.StatusCreated)
+	}
+}
+
+func TestKeyParam(t *testing.T) {
+	c := newTestController(t, &testutil.TwitchStub{}, func(conf *config.Config) {
+		conf.RequireTwitchLive = false
+		conf.AllowedApps = nil
+		conf.KeyParam = "token"
+		conf.HidePublisherExistence = false
+	})
+	createPublisher(t, c, `{"name":"alice","key":"secret"}`)
+
+	tests := []struct {
+		form url.Values
+		want int
+	}{
+		{url.Values{"name": {"alice"}, "token": {"secret"}}, http.StatusCreated},
+		{url.Values{"name": {"alice"}, "token": {"wrong"}}, c.Config.DenyStatusCode},
+		// the default param no longer carries the key
+		{url.Values{"name": {"alice"}, "key": {"secret"}}, c.Config.DenyStatusCode},
+	}
+	for _, test := range tests {
+		test.form.Set("app", "stream")
+		w := serve(c.OnPublishHandler, "POST", "/on_publish", test.form.Encode())
+		if w.Code != test.want {
+			t.Errorf("publish with %s: got %d, want %d", test.form.Encode(), w.Code, test.want)
+		}
+	}
+}
+
+func TestNotifyDeniesOnce(t *testing.T) {
+	stub := &testutil.TwitchStub{}
+	alerts := make(chan string, 10)
+	stub.Handle(testWebhook, func(r *http.Request) (int, string) {
+		body, _ := ioutil.ReadAll(r.Body)
+		alerts <- string(body)
+		return http.StatusNoContent, ""
+	})
+	c := newTestController(t, stub, func(conf *config.Config) {
+		conf.RequireTwitchLive = false
+		conf.AllowedApps = nil
+		conf.DiscordEnabled = true
+		conf.DiscordWebhook = "https://" + testWebhook
+		conf.NotifyDenies = true
+		conf.DenyNotifyInterval = time.Minute
+		conf.PublishDenyLimit = 0
+		conf.HidePublisherExistence = false
+	})
+	createPublisher(t, c, `{"name":"alice","key":"secret"}`)
+
+	// nginx reports the address of the encoder
+	form := url.Values{"name": {"alice"}, "key": {"attempted-key"}, "app": {"stream"}, "addr": {"198.51.100.7"}}
+	for i := 0; i < 5; i++ {
+		w := serve(c.OnPublishHandler, "POST", "/on_publish", form.Encode())
+		if w.Code == http.StatusCreated {
+			t.Fatal("publish with a wrong key was allowed")
+		}
+	}
+	select {
+	case alert := <-alerts:
+		if !strings.Contains(alert, "publish denied for alice from 198.51.100.7") {
+			t.Errorf("deny notification without the publisher & address: %s", alert)
+		}
+		if strings.Contains(alert, "attempted-key") {
+			t.Errorf("deny notification reveals the attempted key: %s", alert)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no deny notification")
+	}
+	select {
+	case alert := <-alerts:
+		t.Fatalf("repeated denies notified again: %s", alert)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestAuthDeadline(t *testing.T) {
+	stub := &testutil.TwitchStub{}
+	stub.SetStreams(http.StatusOK, aliceLive)
+	c := newTestController(t, stub, func(conf *config.Config) {
+		conf.RequireTwitchLive = true
+		conf.LiveGracePeriod = 0
+		conf.NegativeCacheTTL = 0
+		conf.PublishDenyLimit = 0
+		conf.AuthDeadline = 50 * time.Millisecond
+	})
+	createPublisher(t, c, `{"name":"alice","key":"secret","twitch_stream":"alice"}`)
+
+	// twitch answers the lookup after the deadline
+	stub.Delay(testutil.TwitchStreams, 300*time.Millisecond)
+	start := time.Now()
+	status := publish(c, "alice", "secret")
+	elapsed := time.Since(start)
+	if status != http.StatusServiceUnavailable {
+		t.Errorf("publish past the deadline: got %d, want %d", status, http.StatusServiceUnavailable)
+	}
+	if elapsed > 200*time.Millisecond {
+		t.Errorf("publish past the deadline took %s", elapsed)
+	}
+	// let the abandoned lookup finish before the database is closed
+	time.Sleep(300*time.Millisecond - elapsed)
+
+	stub.Delay(testutil.TwitchStreams, 0)
+	if status := publish(c, "alice", "secret"); status != http.StatusCreated {
+		t.Fatalf("publish within the deadline: got %d, want %d", status, http.StatusCreated)
+	}
+}
+
+func TestForEachPublisher(t *testing.T) {
+	c := newTestController(t, &testutil.TwitchStub{}, nil)
+	for _, name := range []string{"carol", "alice", "bob"} {
+		createPublisher(t, c, fmt.Sprintf(`{"name":%q,"key":"secret","twitch_stream":%q}`, name, name))
+	}
+
+	var names []string
+	err := c.forEachPublisher(func(p Publisher) error {
+		if p.Key != "secret" || p.TwitchStream != p.Name {
+			t.Errorf("%s: fetched %+v", p.Name, p)
+		}
+		names = append(names, p.Name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(names, ",") != "alice,bob,carol" {
+		t.Fatalf("iterated %v, want every publisher by name", names)
+	}
+
+	// an error stops the iteration and is returned
+	stop := errors.New("stop")
+	visited := 0
+	err = c.forEachPublisher(func(p Publisher) error {
+		visited++
+		return stop
+	})
+	if err != stop || visited != 1 {
+		t.Fatalf("stopping: got %v after %d publishers, want %v after 1", err, visited, stop)
+	}
+}
+
+// benchmarkPublishers returns a controller with 500 publishers
+func benchmarkPublishers(b *testing.B) *Controller {
+	c := newTestController(b, &testutil.TwitchStub{}, nil)
+	for i := 0; i < 500; i++ {
+		createPublisher(b, c, fmt.Sprintf(`{"name":"publisher%03d","key":"secret","twitch_stream":"login%03d"}`, i, i))
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	return c
+}
+
+func BenchmarkForEachPublisher(b *testing.B) {
+	c := benchmarkPublishers(b)
+	for i := 0; i < b.N; i++ {
+		live := 0
+		err := c.forEachPublisher(func(p Publisher) error {
+			if p.IsTwitchLive() {
+				live++
+			}
+			return nil
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetAllPublisher(b *testing.B) {
+	c := benchmarkPublishers(b)
+	for i := 0; i < b.N; i++ {
+		publishers, err := c.getAllPublisher()
+		if err != nil {
+			b.Fatal(err)
+		}
+		live := 0
+		for _, p := range publishers {
+			if p.IsTwitchLive() {
+				live++
+			}
+		}
+	}
+}
+
+func TestTenantIsolation(t *testing.T) {
+	a := newTestController(t, &testutil.TwitchStub{}, func(conf *config.Config) {
+		conf.Tenant = "a"
+		conf.RequireTwitchLive = false
+		conf.AllowedApps = nil
+	})
+	confB := *a.Config
+	confB.Tenant = "b"
+	err := a.DB.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range DataBuckets {
+			_, err := tx.CreateBucketIfNotExists([]byte(confB.BucketName(bucket)))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &Controller{Config: &confB, DB: a.DB}
+	b.SetHTTPClient(a.httpClient())
+	b.RegisterSources()
+
+	createPublisher(t, a, `{"name":"alice","key":"secret-a"}`)
+	createPublisher(t, b, `{"name":"bob","key":"secret-b"}`)
+
+	if names := publisherNames(t, a); strings.Join(names, ",") != "alice" {
+		t.Errorf("tenant a: got publishers %v, want [alice]", names)
+	}
+	if names := publisherNames(t, b); strings.Join(names, ",") != "bob" {
+		t.Errorf("tenant b: got publishers %v, want [bob]", names)
+	}
+	_, err = b.getPublisher("alice")
+	if !errors.Is(err, ErrPublisherNotFound) {
+		t.Errorf("tenant b: looking up alice of tenant a: got %v, want %v", err, ErrPublisherNotFound)
+	}
+	if status := publish(b, "alice", "secret-a"); status == http.StatusCreated {
+		t.Error("tenant b allowed a publisher of tenant a")
+	}
+	if status := publish(a, "alice", "secret-a"); status != http.StatusCreated {
+		t.Errorf("tenant a: publish: got %d, want %d", status, http.StatusCreated)
+	}
+}
+
+func TestPublishHeaders(t *testing.T) {
+	stub := &testutil.TwitchStub{}
+	stub.SetStreams(http.StatusOK, aliceLive)
+	c := newTestController(t, stub, func(conf *config.Config) {
+		conf.RequireTwitchLive = false
+		conf.AllowedApps = nil
+		conf.DiscordEnabled = false
+		conf.PublishHeaders = true
+	})
+	createPublisher(t, c, `{"name":"alice","key":"secret","twitch_stream":"alice"}`)
+	_, err := c.refreshTwitch()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	form := url.Values{"name": {"alice"}, "key": {"secret"}, "app": {"stream"}}
+	w := serve(c.OnPublishHandler, "POST", "/on_publish", form.Encode())
+	if w.Code != http.StatusCreated {
+		t.Fatalf("publish: got %d, want %d", w.Code, http.StatusCreated)
+	}
+	want := map[string]string{"X-Publisher-Name": "alice", "X-Twitch-Live": "true", "X-Viewer-Count": "5"}
+	for header, value := range want {
+		if got := w.Header().Get(header); got != value {
+			t.Errorf("%s: got %q, want %q", header, got, value)
+		}
+	}
+
+	// the headers are optional
+	conf := *c.Config
+	conf.PublishHeaders = false
+	c.SetConfig(&conf)
+	w = serve(c.OnPublishHandler, "POST", "/on_publish", form.Encode())
+	if w.Header().Get("X-Publisher-Name") != "" {
+		t.Error("headers set with PUBLISH_HEADERS disabled")
+	}
+}
+
+func TestAllowCache(t *testing.T) {
+	stub := &testutil.TwitchStub{}
+	stub.SetStreams(http.StatusOK, aliceLive)
+	c := newTestController(t, stub, func(conf *config.Config) {
+		conf.RequireTwitchLive = true
+		conf.LiveGracePeriod = 0
+		conf.NegativeCacheTTL = 0
+		conf.AllowCacheTTL = time.Minute
+		conf.PublishDenyLimit = 0
+	})
+	createPublisher(t, c, `{"name":"alice","key":"secret","twitch_stream":"alice"}`)
+	// publish & return whether twitch was queried
+	queried := func(key string, want int) bool {
+		t.Helper()
+		queries := stub.Queries()
+		if status := publish(c, "alice", key); status != want {
+			t.Fatalf("publish: got %d, want %d", status, want)
+		}
+		return stub.Queries() > queries
+	}
+
+	if !queried("secret", http.StatusCreated) {
+		t.Fatal("first publish did not query twitch")
+	}
+	if queried("secret", http.StatusCreated) {
+		t.Error("quick reconnect queried twitch again")
+	}
+
+	// the key check always runs
+	deny := c.Config.DenyStatusCode
+	queried("wrong", deny)
+
+	// a rotated key requires a new live check
+	createPublisher(t, c, `{"name":"alice","key":"rotated","twitch_stream":"alice"}`)
+	queried("secret", deny)
+	if !queried("rotated", http.StatusCreated) {
+		t.Error("publish with a rotated key did not query twitch")
+	}
+
+	// a disabled publisher is denied despite the cache
+	w := serve(c.PublishersAPIHandler, "PUT", "/api/publishers/alice", `{"key":"rotated","enabled":false}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("disable: got %d %s", w.Code, w.Body.String())
+	}
+	if status := publish(c, "alice", "rotated"); status == http.StatusCreated {
+		t.Errorf("disabled publisher allowed from the cache")
+	}
+}
+
+func TestActiveWindow(t *testing.T) {
+	from := time.Date(2026, 6, 1, 18, 0, 0, 0, time.UTC)
+	until := from.Add(4 * time.Hour)
+	zero := time.Time{}
+	tests := []struct {
+		name        string
+		from, until *time.Time
+		now         time.Time
+		active      bool
+	}{
+		{"before the window", &from, &until, from.Add(-time.Second), false},
+		{"at the start", &from, &until, from, true},
+		{"in the window", &from, &until, from.Add(time.Hour), true},
+		{"at the end", &from, &until, until, false},
+		{"after the window", &from, &until, until.Add(time.Hour), false},
+		{"no window", nil, nil, from, true},
+		{"cleared window", &zero, &zero, from, true},
+		{"open start", nil, &until, from.Add(-24 * time.Hour), true},
+		{"open end", &from, nil, until.Add(24 * time.Hour), true},
+	}
+	for _, test := range tests {
+		p := Publisher{Name: "alice", ActiveFrom: test.from, ActiveUntil: test.until}
+		err := p.activeAt(test.now)
+		if test.active && err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+		if !test.active && !errors.Is(err, ErrInactive) {
+			t.Errorf("%s: got %v, want %v", test.name, err, ErrInactive)
+		}
+	}
+}
+
+func TestPublishActiveWindow(t *testing.T) {
+	c := newTestController(t, &testutil.TwitchStub{}, func(conf *config.Config) {
+		conf.RequireTwitchLive = false
+		conf.AllowedApps = nil
+		conf.DiscordEnabled = false
+		conf.PublishDenyLimit = 0
+	})
+	window := func(from, until time.Duration, enabled bool) string {
+		now := time.Now()
+		return fmt.Sprintf(`{"key":"secret","enabled":%t,"active_from":%q,"active_until":%q}`, enabled,
+			now.Add(from).UTC().Format(time.RFC3339), now.Add(until).UTC().Format(time.RFC3339))
+	}
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"before the window", window(time.Hour, 2*time.Hour, true), c.Config.DenyStatusCode},
+		{"in the window", window(-time.Hour, time.Hour, true), http.StatusCreated},
+		{"after the window", window(-2*time.Hour, -time.Hour, true), c.Config.DenyStatusCode},
+		{"disabled in the window", window(-time.Hour, time.Hour, false), c.Config.DenyStatusCode},
+	}
+	for _, test := range tests {
+		w := serve(c.PublishersAPIHandler, "PUT", "/api/publishers/alice", test.body)
+		if w.Code >= 300 {
+			t.Fatalf("%s: %d %s", test.name, w.Code, w.Body.String())
+		}
+		if status := publish(c, "alice", "secret"); status != test.want {
+			t.Errorf("publish %s: got %d, want %d", test.name, status, test.want)
+		}
+	}
+
+	w := serve(c.PublishersAPIHandler, "PUT", "/api/publishers/alice", window(time.Hour, -time.Hour, true))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("window ending before it starts: got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestNoPlatformPolicy(t *testing.T) {
+	for _, policy := range []string{"allow", "deny"} {
+		stub := &testutil.TwitchStub{}
+		c := newTestController(t, stub, func(conf *config.Config) {
+			conf.RequireTwitchLive = true
+			conf.LiveGracePeriod = 0
+			conf.PublishDenyLimit = 0
+			conf.NoPlatformPolicy = policy
+		})
+		createPublisher(t, c, `{"name":"alice","key":"secret"}`)
+		createPublisher(t, c, `{"name":"bob","key":"secret","mode":"ingest"}`)
+
+		want := http.StatusCreated
+		if policy == "deny" {
+			want = c.Config.DenyStatusCode
+		}
+		if status := publish(c, "alice", "secret"); status != want {
+			t.Errorf("%s: publish without a twitch stream: got %d, want %d", policy, status, want)
+		}
+		// the key is still checked
+		if status := publish(c, "alice", "wrong"); status == http.StatusCreated {
+			t.Errorf("%s: publish without a twitch stream allowed with a wrong key", policy)
+		}
+		// ingest publishers never need a platform
+		if status := publish(c, "bob", "secret"); status != http.StatusCreated {
+			t.Errorf("%s: ingest publish: got %d, want %d", policy, status, http.StatusCreated)
+		}
+		if stub.Queries() != 0 {
+			t.Errorf("%s: twitch queried for publishers without a twitch stream", policy)
+		}
+	}
+}
+
+func TestTwitchLoginsCache(t *testing.T) {
+	c := newTestController(t, &testutil.TwitchStub{}, nil)
+	createPublisher(t, c, `{"name":"alice","key":"secret","twitch_stream":"Alice"}`)
+	createPublisher(t, c, `{"name":"alice2","key":"secret","twitch_stream":"alice"}`)
+	logins := func() string {
+		t.Helper()
+		logins, err := c.twitchLogins()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Join(logins, ",")
+	}
+	if got := logins(); got != "alice" {
+		t.Fatalf("logins: got %s, want alice", got)
+	}
+
+	// a write bypassing the api is not seen, the list is cached
+	err := c.setBucketValue("TwitchStreamBucket", "alice2", "carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := logins(); got != "alice" {
+		t.Fatalf("cached logins: got %s, want alice", got)
+	}
+
+	tests := []struct {
+		name   string
+		change func()
+		want   string
+	}{
+		{"create", func() { createPublisher(t, c, `{"name":"bob","key":"secret","twitch_stream":"bob"}`) }, "alice,carol,bob"},
+		{"update", func() {
+			serve(c.PublishersAPIHandler, "PUT", "/api/publishers/bob", `{"key":"secret","twitch_stream":"dave"}`)
+		}, "alice,carol,dave"},
+		{"delete", func() { serve(c.PublisherAPIHandler, "DELETE", "/api/publisher", `{"name":"alice2"}`) }, "alice,dave"},
+		{"sync", func() {
+			serve(c.SyncAPIHandler, "POST", "/api/publishers/sync?prune=false", `[{"name":"erin","key":"secret","twitch_stream":"erin"}]`)
+		}, "alice,dave,erin"},
+	}
+	for _, test := range tests {
+		test.change()
+		if got := logins(); got != test.want {
+			t.Errorf("logins after %s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestHidePublisherExistence(t *testing.T) {
+	for _, hide := range []bool{false, true} {
+		c := newTestController(t, &testutil.TwitchStub{}, func(conf *config.Config) {
+			conf.RequireTwitchLive = false
+			conf.AllowedApps = nil
+			conf.DiscordEnabled = false
+			conf.PublishDenyLimit = 1
+			conf.PublishDenyWindow = time.Minute
+			conf.PublishThrottleBackoff = time.Minute
+			conf.HidePublisherExistence = hide
+		})
+		createPublisher(t, c, `{"name":"alice","key":"secret"}`)
+		hook := captureLogs(t)
+		callback := func(handler http.HandlerFunc, target, name, key string) *httptest.ResponseRecorder {
+			form := url.Values{"name": {name}, "key": {key}, "app": {"stream"}}
+			return serve(handler, "POST", target, form.Encode())
+		}
+
+		unknown := callback(c.OnPublishHandler, "/on_publish", "nobody", "secret")
+		wrongKey := callback(c.OnPublishHandler, "/on_publish", "alice", "wrong")
+		// alice is throttled after a single deny
+		throttled := callback(c.OnPublishHandler, "/on_publish", "alice", "wrong")
+		if !hide {
+			if throttled.Code != http.StatusTooManyRequests {
+				t.Errorf("default: throttled got %d, want %d", throttled.Code, http.StatusTooManyRequests)
+			}
+			if w := callback(c.OnPlayHandler, "/on_play", "nobody", ""); w.Code != http.StatusNotFound {
+				t.Errorf("default: /on_play unknown stream got %d, want %d", w.Code, http.StatusNotFound)
+			}
+			continue
+		}
+		for _, w := range []*httptest.ResponseRecorder{wrongKey, throttled} {
+			if unknown.Code != w.Code || unknown.Body.String() != w.Body.String() ||
+				!reflect.DeepEqual(unknown.Header(), w.Header()) {
+				t.Errorf("hidden: unknown %d %v %q & denied %d %v %q differ",
+					unknown.Code, unknown.Header(), unknown.Body.String(), w.Code, w.Header(), w.Body.String())
+			}
+		}
+		if unknown.Code != c.Config.DenyStatusCode {
+			t.Errorf("hidden: unknown stream got %d, want %d", unknown.Code, c.Config.DenyStatusCode)
+		}
+		for _, target := range []string{"/on_play", "/on_publish_done"} {
+			handler := c.OnPlayHandler
+			if target == "/on_publish_done" {
+				handler = c.OnPublishDoneHandler
+			}
+			if w := callback(handler, target, "nobody", ""); w.Code != c.Config.DenyStatusCode {
+				t.Errorf("hidden: %s unknown stream got %d, want %d", target, w.Code, c.Config.DenyStatusCode)
+			}
+		}
+
+		// the real reasons are still logged
+		var logged []string
+		for _, entry := range hook.AllEntries() {
+			logged = append(logged, entry.Message)
+		}
+		all := strings.Join(logged, "\n")
+		for _, reason := range []string{ErrPublisherNotFound.Error(), ErrKeyMismatch.Error()} {
+			if !strings.Contains(all, reason) {
+				t.Errorf("hidden: reason %q not logged in:\n%s", reason, all)
+			}
+		}
+	}
+}
+
+func TestAllowedApps(t *testing.T) {
+	stub := &testutil.TwitchStub{}
+	stub.SetStreams(http.StatusOK, aliceLive)
+	for _, allowed := range [][]string{nil, {"stream", "live"}} {
+		c := newTestController(t, stub, func(conf *config.Config) {
+			conf.RequireTwitchLive = true
+			conf.LiveGracePeriod = 0
+			conf.PublishDenyLimit = 0
+			conf.HidePublisherExistence = false
+			conf.AllowedApps = allowed
+		})
+		createPublisher(t, c, `{"name":"alice","key":"secret","twitch_stream":"alice"}`)
+		want := http.StatusCreated
+		if len(allowed) > 0 {
+			want = c.Config.DenyStatusCode
+		}
+		queries := stub.Queries()
+		if status := publishApp(c, "alice", "secret", "other"); status != want {
+			t.Errorf("ALLOWED_APPS=%v: publish to another app: got %d, want %d", allowed, status, want)
+		}
+		if len(allowed) > 0 && stub.Queries() != queries {
+			t.Errorf("ALLOWED_APPS=%v: twitch queried for a publish to another app", allowed)
+		}
+		for _, app := range []string{"stream", "live"} {
+			if status := publishApp(c, "alice", "secret", app); status != http.StatusCreated {
+				t.Errorf("ALLOWED_APPS=%v: publish to %s: got %d, want %d", allowed, app, status, http.StatusCreated)
+			}
+		}
+		if len(allowed) == 0 {
+			continue
+		}
+		// rejected before any lookup, unknown streams included
+		if status := publishApp(c, "nobody", "secret", "Stream"); status != c.Config.DenyStatusCode {
+			t.Errorf("publish of an unknown stream to another app: got %d, want %d", status, c.Config.DenyStatusCode)
+		}
+	}
+}
+
+func TestPlatformRoles(t *testing.T) {
+	tests := []struct {
+		roles         string
+		twitch, trovo bool
+		allowed       bool
+	}{
+		// twitch is authoritative, trovo informational
+		{`{"twitch":"require","trovo":"any"}`, true, false, true},
+		{`{"twitch":"require","trovo":"any"}`, false, true, false},
+		{`{"twitch":"require","trovo":"require"}`, true, false, false},
+		{`{"twitch":"require","trovo":"require"}`, true, true, true},
+		// without a required platform any one of them is enough
+		{`{"twitch":"any","trovo":"any"}`, false, true, true},
+		{`{"twitch":"any","trovo":"any"}`, false, false, false},
+		// without roles only twitch is checked
+		{`{}`, false, true, false},
+		{`{}`, true, false, true},
+	}
+	for _, test := range tests {
+		stub := &testutil.TwitchStub{}
+		stub.SetStreams(http.StatusOK, aliceOffline)
+		if test.twitch {
+			stub.SetStreams(http.StatusOK, aliceLive)
+		}
+		stub.Handle(trovoRoute, func(r *http.Request) (int, string) {
+			return http.StatusOK, fmt.Sprintf(`{"is_live":%t,"username":"alice"}`, test.trovo)
+		})
+		c := newTestController(t, stub, func(conf *config.Config) {
+			conf.EnabledPlatforms = []string{"twitch", "trovo"}
+			conf.TrovoClientID = "trovo-id"
+			conf.RequireTwitchLive = true
+			conf.LiveGracePeriod = 0
+			conf.NegativeCacheTTL = 0
+			conf.PublishDenyLimit = 0
+		})
+		createPublisher(t, c, `{"name":"alice","key":"secret","twitch_stream":"alice",`+
+			`"trovo_channel":"alice","platform_roles":`+test.roles+`}`)
+
+		want := c.Config.DenyStatusCode
+		if test.allowed {
+			want = http.StatusCreated
+		}
+		if status := publish(c, "alice", "secret"); status != want {
+			t.Errorf("roles %s, live on twitch %t & trovo %t: got %d, want %d",
+				test.roles, test.twitch, test.trovo, status, want)
+		}
+	}
+}
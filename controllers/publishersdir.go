@@ -0,0 +1,142 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// publisherFileExt is the extension of the publisher files in PUBLISHERS_DIR
+const publisherFileExt = ".json"
+
+// publisherFiles returns the publisher files of the directory in name order,
+// skipping hidden files such as editor swap files
+func publisherFiles(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || filepath.Ext(name) != publisherFileExt {
+			continue
+		}
+		files = append(files, name)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// publishersDirVersion hashes the names & contents of the publisher files so
+// that unchanged directories are not reconciled again
+func publishersDirVersion(dir string) (string, error) {
+	files, err := publisherFiles(dir)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	for _, name := range files {
+		content, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s\n%d\n", name, len(content))
+		h.Write(content)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// readPublishersDir reads one publisher per file of the directory. The name
+// of a publisher defaults to the file name without the extension and must
+// match it when provided.
+func readPublishersDir(dir string) ([]Publisher, error) {
+	files, err := publisherFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	target := []Publisher{}
+	for _, name := range files {
+		content, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		p := Publisher{}
+		err = json.Unmarshal(content, &p)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		stem := strings.TrimSuffix(name, publisherFileExt)
+		if p.Name == "" {
+			p.Name = stem
+		}
+		if p.Name != stem {
+			return nil, fmt.Errorf("%s: name '%s' does not match the file name", name, p.Name)
+		}
+		target = append(target, p)
+	}
+	return target, nil
+}
+
+// reconcilePublishersDir syncs the publishers to the files of the directory.
+// When pruning, publishers without a file are deleted.
+func (c *Controller) reconcilePublishersDir(dir string, prune bool) (SyncResponse, error) {
+	target, err := readPublishersDir(dir)
+	if err != nil {
+		return SyncResponse{}, err
+	}
+	return c.syncPublishers(target, prune)
+}
+
+// PublishersDirScheduler reconciles the publishers to the files of
+// PUBLISHERS_DIR at startup and whenever the files change. Directories which
+// cannot be read, or contain an invalid file, are not reconciled until fixed.
+func (c *Controller) PublishersDirScheduler(ctx context.Context, dir string, interval time.Duration, prune bool) {
+	if dir == "" {
+		return
+	}
+	log.Infof("watching publishers directory %s (interval: %s, prune: %t)", dir, interval.String(), prune)
+	// the version last applied, or last failed so that errors are logged once
+	var applied, failed string
+	reconcile := func() {
+		version, err := publishersDirVersion(dir)
+		if err != nil {
+			log.Error("error reading publishers directory: ", err)
+			return
+		}
+		if version == applied || version == failed {
+			return
+		}
+		result, err := c.reconcilePublishersDir(dir, prune)
+		if err != nil {
+			log.Error("error reconciling publishers directory: ", err)
+			failed = version
+			return
+		}
+		applied, failed = version, ""
+		log.Infof("publishers directory reconciled: %d created, %d updated, %d deleted, %d unchanged",
+			len(result.Created), len(result.Updated), len(result.Deleted), result.Unchanged)
+	}
+	reconcile()
+	ticker := time.NewTicker(interval)
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				reconcile()
+			case <-ctx.Done():
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
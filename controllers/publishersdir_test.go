@@ -0,0 +1,102 @@
+package controllers
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bcambl/rtmpauthbot/internal/testutil"
+)
+
+func TestPublishersDirScheduler(t *testing.T) {
+	for _, prune := range []bool{true, false} {
+		dir := testutil.TempDir(t)
+		write := func(name, content string) {
+			t.Helper()
+			err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		write("alice.json", `{"key":"secret"}`)
+		write("bob.json", `{"name":"bob","key":"secret"}`)
+		// not publisher files
+		write(".carol.json", `{"key":"secret"}`)
+		write("dave.txt", `{"key":"secret"}`)
+
+		c := newTestController(t, &testutil.TwitchStub{}, nil)
+		createPublisher(t, c, `{"name":"erin","key":"secret"}`)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		c.PublishersDirScheduler(ctx, dir, 10*time.Millisecond, prune)
+
+		// waitFor returns once the publishers are the wanted ones
+		waitFor := func(step string, want ...string) {
+			t.Helper()
+			deadline := time.Now().Add(5 * time.Second)
+			for !reflect.DeepEqual(publisherNames(t, c), want) {
+				if time.Now().After(deadline) {
+					t.Fatalf("prune %t, %s: publishers %v, want %v", prune, step, publisherNames(t, c), want)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+		if prune {
+			waitFor("at startup", "alice", "bob")
+		} else {
+			waitFor("at startup", "alice", "bob", "erin")
+		}
+
+		// an invalid file leaves the directory unreconciled until fixed
+		write("frank.json", `{"key":`)
+		err := os.Remove(filepath.Join(dir, "bob.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+		if names := publisherNames(t, c); !containsString(names, "bob") {
+			t.Errorf("prune %t: reconciled with an invalid file: %v", prune, names)
+		}
+
+		write("frank.json", `{"key":"secret"}`)
+		if prune {
+			waitFor("after removing a file", "alice", "frank")
+		} else {
+			waitFor("after removing a file", "alice", "bob", "erin", "frank")
+		}
+
+		// changed files update their publisher
+		write("alice.json", `{"key":"rotated"}`)
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			p, err := c.getPublisher("alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.Key == "rotated" {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("prune %t: key of a changed file not updated", prune)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestReadPublishersDirName(t *testing.T) {
+	dir := testutil.TempDir(t)
+	err := ioutil.WriteFile(filepath.Join(dir, "alice.json"), []byte(`{"name":"bob","key":"secret"}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = readPublishersDir(dir)
+	if err == nil || !strings.Contains(err.Error(), "does not match the file name") {
+		t.Errorf("publisher named differently from its file: got %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// recordWebhookTimeout limits each request to RECORD_WEBHOOK_URL
+const recordWebhookTimeout = 10 * time.Second
+
+// Recording is a finished nginx-rtmp recording, as posted to
+// RECORD_WEBHOOK_URL
+type Recording struct {
+	Publisher  string    `json:"publisher"`
+	App        string    `json:"app"`
+	Recorder   string    `json:"recorder,omitempty"`
+	Path       string    `json:"path"`
+	RecordedAt time.Time `json:"recorded_at"`
+}
+
+// postRecording posts a finished recording to the record webhook
+func (c *Controller) postRecording(rec Recording) error {
+	body, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), recordWebhookTimeout)
+	defer cancel()
+	r, err := http.NewRequestWithContext(ctx, "POST", c.cfg().RecordWebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	c.setWebhookHeaders(r)
+	resp, err := c.httpClient().Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("record webhook request failed: %s", resp.Status)
+	}
+	return nil
+}
+
+// OnRecordDoneHandler is the http handler for "/on_record_done", which nginx
+// calls when a recording of a publisher is finished. The path of the
+// recording is stored as the last recording of the publisher and posted to
+// RECORD_WEBHOOK_URL (e.g. to start transcoding) when it is set.
+func (c *Controller) OnRecordDoneHandler(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
+	if !c.parseCallbackForm(w, r) {
+		return
+	}
+	streamName := r.Form.Get("name")
+	p, err := c.getPublisher(streamName)
+	if err != nil {
+		logger.Warnf("on_record_done: stream not found: %s", streamName)
+		w.WriteHeader(c.notFoundStatus())
+		return
+	}
+	rec := Recording{
+		Publisher:  p.Name,
+		App:        r.Form.Get("app"),
+		Recorder:   r.Form.Get("recorder"),
+		Path:       r.Form.Get("path"),
+		RecordedAt: time.Now().UTC().Truncate(time.Second),
+	}
+	logger.WithFields(log.Fields{"recorder": rec.Recorder, "path": rec.Path}).
+		Infof("on_record_done: %s", p.Name)
+
+	err = c.setBucketValue("RecordingBucket", p.Name, rec.Path)
+	if err != nil {
+		logger.Error("error storing recording path: ", err)
+	}
+
+	if c.cfg().RecordWebhookURL != "" {
+		// nginx does not wait for the webhook
+		go func() {
+			err := c.postRecording(rec)
+			if err != nil {
+				log.Errorf("error posting recording of %s: %s", rec.Publisher, err)
+			}
+		}()
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
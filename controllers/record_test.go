@@ -0,0 +1,102 @@
+package controllers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/bcambl/rtmpauthbot/config"
+	"github.com/bcambl/rtmpauthbot/internal/testutil"
+)
+
+// recordWebhook is the record webhook route answered by the twitch stub
+const recordWebhook = "transcoder.example/recordings"
+
+func TestOnRecordDone(t *testing.T) {
+	stub := &testutil.TwitchStub{}
+	posted := make(chan Recording, 1)
+	stub.Handle(recordWebhook, func(r *http.Request) (int, string) {
+		var rec Recording
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &rec)
+		posted <- rec
+		return http.StatusAccepted, ""
+	})
+	c := newTestController(t, stub, func(conf *config.Config) {
+		conf.RecordWebhookURL = "https://" + recordWebhook
+	})
+	createPublisher(t, c, `{"name":"alice","key":"secret"}`)
+
+	form := url.Values{"name": {"alice"}, "app": {"stream"}, "recorder": {"all"}, "path": {"/var/rec/alice-1700000000.flv"}}
+	if w := serve(c.OnRecordDoneHandler, "POST", "/on_record_done", form.Encode()); w.Code != http.StatusCreated {
+		t.Fatalf("on_record_done: got %d, want %d", w.Code, http.StatusCreated)
+	}
+	p, err := c.getPublisher("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.LastRecording != "/var/rec/alice-1700000000.flv" {
+		t.Errorf("last recording: got %q, want the recorded path", p.LastRecording)
+	}
+
+	select {
+	case rec := <-posted:
+		want := Recording{Publisher: "alice", App: "stream", Recorder: "all", Path: "/var/rec/alice-1700000000.flv", RecordedAt: rec.RecordedAt}
+		if rec != want {
+			t.Errorf("webhook: got %+v, want %+v", rec, want)
+		}
+		if time.Since(rec.RecordedAt) > time.Minute {
+			t.Errorf("webhook: recorded at %s", rec.RecordedAt)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("record webhook not called")
+	}
+
+	form.Set("name", "nobody")
+	if w := serve(c.OnRecordDoneHandler, "POST", "/on_record_done", form.Encode()); w.Code != c.notFoundStatus() {
+		t.Errorf("on_record_done of an unknown stream: got %d, want %d", w.Code, c.notFoundStatus())
+	}
+}
+
+func TestWebhookHeaders(t *testing.T) {
+	stub := &testutil.TwitchStub{}
+	received := make(chan http.Header, 2)
+	for _, route := range []string{testWebhook, recordWebhook} {
+		stub.Handle(route, func(r *http.Request) (int, string) {
+			received <- r.Header
+			return http.StatusNoContent, ""
+		})
+	}
+	c := newTestController(t, stub, func(conf *config.Config) {
+		conf.DiscordEnabled = true
+		conf.DiscordWebhook = "https://" + testWebhook
+		conf.RecordWebhookURL = "https://" + recordWebhook
+		// the content type is set even when configured
+		conf.WebhookHeaders = map[string]string{"X-Gateway-Token": "gateway-secret", "Content-Type": "text/plain"}
+	})
+	createPublisher(t, c, `{"name":"alice","key":"secret"}`)
+
+	_, err := c.postWebhook(c.Config.DiscordWebhook, "alice is live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	form := url.Values{"name": {"alice"}, "app": {"stream"}, "path": {"/var/rec/alice.flv"}}
+	serve(c.OnRecordDoneHandler, "POST", "/on_record_done", form.Encode())
+
+	for _, webhook := range []string{"discord", "record"} {
+		select {
+		case header := <-received:
+			if header.Get("X-Gateway-Token") != "gateway-secret" {
+				t.Errorf("%s webhook: X-Gateway-Token %q, want the configured value", webhook, header.Get("X-Gateway-Token"))
+			}
+			if header.Get("Content-Type") != "application/json" {
+				t.Errorf("%s webhook: Content-Type %q, want application/json", webhook, header.Get("Content-Type"))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s webhook not called", webhook)
+		}
+	}
+}
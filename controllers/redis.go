@@ -0,0 +1,173 @@
+package controllers
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// redisCache is a Cache stored in redis so that it is shared by every server
+// using the same redis. Only the few commands needed are implemented over a
+// single connection, which is re-established after any error. Errors are
+// logged & treated as a cache miss so that redis being unavailable only
+// costs extra twitch requests.
+type redisCache struct {
+	addr     string
+	password string
+	prefix   string
+	timeout  time.Duration
+
+	mu   sync.Mutex
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+// NewRedisCache returns a Cache stored in the redis server at addr. Keys are
+// prefixed so that several caches may share a redis database.
+func NewRedisCache(addr, password, prefix string, timeout time.Duration) Cache {
+	return &redisCache{addr: addr, password: password, prefix: prefix, timeout: timeout}
+}
+
+// Set adds a key to the cache which expires after the provided ttl
+func (r *redisCache) Set(key string, ttl time.Duration) {
+	ms := ttl.Milliseconds()
+	if ms < 1 {
+		return
+	}
+	_, err := r.do("SET", r.prefix+key, "1", "PX", strconv.FormatInt(ms, 10))
+	if err != nil {
+		log.Warn("redis cache: ", err)
+	}
+}
+
+// Has returns true when the key is cached and has not expired
+func (r *redisCache) Has(key string) bool {
+	reply, err := r.do("EXISTS", r.prefix+key)
+	if err != nil {
+		log.Warn("redis cache: ", err)
+		return false
+	}
+	n, ok := reply.(int64)
+	return ok && n > 0
+}
+
+// Delete removes a key from the cache, returning true when it was cached
+func (r *redisCache) Delete(key string) bool {
+	reply, err := r.do("DEL", r.prefix+key)
+	if err != nil {
+		log.Warn("redis cache: ", err)
+		return false
+	}
+	n, ok := reply.(int64)
+	return ok && n > 0
+}
+
+// redisError is an error reply from redis, after which the connection
+// remains usable
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+// do sends a command and returns its reply, which is an int64, string or nil
+func (r *redisCache) do(args ...string) (interface{}, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn == nil {
+		err := r.connect()
+		if err != nil {
+			return nil, err
+		}
+	}
+	reply, err := r.command(args...)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		r.conn.Close()
+		r.conn = nil
+	}
+	return reply, err
+}
+
+// connect dials redis & authenticates when a password is configured. The
+// caller must hold mu.
+func (r *redisCache) connect() error {
+	conn, err := net.DialTimeout("tcp", r.addr, r.timeout)
+	if err != nil {
+		return err
+	}
+	r.conn = conn
+	r.rd = bufio.NewReader(conn)
+	if r.password != "" {
+		_, err = r.command("AUTH", r.password)
+		if err != nil {
+			conn.Close()
+			r.conn = nil
+			return fmt.Errorf("error authenticating: %s", err)
+		}
+	}
+	return nil
+}
+
+// command writes a command to the connection & reads the reply. The caller
+// must hold mu.
+func (r *redisCache) command(args ...string) (interface{}, error) {
+	err := r.conn.SetDeadline(time.Now().Add(r.timeout))
+	if err != nil {
+		return nil, err
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err = io.WriteString(r.conn, b.String())
+	if err != nil {
+		return nil, err
+	}
+	return r.readReply()
+}
+
+// readReply reads a single non array reply
+func (r *redisCache) readReply() (interface{}, error) {
+	line, err := r.rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		_, err = io.ReadFull(r.rd, buf)
+		if err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	default:
+		return nil, fmt.Errorf("unsupported reply: %q", line)
+	}
+}
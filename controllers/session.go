@@ -0,0 +1,310 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// minSessionSweepInterval bounds how often stale sessions are swept
+const minSessionSweepInterval = time.Second
+
+// Session is an active publish to the rtmp server. Sessions are identified
+// by the publisher name as a publisher has at most one active publish.
+type Session struct {
+	Publisher string    `json:"publisher"`
+	App       string    `json:"app,omitempty"`
+	Addr      string    `json:"addr,omitempty"`
+	ClientID  string    `json:"client_id,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// startSession records the details of a new publish session
+func (c *Controller) startSession(s Session) error {
+	content, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return c.setBucketValue("SessionBucket", s.Publisher, string(content))
+}
+
+// activeSessions returns the active publish sessions ordered by publisher
+func (c *Controller) activeSessions() ([]Session, error) {
+	sessions := []Session{}
+	err := c.DB.View(func(tx *bolt.Tx) error {
+		live := c.bucket(tx, "RTMPLiveBucket")
+		details := c.bucket(tx, "SessionBucket")
+		seen := c.bucket(tx, "SessionSeenBucket")
+		if live == nil || details == nil || seen == nil {
+			return ErrBucketMissing
+		}
+		cur := live.Cursor()
+		for k, v := cur.First(); k != nil; k, v = cur.Next() {
+			if string(v) != "live" {
+				continue
+			}
+			s := Session{}
+			if b := details.Get(k); len(b) > 0 {
+				err := json.Unmarshal(b, &s)
+				if err != nil {
+					return err
+				}
+			}
+			// sessions started before details were recorded only have a name
+			s.Publisher = string(k)
+			s.LastSeen = parseTimestamp(seen.Get(k))
+			sessions = append(sessions, s)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// endSession clears the local live status & session of a publisher, as
+// on_publish_done does
+func (c *Controller) endSession(tx *bolt.Tx, name string) error {
+	for _, bucket := range []string{"RTMPLiveBucket", "PublishAttemptBucket"} {
+		b := c.bucket(tx, bucket)
+		if b == nil {
+			return fmt.Errorf("%w: %s", ErrBucketMissing, bucket)
+		}
+		err := b.Put([]byte(name), []byte(""))
+		if err != nil {
+			return err
+		}
+	}
+	for _, bucket := range []string{"SessionBucket", "SessionSeenBucket"} {
+		b := c.bucket(tx, bucket)
+		if b == nil {
+			return fmt.Errorf("%w: %s", ErrBucketMissing, bucket)
+		}
+		err := b.Delete([]byte(name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// touchSession records that a publish session was seen
+func (c *Controller) touchSession(name string, now time.Time) error {
+	return c.setBucketValue("SessionSeenBucket", name, string(formatTimestamp(now)))
+}
+
+// sweepSessions ends the local live status of publishers whose session has
+// not been seen (on_publish or on_update) within the ttl, as happens when
+// on_publish_done is never delivered. Sessions without a recorded time, such
+// as those started before the sweep was enabled, are given the ttl from now.
+// The names of the publishers whose sessions were ended are returned.
+func (c *Controller) sweepSessions(now time.Time, ttl time.Duration) ([]string, error) {
+	var stale []string
+	err := c.DB.Update(func(tx *bolt.Tx) error {
+		live := c.bucket(tx, "RTMPLiveBucket")
+		seen := c.bucket(tx, "SessionSeenBucket")
+		if live == nil || seen == nil {
+			return ErrBucketMissing
+		}
+		var unseen []string
+		cur := live.Cursor()
+		for k, v := cur.First(); k != nil; k, v = cur.Next() {
+			if string(v) != "live" {
+				continue
+			}
+			lastSeen := parseTimestamp(seen.Get(k))
+			if lastSeen.IsZero() {
+				unseen = append(unseen, string(k))
+				continue
+			}
+			if now.Sub(lastSeen) > ttl {
+				stale = append(stale, string(k))
+			}
+		}
+		// buckets are only modified once the cursor is no longer in use
+		for _, name := range unseen {
+			err := seen.Put([]byte(name), formatTimestamp(now))
+			if err != nil {
+				return err
+			}
+		}
+		for _, name := range stale {
+			err := c.endSession(tx, name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stale, nil
+}
+
+// SessionSweepScheduler launches the periodic sweep of stale publish
+// sessions. A ttl of 0 disables the sweep.
+func (c *Controller) SessionSweepScheduler(ctx context.Context, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	interval := ttl / 2
+	if interval < minSessionSweepInterval {
+		interval = minSessionSweepInterval
+	}
+	log.Infof("starting stale session sweep (ttl: %s)", ttl.String())
+	ticker := time.NewTicker(interval)
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				stale, err := c.sweepSessions(time.Now(), ttl)
+				if err != nil {
+					log.Error("error sweeping stale sessions: ", err)
+					continue
+				}
+				for _, name := range stale {
+					log.Warnf("%s has not been seen for %s, ending stale session", name, ttl.String())
+				}
+			case <-ctx.Done():
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// OnUpdateHandler is the http handler for "/on_update", which nginx calls
+// periodically for each session. Publish sessions of publishers with a
+// matching key record that they are still alive. Other sessions (including
+// play sessions) are always allowed so that they are not disconnected.
+func (c *Controller) OnUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
+	if !c.parseCallbackForm(w, r) {
+		return
+	}
+	streamName := r.Form.Get("name")
+	streamKey := r.Form.Get(c.cfg().KeyParam)
+	p, err := c.getPublisher(streamName)
+	if err == nil && streamKey == p.Key && p.RTMPLive == "live" && !c.cfg().ReadOnlyDB {
+		logger.Debugf("on_update: %s", p.Name)
+		err = c.touchSession(p.Name, time.Now())
+		if err != nil {
+			logger.Error("error recording session update: ", err)
+		}
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// dropPublisher asks nginx to disconnect a publisher through the nginx-rtmp
+// control module
+func (c *Controller) dropPublisher(s Session) error {
+	query := url.Values{}
+	query.Set("app", s.App)
+	query.Set("name", s.Publisher)
+	if s.ClientID != "" {
+		query.Set("clientid", s.ClientID)
+	}
+	dropURL := strings.TrimSuffix(c.cfg().NginxControlURL, "/") + "/drop/publisher?" + query.Encode()
+	ctx, cancel := context.WithTimeout(context.Background(), nginxStatTimeout)
+	defer cancel()
+	r, err := http.NewRequestWithContext(ctx, "GET", dropURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.httpClient().Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("nginx control request failed: %s", resp.Status)
+	}
+	return nil
+}
+
+// SessionsAPIHandler is the http handler for "/api/sessions", listing the
+// active publish sessions, and "/api/sessions/{publisher}", ending the
+// session of a publisher. When NGINX_CONTROL_URL is set the publisher is also
+// disconnected from nginx.
+func (c *Controller) SessionsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
+
+	w.Header().Add("Content-Type", "application/json")
+
+	if r.Method == "GET" && r.URL.Path == "/api/sessions" {
+		sessions, err := c.activeSessions()
+		if err != nil {
+			logger.Debug("error retrieving sessions: ", err)
+			writeStatusError(w, http.StatusInternalServerError)
+			return
+		}
+		content, err := json.Marshal(sessions)
+		if err != nil {
+			logger.Debug(err)
+			writeStatusError(w, http.StatusInternalServerError)
+			return
+		}
+		logger.Info("listing sessions")
+		w.Write(content)
+		return
+	}
+
+	if r.Method == "DELETE" {
+		name := strings.TrimPrefix(r.URL.Path, "/api/sessions/")
+		if name == "" || strings.Contains(name, "/") {
+			writeStatusError(w, http.StatusNotFound)
+			return
+		}
+		sessions, err := c.activeSessions()
+		if err != nil {
+			logger.Debug("error retrieving sessions: ", err)
+			writeStatusError(w, http.StatusInternalServerError)
+			return
+		}
+		var session *Session
+		for i := range sessions {
+			if sessions[i].Publisher == name {
+				session = &sessions[i]
+			}
+		}
+		if session == nil {
+			writeStatusError(w, http.StatusNotFound)
+			return
+		}
+		if c.cfg().NginxControlURL != "" {
+			err = c.dropPublisher(*session)
+			if err != nil {
+				// the stream is still flowing, keep the session
+				logger.Errorf("error dropping %s from nginx: %s", name, err)
+				writeJSONError(w, http.StatusBadGateway, codeBadGateway, err.Error())
+				return
+			}
+		}
+		err = c.DB.Update(func(tx *bolt.Tx) error {
+			return c.endSession(tx, name)
+		})
+		if err != nil {
+			logger.Debugf("error ending session of '%s': %s", name, err)
+			writeStatusError(w, http.StatusInternalServerError)
+			return
+		}
+		logger.Infof("session ended: %s", name)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	logger.Debug(http.StatusNotImplemented)
+	writeStatusError(w, http.StatusNotImplemented)
+}
@@ -0,0 +1,143 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bcambl/rtmpauthbot/config"
+	"github.com/bcambl/rtmpauthbot/internal/testutil"
+)
+
+func TestSweepStaleSessions(t *testing.T) {
+	c := newTestController(t, &testutil.TwitchStub{}, func(conf *config.Config) {
+		conf.RequireTwitchLive = false
+		conf.AllowedApps = nil
+		conf.DiscordEnabled = false
+	})
+	createPublisher(t, c, `{"name":"alice","key":"secret"}`)
+	createPublisher(t, c, `{"name":"bob","key":"secret"}`)
+	for _, name := range []string{"alice", "bob"} {
+		if status := publish(c, name, "secret"); status != http.StatusCreated {
+			t.Fatalf("publish %s: got %d, want %d", name, status, http.StatusCreated)
+		}
+	}
+	sessionNames := func() string {
+		t.Helper()
+		sessions, err := c.activeSessions()
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := []string{}
+		for _, s := range sessions {
+			names = append(names, s.Publisher)
+		}
+		return strings.Join(names, ",")
+	}
+
+	// alice keeps sending on_update heartbeats, bob's on_publish_done was lost
+	ttl := time.Minute
+	now := time.Now()
+	err := c.touchSession("bob", now.Add(-2*ttl))
+	if err != nil {
+		t.Fatal(err)
+	}
+	form := url.Values{"name": {"alice"}, "key": {"secret"}, "call": {"update_publish"}}
+	if w := serve(c.OnUpdateHandler, "POST", "/on_update", form.Encode()); w.Code != http.StatusCreated {
+		t.Fatalf("on_update: got %d, want %d", w.Code, http.StatusCreated)
+	}
+
+	stale, err := c.sweepSessions(now, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(stale, ",") != "bob" {
+		t.Fatalf("swept %v, want [bob]", stale)
+	}
+	if names := sessionNames(); names != "alice" {
+		t.Fatalf("sessions after the sweep: got %s, want alice", names)
+	}
+	p, err := c.getPublisher("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.RTMPLive == "live" {
+		t.Fatal("bob is still live after the sweep")
+	}
+
+	// bob may publish again
+	if status := publish(c, "bob", "secret"); status != http.StatusCreated {
+		t.Fatalf("publish after the sweep: got %d, want %d", status, http.StatusCreated)
+	}
+	if names := sessionNames(); names != "alice,bob" {
+		t.Fatalf("sessions after publishing again: got %s, want alice,bob", names)
+	}
+}
+
+func TestSessionsAPI(t *testing.T) {
+	stub := &testutil.TwitchStub{}
+	dropStatus := http.StatusOK
+	stub.Handle("nginx.example/control/drop/publisher", func(*http.Request) (int, string) { return dropStatus, "1" })
+	c := newTestController(t, stub, func(conf *config.Config) {
+		conf.NginxControlURL = "http://nginx.example/control/"
+	})
+	started := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	session := Session{Publisher: "alice", App: "stream", Addr: "198.51.100.7", ClientID: "42",
+		StartedAt: started, LastSeen: started.Add(time.Minute)}
+	err := c.setBucketValue("RTMPLiveBucket", "alice", "live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.startSession(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.touchSession("alice", session.LastSeen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := func() []Session {
+		t.Helper()
+		w := serve(c.SessionsAPIHandler, "GET", "/api/sessions", "")
+		var sessions []Session
+		err := json.Unmarshal(w.Body.Bytes(), &sessions)
+		if w.Code != http.StatusOK || err != nil {
+			t.Fatalf("sessions: got %d %s", w.Code, w.Body.String())
+		}
+		return sessions
+	}
+
+	sessions := list()
+	if len(sessions) != 1 || !reflect.DeepEqual(sessions[0], session) {
+		t.Fatalf("sessions: got %+v, want [%+v]", sessions, session)
+	}
+
+	// the session is kept while nginx fails to drop the publisher
+	dropStatus = http.StatusInternalServerError
+	if w := serve(c.SessionsAPIHandler, "DELETE", "/api/sessions/alice", ""); w.Code != http.StatusBadGateway {
+		t.Errorf("revoke while nginx fails: got %d, want %d", w.Code, http.StatusBadGateway)
+	}
+	if len(list()) != 1 {
+		t.Fatal("session ended without dropping the publisher")
+	}
+
+	dropStatus = http.StatusOK
+	if w := serve(c.SessionsAPIHandler, "DELETE", "/api/sessions/alice", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("revoke: got %d, want %d", w.Code, http.StatusNoContent)
+	}
+	drops := stub.Requests("nginx.example/control/drop/publisher")
+	want := url.Values{"app": {"stream"}, "name": {"alice"}, "clientid": {"42"}}
+	if len(drops) != 2 || !reflect.DeepEqual(drops[1].URL.Query(), want) {
+		t.Errorf("nginx drop requests: got %d, want 2 with %v", len(drops), want)
+	}
+	if sessions := list(); len(sessions) != 0 {
+		t.Errorf("sessions after the revoke: got %+v, want none", sessions)
+	}
+	if w := serve(c.SessionsAPIHandler, "DELETE", "/api/sessions/alice", ""); w.Code != http.StatusNotFound {
+		t.Errorf("revoke an ended session: got %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,205 @@
+package controllers
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// StreamSource is implemented by each streaming platform which is able to
+// report the live status of publishers
+type StreamSource interface {
+	// Name returns the platform name as used in ENABLED_PLATFORMS
+	Name() string
+	// Setup performs any one-time preparation before the first poll
+	Setup() error
+	// Poll queries the platform and updates the live status of publishers
+	Poll()
+	// Live returns the publishers live on the platform as of the last poll
+	Live() ([]LiveStream, error)
+}
+
+// LiveStream is a publisher which is live on a platform
+type LiveStream struct {
+	Publisher    string `json:"publisher"`
+	Platform     string `json:"platform"`
+	ViewerCount  int    `json:"viewer_count"`
+	Title        string `json:"title"`
+	ThumbnailURL string `json:"thumbnail_url,omitempty"`
+}
+
+// twitchSource polls twitch for publishers with a twitch stream configured
+type twitchSource struct {
+	c *Controller
+}
+
+func (s *twitchSource) Name() string {
+	return "twitch"
+}
+
+func (s *twitchSource) Setup() error {
+	return s.c.resolveAllUserIDs()
+}
+
+func (s *twitchSource) Poll() {
+	s.c.twitchMain()
+}
+
+func (s *twitchSource) Live() ([]LiveStream, error) {
+	live := []LiveStream{}
+	err := s.c.forEachPublisher(func(p Publisher) error {
+		if p.IsTwitchLive() {
+			live = append(live, LiveStream{
+				Publisher:    p.Name,
+				Platform:     s.Name(),
+				ViewerCount:  p.ViewerCount,
+				Title:        p.Title,
+				ThumbnailURL: p.ThumbnailURL,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return live, nil
+}
+
+// RegisterSources registers a StreamSource for each enabled platform.
+// Sources for platforms which are not enabled are never registered and
+// therefore never polled.
+func (c *Controller) RegisterSources() {
+	c.Sources = nil
+	for _, name := range c.cfg().EnabledPlatforms {
+		switch name {
+		case "twitch":
+			if !c.cfg().TwitchEnabled {
+				log.Infof("twitch integration disabled")
+				continue
+			}
+			log.Infof("twitch integration enabled")
+			c.Sources = append(c.Sources, &twitchSource{c: c})
+		case "trovo":
+			if c.cfg().TrovoClientID == "" {
+				log.Warnf("trovo enabled without TROVO_CLIENT_ID, trovo integration disabled")
+				continue
+			}
+			log.Infof("trovo integration enabled")
+			c.Sources = append(c.Sources, &trovoSource{c: c})
+		case "nginx":
+			if c.cfg().NginxStatURL == "" {
+				log.Warnf("nginx enabled without NGINX_STAT_URL, nginx integration disabled")
+				continue
+			}
+			log.Infof("nginx integration enabled")
+			c.Sources = append(c.Sources, &nginxSource{c: c})
+		default:
+			log.Warnf("unknown platform in enabled platforms: %s", name)
+		}
+	}
+}
+
+// sourceRegistered returns true when a source is registered for a platform
+func (c *Controller) sourceRegistered(name string) bool {
+	for i := range c.Sources {
+		if c.Sources[i].Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// SourceNames returns the platform names of the registered sources
+func (c *Controller) SourceNames() []string {
+	names := []string{}
+	for i := range c.Sources {
+		names = append(names, c.Sources[i].Name())
+	}
+	return names
+}
+
+// liveStreams returns the merged live streams of all registered sources
+func (c *Controller) liveStreams() ([]LiveStream, error) {
+	live := []LiveStream{}
+	for i := range c.Sources {
+		streams, err := c.Sources[i].Live()
+		if err != nil {
+			return nil, err
+		}
+		live = append(live, streams...)
+	}
+	sort.Slice(live, func(i, j int) bool {
+		if live[i].Publisher != live[j].Publisher {
+			return live[i].Publisher < live[j].Publisher
+		}
+		return live[i].Platform < live[j].Platform
+	})
+	return live, nil
+}
+
+// SourceScheduler launches the background poll of all registered sources
+func (c *Controller) SourceScheduler(ctx context.Context, pollRate time.Duration) {
+	ticker := time.NewTicker(pollRate)
+	go func() {
+		for i := range c.Sources {
+			err := c.Sources[i].Setup()
+			if err != nil {
+				log.Warnf("%s: setup failed: %s", c.Sources[i].Name(), err)
+			}
+		}
+		polling := make([]int32, len(c.Sources))
+		atomic.StoreInt64(&c.lastPoll, time.Now().UnixNano())
+		for {
+			select {
+			case <-ticker.C:
+				c.pollSources(polling, c.cfg().SourceTimeout)
+				atomic.StoreInt64(&c.lastPoll, time.Now().UnixNano())
+			case <-ctx.Done():
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// pollSources polls every source concurrently and waits up to the timeout
+// for each, so that a slow platform cannot delay the others. A source which
+// is still polling from a previous tick is skipped until it finishes. A
+// timeout of 0 waits for every source.
+func (c *Controller) pollSources(polling []int32, timeout time.Duration) {
+	var wg sync.WaitGroup
+	for i := range c.Sources {
+		source := c.Sources[i]
+		running := &polling[i]
+		if !atomic.CompareAndSwapInt32(running, 0, 1) {
+			log.Warnf("%s: previous poll still running, skipping poll", source.Name())
+			continue
+		}
+		done := make(chan struct{})
+		go func() {
+			defer atomic.StoreInt32(running, 0)
+			defer close(done)
+			source.Poll()
+		}()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if timeout <= 0 {
+				<-done
+				return
+			}
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			select {
+			case <-done:
+			case <-timer.C:
+				log.Warnf("%s: poll did not complete within %s", source.Name(), timeout.String())
+			}
+		}()
+	}
+	wg.Wait()
+}
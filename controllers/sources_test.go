@@ -0,0 +1,145 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bcambl/rtmpauthbot/config"
+	"github.com/bcambl/rtmpauthbot/internal/testutil"
+)
+
+// trovoRoute is the trovo api route answered by the twitch stub with 404
+const trovoRoute = "open-api.trovo.live/openplatform/channels/id"
+
+func TestDisabledPlatformNeverInvoked(t *testing.T) {
+	for _, platforms := range [][]string{{"twitch"}, {"twitch", "trovo"}} {
+		stub := &testutil.TwitchStub{}
+		stub.SetStreams(http.StatusOK, aliceOffline)
+		c := newTestController(t, stub, func(conf *config.Config) {
+			conf.EnabledPlatforms = platforms
+			conf.TrovoClientID = "trovo-id"
+			conf.RequireTwitchLive = true
+			conf.LiveGracePeriod = 0
+		})
+		createPublisher(t, c, `{"name":"alice","key":"secret","twitch_stream":"alice",`+
+			`"trovo_channel":"alice","platform_roles":{"twitch":"any","trovo":"any"}}`)
+
+		c.pollSources(make([]int32, len(c.Sources)), 0)
+		status := publish(c, "alice", "secret")
+		if status != c.Config.DenyStatusCode {
+			t.Fatalf("%v: publish while not live: got %d, want %d", platforms, status, c.Config.DenyStatusCode)
+		}
+		trovoEnabled := len(platforms) > 1
+		if queried := len(stub.Requests(trovoRoute)) > 0; queried != trovoEnabled {
+			t.Errorf("%v: trovo queried %t, want %t", platforms, queried, trovoEnabled)
+		}
+	}
+}
+
+func TestLiveThumbnail(t *testing.T) {
+	stub := &testutil.TwitchStub{}
+	stub.SetStreams(http.StatusOK, `{"data":[{"user_login":"alice","user_name":"Alice","type":"live","viewer_count":5,`+
+		`"thumbnail_url":"https://static-cdn.jtvnw.net/previews-ttv/live_user_alice-{width}x{height}.jpg"}]}`)
+	c := newTestController(t, stub, func(conf *config.Config) {
+		conf.DiscordEnabled = false
+	})
+	createPublisher(t, c, `{"name":"alice","key":"secret","twitch_stream":"alice"}`)
+	_, err := c.refreshTwitch()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := serve(c.LiveAPIHandler, "GET", "/api/live", "")
+	var live []LiveStream
+	err = json.Unmarshal(w.Body.Bytes(), &live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "https://static-cdn.jtvnw.net/previews-ttv/live_user_alice-320x180.jpg"
+	if len(live) != 1 || live[0].ThumbnailURL != want {
+		t.Fatalf("live streams: got %s, want the thumbnail %s", w.Body.String(), want)
+	}
+}
+
+// fakeSource is a source reporting fixed live streams
+type fakeSource struct {
+	name string
+	live []LiveStream
+}
+
+func (s *fakeSource) Name() string                { return s.name }
+func (s *fakeSource) Setup() error                { return nil }
+func (s *fakeSource) Poll()                       {}
+func (s *fakeSource) Live() ([]LiveStream, error) { return s.live, nil }
+
+func TestLiveMergesSources(t *testing.T) {
+	c := newTestController(t, &testutil.TwitchStub{}, nil)
+	c.Sources = []StreamSource{
+		&fakeSource{name: "twitch", live: []LiveStream{{Publisher: "bob", Platform: "twitch", ViewerCount: 3, Title: "practice"}}},
+		&fakeSource{name: "trovo", live: []LiveStream{{Publisher: "alice", Platform: "trovo", ViewerCount: 7, Title: "finals"}}},
+	}
+
+	w := serve(c.LiveAPIHandler, "GET", "/api/live", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("live: got %d, want %d", w.Code, http.StatusOK)
+	}
+	var live []LiveStream
+	err := json.Unmarshal(w.Body.Bytes(), &live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []LiveStream{
+		{Publisher: "alice", Platform: "trovo", ViewerCount: 7, Title: "finals"},
+		{Publisher: "bob", Platform: "twitch", ViewerCount: 3, Title: "practice"},
+	}
+	if len(live) != len(want) {
+		t.Fatalf("live: got %s, want both sources", w.Body.String())
+	}
+	for i := range want {
+		if live[i] != want[i] {
+			t.Errorf("live stream %d: got %+v, want %+v", i, live[i], want[i])
+		}
+	}
+}
+
+// blockingSource is a source whose polls block until release is closed
+type blockingSource struct {
+	fakeSource
+	release chan struct{}
+	polls   int32
+}
+
+func (s *blockingSource) Poll() {
+	atomic.AddInt32(&s.polls, 1)
+	if s.release != nil {
+		<-s.release
+	}
+}
+
+func TestPollSourceTimeout(t *testing.T) {
+	c := newTestController(t, &testutil.TwitchStub{}, nil)
+	fast := &blockingSource{fakeSource: fakeSource{name: "twitch"}}
+	hanging := &blockingSource{fakeSource: fakeSource{name: "trovo"}, release: make(chan struct{})}
+	defer close(hanging.release)
+	c.Sources = []StreamSource{hanging, fast}
+	polling := make([]int32, len(c.Sources))
+
+	timeout := 50 * time.Millisecond
+	for tick := 1; tick <= 2; tick++ {
+		start := time.Now()
+		c.pollSources(polling, timeout)
+		if elapsed := time.Since(start); elapsed > timeout+time.Second {
+			t.Fatalf("tick %d: took %s with a source timeout of %s", tick, elapsed, timeout)
+		}
+		if polls := atomic.LoadInt32(&fast.polls); polls != int32(tick) {
+			t.Errorf("tick %d: fast source polled %d times, want %d", tick, polls, tick)
+		}
+		// the hanging poll still runs, so it is skipped rather than stacked
+		if polls := atomic.LoadInt32(&hanging.polls); polls != 1 {
+			t.Errorf("tick %d: hanging source polled %d times, want 1", tick, polls)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// SyncResponse summarises the changes made to reconcile the publishers
+type SyncResponse struct {
+	Created   []string `json:"created"`
+	Updated   []string `json:"updated"`
+	Deleted   []string `json:"deleted"`
+	Unchanged int      `json:"unchanged"`
+}
+
+// syncPublishers reconciles the database to the provided publishers, creating
+// missing publishers, updating changed publishers and, when pruning,
+// deleting publishers which are not provided. Fields which are not provided
+// are left as they are, as with POST /api/publisher. The reconcile is a
+// single transaction, so nothing is changed when it fails.
+func (c *Controller) syncPublishers(target []Publisher, prune bool) (SyncResponse, error) {
+	result := SyncResponse{Created: []string{}, Updated: []string{}, Deleted: []string{}}
+
+	err := validateSyncTarget(target)
+	if err != nil {
+		return result, err
+	}
+	wanted := make(map[string]bool, len(target))
+	for i := range target {
+		wanted[target[i].Name] = true
+	}
+
+	changes := SyncResponse{Created: []string{}, Updated: []string{}, Deleted: []string{}}
+	now := time.Now()
+	err = c.DB.Update(func(tx *bolt.Tx) error {
+		b := c.bucket(tx, "PublisherBucket")
+		if b == nil {
+			return fmt.Errorf("%w: PublisherBucket", ErrBucketMissing)
+		}
+		existing := make(map[string]Publisher)
+		cur := b.Cursor()
+		for k, v := cur.First(); k != nil; k, v = cur.Next() {
+			p := Publisher{Name: string(k), Key: string(v)}
+			err := c.fetchPublisher(tx, &p)
+			if err != nil {
+				return err
+			}
+			existing[p.Name] = p
+		}
+
+		total := len(target)
+		if !prune {
+			for name := range existing {
+				if !wanted[name] {
+					total++
+				}
+			}
+		}
+		limit := c.cfg().MaxPublishers
+		if limit > 0 && total > limit {
+			return fmt.Errorf("%w: sync would result in %d of %d publishers", ErrPublisherLimit, total, limit)
+		}
+
+		if prune {
+			for name := range existing {
+				if wanted[name] {
+					continue
+				}
+				err := c.deletePublisherTx(tx, name)
+				if err != nil {
+					return fmt.Errorf("error deleting publisher '%s': %w", name, err)
+				}
+				changes.Deleted = append(changes.Deleted, name)
+			}
+			sort.Strings(changes.Deleted)
+		}
+
+		for i := range target {
+			current, ok := existing[target[i].Name]
+			if ok && !publisherChanged(current, target[i]) {
+				changes.Unchanged++
+				continue
+			}
+			err := c.updatePublisherTx(tx, target[i], now)
+			if err != nil {
+				return fmt.Errorf("error updating publisher '%s': %w", target[i].Name, err)
+			}
+			if ok {
+				changes.Updated = append(changes.Updated, target[i].Name)
+			} else {
+				changes.Created = append(changes.Created, target[i].Name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+	c.publishersChanged()
+	return changes, nil
+}
+
+// validateSyncTarget validates every publisher to be synced & ensures each
+// publisher is only listed once
+func validateSyncTarget(target []Publisher) error {
+	seen := make(map[string]bool, len(target))
+	for i := range target {
+		err := target[i].IsValid()
+		if err != nil {
+			return fmt.Errorf("publisher %d: %w", i, err)
+		}
+		if seen[target[i].Name] {
+			return fmt.Errorf("publisher %d: duplicate name '%s'", i, target[i].Name)
+		}
+		seen[target[i].Name] = true
+	}
+	return nil
+}
+
+// publisherChanged returns true when updating the current publisher with the
+// desired publisher would change any of its fields
+func publisherChanged(current, desired Publisher) bool {
+	switch {
+	case desired.Key != current.Key:
+		return true
+	case desired.TwitchStream != "" && desired.TwitchStream != current.TwitchStream:
+		return true
+	case desired.TrovoChannel != nil && *desired.TrovoChannel != current.trovoChannel():
+		return true
+	case desired.App != nil && *desired.App != current.app():
+		return true
+	case desired.Mode != nil && desired.mode() != current.mode():
+		return true
+	case desired.MinViewers != nil && *desired.MinViewers != current.minViewers():
+		return true
+	case desired.Enabled != nil && *desired.Enabled != current.IsEnabled():
+		return true
+	case desired.Tags != nil && strings.Join(desired.Tags, ",") != strings.Join(current.Tags, ","):
+		return true
+	case desired.Metadata != nil && !metadataEqual(desired.Metadata, current.Metadata):
+		return true
+	case desired.WebhookURL != nil && *desired.WebhookURL != current.webhookURL():
+		return true
+	case desired.PlatformRoles != nil && !metadataEqual(desired.PlatformRoles, current.PlatformRoles):
+		return true
+	case desired.ActiveFrom != nil && !timestampEqual(*desired.ActiveFrom, current.ActiveFrom):
+		return true
+	case desired.ActiveUntil != nil && !timestampEqual(*desired.ActiveUntil, current.ActiveUntil):
+		return true
+	}
+	return false
+}
+
+// timestampEqual compares a desired window bound, where the zero time clears
+// the bound, to the current bound
+func timestampEqual(desired time.Time, current *time.Time) bool {
+	if current == nil {
+		return desired.IsZero()
+	}
+	return desired.Truncate(time.Second).Equal(*current)
+}
+
+func metadataEqual(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		other, ok := b[k]
+		if !ok || other != v {
+			return false
+		}
+	}
+	return true
+}
+
+// SyncAPIHandler is the http handler for "/api/publishers/sync", reconciling
+// the publishers to match the json list of publishers in the request body.
+// Publishers which are not listed are deleted unless prune=false is provided.
+func (c *Controller) SyncAPIHandler(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
+
+	w.Header().Add("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		logger.Debug(http.StatusNotImplemented)
+		writeStatusError(w, http.StatusNotImplemented)
+		return
+	}
+
+	prune := true
+	if value := r.URL.Query().Get("prune"); value != "" {
+		var err error
+		prune, err = strconv.ParseBool(value)
+		if err != nil {
+			logger.Debug(err)
+			writeJSONError(w, http.StatusBadRequest, codeBadRequest, "invalid prune: "+value)
+			return
+		}
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		logger.Debug("error reading POST body: ", err)
+		writeJSONError(w, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+	var target []Publisher
+	err = json.Unmarshal(body, &target)
+	if err != nil {
+		logger.Debug("error unmarshaling body json: ", err)
+		writeJSONError(w, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+
+	err = validateSyncTarget(target)
+	if err != nil {
+		logger.Debug(err)
+		writeJSONError(w, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+
+	result, err := c.syncPublishers(target, prune)
+	if err != nil {
+		logger.Warn("error syncing publishers: ", err)
+		writeAPIError(w, err)
+		return
+	}
+
+	content, err := json.Marshal(result)
+	if err != nil {
+		logger.Debug(err)
+		writeStatusError(w, http.StatusInternalServerError)
+		return
+	}
+	logger.Infof("publishers synced: %d created, %d updated, %d deleted, %d unchanged",
+		len(result.Created), len(result.Updated), len(result.Deleted), result.Unchanged)
+	w.Write(content)
+}
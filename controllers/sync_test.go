@@ -0,0 +1,49 @@
+package controllers
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/bcambl/rtmpauthbot/config"
+	"github.com/bcambl/rtmpauthbot/internal/testutil"
+)
+
+func TestSyncPublishers(t *testing.T) {
+	c := newTestController(t, &testutil.TwitchStub{}, func(conf *config.Config) {
+		conf.MaxPublishers = 3
+	})
+	createPublisher(t, c, `{"name":"alice","key":"secret","tags":["event"]}`)
+	createPublisher(t, c, `{"name":"bob","key":"secret"}`)
+	createPublisher(t, c, `{"name":"carol","key":"secret"}`)
+
+	// without pruning the limit is exceeded, which must not change anything
+	w := serve(c.SyncAPIHandler, "POST", "/api/publishers/sync?prune=false",
+		`[{"name":"alice","key":"changed"},{"name":"dave","key":"secret"}]`)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("sync beyond the publisher limit: got %d, want %d: %s", w.Code, http.StatusConflict, w.Body.String())
+	}
+	if names := strings.Join(publisherNames(t, c), ","); names != "alice,bob,carol" {
+		t.Fatalf("failed sync changed the publishers: %s", names)
+	}
+
+	w = serve(c.SyncAPIHandler, "POST", "/api/publishers/sync",
+		`[{"name":"alice","key":"changed"},{"name":"carol","key":"secret"},{"name":"dave","key":"secret"}]`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("sync: got %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	want := `{"created":["dave"],"updated":["alice"],"deleted":["bob"],"unchanged":1}`
+	if body := w.Body.String(); body != want {
+		t.Fatalf("sync: got %s, want %s", body, want)
+	}
+	if names := strings.Join(publisherNames(t, c), ","); names != "alice,carol,dave" {
+		t.Fatalf("publishers after the sync: %s", names)
+	}
+	p, err := c.getPublisher("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Key != "changed" || strings.Join(p.Tags, ",") != "event" {
+		t.Fatalf("alice after the sync: key %s, tags %v", p.Key, p.Tags)
+	}
+}
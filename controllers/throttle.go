@@ -0,0 +1,63 @@
+package controllers
+
+import (
+	"sync"
+	"time"
+)
+
+// publishThrottle tracks denied publishes per publisher. Once a publisher
+// has been denied limit times within the window, its publishes are rejected
+// for the backoff period even when they would otherwise be allowed, so that
+// a flapping encoder does not hammer twitch through the live check.
+type publishThrottle struct {
+	mu      sync.Mutex
+	entries map[string]*throttleEntry
+}
+
+type throttleEntry struct {
+	windowStart  time.Time
+	denies       int
+	blockedUntil time.Time
+}
+
+// Blocked returns the time until which the publisher is throttled, or the
+// zero time when it is not
+func (t *publishThrottle) Blocked(name string, now time.Time) time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, ok := t.entries[name]
+	if !ok || !now.Before(e.blockedUntil) {
+		return time.Time{}
+	}
+	return e.blockedUntil
+}
+
+// Deny records a denied publish, returning true when the publisher has
+// become throttled
+func (t *publishThrottle) Deny(name string, now time.Time, limit int, window, backoff time.Duration) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.entries == nil {
+		t.entries = make(map[string]*throttleEntry)
+	}
+	e, ok := t.entries[name]
+	if !ok || now.Sub(e.windowStart) > window {
+		e = &throttleEntry{windowStart: now}
+		t.entries[name] = e
+	}
+	e.denies++
+	if e.denies < limit {
+		return false
+	}
+	e.blockedUntil = now.Add(backoff)
+	e.windowStart = now
+	e.denies = 0
+	return true
+}
+
+// Reset clears the denies of a publisher after a successful publish
+func (t *publishThrottle) Reset(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.entries, name)
+}
@@ -0,0 +1,163 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// trovoChannelURL is the trovo open api endpoint for public channel info
+const trovoChannelURL = "https://open-api.trovo.live/openplatform/channels/id"
+
+// TrovoChannelResponse is the subset of trovo channel info used to check
+// whether a channel is live
+type TrovoChannelResponse struct {
+	IsLive         bool   `json:"is_live"`
+	Username       string `json:"username"`
+	LiveTitle      string `json:"live_title"`
+	CurrentViewers int    `json:"current_viewers"`
+	CategoryName   string `json:"category_name"`
+}
+
+// trovoSource polls trovo for publishers with a trovo channel configured.
+// Trovo channel info only requires the client id, so there is no access
+// token to manage. The live streams of the last poll are kept in memory.
+type trovoSource struct {
+	c *Controller
+
+	mu   sync.Mutex
+	live map[string]LiveStream
+}
+
+func (s *trovoSource) Name() string {
+	return "trovo"
+}
+
+func (s *trovoSource) Setup() error {
+	return nil
+}
+
+func (s *trovoSource) Poll() {
+	publishers, err := s.c.getAllPublisher()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	s.mu.Lock()
+	previous := s.live
+	s.mu.Unlock()
+
+	live := make(map[string]LiveStream)
+	for i := range publishers {
+		p := publishers[i]
+		if p.trovoChannel() == "" {
+			continue
+		}
+		channel, err := s.c.getTrovoChannel(p.trovoChannel())
+		if err != nil {
+			// keep the last known status rather than marking the publisher
+			// offline because trovo could not be reached
+			log.Warnf("error checking trovo live status of %s: %s", p.trovoChannel(), err)
+			if stream, ok := previous[p.Name]; ok {
+				live[p.Name] = stream
+			}
+			continue
+		}
+		if !channel.IsLive {
+			continue
+		}
+		live[p.Name] = LiveStream{
+			Publisher:   p.Name,
+			Platform:    s.Name(),
+			ViewerCount: channel.CurrentViewers,
+			Title:       channel.LiveTitle,
+		}
+	}
+
+	s.mu.Lock()
+	s.live = live
+	s.mu.Unlock()
+	log.WithFields(log.Fields{"source": s.Name(), "live": len(live)}).Info("trovo poll")
+}
+
+func (s *trovoSource) Live() ([]LiveStream, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	live := []LiveStream{}
+	for _, stream := range s.live {
+		live = append(live, stream)
+	}
+	return live, nil
+}
+
+// getTrovoChannel retrieves the public channel info of a trovo user
+func (c *Controller) getTrovoChannel(username string) (TrovoChannelResponse, error) {
+	var channel TrovoChannelResponse
+
+	reqBody, err := json.Marshal(map[string]string{"username": strings.ToLower(username)})
+	if err != nil {
+		return channel, err
+	}
+	r, err := http.NewRequest("POST", trovoChannelURL, bytes.NewReader(reqBody))
+	if err != nil {
+		return channel, err
+	}
+	r.Header.Set("Accept", "application/json")
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Client-ID", c.cfg().TrovoClientID)
+
+	resp, err := c.httpClient().Do(r)
+	if err != nil {
+		return channel, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return channel, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return channel, fmt.Errorf("trovo channel request failed: %s", resp.Status)
+	}
+
+	err = json.Unmarshal(body, &channel)
+	return channel, err
+}
+
+// checkTrovoLive returns an error unless the publisher is live on trovo,
+// either as of the last poll or when checking trovo directly. Trovo is never
+// queried unless it is an enabled platform.
+func (c *Controller) checkTrovoLive(p Publisher) error {
+	if p.trovoChannel() == "" {
+		return fmt.Errorf("%w: %s has no trovo channel configured", ErrNotLive, p.Name)
+	}
+	if !c.sourceRegistered("trovo") {
+		return fmt.Errorf("%w: %s: trovo is not an enabled platform", ErrNotLive, p.Name)
+	}
+	for i := range c.Sources {
+		if s, ok := c.Sources[i].(*trovoSource); ok {
+			s.mu.Lock()
+			_, live := s.live[p.Name]
+			s.mu.Unlock()
+			if live {
+				return nil
+			}
+		}
+	}
+	// the poller may not have caught up yet, check trovo directly
+	channel, err := c.getTrovoChannel(p.trovoChannel())
+	if err != nil {
+		log.Warnf("error checking trovo live status of %s: %s", p.trovoChannel(), err)
+	}
+	if err == nil && channel.IsLive {
+		return nil
+	}
+	return fmt.Errorf("%w: %s is not live on trovo (%s)", ErrNotLive, p.Name, p.trovoChannel())
+}
@@ -7,10 +7,15 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/bcambl/rtmpauthbot/config"
 	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/clientcredentials"
 	"golang.org/x/oauth2/twitch"
 )
@@ -27,14 +32,41 @@ type TwitchStreamsResponse struct {
 
 // StreamData to marshal the inner data of the TwitchStreamsResponse
 type StreamData struct {
-	ID          string `json:"id"`
-	UserID      string `json:"user_id"`
-	UserName    string `json:"user_name"`
-	GameID      string `json:"game_id"`
-	Type        string `json:"type"`
-	Title       string `json:"title"`
-	ViewerCount int    `json:"viewer_count"`
-	StartedAt   string `json:"started_at"`
+	ID           string `json:"id"`
+	UserID       string `json:"user_id"`
+	UserLogin    string `json:"user_login"`
+	UserName     string `json:"user_name"`
+	GameID       string `json:"game_id"`
+	Type         string `json:"type"`
+	Title        string `json:"title"`
+	ViewerCount  int    `json:"viewer_count"`
+	StartedAt    string `json:"started_at"`
+	ThumbnailURL string `json:"thumbnail_url"`
+}
+
+// login returns the lowercase twitch login of the stream. The display name
+// only differs from the login in case for most users, but not for all (e.g.
+// localized names), so it is only used when twitch omits the login.
+func (s StreamData) login() string {
+	if s.UserLogin == "" {
+		return strings.ToLower(s.UserName)
+	}
+	return strings.ToLower(s.UserLogin)
+}
+
+// thumbnail dimensions substituted into the templated stream thumbnail url
+const (
+	thumbnailWidth  = 320
+	thumbnailHeight = 180
+)
+
+// thumbnailURL substitutes the thumbnail dimensions into a templated url
+func thumbnailURL(template string) string {
+	r := strings.NewReplacer(
+		"{width}", strconv.Itoa(thumbnailWidth),
+		"{height}", strconv.Itoa(thumbnailHeight),
+	)
+	return r.Replace(template)
 }
 
 // TwitchGamesResponse to marshal the json response from /helix/games/
@@ -49,12 +81,79 @@ type GameData struct {
 	BoxArtURL string `json:"box_art_url"`
 }
 
-// retrieve cached twitch access token from database and set in the
-// Config struct. This is only called when the token is not set in Config
-func (c *Controller) getCachedAccessToken() (string, error) {
+// TwitchValidateResponse to marshal the json response from /oauth2/validate
+type TwitchValidateResponse struct {
+	ClientID  string   `json:"client_id"`
+	Login     string   `json:"login"`
+	UserID    string   `json:"user_id"`
+	Scopes    []string `json:"scopes"`
+	ExpiresIn int      `json:"expires_in"`
+}
+
+// TwitchUsersResponse to marshal the json response from /helix/users/
+type TwitchUsersResponse struct {
+	Data []UserData `json:"data"`
+}
+
+// UserData to marshal the inner data of the TwitchUsersResponse
+type UserData struct {
+	ID          string `json:"id"`
+	Login       string `json:"login"`
+	DisplayName string `json:"display_name"`
+}
+
+// errNoStreamsToQuery is returned when no publisher has a twitch stream
+var errNoStreamsToQuery = errors.New("no streams to query")
+
+// refreshMinInterval is the minimum time between on-demand refreshes
+const refreshMinInterval = 10 * time.Second
+
+// maxUsersPerQuery is the maximum number of logins helix accepts per request
+const maxUsersPerQuery = 100
+
+// userIDMaxAge is how long a cached twitch user id is trusted before it is
+// resolved again at startup, in case the login changed owners
+const userIDMaxAge = 7 * 24 * time.Hour
+
+// accessTokenKey returns the ConfigBucket key of a client's cached token
+func accessTokenKey(client config.TwitchClient) string {
+	return "twitchAccessToken:" + client.ID
+}
+
+// accessTokenExpiryKey returns the ConfigBucket key of a client's token expiry
+func accessTokenExpiryKey(client config.TwitchClient) string {
+	return "twitchAccessTokenExpiry:" + client.ID
+}
+
+// accessTokenValidatedKey returns the ConfigBucket key of the last time a
+// client's token was successfully validated
+func accessTokenValidatedKey(client config.TwitchClient) string {
+	return "twitchAccessTokenValidated:" + client.ID
+}
+
+// accessTokenScopesKey returns the ConfigBucket key of the scopes granted to
+// a client's token
+func accessTokenScopesKey(client config.TwitchClient) string {
+	return "twitchAccessTokenScopes:" + client.ID
+}
+
+// nextTwitchClient rotates through the configured twitch clients so that
+// helix requests are spread across the rate limits of every client
+func (c *Controller) nextTwitchClient() config.TwitchClient {
+	conf := c.cfg()
+	clients := conf.TwitchClients
+	if len(clients) == 0 {
+		return config.TwitchClient{ID: conf.TwitchClientID, Secret: conf.TwitchClientSecret}
+	}
+	i := atomic.AddUint32(&c.twitchClientIndex, 1) - 1
+	return clients[int(i%uint32(len(clients)))]
+}
+
+// retrieve cached twitch access token of a client from database
+func (c *Controller) getCachedAccessToken(client config.TwitchClient) (string, error) {
 	var tokenBytes []byte
 	var err error
-	tokenBytes, err = c.getBucketValue("ConfigBucket", "twitchAccessToken")
+	tokenBytes, err = c.getBucketValue("ConfigBucket", accessTokenKey(client))
 	if err != nil {
 		return "", err
 	}
@@ -65,97 +164,294 @@ func (c *Controller) getCachedAccessToken() (string, error) {
 }
 
 // update the cached access token record in the database
-func (c *Controller) updateCachedAccessToken(accessToken string) error {
+func (c *Controller) updateCachedAccessToken(client config.TwitchClient, accessToken string) error {
 	var err error
 	if accessToken == "" {
 		return errors.New("updateCachedAccessToken: no token provided")
 	}
-	err = c.setBucketValue("ConfigBucket", "twitchAccessToken", accessToken)
+	err = c.setBucketValue("ConfigBucket", accessTokenKey(client), accessToken)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func validateAccessToken(accessToken string) error {
+// errTokenInvalid is returned when twitch reports an access token as invalid
+var errTokenInvalid = errors.New("twitch access token invalid")
+
+// validateAccessToken validates an access token with twitch. An error
+// matching errTokenInvalid means the token must be replaced, whereas an
+// error matching ErrTwitchUnavailable means the token could not be checked.
+// Each attempt is limited to TWITCH_VALIDATE_TIMEOUT and transport errors
+// are retried up to TWITCH_VALIDATE_RETRIES times.
+func (c *Controller) validateAccessToken(accessToken string) (TwitchValidateResponse, error) {
+	validation := TwitchValidateResponse{}
 	if accessToken == "" {
-		err := errors.New("token validation fail - not set")
-		return err
+		return validation, fmt.Errorf("%w: not set", errTokenInvalid)
+	}
+
+	var (
+		status int
+		body   []byte
+		err    error
+	)
+	conf := c.cfg()
+	for attempt := 0; attempt <= conf.TwitchValidateRetries; attempt++ {
+		start := time.Now()
+		status, body, err = c.validateRequest(accessToken, conf.TwitchValidateTimeout)
+		c.timeTwitch(twitchValidate, start)
+		if err == nil {
+			break
+		}
+		log.Debugf("token validation attempt %d failed: %s", attempt+1, err)
 	}
-	r, err := http.NewRequest("GET", "https://id.twitch.tv/oauth2/validate", nil)
 	if err != nil {
-		log.Error(err)
+		return validation, fmt.Errorf("%w: token validation: %s", ErrTwitchUnavailable, err)
+	}
+	switch {
+	case status >= 500 || status == http.StatusTooManyRequests:
+		return validation, fmt.Errorf("%w: token validation: %s", ErrTwitchUnavailable, http.StatusText(status))
+	case status != http.StatusOK:
+		var e twitchError
+		if json.Unmarshal(body, &e) == nil && e.Message != "" {
+			return validation, fmt.Errorf("%w: %s: %s", errTokenInvalid, http.StatusText(status), e.Message)
+		}
+		return validation, fmt.Errorf("%w: %s", errTokenInvalid, http.StatusText(status))
+	}
+
+	err = json.Unmarshal(body, &validation)
+	if err != nil {
+		return validation, fmt.Errorf("%w: token validation: %s", ErrTwitchUnavailable, err)
+	}
+
+	return validation, nil
+}
+
+// validateRequest performs a single token validation request which is
+// cancelled after the timeout
+func (c *Controller) validateRequest(accessToken string, timeout time.Duration) (int, []byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	r, err := http.NewRequestWithContext(ctx, "GET", "https://id.twitch.tv/oauth2/validate", nil)
+	if err != nil {
+		return 0, nil, err
 	}
 	r.Header.Set("Content-Type", "application/json")
 	r.Header.Set("Authorization", "OAuth "+accessToken)
 
-	resp, err := http.DefaultClient.Do(r)
+	resp, err := c.httpClient().Do(r)
 	if err != nil {
-		return err
+		return 0, nil, err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		return errors.New("token validation response status code != 200")
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, err
 	}
+	return resp.StatusCode, body, nil
+}
 
-	return nil
+// oauth2Context requests access tokens with the client of outbound requests
+func (c *Controller) oauth2Context() context.Context {
+	return context.WithValue(context.Background(), oauth2.HTTPClient, c.httpClient())
 }
 
-func (c *Controller) getNewAuthToken() error {
+func (c *Controller) getNewAuthToken(client config.TwitchClient) error {
 	var oauth2Config *clientcredentials.Config
 
 	oauth2Config = &clientcredentials.Config{
-		ClientID:     c.Config.TwitchClientID,
-		ClientSecret: c.Config.TwitchClientSecret,
+		ClientID:     client.ID,
+		ClientSecret: client.Secret,
 		TokenURL:     twitch.Endpoint.TokenURL,
 	}
 
-	token, err := oauth2Config.Token(context.Background())
+	start := time.Now()
+	token, err := oauth2Config.Token(c.oauth2Context())
+	c.timeTwitch(twitchToken, start)
 	if err != nil {
 		return err
 	}
 
 	log.Debug("New Access Token: ", token.AccessToken)
-	err = c.updateCachedAccessToken(token.AccessToken)
+	err = c.updateCachedAccessToken(client, token.AccessToken)
 	if err != nil {
 		return err
 	}
+	if token.Expiry.IsZero() {
+		// no expires_in was returned. the expiry & validation of the previous
+		// token do not apply, so the token is validated with twitch before it
+		// is trusted, which records the expiry reported by the validation
+		log.Debug("new access token has no expiry, relying on token validation")
+		for _, key := range []string{accessTokenExpiryKey(client), accessTokenValidatedKey(client)} {
+			err = c.setBucketValue("ConfigBucket", key, "")
+			if err != nil {
+				return err
+			}
+		}
+	} else {
+		err = c.setBucketValue("ConfigBucket", accessTokenExpiryKey(client), string(formatTimestamp(token.Expiry)))
+		if err != nil {
+			return err
+		}
+	}
+	c.refreshAfterNewToken()
 	return nil
 
 }
 
-func (c *Controller) validateClientCredentials() error {
-	if c.Config.TwitchClientID == defaultClientID || c.Config.TwitchClientID == "" {
+// refreshAfterNewToken starts a single twitch refresh after a new access
+// token is obtained, exercising the token & updating live status rather than
+// waiting for the next poll. The refresh runs in the background as the token
+// may have been requested during a refresh. Tokens obtained by the follow-up
+// refresh do not start another.
+func (c *Controller) refreshAfterNewToken() {
+	if !c.cfg().RefreshOnNewToken || !c.sourceRegistered("twitch") {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&c.tokenRefreshing, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&c.tokenRefreshing, 0)
+		log.Debug("refreshing twitch after obtaining a new access token")
+		_, err := c.refreshTwitch()
+		if err != nil {
+			log.Warn("error refreshing twitch after obtaining a new access token: ", err)
+		}
+	}()
+}
+
+// CheckTwitchCredentials requests an access token for each twitch client &
+// probes the helix streams endpoint with it, logging whether the credentials
+// work or why they do not. It is intended to run once at startup.
+func (c *Controller) CheckTwitchCredentials() {
+	if !c.sourceRegistered("twitch") {
+		return
+	}
+	for _, client := range c.cfg().TwitchClients {
+		err := validateClientCredentials(client)
+		if err != nil {
+			log.Warnf("twitch client %s: %s", client.ID, err)
+			continue
+		}
+		oauth2Config := &clientcredentials.Config{
+			ClientID:     client.ID,
+			ClientSecret: client.Secret,
+			TokenURL:     twitch.Endpoint.TokenURL,
+		}
+		start := time.Now()
+		token, err := oauth2Config.Token(c.oauth2Context())
+		c.timeTwitch(twitchToken, start)
+		if err != nil {
+			log.Errorf("twitch client %s: credentials check failed: %s", client.ID, describeTokenError(err))
+			continue
+		}
+		resp, err := c.helixRequest(client, token.AccessToken, "https://api.twitch.tv/helix/streams?first=1")
+		if err != nil {
+			log.Errorf("twitch client %s: credentials check failed: unable to reach twitch: %s", client.ID, err)
+			continue
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			log.Errorf("twitch client %s: credentials check failed: %s", client.ID, helixFailure(resp.Status, body))
+			continue
+		}
+		log.Infof("twitch client %s: Twitch credentials OK", client.ID)
+	}
+}
+
+// describeTokenError explains why a client credentials token request failed,
+// distinguishing an invalid client id or secret from twitch being unreachable
+func describeTokenError(err error) string {
+	var retrieveErr *oauth2.RetrieveError
+	if !errors.As(err, &retrieveErr) {
+		return fmt.Sprintf("unable to reach twitch: %s", err)
+	}
+	var body struct {
+		Message string `json:"message"`
+	}
+	json.Unmarshal(retrieveErr.Body, &body)
+	message := strings.ToLower(body.Message)
+	switch {
+	case strings.Contains(message, "secret"):
+		return "invalid client secret"
+	case strings.Contains(message, "client"):
+		return "invalid client id"
+	default:
+		return fmt.Sprintf("token request rejected: %s %s", retrieveErr.Response.Status, body.Message)
+	}
+}
+
+// CheckDefaultCredentials returns an error when twitch is registered with a
+// placeholder (or empty) client id or secret, or discord is enabled with the
+// placeholder webhook, as twitch or discord would then be skipped at every
+// use. RegisterSources must be called first.
+func (c *Controller) CheckDefaultCredentials() error {
+	conf := c.cfg()
+	if c.sourceRegistered("twitch") {
+		for _, client := range conf.TwitchClients {
+			if client.ID == defaultClientID || client.ID == "" {
+				return errors.New("twitch is enabled without a real client id")
+			}
+			if client.Secret == defaultClientSecret || client.Secret == "" {
+				return fmt.Errorf("twitch client %s has no real secret", client.ID)
+			}
+		}
+	}
+	if conf.DiscordEnabled && (conf.DiscordWebhook == defaultWebhookURL || conf.DiscordWebhook == "") {
+		return errors.New("discord is enabled without a real webhook")
+	}
+	return nil
+}
+
+func validateClientCredentials(client config.TwitchClient) error {
+	if client.ID == defaultClientID || client.ID == "" {
 		err := errors.New("Default twitch client id value detected. Skipping twitch call")
 		return err
 	}
-	if c.Config.TwitchClientSecret == defaultClientSecret || c.Config.TwitchClientSecret == "" {
+	if client.Secret == defaultClientSecret || client.Secret == "" {
 		err := errors.New("Default twitch client secret value detected. Skipping twitch call")
 		return err
 	}
 	return nil
 }
 
-//twitchAuthToken handles the lifecycle of the twitch access token
-func (c *Controller) twitchAuthToken() (string, error) {
+// twitchAuthToken handles the lifecycle of the twitch access token of a client
+func (c *Controller) twitchAuthToken(client config.TwitchClient) (string, error) {
 	var token string
 	var err error
 
-	token, err = c.getCachedAccessToken()
+	token, err = c.getCachedAccessToken(client)
 	if err != nil {
 		log.Debug(err)
 	}
+	if token != "" && c.recentlyValidated(client) {
+		return token, nil
+	}
 
-	err = validateAccessToken(token)
+	validation, err := c.validateAccessToken(token)
+	if errors.Is(err, ErrTwitchUnavailable) && token != "" {
+		// the token could not be checked, keep using it rather than
+		// replacing a token which may well be valid
+		log.Warn(err)
+		return token, nil
+	}
 	if err != nil {
-		err = c.getNewAuthToken()
+		log.Debug(err)
+		err = c.getNewAuthToken(client)
 		if err != nil {
 			return "", err
 		}
+	} else {
+		err = c.updateTokenValidation(client, validation)
+		if err != nil {
+			log.Error(err)
+		}
 	}
 
-	token, err = c.getCachedAccessToken()
+	token, err = c.getCachedAccessToken(client)
 	if err != nil {
 		return "", err
 	}
@@ -163,21 +459,112 @@ func (c *Controller) twitchAuthToken() (string, error) {
 	return token, nil
 }
 
-func streamQueryURL(publishers []Publisher) (string, error) {
-	var userQuery string
-	for i := range publishers {
-		if publishers[i].TwitchStream == "" {
-			continue
+// recentlyValidated returns true when the cached token of a client was
+// successfully validated within TWITCH_VALIDATE_CACHE and has not expired,
+// tolerating TWITCH_CLOCK_SKEW either way
+func (c *Controller) recentlyValidated(client config.TwitchClient) bool {
+	conf := c.cfg()
+	ttl := conf.TwitchValidateCache
+	if ttl <= 0 {
+		return false
+	}
+	value, err := c.getBucketValue("ConfigBucket", accessTokenValidatedKey(client))
+	if err != nil || len(value) == 0 {
+		return false
+	}
+	now := time.Now()
+	age := now.Sub(parseTimestamp(value))
+	// a validation further in the future than the skew means the clock was
+	// moved back & the validation can no longer be dated
+	if age >= ttl+conf.TwitchClockSkew || age < -conf.TwitchClockSkew {
+		return false
+	}
+	value, err = c.getBucketValue("ConfigBucket", accessTokenExpiryKey(client))
+	if err == nil && len(value) > 0 && !now.Before(parseTimestamp(value).Add(conf.TwitchClockSkew)) {
+		return false
+	}
+	return true
+}
+
+// updateTokenValidation records the time, expiry and scopes of a successful
+// access token validation
+func (c *Controller) updateTokenValidation(client config.TwitchClient, validation TwitchValidateResponse) error {
+	now := time.Now()
+	err := c.setBucketValue("ConfigBucket", accessTokenValidatedKey(client), string(formatTimestamp(now)))
+	if err != nil {
+		return err
+	}
+	err = c.setBucketValue("ConfigBucket", accessTokenScopesKey(client), strings.Join(validation.Scopes, ","))
+	if err != nil {
+		return err
+	}
+	if validation.ExpiresIn > 0 {
+		expiry := now.Add(time.Duration(validation.ExpiresIn) * time.Second)
+		err = c.setBucketValue("ConfigBucket", accessTokenExpiryKey(client), string(formatTimestamp(expiry)))
+		if err != nil {
+			return err
 		}
+	}
+	return nil
+}
+
+// TokenStatus describes the cached access token of a twitch client without
+// revealing the token itself
+type TokenStatus struct {
+	ClientIDSuffix string     `json:"client_id_suffix"`
+	Cached         bool       `json:"cached"`
+	ExpiresAt      *time.Time `json:"expires_at"`
+	ValidatedAt    *time.Time `json:"validated_at"`
+	Scopes         []string   `json:"scopes"`
+}
+
+// tokenStatus returns the status of the cached access token of a client
+func (c *Controller) tokenStatus(client config.TwitchClient) (TokenStatus, error) {
+	status := TokenStatus{}
+	suffix := client.ID
+	if len(suffix) > 4 {
+		suffix = suffix[len(suffix)-4:]
+	}
+	status.ClientIDSuffix = suffix
+
+	b, err := c.getBucketValue("ConfigBucket", accessTokenKey(client))
+	if err != nil {
+		return status, err
+	}
+	status.Cached = len(b) > 0
+	b, err = c.getBucketValue("ConfigBucket", accessTokenExpiryKey(client))
+	if err != nil {
+		return status, err
+	}
+	if t := parseTimestamp(b); !t.IsZero() {
+		status.ExpiresAt = &t
+	}
+	b, err = c.getBucketValue("ConfigBucket", accessTokenValidatedKey(client))
+	if err != nil {
+		return status, err
+	}
+	if t := parseTimestamp(b); !t.IsZero() {
+		status.ValidatedAt = &t
+	}
+	b, err = c.getBucketValue("ConfigBucket", accessTokenScopesKey(client))
+	if err != nil {
+		return status, err
+	}
+	status.Scopes = splitList(string(b))
+	return status, nil
+}
+
+func streamQueryURL(logins []string) (string, error) {
+	var userQuery string
+	for i := range logins {
 		if userQuery != "" {
 			userQuery = userQuery + "&"
 		}
-		userQuery = userQuery + fmt.Sprintf("user_login=%s", publishers[i].TwitchStream)
+		userQuery = userQuery + fmt.Sprintf("user_login=%s", logins[i])
 	}
 
 	if userQuery == "" {
-		err := errors.New("no streams to query")
-		return "", err
+		return "", errNoStreamsToQuery
 	}
 
 	//log.Debug("stream userQuery: ", userQuery)
@@ -192,66 +579,199 @@ func (c *Controller) getStreamInfo(s StreamData) (string, error) {
 	return fmt.Sprintf("title: %s\ngame: %s", s.Title, g.Name), err
 }
 
-func (c *Controller) getStreams() ([]StreamData, error) {
-
-	var (
-		err         error
-		streamQuery string
-	)
+// notificationStreamInfo returns the stream info to post in a notification,
+// with the title sanitized. The stored stream info keeps the original title.
+func (c *Controller) notificationStreamInfo(s StreamData) (string, error) {
+	s.Title = sanitizeTitle(s.Title, c.cfg().NotifyTitleMaxLength)
+	return c.getStreamInfo(s)
+}
 
-	err = c.validateClientCredentials()
+// helixRequest performs an authenticated GET request against the helix api.
+// The duration until the response headers is recorded by endpoint.
+func (c *Controller) helixRequest(client config.TwitchClient, accessToken, query string) (*http.Response, error) {
+	r, err := http.NewRequest("GET", query, nil)
 	if err != nil {
 		return nil, err
 	}
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("client-id", client.ID)
+	r.Header.Set("Authorization", "Bearer "+accessToken)
 
-	accessToken, err := c.twitchAuthToken()
-	if err != nil {
-		return nil, err
+	start := time.Now()
+	defer c.timeTwitch(helixEndpoint(r.URL.Path), start)
+	return c.httpClient().Do(r)
+}
+
+// helixEndpoint returns the metric label of a helix api path
+func helixEndpoint(path string) string {
+	switch strings.Trim(strings.TrimPrefix(path, "/helix/"), "/") {
+	case "games":
+		return twitchGames
+	case "users":
+		return twitchUsers
+	default:
+		return twitchStreams
 	}
+}
 
-	publishers, err := c.getAllPublisher()
-	if err != nil {
-		return nil, err
+// twitchError is the json body of a failed twitch api request
+type twitchError struct {
+	Error   string `json:"error"`
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+// helixFailure describes a failed helix request, including the message of
+// the error body (e.g. "invalid OAuth token") when twitch provides one
+func helixFailure(status string, body []byte) string {
+	var e twitchError
+	err := json.Unmarshal(body, &e)
+	if err != nil || e.Message == "" {
+		return "helix request failed: " + status
 	}
+	return fmt.Sprintf("helix request failed: %s: %s", status, e.Message)
+}
 
-	streamQuery, err = streamQueryURL(publishers)
+// helixGet queries the helix api and unmarshals the json response into v.
+// When twitch rejects the access token (revoked between validation and use)
+// a new token is requested and the request is retried once.
+func (c *Controller) helixGet(query string, v interface{}) error {
+	client := c.nextTwitchClient()
+	err := validateClientCredentials(client)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	r, err := http.NewRequest("GET", streamQuery, nil)
+	accessToken, err := c.twitchAuthToken(client)
 	if err != nil {
-		log.Error(err)
+		return err
 	}
-	r.Header.Set("Content-Type", "application/json")
-	r.Header.Set("client-id", c.Config.TwitchClientID)
-	r.Header.Set("Authorization", "Bearer "+accessToken)
 
-	resp, err := http.DefaultClient.Do(r)
+	resp, err := c.helixRequest(client, accessToken, query)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("%w: %s", ErrTwitchUnavailable, err)
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		resp.Body.Close()
+		log.Debug("helix request unauthorized, requesting new access token")
+		err = c.getNewAuthToken(client)
+		if err != nil {
+			return err
+		}
+		accessToken, err = c.getCachedAccessToken(client)
+		if err != nil {
+			return err
+		}
+		resp, err = c.helixRequest(client, accessToken, query)
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrTwitchUnavailable, err)
+		}
 	}
 	defer resp.Body.Close()
 
 	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return fmt.Errorf("%w: %s", ErrRateLimited, helixFailure(resp.Status, body))
+	case resp.StatusCode >= 500:
+		return fmt.Errorf("%w: %s", ErrTwitchUnavailable, helixFailure(resp.Status, body))
+	case resp.StatusCode != http.StatusOK:
+		return errors.New(helixFailure(resp.Status, body))
+	}
+
+	return json.Unmarshal(body, v)
+}
+
+// pollSummary describes a twitch refresh for the per poll summary log
+type pollSummary struct {
+	Queried int
+	Latency time.Duration
+}
+
+func (c *Controller) getStreams(summary *pollSummary) ([]StreamData, error) {
+
+	logins, err := c.twitchLogins()
 	if err != nil {
 		return nil, err
 	}
+	summary.Queried = len(logins)
 
-	streamResponse := TwitchStreamsResponse{}
-	err = json.Unmarshal(body, &streamResponse)
+	start := time.Now()
+	streams, err := c.queryStreams(logins)
+	summary.Latency = time.Since(start)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(streamResponse.Data) == 0 {
-		log.Debug("no twitch streams currently live")
+	if len(streams) == 0 {
+		log.Trace("no twitch streams currently live")
 	}
-	for i := range streamResponse.Data {
-		log.Debug("Live Now:", streamResponse.Data[i].UserName)
+	for i := range streams {
+		log.Trace("Live Now:", streams[i].UserName)
 	}
 
-	return streamResponse.Data, nil
+	return streams, nil
+}
+
+// maxStreamsQuery is the most logins helix accepts in a single streams query
+const maxStreamsQuery = 100
+
+// queryStreams returns the live streams of the logins, querying helix in
+// batches of maxStreamsQuery logins
+func (c *Controller) queryStreams(logins []string) ([]StreamData, error) {
+	if len(logins) == 0 {
+		return nil, errNoStreamsToQuery
+	}
+	var streams []StreamData
+	for start := 0; start < len(logins); start += maxStreamsQuery {
+		end := start + maxStreamsQuery
+		if end > len(logins) {
+			end = len(logins)
+		}
+		streamQuery, err := streamQueryURL(logins[start:end])
+		if err != nil {
+			return nil, err
+		}
+		streamResponse := TwitchStreamsResponse{}
+		err = c.helixGet(streamQuery, &streamResponse)
+		if err != nil {
+			return nil, err
+		}
+		streams = append(streams, streamResponse.Data...)
+	}
+	return streams, nil
+}
+
+// lookupTwitchLive queries twitch for the live stream of a single login.
+// Logins which are not live are cached for NEGATIVE_CACHE_SECONDS so that
+// repeated publish attempts do not each query twitch.
+func (c *Controller) lookupTwitchLive(login string) (StreamData, bool, error) {
+	login = strings.ToLower(login)
+	if !c.sourceRegistered("twitch") {
+		return StreamData{}, false, nil
+	}
+	if c.notLive().Has(login) {
+		log.Debugf("%s is cached as not live on twitch", login)
+		return StreamData{}, false, nil
+	}
+
+	streamResponse := TwitchStreamsResponse{}
+	err := c.helixGet("https://api.twitch.tv/helix/streams/?user_login="+login, &streamResponse)
+	if err != nil {
+		return StreamData{}, false, err
+	}
+	streams := c.filterBlockedGames(streamResponse.Data)
+	if len(streams) > 0 {
+		return streams[0], true, nil
+	}
+	if ttl := c.cfg().NegativeCacheTTL; ttl > 0 {
+		c.notLive().Set(login, ttl)
+	}
+	return StreamData{}, false, nil
 }
 
 func (c *Controller) getGame(gameID string) (GameData, error) {
@@ -262,84 +782,294 @@ func (c *Controller) getGame(gameID string) (GameData, error) {
 		g          GameData
 	)
 
-	err = c.validateClientCredentials()
+	// game names rarely change, so games are cached for the process lifetime
+	c.gamesMu.Lock()
+	g, ok := c.games[gameID]
+	c.gamesMu.Unlock()
+	if ok {
+		return g, nil
+	}
+
+	gamesQuery = fmt.Sprintf("https://api.twitch.tv/helix/games?id=%s", gameID)
+
+	gamesResponse := TwitchGamesResponse{}
+	err = c.helixGet(gamesQuery, &gamesResponse)
 	if err != nil {
 		return g, err
 	}
 
-	accessToken, err := c.twitchAuthToken()
-	if err != nil {
+	if len(gamesResponse.Data) != 1 {
+		err = fmt.Errorf("game query for '%s' did not return exactly 1 result", gameID)
 		return g, err
 	}
 
-	gamesQuery = fmt.Sprintf("https://api.twitch.tv/helix/games?id=%s", gameID)
+	g = gamesResponse.Data[0]
+	c.gamesMu.Lock()
+	if c.games == nil {
+		c.games = make(map[string]GameData)
+	}
+	c.games[gameID] = g
+	c.gamesMu.Unlock()
+	return g, nil
+}
+
+// gameBlocked returns true when the game is in BLOCKED_GAME_IDS
+func (c *Controller) gameBlocked(gameID string) bool {
+	blocked := c.cfg().BlockedGameIDs
+	for i := range blocked {
+		if blocked[i] == gameID {
+			return true
+		}
+	}
+	return false
+}
+
+// filterBlockedGames removes streams of blocked games, which do not count
+// as live
+func (c *Controller) filterBlockedGames(streams []StreamData) []StreamData {
+	if len(c.cfg().BlockedGameIDs) == 0 {
+		return streams
+	}
+	allowed := []StreamData{}
+	for i := range streams {
+		s := streams[i]
+		if !c.gameBlocked(s.GameID) {
+			allowed = append(allowed, s)
+			continue
+		}
+		gameName := s.GameID
+		g, err := c.getGame(s.GameID)
+		if err == nil {
+			gameName = fmt.Sprintf("%s (%s)", g.Name, s.GameID)
+		}
+		log.Debugf("%s is streaming blocked game %s, not counting as live", s.UserLogin, gameName)
+	}
+	return allowed
+}
+
+func (c *Controller) getUsers(logins []string) ([]UserData, error) {
+
+	var (
+		err        error
+		usersQuery string
+	)
 
-	r, err := http.NewRequest("GET", gamesQuery, nil)
+	for i := range logins {
+		if usersQuery != "" {
+			usersQuery = usersQuery + "&"
+		}
+		usersQuery = usersQuery + fmt.Sprintf("login=%s", logins[i])
+	}
+	usersQuery = "https://api.twitch.tv/helix/users?" + usersQuery
+
+	usersResponse := TwitchUsersResponse{}
+	err = c.helixGet(usersQuery, &usersResponse)
 	if err != nil {
-		log.Error(err)
+		return nil, err
 	}
-	r.Header.Set("Content-Type", "application/json")
-	r.Header.Set("client-id", c.Config.TwitchClientID)
-	r.Header.Set("Authorization", "Bearer "+accessToken)
 
-	resp, err := http.DefaultClient.Do(r)
+	return usersResponse.Data, nil
+}
+
+// cacheUserID records the twitch user id of a login & when it was resolved.
+// An empty id forgets the login, e.g. when the account no longer exists.
+func (c *Controller) cacheUserID(login, id string, now time.Time) error {
+	return c.DB.Update(func(tx *bolt.Tx) error {
+		users := c.bucket(tx, "UsersBucket")
+		resolved := c.bucket(tx, "UserResolvedBucket")
+		if users == nil || resolved == nil {
+			return ErrBucketMissing
+		}
+		if id == "" {
+			err := users.Delete([]byte(login))
+			if err != nil {
+				return err
+			}
+			return resolved.Delete([]byte(login))
+		}
+		err := users.Put([]byte(login), []byte(id))
+		if err != nil {
+			return err
+		}
+		return resolved.Put([]byte(login), formatTimestamp(now))
+	})
+}
+
+// cachedUserID returns the cached twitch user id of a login, and whether it
+// was resolved within userIDMaxAge. Ids cached before resolve times were
+// recorded count as stale.
+func (c *Controller) cachedUserID(login string, now time.Time) (string, bool, error) {
+	idBytes, err := c.getBucketValue("UsersBucket", login)
 	if err != nil {
-		return g, err
+		return "", false, err
 	}
-	defer resp.Body.Close()
+	resolvedAt, err := c.getBucketValue("UserResolvedBucket", login)
+	if err != nil {
+		return "", false, err
+	}
+	fresh := len(idBytes) > 0 && now.Sub(parseTimestamp(resolvedAt)) < userIDMaxAge
+	return string(idBytes), fresh, nil
+}
 
-	body, err := ioutil.ReadAll(resp.Body)
+// resolveUserID returns the twitch user id of a login. Helix is only queried
+// when the id is not cached, or was resolved longer than userIDMaxAge ago as
+// the login may have changed owners since.
+func (c *Controller) resolveUserID(login string) (string, error) {
+	login = strings.ToLower(login)
+	now := time.Now()
+	id, fresh, err := c.cachedUserID(login, now)
 	if err != nil {
-		return g, err
+		return "", err
+	}
+	if fresh {
+		return id, nil
 	}
 
-	gamesResponse := TwitchGamesResponse{}
-	err = json.Unmarshal(body, &gamesResponse)
+	users, err := c.getUsers([]string{login})
 	if err != nil {
-		return g, err
+		return "", err
+	}
+	for i := range users {
+		if strings.ToLower(users[i].Login) == login {
+			log.Debugf("resolved twitch user id for %s: %s", login, users[i].ID)
+			return users[i].ID, c.cacheUserID(login, users[i].ID, now)
+		}
+	}
+	err = c.cacheUserID(login, "", now)
+	if err != nil {
+		return "", err
 	}
+	return "", fmt.Errorf("twitch login %s does not exist", login)
+}
 
-	if len(gamesResponse.Data) != 1 {
-		err = fmt.Errorf("game query for '%s' did not return exactly 1 result", gameID)
-		return g, err
+// resolveAllUserIDs caches the twitch user id of every publisher twitch
+// stream which is not cached or is stale, as resolveUserID does, but batches
+// the helix queries. Logins which helix no longer returns are forgotten.
+func (c *Controller) resolveAllUserIDs() error {
+	publishers, err := c.getAllPublisher()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var logins []string
+	seen := make(map[string]bool)
+	for i := range publishers {
+		login := strings.ToLower(publishers[i].TwitchStream)
+		if login == "" || seen[login] {
+			continue
+		}
+		seen[login] = true
+		_, fresh, err := c.cachedUserID(login, now)
+		if err != nil {
+			return err
+		}
+		if fresh {
+			continue
+		}
+		logins = append(logins, login)
+	}
+
+	for len(logins) > 0 {
+		batch := logins
+		if len(batch) > maxUsersPerQuery {
+			batch = logins[:maxUsersPerQuery]
+		}
+		logins = logins[len(batch):]
+
+		users, err := c.getUsers(batch)
+		if err != nil {
+			return err
+		}
+		found := make(map[string]bool, len(users))
+		for i := range users {
+			login := strings.ToLower(users[i].Login)
+			found[login] = true
+			log.Debugf("resolved twitch user id for %s: %s", login, users[i].ID)
+			err = c.cacheUserID(login, users[i].ID, now)
+			if err != nil {
+				return err
+			}
+		}
+		for _, login := range batch {
+			if found[login] {
+				continue
+			}
+			log.Debugf("twitch login %s no longer exists, forgetting its user id", login)
+			err = c.cacheUserID(login, "", now)
+			if err != nil {
+				return err
+			}
+		}
 	}
 
-	return gamesResponse.Data[0], nil
+	return nil
 }
 
+// refreshUserID updates the cached user id of a login when a live stream
+// reports a different owner (the login was renamed and later re-claimed)
+func (c *Controller) refreshUserID(s StreamData) {
+	if s.UserLogin == "" || s.UserID == "" {
+		return
+	}
+	login := strings.ToLower(s.UserLogin)
+	idBytes, err := c.getBucketValue("UsersBucket", login)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if string(idBytes) == s.UserID {
+		return
+	}
+	log.Debugf("twitch login %s changed owner: %s -> %s", login, string(idBytes), s.UserID)
+	err = c.cacheUserID(login, s.UserID, time.Now())
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// updateLiveStatus updates the twitch live status of every publisher from the
+// live streams. Several publishers may share a twitch login, in which case
+// each of them is marked live & notified.
 func (c *Controller) updateLiveStatus(streams []StreamData) error {
 
-	var live bool
 	publishers, err := c.getAllPublisher()
 	if err != nil {
 		return err
 	}
 
+	live := make(map[string]StreamData, len(streams))
+	for x := range streams {
+		live[streams[x].login()] = streams[x]
+	}
+
 	// mark previous live streams -> offline and notify of stream info change
 	for i := range publishers {
-		live = false
 		p := &publishers[i]
 		if p.IsTwitchLive() {
-			for x := range streams {
-				s := streams[x]
-				if strings.ToLower(s.UserName) == strings.ToLower(p.TwitchStream) {
-					live = true
-					// save stream info for comparison against existing p.StreamInfo
-					streamInfo, err := c.getStreamInfo(s)
+			s, ok := live[strings.ToLower(p.TwitchStream)]
+			if ok && p.TwitchStream != "" {
+				// save stream info for comparison against existing p.StreamInfo
+				streamInfo, err := c.getStreamInfo(s)
+				if err != nil {
+					return err
+				}
+				if p.StreamInfo != streamInfo {
+					// streamer changed their stream info, set notification
+					safeInfo, err := c.notificationStreamInfo(s)
 					if err != nil {
 						return err
 					}
-					if p.StreamInfo != streamInfo {
-						// streamer changed their stream info, set notification
-						notification := fmt.Sprintf("%s updated stream info:\n%s", p.Name, streamInfo)
-						c.setBucketValue("TwitchNotificationBucket", p.Name, notification)
-						c.setBucketValue("StreamInfoBucket", p.Name, streamInfo)
-					}
+					notification := fmt.Sprintf("%s updated stream info:\n%s", p.Name, safeInfo)
+					c.setBucketValue("TwitchNotificationBucket", p.Name, notification)
+					c.setBucketValue("StreamInfoBucket", p.Name, streamInfo)
 				}
-			}
-			if !live {
+			} else {
 				c.setBucketValue("TwitchLiveBucket", p.Name, "")
 				c.setBucketValue("StreamInfoBucket", p.Name, "")
+				c.setBucketValue("ThumbnailBucket", p.Name, "")
+				c.setBucketValue("ViewersBucket", p.Name, "")
+				c.setBucketValue("TitleBucket", p.Name, "")
 				notification := fmt.Sprintf(":checkered_flag: %s finished streaming on twitch", p.Name)
 				c.setBucketValue("TwitchNotificationBucket", p.Name, notification)
 			}
@@ -348,25 +1078,35 @@ func (c *Controller) updateLiveStatus(streams []StreamData) error {
 
 	// mark live twitch streams -> online
 	for x := range streams {
-		s := streams[x]
-		for i := range publishers {
-			p := &publishers[i]
-			if p.TwitchStream == "" {
-				continue
-			}
-			if strings.ToLower(s.UserName) == strings.ToLower(p.TwitchStream) {
-				if !p.IsTwitchLive() {
-					c.setBucketValue("TwitchLiveBucket", p.Name, s.Type)
-					streamInfo, err := c.getStreamInfo(s)
-					if err != nil {
-						return err
-					}
-					streamLink := fmt.Sprintf("https://twitch.tv/%s", p.TwitchStream)
-					notification := fmt.Sprintf(":movie_camera: %s started streaming on twitch!"+
-						"\n%s\nwatch now: `%s`", p.Name, streamInfo, streamLink)
-					c.setBucketValue("StreamInfoBucket", p.Name, streamInfo)
-					c.setBucketValue("TwitchNotificationBucket", p.Name, notification)
+		c.refreshUserID(streams[x])
+	}
+	for i := range publishers {
+		p := &publishers[i]
+		if p.TwitchStream == "" {
+			continue
+		}
+		if s, ok := live[strings.ToLower(p.TwitchStream)]; ok {
+			c.setBucketValue("ThumbnailBucket", p.Name, thumbnailURL(s.ThumbnailURL))
+			c.setBucketValue("ViewersBucket", p.Name, strconv.Itoa(s.ViewerCount))
+			c.setBucketValue("TitleBucket", p.Name, s.Title)
+			if !p.IsTwitchLive() {
+				c.setBucketValue("TwitchLiveBucket", p.Name, s.Type)
+				// twitch caught up, end any publish grace period
+				c.setBucketValue("PublishAttemptBucket", p.Name, "")
+				c.notLive().Delete(strings.ToLower(p.TwitchStream))
+				streamInfo, err := c.getStreamInfo(s)
+				if err != nil {
+					return err
 				}
+				safeInfo, err := c.notificationStreamInfo(s)
+				if err != nil {
+					return err
+				}
+				streamLink := fmt.Sprintf("https://twitch.tv/%s", p.TwitchStream)
+				notification := fmt.Sprintf(":movie_camera: %s started streaming on twitch!"+
+					"\n%s\nwatch now: `%s`", p.Name, safeInfo, streamLink)
+				c.setBucketValue("StreamInfoBucket", p.Name, streamInfo)
+				c.setBucketValue("TwitchNotificationBucket", p.Name, notification)
 			}
 		}
 	}
@@ -390,12 +1130,10 @@ func (c *Controller) processNotifications() error {
 			continue
 		}
 		log.Debug("notification: ", p.TwitchNotification)
-		if c.Config.DiscordEnabled {
-			log.Debug("sending discord notification: ", p.TwitchNotification)
-			err := c.callWebhook(p.TwitchNotification)
-			if err != nil {
-				return err
-			}
+		log.Debug("sending notification: ", p.TwitchNotification)
+		err := c.notifyPublisher(p, p.TwitchNotification)
+		if err != nil {
+			return err
 		}
 		if p.TwitchNotification != "" {
 			log.Debugf("resetting notification for %s (%s)", p.Name, p.TwitchStream)
@@ -409,38 +1147,62 @@ func (c *Controller) processNotifications() error {
 	return nil
 }
 
-func (c *Controller) twitchMain() {
-	streams, err := c.getStreams()
-	if err != nil {
-		log.Debug(err)
-		return
+// refreshTwitch queries twitch for live streams, updates the live status of
+// publishers and sends any resulting notifications. Only one refresh runs at
+// a time so that scheduled and on-demand refreshes do not double notify.
+func (c *Controller) refreshTwitch() (pollSummary, error) {
+	c.twitchMu.Lock()
+	defer c.twitchMu.Unlock()
+
+	var summary pollSummary
+	streams, err := c.getStreams(&summary)
+	if err != nil && !errors.Is(err, errNoStreamsToQuery) {
+		return summary, err
 	}
+	streams = c.filterBlockedGames(streams)
 
 	err = c.updateLiveStatus(streams)
 	if err != nil {
-		log.Error(err)
-		return
+		return summary, err
 	}
 
-	err = c.processNotifications()
+	return summary, c.processNotifications()
+}
+
+// twitchLivePublishers returns the names of publishers which are live on twitch
+func (c *Controller) twitchLivePublishers() ([]string, error) {
+	live := []string{}
+	err := c.forEachPublisher(func(p Publisher) error {
+		if p.IsTwitchLive() {
+			live = append(live, p.Name)
+		}
+		return nil
+	})
 	if err != nil {
-		log.Error(err)
-		return
+		return nil, err
 	}
+	return live, nil
 }
 
-// TwitchScheduler launches the twitch stream query & notification background processes
-func (c *Controller) TwitchScheduler(ctx context.Context, pollRate time.Duration) {
-	ticker := time.NewTicker(pollRate)
-	go func() {
-		for {
-			select {
-			case <-ticker.C:
-				c.twitchMain()
-			case <-ctx.Done():
-				ticker.Stop()
-				return
-			}
-		}
-	}()
+// twitchMain refreshes twitch & logs a single summary line for the poll
+func (c *Controller) twitchMain() {
+	summary, err := c.refreshTwitch()
+	fields := log.Fields{
+		"source":         "twitch",
+		"queried":        summary.Queried,
+		"api_latency_ms": summary.Latency.Milliseconds(),
+	}
+	live, liveErr := c.twitchLivePublishers()
+	if liveErr == nil {
+		fields["live"] = live
+	}
+	if err == nil {
+		err = liveErr
+	}
+	if err != nil {
+		fields["error"] = err.Error()
+		log.WithFields(fields).Error("twitch poll failed")
+		return
+	}
+	log.WithFields(fields).Info("twitch poll")
 }
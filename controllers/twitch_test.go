@@ -0,0 +1,555 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bcambl/rtmpauthbot/config"
+	"github.com/bcambl/rtmpauthbot/internal/testutil"
+)
+
+func TestUpdateLiveStatusByLogin(t *testing.T) {
+	c := newTestController(t, &testutil.TwitchStub{}, func(conf *config.Config) {
+		conf.DiscordEnabled = false
+	})
+	createPublisher(t, c, `{"name":"alice","key":"secret","twitch_stream":"alice"}`)
+
+	// a localized display name differs from the login
+	err := c.updateLiveStatus([]StreamData{{UserID: "1", UserLogin: "alice", UserName: "アリス", GameID: "1", Type: "live"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := c.getPublisher("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.IsTwitchLive() {
+		t.Fatal("publisher with a localized display name is not live")
+	}
+}
+
+func TestTwitchTokenReused(t *testing.T) {
+	stub := &testutil.TwitchStub{}
+	stub.SetStreams(http.StatusOK, aliceOffline)
+	c := newTestController(t, stub, func(conf *config.Config) {
+		conf.NegativeCacheTTL = 0
+	})
+	for i := 0; i < 3; i++ {
+		_, _, err := c.lookupTwitchLive("alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if issued, _ := stub.Tokens(); issued != 1 {
+		t.Fatalf("%d access tokens requested, want 1", issued)
+	}
+}
+
+func TestTwitchTokenRevokedBeforeUse(t *testing.T) {
+	stub := &testutil.TwitchStub{}
+	stub.SetStreams(http.StatusOK, aliceOffline)
+	c := newTestController(t, stub, func(conf *config.Config) {
+		conf.NegativeCacheTTL = 0
+		conf.TwitchValidateCache = time.Hour
+	})
+	// the second lookup validates the new token
+	for i := 0; i < 2; i++ {
+		_, _, err := c.lookupTwitchLive("alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the token was recently validated, so helix is the first to reject it
+	stub.Revoke(stub.LastToken())
+	_, _, err := c.lookupTwitchLive("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	issued, unauthorized := stub.Tokens()
+	if issued != 2 || unauthorized != 1 {
+		t.Fatalf("%d access tokens requested & %d helix requests unauthorized, want 2 & 1", issued, unauthorized)
+	}
+}
+
+func TestTwitchTokenRevokedOnValidation(t *testing.T) {
+	stub := &testutil.TwitchStub{}
+	stub.SetStreams(http.StatusOK, aliceOffline)
+	c := newTestController(t, stub, func(conf *config.Config) {
+		conf.NegativeCacheTTL = 0
+		conf.TwitchValidateCache = 0
+	})
+	_, _, err := c.lookupTwitchLive("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every use validates the token, which replaces it before helix is used
+	stub.Revoke(stub.LastToken())
+	_, _, err = c.lookupTwitchLive("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	issued, unauthorized := stub.Tokens()
+	if issued != 2 || unauthorized != 0 {
+		t.Fatalf("%d access tokens requested & %d helix requests unauthorized, want 2 & 0", issued, unauthorized)
+	}
+}
+
+func TestResolveUserIDCached(t *testing.T) {
+	stub := &testutil.TwitchStub{}
+	stub.SetUsers(map[string]string{"alice": "1001"})
+	c := newTestController(t, stub, nil)
+
+	for i := 0; i < 2; i++ {
+		id, err := c.resolveUserID("Alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != "1001" {
+			t.Fatalf("resolve %d: got user id %s, want 1001", i+1, id)
+		}
+	}
+	if queries := len(stub.Requests(testutil.TwitchUsers)); queries != 1 {
+		t.Fatalf("helix users was queried %d times, want 1", queries)
+	}
+	b, err := c.getBucketValue("UsersBucket", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "1001" {
+		t.Fatalf("UsersBucket: got %s, want 1001", b)
+	}
+
+	// a stale id is resolved again, in case the login changed owners
+	err = c.cacheUserID("alice", "1001", time.Now().Add(-userIDMaxAge))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub.SetUsers(map[string]string{"alice": "2002"})
+	id, err := c.resolveUserID("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "2002" {
+		t.Fatalf("stale resolve: got user id %s, want 2002", id)
+	}
+
+	_, err = c.resolveUserID("nobody")
+	if err == nil {
+		t.Fatal("resolving an unknown login succeeded")
+	}
+}
+
+func TestTwitchClientsRotate(t *testing.T) {
+	stub := &testutil.TwitchStub{}
+	stub.SetStreams(http.StatusOK, aliceOffline)
+	c := newTestController(t, stub, func(conf *config.Config) {
+		conf.NegativeCacheTTL = 0
+		conf.TwitchClients = []config.TwitchClient{{ID: "first", Secret: "secret-1"}, {ID: "second", Secret: "secret-2"}}
+	})
+	for i := 0; i < 4; i++ {
+		_, _, err := c.lookupTwitchLive("alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []string{"first", "second", "first", "second"}
+	requests := stub.Requests(testutil.TwitchStreams)
+	if len(requests) != len(want) {
+		t.Fatalf("helix streams was queried %d times, want %d", len(requests), len(want))
+	}
+	tokens := map[string]string{}
+	for i, r := range requests {
+		client := r.Header.Get("client-id")
+		if client != want[i] {
+			t.Errorf("request %d: client %s, want %s", i+1, client, want[i])
+		}
+		token := r.Header.Get("Authorization")
+		if tokens[client] != "" && tokens[client] != token {
+			t.Errorf("request %d: client %s did not reuse its token", i+1, client)
+		}
+		tokens[client] = token
+	}
+	if tokens["first"] == tokens["second"] {
+		t.Error("both clients used the same token")
+	}
+	if issued, _ := stub.Tokens(); issued != 2 {
+		t.Fatalf("%d access tokens requested, want 2", issued)
+	}
+}
+
+func TestHelixUnauthorizedRetriedOnce(t *testing.T) {
+	stub := &testutil.TwitchStub{}
+	c := newTestController(t, stub, func(conf *config.Config) {
+		conf.NegativeCacheTTL = 0
+	})
+	// helix rejects the first token, then accepts the new one
+	stub.Handle(testutil.TwitchStreams, func(r *http.Request) (int, string) {
+		if r.Header.Get("Authorization") == "Bearer test-token-1" {
+			return http.StatusUnauthorized, `{"status":401,"message":"invalid OAuth token"}`
+		}
+		return http.StatusOK, aliceLive
+	})
+	_, live, err := c.lookupTwitchLive("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !live {
+		t.Fatal("the retry with the new token was not used")
+	}
+	requests := stub.Requests(testutil.TwitchStreams)
+	if len(requests) != 2 || requests[1].Header.Get("Authorization") != "Bearer test-token-2" {
+		t.Fatalf("helix streams was queried %d times, want once with each token", len(requests))
+	}
+
+	// a token rejected again is not retried indefinitely
+	stub.Handle(testutil.TwitchStreams, func(r *http.Request) (int, string) {
+		return http.StatusUnauthorized, `{"status":401,"message":"invalid OAuth token"}`
+	})
+	_, _, err = c.lookupTwitchLive("alice")
+	if err == nil {
+		t.Fatal("lookup succeeded while helix rejects every token")
+	}
+	if queries := stub.Queries(); queries != 4 {
+		t.Fatalf("helix streams was queried %d times, want 4", queries)
+	}
+}
+
+func TestHelixErrorMessage(t *testing.T) {
+	stub := &testutil.TwitchStub{}
+	c := newTestController(t, stub, func(conf *config.Config) {
+		conf.NegativeCacheTTL = 0
+	})
+	tests := []struct {
+		status int
+		body   string
+		want   string
+	}{
+		{http.StatusUnauthorized, `{"error":"Unauthorized","status":401,"message":"invalid OAuth token"}`,
+			"helix request failed: 401 Unauthorized: invalid OAuth token"},
+		{http.StatusBadRequest, `{"error":"Bad Request","status":400,"message":"Malformed query params."}`,
+			"helix request failed: 400 Bad Request: Malformed query params."},
+		{http.StatusServiceUnavailable, `{"error":"Service Unavailable","status":503,"message":"try again"}`,
+			"helix request failed: 503 Service Unavailable: try again"},
+		// without an error body the status alone is reported
+		{http.StatusBadRequest, `<html>Bad Request</html>`, "helix request failed: 400 Bad Request"},
+	}
+	for _, test := range tests {
+		stub.Handle(testutil.TwitchStreams, func(r *http.Request) (int, string) {
+			return test.status, test.body
+		})
+		_, _, err := c.lookupTwitchLive("alice")
+		if err == nil || !strings.HasSuffix(err.Error(), test.want) {
+			t.Errorf("helix %d %s: got error %v, want %q", test.status, test.body, err, test.want)
+		}
+	}
+}
+
+func TestTokenScopesRecorded(t *testing.T) {
+	stub := &testutil.TwitchStub{}
+	stub.Handle(testutil.TwitchValidate, func(r *http.Request) (int, string) {
+		return http.StatusOK, `{"client_id":"test-id","expires_in":3600,"scopes":["channel:read:subscriptions","user:read:email"]}`
+	})
+	c := newTestController(t, stub, func(conf *config.Config) {
+		conf.NegativeCacheTTL = 0
+		conf.TwitchValidateCache = 0
+	})
+	for i := 0; i < 2; i++ {
+		_, _, err := c.lookupTwitchLive("alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(stub.Requests(testutil.TwitchValidate)) == 0 {
+		t.Fatal("the access token was never validated")
+	}
+	status, err := c.tokenStatus(c.Config.TwitchClients[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(status.Scopes, " ") != "channel:read:subscriptions user:read:email" {
+		t.Fatalf("token scopes: got %v", status.Scopes)
+	}
+	if status.ValidatedAt == nil {
+		t.Fatal("token validation time not recorded")
+	}
+}
+
+func TestPollSummaryLogged(t *testing.T) {
+	stub := &testutil.TwitchStub{}
+	stub.SetStreams(http.StatusOK, aliceLive)
+	c := newTestController(t, stub, func(conf *config.Config) {
+		conf.DiscordEnabled = false
+	})
+	createPublisher(t, c, `{"name":"alice","key":"secret","twitch_stream":"alice"}`)
+	createPublisher(t, c, `{"name":"bob","key":"secret","twitch_stream":"bob"}`)
+
+	hook := captureLogs(t)
+	c.twitchMain()
+	summary := hook.LastEntry()
+	if summary == nil || summary.Message != "twitch poll" {
+		t.Fatalf("last log entry of the poll: got %v, want the summary", summary)
+	}
+	if summary.Data["queried"] != 2 {
+		t.Errorf("queried: got %v, want 2", summary.Data["queried"])
+	}
+	if live, ok := summary.Data["live"].([]string); !ok || strings.Join(live, ",") != "alice" {
+		t.Errorf("live: got %v, want [alice]", summary.Data["live"])
+	}
+	if _, ok := summary.Data["api_latency_ms"].(int64); !ok {
+		t.Errorf("api_latency_ms: got %v", summary.Data["api_latency_ms"])
+	}
+	if _, ok := summary.Data["error"]; ok {
+		t.Errorf("successful poll logged an error: %v", summary.Data["error"])
+	}
+
+	stub.SetStreams(http.StatusServiceUnavailable, `{"message":"unavailable"}`)
+	c.twitchMain()
+	summary = hook.LastEntry()
+	if summary.Message != "twitch poll failed" || summary.Data["error"] == nil {
+		t.Fatalf("failed poll: got %s %v, want the failure summary", summary.Message, summary.Data)
+	}
+}
+
+func TestValidateAccessToken(t *testing.T) {
+	stub := &testutil.TwitchStub{}
+	c := newTestController(t, stub, func(conf *config.Config) {
+		conf.TwitchValidateTimeout = 20 * time.Millisecond
+		conf.TwitchValidateRetries = 1
+	})
+	validations := func() int {
+		return len(stub.Requests(testutil.TwitchValidate))
+	}
+
+	validation, err := c.validateAccessToken("test-token-1")
+	if err != nil {
+		t.Fatalf("valid token: %s", err)
+	}
+	if validation.ExpiresIn != 3600 || validations() != 1 {
+		t.Fatalf("valid token: expires in %d after %d validations, want 3600 after 1", validation.ExpiresIn, validations())
+	}
+
+	// an invalid token is not retried
+	stub.Revoke("test-token-1")
+	_, err = c.validateAccessToken("test-token-1")
+	if !errors.Is(err, errTokenInvalid) || errors.Is(err, ErrTwitchUnavailable) {
+		t.Fatalf("revoked token: got %v, want %v", err, errTokenInvalid)
+	}
+	if validations() != 2 {
+		t.Fatalf("revoked token: validated %d times, want once", validations()-1)
+	}
+
+	// a token which could not be checked is neither valid nor invalid
+	stub.Delay(testutil.TwitchValidate, time.Second)
+	start := time.Now()
+	_, err = c.validateAccessToken("test-token-2")
+	if !errors.Is(err, ErrTwitchUnavailable) || errors.Is(err, errTokenInvalid) {
+		t.Fatalf("validation timeout: got %v, want %v", err, ErrTwitchUnavailable)
+	}
+	if validations() != 4 {
+		t.Fatalf("validation timeout: validated %d times, want twice", validations()-2)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("validation timeout: took %s", elapsed)
+	}
+}
+
+func TestRefreshOnNewToken(t *testing.T) {
+	stub := &testutil.TwitchStub{}
+	// helix rejects the first token, so the follow-up refresh obtains another
+	stub.Handle(testutil.TwitchStreams, func(r *http.Request) (int, string) {
+		if r.Header.Get("Authorization") == "Bearer test-token-1" {
+			return http.StatusUnauthorized, `{"status":401,"message":"invalid OAuth token"}`
+		}
+		return http.StatusOK, aliceLive
+	})
+	c := newTestController(t, stub, func(conf *config.Config) {
+		conf.RefreshOnNewToken = true
+		conf.DiscordEnabled = false
+	})
+	createPublisher(t, c, `{"name":"alice","key":"secret","twitch_stream":"alice"}`)
+
+	_, err := c.twitchAuthToken(c.Config.TwitchClients[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for stub.Queries() < 2 || atomic.LoadInt32(&c.tokenRefreshing) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no refresh after obtaining a new access token")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	p, err := c.getPublisher("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.IsTwitchLive() {
+		t.Fatal("the refresh did not update the live status")
+	}
+
+	// the token obtained by the follow-up refresh does not start another
+	time.Sleep(20 * time.Millisecond)
+	issued, _ := stub.Tokens()
+	if queries := stub.Queries(); issued != 2 || queries != 2 {
+		t.Fatalf("%d access tokens requested & helix streams queried %d times, want 2 & 2", issued, queries)
+	}
+}
+
+func TestCheckTwitchCredentials(t *testing.T) {
+	tests := []struct {
+		name   string
+		token  string
+		status int
+		want   string
+	}{
+		{"ok", "", http.StatusOK, "twitch client test-id: Twitch credentials OK"},
+		{"bad secret", `{"status":403,"message":"invalid client secret"}`, http.StatusForbidden,
+			"twitch client test-id: credentials check failed: invalid client secret"},
+		{"bad client id", `{"status":400,"message":"invalid client"}`, http.StatusBadRequest,
+			"twitch client test-id: credentials check failed: invalid client id"},
+		{"helix failure", "", http.StatusInternalServerError,
+			"twitch client test-id: credentials check failed: helix request failed: 500 Internal Server Error: unavailable"},
+	}
+	for _, test := range tests {
+		stub := &testutil.TwitchStub{}
+		if test.token != "" {
+			status, body := test.status, test.token
+			stub.Handle(testutil.TwitchToken, func(r *http.Request) (int, string) { return status, body })
+		} else if test.status != http.StatusOK {
+			stub.SetStreams(test.status, `{"status":500,"message":"unavailable"}`)
+		}
+		c := newTestController(t, stub, nil)
+		hook := captureLogs(t)
+		c.CheckTwitchCredentials()
+		entry := hook.LastEntry()
+		if entry == nil || entry.Message != test.want {
+			t.Errorf("%s: got log %v, want %q", test.name, entry, test.want)
+		}
+	}
+}
+
+func TestTwitchValidateCache(t *testing.T) {
+	tests := []struct {
+		cache time.Duration
+		want  int
+	}{
+		// a new token is trusted, the first use of the cached token validates it
+		{time.Hour, 1},
+		{0, 2},
+	}
+	for _, test := range tests {
+		stub := &testutil.TwitchStub{}
+		c := newTestController(t, stub, func(conf *config.Config) {
+			conf.NegativeCacheTTL = 0
+			conf.TwitchValidateCache = test.cache
+		})
+		for i := 0; i < 3; i++ {
+			_, _, err := c.lookupTwitchLive("alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if validations := len(stub.Requests(testutil.TwitchValidate)); validations != test.want {
+			t.Errorf("TWITCH_VALIDATE_CACHE=%s: validated %d times, want %d", test.cache, validations, test.want)
+		}
+	}
+}
+
+func TestTwitchClockSkew(t *testing.T) {
+	stub := &testutil.TwitchStub{}
+	c := newTestController(t, stub, func(conf *config.Config) {
+		conf.TwitchValidateCache = time.Minute
+		conf.TwitchClockSkew = 30 * time.Second
+	})
+	client := c.Config.TwitchClients[0]
+	_, err := c.twitchAuthToken(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name              string
+		validated, expiry time.Duration
+		validate          bool
+	}{
+		{"validation older than the cache within the skew", -70 * time.Second, time.Hour, false},
+		{"validation older than the cache & the skew", -100 * time.Second, time.Hour, true},
+		{"validation in the future within the skew", 20 * time.Second, time.Hour, false},
+		{"validation in the future past the skew", 60 * time.Second, time.Hour, true},
+		{"expired within the skew", 0, -10 * time.Second, false},
+		{"expired past the skew", 0, -60 * time.Second, true},
+	}
+	for _, test := range tests {
+		now := time.Now()
+		c.setBucketValue("ConfigBucket", accessTokenValidatedKey(client), string(formatTimestamp(now.Add(test.validated))))
+		c.setBucketValue("ConfigBucket", accessTokenExpiryKey(client), string(formatTimestamp(now.Add(test.expiry))))
+		validations := len(stub.Requests(testutil.TwitchValidate))
+		token, err := c.twitchAuthToken(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if validated := len(stub.Requests(testutil.TwitchValidate)) > validations; validated != test.validate {
+			t.Errorf("%s: validated %t, want %t", test.name, validated, test.validate)
+		}
+		// the token is still valid, it is never replaced
+		if issued, _ := stub.Tokens(); issued != 1 || token != "test-token-1" {
+			t.Errorf("%s: %d tokens issued, using %s, want test-token-1 only", test.name, issued, token)
+		}
+	}
+}
+
+func TestTokenWithoutExpiry(t *testing.T) {
+	stub := &testutil.TwitchStub{}
+	stub.SetNoExpiry(true)
+	c := newTestController(t, stub, func(conf *config.Config) {
+		conf.TwitchValidateCache = time.Hour
+	})
+	client := c.Config.TwitchClients[0]
+	// left by the previous token
+	now := time.Now()
+	c.setBucketValue("ConfigBucket", accessTokenValidatedKey(client), string(formatTimestamp(now)))
+	c.setBucketValue("ConfigBucket", accessTokenExpiryKey(client), string(formatTimestamp(now.Add(time.Hour))))
+
+	_, err := c.twitchAuthToken(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{accessTokenValidatedKey(client), accessTokenExpiryKey(client)} {
+		value, err := c.getBucketValue("ConfigBucket", key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(value) != 0 {
+			t.Errorf("%s of the previous token kept for a token without an expiry: %s", key, value)
+		}
+	}
+
+	// the token is validated before it is trusted, which records its expiry
+	validations := len(stub.Requests(testutil.TwitchValidate))
+	for i := 0; i < 3; i++ {
+		token, err := c.twitchAuthToken(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "test-token-1" {
+			t.Fatalf("token without an expiry replaced by %s", token)
+		}
+	}
+	if n := len(stub.Requests(testutil.TwitchValidate)) - validations; n != 1 {
+		t.Errorf("token without an expiry validated %d times, want once", n)
+	}
+	value, err := c.getBucketValue("ConfigBucket", accessTokenExpiryKey(client))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expiry := parseTimestamp(value); expiry.Sub(now) < 59*time.Minute || expiry.Sub(now) > 61*time.Minute {
+		t.Errorf("expiry after validation: got %s, want the expires_in of the validation", expiry)
+	}
+}
@@ -0,0 +1,72 @@
+// Package testutil provides the helpers shared by the tests of the rtmpauthd
+// packages: a default configuration, a temporary database with every bucket
+// created and a stub of the twitch api.
+package testutil
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bcambl/rtmpauthbot/config"
+	bolt "go.etcd.io/bbolt"
+)
+
+// TempDir returns a new directory which is removed at the end of the test
+func TempDir(t testing.TB) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "rtmpauthd-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// NewConfig returns the default configuration with a database in a new
+// directory and twitch enabled with test credentials, as answered by
+// TwitchStub
+func NewConfig(t testing.TB) config.Config {
+	t.Helper()
+	conf := config.Config{}
+	err := conf.ParseEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.DatabasePath = filepath.Join(TempDir(t), "test.db")
+	conf.TwitchEnabled = true
+	conf.TwitchClientID = "test-id"
+	conf.TwitchClientSecret = "test-secret"
+	conf.TwitchClients = []config.TwitchClient{{ID: conf.TwitchClientID, Secret: conf.TwitchClientSecret}}
+	conf.EnabledPlatforms = []string{"twitch"}
+	conf.RTMPServerFQDN = ""
+	// a refresh in the background would query twitch at random
+	conf.RefreshOnNewToken = false
+	return conf
+}
+
+// OpenDB opens the database of the configuration with the buckets created
+// within its tenant. The database is closed at the end of the test.
+func OpenDB(t testing.TB, conf *config.Config, buckets []string) *bolt.DB {
+	t.Helper()
+	db, err := bolt.Open(conf.DatabasePath, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range buckets {
+			_, err := tx.CreateBucketIfNotExists([]byte(conf.BucketName(bucket)))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
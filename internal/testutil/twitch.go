@@ -0,0 +1,195 @@
+package testutil
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Twitch api routes answered by TwitchStub
+const (
+	TwitchToken    = "id.twitch.tv/oauth2/token"
+	TwitchValidate = "id.twitch.tv/oauth2/validate"
+	TwitchStreams  = "api.twitch.tv/helix/streams"
+	TwitchUsers    = "api.twitch.tv/helix/users"
+	TwitchGames    = "api.twitch.tv/helix/games"
+)
+
+// TwitchStub answers the twitch api requests of a client using it as its
+// transport. Every access token issued is distinct and revoked tokens are
+// rejected by the token validation & helix. The helix streams endpoint
+// answers with the status & body set by SetStreams, and any route can be
+// replaced with Handle.
+type TwitchStub struct {
+	mu            sync.Mutex
+	streamsStatus int
+	streamsBody   string
+	users         map[string]string
+	noExpiry      bool
+	delays        map[string]time.Duration
+	handlers      map[string]func(*http.Request) (int, string)
+	issued        int
+	revoked       map[string]bool
+	unauthorized  int
+	requests      map[string][]*http.Request
+}
+
+// SetStreams sets the response of the helix streams endpoint
+func (s *TwitchStub) SetStreams(status int, body string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.streamsStatus, s.streamsBody = status, body
+}
+
+// SetUsers sets the twitch user ids by login returned by the helix users
+// endpoint
+func (s *TwitchStub) SetUsers(users map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users = users
+}
+
+// SetNoExpiry issues access tokens without an expires_in
+func (s *TwitchStub) SetNoExpiry(noExpiry bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.noExpiry = noExpiry
+}
+
+// Delay holds the responses of a route until the delay passed or the request
+// was cancelled
+func (s *TwitchStub) Delay(route string, delay time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.delays == nil {
+		s.delays = make(map[string]time.Duration)
+	}
+	s.delays[route] = delay
+}
+
+// Handle answers a route with the status & body returned by fn
+func (s *TwitchStub) Handle(route string, fn func(*http.Request) (int, string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.handlers == nil {
+		s.handlers = make(map[string]func(*http.Request) (int, string))
+	}
+	s.handlers[route] = fn
+}
+
+// LastToken returns the access token issued last
+func (s *TwitchStub) LastToken() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fmt.Sprintf("test-token-%d", s.issued)
+}
+
+// Revoke rejects the access token from now on
+func (s *TwitchStub) Revoke(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.revoked == nil {
+		s.revoked = make(map[string]bool)
+	}
+	s.revoked[token] = true
+}
+
+// Tokens returns the number of access tokens issued & of helix requests
+// rejected as unauthorized
+func (s *TwitchStub) Tokens() (int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.issued, s.unauthorized
+}
+
+// Requests returns the requests received by a route
+func (s *TwitchStub) Requests(route string) []*http.Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*http.Request(nil), s.requests[route]...)
+}
+
+// Queries returns the number of helix streams requests received
+func (s *TwitchStub) Queries() int {
+	return len(s.Requests(TwitchStreams))
+}
+
+// RoundTrip implements http.RoundTripper
+func (s *TwitchStub) RoundTrip(r *http.Request) (*http.Response, error) {
+	route := r.URL.Host + strings.TrimSuffix(r.URL.Path, "/")
+	s.mu.Lock()
+	if s.requests == nil {
+		s.requests = make(map[string][]*http.Request)
+	}
+	s.requests[route] = append(s.requests[route], r)
+	delay := s.delays[route]
+	fn, handled := s.handlers[route]
+	s.mu.Unlock()
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		}
+	}
+
+	var status int
+	var body string
+	if handled {
+		status, body = fn(r)
+	} else {
+		s.mu.Lock()
+		status, body = s.answer(route, r)
+		s.mu.Unlock()
+	}
+	return &http.Response{
+		StatusCode: status,
+		Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+		Request:    r,
+	}, nil
+}
+
+// answer returns the status & body of a request to the route
+func (s *TwitchStub) answer(route string, r *http.Request) (int, string) {
+	token := r.Header.Get("Authorization")
+	token = strings.TrimPrefix(strings.TrimPrefix(token, "Bearer "), "OAuth ")
+	if strings.HasPrefix(route, "api.twitch.tv/") && s.revoked[token] {
+		s.unauthorized++
+		return http.StatusUnauthorized, `{"error":"Unauthorized","status":401,"message":"invalid OAuth token"}`
+	}
+	switch route {
+	case TwitchToken:
+		s.issued++
+		if s.noExpiry {
+			return http.StatusOK, fmt.Sprintf(`{"access_token":"test-token-%d","token_type":"bearer"}`, s.issued)
+		}
+		return http.StatusOK, fmt.Sprintf(`{"access_token":"test-token-%d","token_type":"bearer","expires_in":3600}`, s.issued)
+	case TwitchValidate:
+		if s.revoked[token] {
+			return http.StatusUnauthorized, `{"status":401,"message":"invalid access token"}`
+		}
+		return http.StatusOK, `{"client_id":"test-id","expires_in":3600}`
+	case TwitchGames:
+		return http.StatusOK, `{"data":[{"id":"1","name":"Just Chatting"}]}`
+	case TwitchUsers:
+		data := []string{}
+		for _, login := range r.URL.Query()["login"] {
+			if id, ok := s.users[strings.ToLower(login)]; ok {
+				data = append(data, fmt.Sprintf(`{"id":%q,"login":%q}`, id, strings.ToLower(login)))
+			}
+		}
+		return http.StatusOK, `{"data":[` + strings.Join(data, ",") + `]}`
+	case TwitchStreams:
+		if s.streamsStatus == 0 {
+			return http.StatusOK, `{"data":[]}`
+		}
+		return s.streamsStatus, s.streamsBody
+	}
+	return http.StatusNotFound, `{"error":"Not Found","status":404,"message":"not found"}`
+}